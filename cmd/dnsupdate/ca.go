@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/m1k8/DNSUpdate/pkg/ca"
+)
+
+const caUsage = `usage: dnsupdate ca <command> [-dir dir] [-days n] [-out dir] [args]
+
+commands:
+  init [name]                  create a CA for a gateway's agents
+  issue <host> [hostname...]   issue a client certificate that may register
+                               host, and any other hostnames or patterns
+  revoke <cert file|serial>    add a certificate to the revocation list
+
+the CA is kept in the config path with ".ca" appended, unless -dir is given`
+
+// runCA manages the private CA agents' client certificates are issued by
+func runCA(configPath string, args []string) int {
+	flags := flag.NewFlagSet("ca", flag.ContinueOnError)
+	flags.Usage = func() { fmt.Fprintln(os.Stderr, caUsage) }
+	dir := flags.String("dir", configPath+".ca", "directory the CA is kept in")
+	days := flags.Int("days", 0, "days certificates are valid for (default 3650 for the CA, 365 for clients)")
+	out := flags.String("out", ".", "directory issued certificates and keys are written to")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+	// flags may come before or after the command
+	command := flags.Arg(0)
+	if err := flags.Parse(flags.Args()[1:]); err != nil {
+		return 2
+	}
+	validity := func(def int) time.Duration {
+		if *days > 0 {
+			def = *days
+		}
+		return time.Duration(def) * 24 * time.Hour
+	}
+
+	args = flags.Args()
+	switch command {
+	case "init":
+		name := "dnsupdate gateway CA"
+		if len(args) > 0 {
+			name = args[0]
+		}
+		c, err := ca.Init(*dir, name, validity(3650), time.Now())
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Printf("created CA %q in %s, valid until %s\n", name, c.Dir, c.Cert.NotAfter.Format("2006-01-02"))
+		fmt.Printf("set the gateway's client_ca to %s\n", filepath.Join(c.Dir, ca.CertFile))
+		return 0
+
+	case "issue":
+		if len(args) == 0 {
+			flags.Usage()
+			return 2
+		}
+		c, err := ca.Open(*dir)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		certPEM, keyPEM, cert, err := c.Issue(args[0], args[1:], validity(365), time.Now())
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		certFile := filepath.Join(*out, cert.Subject.CommonName+".pem")
+		keyFile := filepath.Join(*out, cert.Subject.CommonName+"-key.pem")
+		if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if err := os.WriteFile(certFile, certPEM, 0644); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Printf("issued %s for %v, valid until %s\n", ca.Serial(cert), cert.DNSNames, cert.NotAfter.Format("2006-01-02"))
+		fmt.Printf("wrote %s and %s, for the agent's tls_cert and tls_key\n", certFile, keyFile)
+		return 0
+
+	case "revoke":
+		if len(args) != 1 {
+			flags.Usage()
+			return 2
+		}
+		c, err := ca.Open(*dir)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		cert, err := findCert(c, args[0])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if err := c.Revoke(cert, time.Now()); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Printf("revoked %s for %v\n", ca.Serial(cert), cert.DNSNames)
+		return 0
+	}
+	fmt.Fprintf(os.Stderr, "unknown ca command '%s'\n", command)
+	return 2
+}
+
+// findCert reads the certificate file arg, or the issued certificate with
+// arg as its serial
+func findCert(c *ca.CA, arg string) (*x509.Certificate, error) {
+	if b, err := os.ReadFile(arg); err == nil {
+		return ca.ParseCert(b)
+	}
+	cert, err := c.Issued(arg)
+	if err != nil {
+		return nil, fmt.Errorf("%s is neither a certificate file nor the serial of one issued", arg)
+	}
+	return cert, nil
+}
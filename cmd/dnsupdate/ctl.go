@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/m1k8/DNSUpdate/pkg/config"
+	"github.com/m1k8/DNSUpdate/pkg/control"
+	"github.com/m1k8/DNSUpdate/pkg/service"
+)
+
+const ctlUsage = `usage: dnsupdate ctl <command> [args]
+
+commands:
+  status                 show the state of each target
+  check [target]         check now, and print the result
+  pause [target]         stop updating DNS
+  resume [target]        start updating DNS again
+  reload                 reread the config file
+  publish <ip> [target]  publish ip instead of the detected address, and pause
+
+commands act on every target unless one is named`
+
+// callControl sends req to the running instance described by the config at
+// configPath and decodes the reply into v
+func callControl(configPath string, req control.Request, timeout time.Duration, v interface{}) error {
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		return err
+	}
+
+	res, err := control.Call(controlAddress(cfg), cfg.ControlToken, req, timeout)
+	if err != nil {
+		return errors.New("could not reach service: " + err.Error())
+	}
+	if !res.OK {
+		return errors.New(res.Error)
+	}
+	if v == nil || len(res.Data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(res.Data, v)
+}
+
+// runCtl sends a command to a running instance and prints the reply
+func runCtl(configPath string, args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, ctlUsage)
+		return 2
+	}
+	req := control.Request{Command: args[0], Args: args[1:]}
+
+	var err error
+	code := 0
+	switch req.Command {
+	case "check", "publish":
+		var results []service.Result
+		err = callControl(configPath, req, service.CheckTimeout+5*time.Second, &results)
+		code = printResults(results)
+
+	case "status", "pause", "resume", "reload":
+		var st service.Status
+		err = callControl(configPath, req, 30*time.Second, &st)
+		if err == nil {
+			printStatus(st)
+		}
+
+	default:
+		fmt.Fprintln(os.Stderr, ctlUsage)
+		return 2
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return code
+}
+
+func printResults(results []service.Result) int {
+	code := 0
+	for _, r := range results {
+		switch {
+		case r.Error != "":
+			fmt.Printf("%s: failed: %s\n", r.Target, r.Error)
+			code = 1
+		case r.Skipped != "":
+			fmt.Printf("%s: skipped: %s\n", r.Target, r.Skipped)
+			if r.Plan != nil {
+				r.Plan.Write(os.Stdout)
+			}
+		case r.Held != "":
+			fmt.Printf("%s: not published: %s\n", r.Target, r.Held)
+		case r.Changed:
+			fmt.Printf("%s: updated %s -> %s\n", r.Target, r.OldIP, r.NewIP)
+		default:
+			fmt.Printf("%s: no change (%s)\n", r.Target, r.NewIP)
+		}
+	}
+	return code
+}
+
+func printStatus(st service.Status) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TARGET\tSTATE\tSINCE\tLAST CHECK\tNEXT CHECK")
+	for _, t := range st.Targets {
+		last := "-"
+		if t.LastResult != nil {
+			last = t.LastResult.Time.Format(time.RFC3339)
+			if t.LastResult.Error != "" {
+				last += " (failed)"
+			}
+		}
+		state := t.State
+		if t.Paused && state != service.StatePaused {
+			state += " (paused)"
+		}
+		next := "-"
+		if !t.NextCheck.IsZero() {
+			next = t.NextCheck.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", t.Target, state, t.Since.Format(time.RFC3339), last, next)
+	}
+	w.Flush()
+
+	var monitored []service.TargetStatus
+	for _, t := range st.Targets {
+		if t.Monitor != nil {
+			monitored = append(monitored, t)
+		}
+	}
+	if len(monitored) > 0 {
+		fmt.Println()
+		w = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "MONITORED TARGET\tJOB\tSTATUS\tSINCE")
+		for _, t := range monitored {
+			job, status, since := "-", "-", "-"
+			if t.Monitor.Job != "" {
+				job = t.Monitor.Job
+			}
+			if t.Monitor.Status != "" {
+				status = t.Monitor.Status
+			}
+			if t.Monitor.Error != "" {
+				status = "error: " + t.Monitor.Error
+			}
+			if !t.Monitor.Since.IsZero() {
+				since = t.Monitor.Since.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", t.Target, job, status, since)
+		}
+		w.Flush()
+	}
+
+	if len(st.Zones) > 0 {
+		fmt.Println()
+		w = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ZONE\tRECORDS\tDRIFT POLICY\tLAST CHECK\tNEXT CHECK")
+		for _, z := range st.Zones {
+			last := "-"
+			if z.LastResult != nil {
+				last = z.LastResult.Time.Format(time.RFC3339)
+				switch {
+				case z.LastResult.Error != "":
+					last += " (failed)"
+				case z.LastResult.Skipped != "":
+					last += " (" + z.LastResult.Skipped + ")"
+				case z.LastResult.Corrected:
+					last += " (corrected)"
+				case len(z.LastResult.Drift) > 0:
+					last += " (drifted)"
+				}
+			}
+			policy := z.Drift
+			if z.Paused {
+				policy += " (paused)"
+			}
+			next := "-"
+			if !z.NextCheck.IsZero() {
+				next = z.NextCheck.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\n", z.Zone, z.Records, policy, last, next)
+		}
+		w.Flush()
+	}
+
+	if len(st.Hosts) > 0 {
+		fmt.Println()
+		w = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "DYNDNS HOST	USER	IP	LAST UPDATE")
+		for _, h := range st.Hosts {
+			user, ip, last := "-", "-", "-"
+			if !h.Time.IsZero() {
+				user, ip, last = h.User, h.IP, h.Time.Format(time.RFC3339)
+				switch {
+				case h.Error != "":
+					last += " (failed)"
+				case h.Changed:
+					last += " (changed)"
+				}
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", h.Host, user, ip, last)
+		}
+		w.Flush()
+	}
+
+	for _, t := range st.Targets {
+		if t.StartupError != "" {
+			fmt.Printf("\n%s: %s\n", t.Target, t.StartupError)
+		} else if t.LastResult != nil && t.LastResult.Error != "" {
+			fmt.Printf("\n%s: %s\n", t.Target, t.LastResult.Error)
+		}
+		if t.Alert != nil {
+			fmt.Printf("\n%s: ALERT since %s: %s\n", t.Target, t.Alert.Time.Format(time.RFC3339), t.Alert.Reason)
+		}
+		if t.LeaseHolder != "" {
+			fmt.Printf("\n%s: lease held by %s until %s\n", t.Target, t.LeaseHolder, t.LeaseExpires.Format(time.RFC3339))
+		}
+	}
+	for _, h := range st.Hosts {
+		if h.Error != "" {
+			fmt.Printf("\n%s: %s\n", h.Host, h.Error)
+		}
+		if h.Alert != nil {
+			fmt.Printf("\n%s: ALERT since %s: %s\n", h.Host, h.Alert.Time.Format(time.RFC3339), h.Alert.Reason)
+		}
+	}
+	for _, z := range st.Zones {
+		if z.Alert != nil {
+			fmt.Printf("\nzone %s: ALERT since %s: %s\n", z.Zone, z.Alert.Time.Format(time.RFC3339), z.Alert.Reason)
+		}
+		if z.LastResult == nil {
+			continue
+		}
+		if z.LastResult.Error != "" {
+			fmt.Printf("\nzone %s: %s\n", z.Zone, z.LastResult.Error)
+		}
+		for _, d := range z.LastResult.Drift {
+			fmt.Printf("\nzone %s: drift: %s\n", z.Zone, d)
+		}
+	}
+}
+
+func controlAddress(cfg *config.Config) string {
+	if cfg.Control != "" {
+		return cfg.Control
+	}
+	return control.DefaultAddress
+}
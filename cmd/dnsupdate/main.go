@@ -2,32 +2,75 @@ package main
 
 import (
 	"context"
+	"flag"
 	"log"
 	"os"
 	"path/filepath"
-	"time"
 
 	"github.com/judwhite/go-svc"
+	"github.com/m1k8/DNSUpdate/pkg/config"
+	"github.com/m1k8/DNSUpdate/pkg/lock"
 	"github.com/m1k8/DNSUpdate/pkg/service"
 )
 
 // implements svc.Service
 type program struct {
-	LogFile *os.File
-	ctx     context.Context
-	s       *service.Svc
+	LogFile    *os.File
+	ctx        context.Context
+	configPath string
+	dryRun     bool
+	cfg        *config.Config
+	lock       *lock.Lock
+	s          *service.Svc
+	sig        chan os.Signal
 }
 
 func (p *program) Context() context.Context {
 	return p.ctx
 }
 
+func defaultConfigPath() string {
+	dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
+	if err != nil {
+		return "dnsupdate.json"
+	}
+	return filepath.Join(dir, "dnsupdate.json")
+}
+
 func main() {
-	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Minute)
+	configPath := flag.String("config", defaultConfigPath(), "path to the config file")
+	dryRun := flag.Bool("dry-run", false, "log the changes each check would make, without making them")
+	flag.Parse()
+
+	if flag.NArg() > 0 {
+		switch flag.Arg(0) {
+		case "ctl":
+			os.Exit(runCtl(*configPath, flag.Args()[1:]))
+		case "plan":
+			os.Exit(runPlan(*configPath))
+		case "adopt":
+			os.Exit(runAdopt(*configPath, *dryRun, flag.Args()[1:]))
+		case "gc":
+			os.Exit(runGC(*configPath, *dryRun))
+		case "ca":
+			os.Exit(runCA(*configPath, flag.Args()[1:]))
+		case "restore":
+			os.Exit(runRestore(*configPath, *dryRun, flag.Args()[1:]))
+		case "check", "status":
+			// shorthand for "ctl check" and "ctl status"
+			os.Exit(runCtl(*configPath, flag.Args()))
+		default:
+			log.Fatalf("unknown command '%s'\n", flag.Arg(0))
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
 	prg := program{
-		ctx: ctx,
+		ctx:        ctx,
+		configPath: *configPath,
+		dryRun:     *dryRun,
 	}
 
 	defer func() {
@@ -65,20 +108,66 @@ func (p *program) Init(env svc.Environment) error {
 		log.SetOutput(f)
 	}
 
-	p.s = service.NewSvc("apiKey", "domain")
+	cfg, err := config.Load(p.configPath)
+	if err != nil {
+		return err
+	}
+	p.cfg = cfg
+
+	l, err := lock.Acquire(cfg.LockFile)
+	if err != nil {
+		return err
+	}
+	p.lock = l
+
+	p.s, err = service.New(cfg, service.Deps{DryRun: p.dryRun})
+	if err != nil {
+		return err
+	}
+
+	if err := p.s.Listen(controlAddress(cfg), cfg.ControlToken); err != nil {
+		return err
+	}
+	if err := p.s.ListenDynDNS(); err != nil {
+		return err
+	}
+	if err := p.s.ListenGateway(); err != nil {
+		return err
+	}
 
 	return nil
 }
 
 func (p *program) Start() error {
 	log.Printf("Starting...\n")
+	if p.dryRun {
+		log.Printf("Dry run, DNS will not be changed\n")
+	}
 	go p.s.Start()
+
+	p.sig = make(chan os.Signal, 1)
+	notifyCheck(p.sig)
+	go func() {
+		for range p.sig {
+			log.Println("Check requested by signal")
+			results, err := p.s.CheckNow(p.ctx)
+			if err != nil {
+				log.Println("Forced check failed - " + err.Error())
+				continue
+			}
+			service.LogResults(results)
+		}
+	}()
 	return nil
 }
 
 func (p *program) Stop() error {
 	log.Printf("Stopping...\n")
+	stopNotifyCheck(p.sig)
 	p.s.Stop()
+	if err := p.lock.Release(); err != nil {
+		log.Println("Error releasing lock - " + err.Error())
+	}
 	log.Printf("Stopped.\n")
 	return nil
 }
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/m1k8/DNSUpdate/pkg/config"
+	"github.com/m1k8/DNSUpdate/pkg/plan"
+	"github.com/m1k8/DNSUpdate/pkg/service"
+)
+
+// runAdopt marks the existing records of the named target, zone or dyndns
+// host, or of every one, as managed by the service
+func runAdopt(configPath string, dryRun bool, args []string) int {
+	name := ""
+	if len(args) > 0 {
+		name = args[0]
+	}
+	return runOwnership(configPath, dryRun, func(ctx context.Context, s *service.Svc) (*plan.Plan, []string, error) {
+		p, err := s.Adopt(ctx, name)
+		return p, nil, err
+	})
+}
+
+// runGC deletes records marked as managed that are no longer in the config,
+// and the monitoring jobs of targets that are no longer monitored
+func runGC(configPath string, dryRun bool) int {
+	return runOwnership(configPath, dryRun, func(ctx context.Context, s *service.Svc) (*plan.Plan, []string, error) {
+		p, err := s.Collect(ctx)
+		if err != nil {
+			return p, nil, err
+		}
+		jobs, err := s.CollectMonitors(ctx)
+		return p, jobs, err
+	})
+}
+
+// runOwnership runs do against a service that hasnt been started, printing
+// its plan and the monitoring jobs it deleted
+func runOwnership(configPath string, dryRun bool, do func(context.Context, *service.Svc) (*plan.Plan, []string, error)) int {
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	s, err := service.New(cfg, service.Deps{DryRun: dryRun})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	// the plan is printed below
+	log.SetOutput(ioutil.Discard)
+
+	ctx, cancel := context.WithTimeout(context.Background(), service.CheckTimeout)
+	defer cancel()
+	p, jobs, err := do(ctx, s)
+	if p != nil {
+		p.Write(os.Stdout)
+	}
+	for _, j := range jobs {
+		fmt.Printf("%s: delete monitoring job %s\n", p.Target, j)
+	}
+	if dryRun && (!p.Empty() || len(jobs) > 0) {
+		fmt.Println("dry run, nothing changed")
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/m1k8/DNSUpdate/pkg/config"
+	"github.com/m1k8/DNSUpdate/pkg/service"
+)
+
+// runPlan checks every target and zone once and prints the changes that would be made,
+// without making them. It doesnt need the service to be running
+func runPlan(configPath string) int {
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	s, err := service.New(cfg, service.Deps{DryRun: true})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	// the plan is printed below; the service's own logging would repeat it
+	log.SetOutput(ioutil.Discard)
+
+	ctx, cancel := context.WithTimeout(context.Background(), service.CheckTimeout)
+	defer cancel()
+	results, err := s.Plan(ctx)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	code := 0
+	for _, r := range results {
+		switch {
+		case r.Error != "":
+			fmt.Printf("%s: failed: %s\n", r.Target, r.Error)
+			code = 1
+		case r.Plan != nil:
+			r.Plan.Write(os.Stdout)
+		case r.Held != "":
+			fmt.Printf("%s: no changes, %s\n", r.Target, r.Held)
+		default:
+			fmt.Printf("%s: no changes (%s)\n", r.Target, r.NewIP)
+		}
+	}
+
+	zones, err := s.PlanZones(ctx)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	for _, z := range zones {
+		switch {
+		case z.Error != "":
+			fmt.Printf("zone %s: failed: %s\n", z.Zone, z.Error)
+			code = 1
+		case z.Plan != nil:
+			z.Plan.Write(os.Stdout)
+		default:
+			fmt.Printf("zone %s: no changes\n", z.Zone)
+		}
+	}
+	return code
+}
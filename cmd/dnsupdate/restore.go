@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/m1k8/DNSUpdate/pkg/config"
+	"github.com/m1k8/DNSUpdate/pkg/service"
+)
+
+// runRestore lists the snapshots, or shows how the named one differs from
+// the records now and asks before putting them back
+func runRestore(configPath string, dryRun bool, args []string) int {
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	s, err := service.New(cfg, service.Deps{DryRun: dryRun})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if len(args) == 0 {
+		names, err := s.Snapshots()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if len(names) == 0 {
+			fmt.Println("no snapshots")
+		}
+		for _, n := range names {
+			fmt.Println(n)
+		}
+		return 0
+	}
+
+	p, err := s.PlanRestore(args[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	p.Write(os.Stdout)
+	if p.Empty() || dryRun {
+		return 0
+	}
+
+	fmt.Print("Restore these records? [y/N] ")
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	if a := strings.ToLower(strings.TrimSpace(answer)); a != "y" && a != "yes" {
+		fmt.Println("not restored")
+		return 1
+	}
+
+	log.SetOutput(ioutil.Discard)
+	if err := s.Restore(p); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Println("restored")
+	return 0
+}
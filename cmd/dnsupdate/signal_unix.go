@@ -0,0 +1,19 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyCheck relays SIGUSR1, which forces an immediate check, to c
+func notifyCheck(c chan os.Signal) {
+	signal.Notify(c, syscall.SIGUSR1)
+}
+
+func stopNotifyCheck(c chan os.Signal) {
+	signal.Stop(c)
+	close(c)
+}
@@ -0,0 +1,13 @@
+//go:build windows
+
+package main
+
+import "os"
+
+// notifyCheck is a no-op on Windows, which has no equivalent of SIGUSR1.
+// Use "dnsupdate check" instead
+func notifyCheck(c chan os.Signal) {}
+
+func stopNotifyCheck(c chan os.Signal) {
+	close(c)
+}
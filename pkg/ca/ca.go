@@ -0,0 +1,252 @@
+// Package ca is a small private certificate authority, for mutual TLS
+// between a gateway and its agents. Each agent's certificate names the
+// hostnames it may register in its DNS SANs, and certificates can be
+// revoked by adding their serial to a revocation list
+package ca
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Files in a CA's directory
+const (
+	CertFile    = "ca.pem"
+	KeyFile     = "ca-key.pem"
+	RevokedFile = "revoked.txt"
+
+	// IssuedDir keeps a copy of each certificate issued, named by serial
+	IssuedDir = "issued"
+)
+
+// ErrExists is returned by Init for a directory that already has a CA
+var ErrExists = errors.New("a CA already exists there")
+
+// CA issues client certificates
+type CA struct {
+	Dir  string
+	Cert *x509.Certificate
+	key  crypto.Signer
+}
+
+// Init creates a CA called name in dir, valid from now for validity
+func Init(dir, name string, validity time.Duration, now time.Time) (*CA, error) {
+	if _, err := os.Stat(filepath.Join(dir, KeyFile)); err == nil {
+		return nil, ErrExists
+	}
+	if err := os.MkdirAll(filepath.Join(dir, IssuedDir), 0700); err != nil {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	keyPEM, err := encodeKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, KeyFile), keyPEM, 0600); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, CertFile), encodeCert(der), 0644); err != nil {
+		return nil, err
+	}
+	header := "# serial host revoked-at, one certificate per line\n"
+	if err := os.WriteFile(filepath.Join(dir, RevokedFile), []byte(header), 0644); err != nil {
+		return nil, err
+	}
+	return &CA{Dir: dir, Cert: cert, key: key}, nil
+}
+
+// Open loads the CA in dir
+func Open(dir string) (*CA, error) {
+	certPEM, err := os.ReadFile(filepath.Join(dir, CertFile))
+	if err != nil {
+		return nil, err
+	}
+	cert, err := ParseCert(certPEM)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := os.ReadFile(filepath.Join(dir, KeyFile))
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM key", KeyFile)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", KeyFile, err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%s: key cant sign", KeyFile)
+	}
+	return &CA{Dir: dir, Cert: cert, key: signer}, nil
+}
+
+// Issue creates a client certificate for host, valid from now for
+// validity, that may register host and any other hostnames given. A
+// hostname may be a pattern, as in a gateway token, e.g.
+// "*.hosts.example.com". The certificate and its key are returned as PEM,
+// and a copy of the certificate is kept in IssuedDir
+func (c *CA) Issue(host string, hostnames []string, validity time.Duration, now time.Time) (certPEM, keyPEM []byte, cert *x509.Certificate, err error) {
+	var names []string
+	seen := map[string]bool{}
+	for _, h := range append([]string{host}, hostnames...) {
+		h = strings.ToLower(strings.TrimSuffix(h, "."))
+		if h == "" {
+			return nil, nil, nil, errors.New("empty hostname")
+		}
+		if !seen[h] {
+			seen[h] = true
+			names = append(names, h)
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	notAfter := now.Add(validity)
+	if notAfter.After(c.Cert.NotAfter) {
+		notAfter = c.Cert.NotAfter
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, c.Cert, key.Public(), c.key)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if cert, err = x509.ParseCertificate(der); err != nil {
+		return nil, nil, nil, err
+	}
+
+	certPEM = encodeCert(der)
+	if keyPEM, err = encodeKey(key); err != nil {
+		return nil, nil, nil, err
+	}
+	issued := filepath.Join(c.Dir, IssuedDir, Serial(cert)+".pem")
+	if err := os.WriteFile(issued, certPEM, 0644); err != nil {
+		return nil, nil, nil, err
+	}
+	return certPEM, keyPEM, cert, nil
+}
+
+// Revoke adds cert to the CA's revocation list, if it isnt there already.
+// A gateway reading the list refuses it from its next connection
+func (c *CA) Revoke(cert *x509.Certificate, now time.Time) error {
+	if err := cert.CheckSignatureFrom(c.Cert); err != nil {
+		return fmt.Errorf("certificate wasnt issued by this CA: %w", err)
+	}
+	path := filepath.Join(c.Dir, RevokedFile)
+	revoked, err := readRevoked(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if revoked[Serial(cert)] {
+		return nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "%s %s %s\n", Serial(cert), cert.Subject.CommonName, now.UTC().Format(time.RFC3339))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Issued returns the certificate kept for serial
+func (c *CA) Issued(serial string) (*x509.Certificate, error) {
+	b, err := os.ReadFile(filepath.Join(c.Dir, IssuedDir, strings.ToLower(serial)+".pem"))
+	if err != nil {
+		return nil, err
+	}
+	return ParseCert(b)
+}
+
+// Serial formats a certificate's serial as in the revocation list
+func Serial(cert *x509.Certificate) string {
+	return fmt.Sprintf("%x", cert.SerialNumber)
+}
+
+// ParseCert parses the first certificate in a PEM file
+func ParseCert(b []byte) (*x509.Certificate, error) {
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			return nil, errors.New("no PEM certificate")
+		}
+		if block.Type == "CERTIFICATE" {
+			return x509.ParseCertificate(block.Bytes)
+		}
+	}
+}
+
+func newSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+func encodeCert(der []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func encodeKey(key *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
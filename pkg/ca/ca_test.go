@@ -0,0 +1,233 @@
+package ca
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m1k8/DNSUpdate/pkg/gateway"
+)
+
+var start = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func newCA(t *testing.T) *CA {
+	t.Helper()
+	c, err := Init(t.TempDir(), "dnsupdate test CA", 365*24*time.Hour, start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestInit(t *testing.T) {
+	c := newCA(t)
+	if !c.Cert.IsCA || c.Cert.Subject.CommonName != "dnsupdate test CA" {
+		t.Errorf("created %+v, want a CA called dnsupdate test CA", c.Cert.Subject)
+	}
+	if _, err := Init(c.Dir, "another", time.Hour, start); !errors.Is(err, ErrExists) {
+		t.Errorf("initialising again gave %v, want %v", err, ErrExists)
+	}
+	info, err := os.Stat(filepath.Join(c.Dir, KeyFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("key file has mode %v, want 0600", perm)
+	}
+
+	opened, err := Open(c.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !opened.Cert.Equal(c.Cert) || !reflect.DeepEqual(opened.key.Public(), c.key.Public()) {
+		t.Error("opened a different CA to the one created")
+	}
+}
+
+func TestIssue(t *testing.T) {
+	c := newCA(t)
+	certPEM, keyPEM, cert, err := c.Issue("Laptop.Hosts.Example.com.", []string{"laptop.hosts.example.com", "*.lab.example.com"}, 30*24*time.Hour, start)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the hostnames are lowercased, without the trailing dot, and none is
+	// repeated
+	if want := []string{"laptop.hosts.example.com", "*.lab.example.com"}; !reflect.DeepEqual(cert.DNSNames, want) {
+		t.Errorf("SANs %q, want %q", cert.DNSNames, want)
+	}
+	if cert.Subject.CommonName != "laptop.hosts.example.com" {
+		t.Errorf("common name %q, want the host", cert.Subject.CommonName)
+	}
+	if want := start.Add(30 * 24 * time.Hour); !cert.NotAfter.Equal(want) {
+		t.Errorf("valid until %s, want %s", cert.NotAfter, want)
+	}
+
+	// the certificate is only good for client auth, against the CA
+	pool := x509.NewCertPool()
+	pool.AddCert(c.Cert)
+	opts := x509.VerifyOptions{Roots: pool, CurrentTime: start, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}
+	if _, err := cert.Verify(opts); err != nil {
+		t.Errorf("doesnt verify as a client certificate: %v", err)
+	}
+	opts.KeyUsages = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	if _, err := cert.Verify(opts); err == nil {
+		t.Error("verifies as a server certificate")
+	}
+
+	parsed, err := ParseCert(certPEM)
+	if err != nil || !parsed.Equal(cert) {
+		t.Errorf("parsed the PEM as %v, %v, want the issued certificate", parsed, err)
+	}
+	// X509KeyPair checks the key is the certificate's
+	if _, err := tls.X509KeyPair(certPEM, keyPEM); err != nil {
+		t.Errorf("certificate and key dont pair: %v", err)
+	}
+	kept, err := c.Issued(Serial(cert))
+	if err != nil || !kept.Equal(cert) {
+		t.Errorf("kept %v, %v, want the issued certificate", kept, err)
+	}
+
+	// a certificate never outlives its CA
+	_, _, long, err := c.Issue("long.example.com", nil, 10*365*24*time.Hour, start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !long.NotAfter.Equal(c.Cert.NotAfter) {
+		t.Errorf("valid until %s, want the CA's %s", long.NotAfter, c.Cert.NotAfter)
+	}
+
+	if _, _, _, err := c.Issue("host.example.com", []string{"."}, time.Hour, start); err == nil {
+		t.Error("an empty hostname should be refused")
+	}
+}
+
+// TestCertAllows checks the gateway only lets a certificate register the
+// hostnames in its SANs
+func TestCertAllows(t *testing.T) {
+	c := newCA(t)
+	_, _, cert, err := c.Issue("laptop.hosts.example.com", []string{"*.lab.example.com"}, time.Hour, start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{host: "laptop.hosts.example.com", want: true},
+		{host: "LAPTOP.hosts.example.com.", want: true},
+		{host: "vm1.lab.example.com", want: true},
+		{host: "desktop.hosts.example.com"},
+		{host: "hosts.example.com"},
+		{host: "a.laptop.hosts.example.com"},
+		{host: "lab.example.com"},
+		{host: "a.vm1.lab.example.com"},
+		{host: "example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			if got := gateway.CertAllows(cert, tt.host); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	c := newCA(t)
+	_, _, good, err := c.Issue("good.example.com", nil, time.Hour, start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, bad, err := c.Issue("bad.example.com", nil, time.Hour, start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, err := LoadRevocations(filepath.Join(c.Dir, RevokedFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revoked, err := list.Revoked(bad); revoked || err != nil {
+		t.Fatalf("revoked %v, %v before revoking", revoked, err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := c.Revoke(bad, start); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, err := os.ReadFile(filepath.Join(c.Dir, RevokedFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "# serial host revoked-at, one certificate per line\n" + Serial(bad) + " bad.example.com 2024-01-01T00:00:00Z\n"
+	if string(b) != want {
+		t.Errorf("revocation list %q, want %q", b, want)
+	}
+
+	// the list is read again once it changes
+	for cert, want := range map[*x509.Certificate]bool{good: false, bad: true} {
+		if revoked, err := list.Revoked(cert); revoked != want || err != nil {
+			t.Errorf("%s revoked %v, %v, want %v", cert.Subject.CommonName, revoked, err, want)
+		}
+	}
+
+	other := newCA(t)
+	_, _, foreign, err := other.Issue("good.example.com", nil, time.Hour, start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Revoke(foreign, start); err == nil {
+		t.Error("revoking another CA's certificate should fail")
+	}
+
+	// a list that cant be read revokes everything
+	if err := os.Remove(filepath.Join(c.Dir, RevokedFile)); err != nil {
+		t.Fatal(err)
+	}
+	if revoked, err := list.Revoked(good); !revoked || err == nil {
+		t.Errorf("with no list, revoked %v, %v, want revoked with an error", revoked, err)
+	}
+}
+
+func TestReadRevoked(t *testing.T) {
+	tests := []struct {
+		name    string
+		list    string
+		want    map[string]bool
+		wantErr string
+	}{
+		{name: "empty", list: "", want: map[string]bool{}},
+		{name: "comments and blanks", list: "# header\n\n  \n# 1234\n", want: map[string]bool{}},
+		{name: "serials", list: "1a2b host 2024-01-01T00:00:00Z\nFF\n", want: map[string]bool{"1a2b": true, "ff": true}},
+		{name: "leading zeros", list: "00ab host\n", want: map[string]bool{"ab": true}},
+		{name: "not hex", list: "# header\nxyz host\n", wantErr: ":2: \"xyz\" is not a serial in hex"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), RevokedFile)
+			if err := os.WriteFile(path, []byte(tt.list), 0644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := readRevoked(path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
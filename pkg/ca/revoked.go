@@ -0,0 +1,90 @@
+package ca
+
+import (
+	"bufio"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Revocations is a revocation list, read again whenever the file changes,
+// so revoking a certificate takes effect without restarting the gateway
+type Revocations struct {
+	path string
+
+	mu      sync.Mutex
+	mod     time.Time
+	size    int64
+	serials map[string]bool
+}
+
+// LoadRevocations reads the revocation list at path
+func LoadRevocations(path string) (*Revocations, error) {
+	r := &Revocations{path: path}
+	if _, err := r.current(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Revoked reports whether cert is on the list. If the list cant be read,
+// every certificate is treated as revoked, as a list that was deleted or
+// broken cant say which are still good
+func (r *Revocations) Revoked(cert *x509.Certificate) (bool, error) {
+	serials, err := r.current()
+	if err != nil {
+		return true, err
+	}
+	return serials[Serial(cert)], nil
+}
+
+// current returns the serials on the list, reading it again if it changed
+func (r *Revocations) current() (map[string]bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	info, err := os.Stat(r.path)
+	if err != nil {
+		return nil, err
+	}
+	if r.serials != nil && info.ModTime().Equal(r.mod) && info.Size() == r.size {
+		return r.serials, nil
+	}
+	serials, err := readRevoked(r.path)
+	if err != nil {
+		return nil, err
+	}
+	if r.serials != nil {
+		log.Printf("Reloaded revocation list, %d revoked\n", len(serials))
+	}
+	r.serials, r.mod, r.size = serials, info.ModTime(), info.Size()
+	return serials, nil
+}
+
+// readRevoked reads a revocation list, one serial in hex per line followed
+// by anything. Blank lines and lines starting with # are ignored
+func readRevoked(path string) (map[string]bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	serials := map[string]bool{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		serial := strings.ToLower(strings.Fields(line)[0])
+		if strings.Trim(serial, "0123456789abcdef") != "" {
+			return nil, fmt.Errorf("%s:%d: %q is not a serial in hex", path, n, serial)
+		}
+		serials[strings.TrimLeft(serial, "0")] = true
+	}
+	return serials, scanner.Err()
+}
@@ -0,0 +1,124 @@
+package compare
+
+import (
+	"context"
+	"errors"
+
+	"github.com/m1k8/DNSUpdate/pkg/provider"
+	"gopkg.in/ns1/ns1-go.v2/rest/model/dns"
+)
+
+// DefaultNote marks the answer a target manages, when the config doesnt
+// give one
+const DefaultNote = "dnsupdate"
+
+// Identity picks out the answer a target manages, among any others in the
+// record such as a manually added backup server
+type Identity struct {
+	// Note is matched against the answer's meta note
+	Note string
+
+	// ID is the NS1 answer ID, once the answer has been seen. It is
+	// preferred to Note, so the answer is still found if its note is edited
+	ID string
+}
+
+// Matches reports whether a is the answer identified
+func (id Identity) Matches(a *dns.Answer) bool {
+	if id.ID != "" && a.ID == id.ID {
+		return true
+	}
+	return id.Note != "" && NoteOf(a) == id.Note
+}
+
+// RecordState is the full answer set of an A record, with the answer this
+// host manages picked out
+type RecordState struct {
+	// Record is nil if the record doesnt exist
+	Record *dns.Record
+
+	// Owned is the index in Record.Answers of the managed answer, or -1
+	Owned int
+}
+
+// Exists reports whether the record exists at all
+func (s RecordState) Exists() bool {
+	return s.Record != nil
+}
+
+// Answer returns the managed answer, or nil if there isnt one
+func (s RecordState) Answer() *dns.Answer {
+	if s.Record == nil || s.Owned < 0 {
+		return nil
+	}
+	return s.Record.Answers[s.Owned]
+}
+
+// IP returns the address in the managed answer, or "" if there isnt one
+func (s RecordState) IP() string {
+	a := s.Answer()
+	if a == nil || len(a.Rdata) == 0 {
+		return ""
+	}
+	return a.Rdata[0]
+}
+
+// Others returns every answer in the record except the managed one
+func (s RecordState) Others() []*dns.Answer {
+	if s.Record == nil {
+		return nil
+	}
+	var others []*dns.Answer
+	for i, a := range s.Record.Answers {
+		if i != s.Owned {
+			others = append(others, a)
+		}
+	}
+	return others
+}
+
+// NewRecordState picks out the answer identified by id in r, which may be nil
+func NewRecordState(r *dns.Record, id Identity) RecordState {
+	s := RecordState{Record: r, Owned: -1}
+	if r == nil {
+		return s
+	}
+	// an ID match wins over a note, in case a copy of the answer was made
+	// with the note still on it
+	for i, a := range r.Answers {
+		if a != nil && id.ID != "" && a.ID == id.ID {
+			s.Owned = i
+			return s
+		}
+	}
+	for i, a := range r.Answers {
+		if a != nil && id.Matches(a) {
+			s.Owned = i
+			return s
+		}
+	}
+	return s
+}
+
+// GetRecord fetches the A record for domain, with the answer identified by id
+// picked out. A missing record is not an error. The lookup is abandoned once
+// ctx is done
+func GetRecord(ctx context.Context, zone *dns.Zone, records provider.Provider, domain string, id Identity) (RecordState, error) {
+	r, err := records.Record(ctx, zone.String(), domain, "A")
+	if errors.Is(err, provider.ErrRecordMissing) {
+		return NewRecordState(nil, id), nil
+	}
+	if err != nil {
+		return RecordState{Owned: -1}, err
+	}
+	return NewRecordState(r, id), nil
+}
+
+// NoteOf returns the meta note of a, or "" if it has none
+func NoteOf(a *dns.Answer) string {
+	if a.Meta == nil {
+		return ""
+	}
+	note, _ := a.Meta.Note.(string)
+	return note
+}
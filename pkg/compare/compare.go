@@ -1,70 +1,88 @@
 package compare
 
 import (
-	"bytes"
-	"errors"
-	"io/ioutil"
-	"log"
-	"net/http"
+	"context"
+	"fmt"
+	"time"
 
-	api "gopkg.in/ns1/ns1-go.v2/rest"
+	"github.com/m1k8/DNSUpdate/pkg/multierr"
+	"github.com/m1k8/DNSUpdate/pkg/provider"
 	"gopkg.in/ns1/ns1-go.v2/rest/model/dns"
 )
 
-func getNewIP(newIPChan chan<- string, errChan chan<- error) {
-	rsp, newIPerr := http.Get("https://api.ipify.org")
-	if newIPerr != nil {
-		errChan <- newIPerr
-		return
-	}
-	defer rsp.Body.Close()
-
-	buf, ipParseErr := ioutil.ReadAll(rsp.Body)
-	if ipParseErr != nil {
-		errChan <- ipParseErr
-		return
-	}
-	newIPChan <- string(bytes.TrimSpace(buf))
+// Timeouts bound each of the lookups made by GetOldNewIPs
+type Timeouts struct {
+	Record time.Duration
+	IP     time.Duration
 }
 
-func getOldIP(oldIPChan chan<- string, zone *dns.Zone, client *api.Client, errChan chan<- error, domain string) {
-	oldIPZ, httpres, getErr := client.Records.Get(zone.String(), domain, "A")
+// DefaultTimeouts are used for any Timeouts left at zero
+var DefaultTimeouts = Timeouts{Record: 20 * time.Second, IP: 10 * time.Second}
 
-	if getErr != nil {
-		oldIPChan <- ""
-		errChan <- getErr
-		return
-	} else if httpres.StatusCode != 200 {
-		errChan <- errors.New("response not OK")
-		oldIPChan <- ""
-		return
-	} else {
-		oldIP := oldIPZ.Answers[0].Rdata[0]
-		oldIPChan <- oldIP
-		return
-	}
+type lookup struct {
+	state RecordState
+	ip    string
+	err   error
 }
 
-// GetOldNewIPs fetches the current local IP, and IP stored in the A record of the DNS zone
-func GetOldNewIPs(zone *dns.Zone, client *api.Client, domain string) (string, string, error) {
+// GetOldNewIPs fetches the current local IP, and the A record of the DNS zone
+// with the answer identified by id, at the same time. It always returns
+// whatever it found of both, along with every error, so a failure of one
+// lookup cannot hide the other. The lookups finish on their own if they time
+// out or ctx is done, so nothing is left waiting on them
+func GetOldNewIPs(ctx context.Context, zone *dns.Zone, records provider.Provider, ips IPSource, domain string, id Identity, timeouts Timeouts) (RecordState, string, error) {
+	if timeouts.Record == 0 {
+		timeouts.Record = DefaultTimeouts.Record
+	}
+	if timeouts.IP == 0 {
+		timeouts.IP = DefaultTimeouts.IP
+	}
+
+	// buffered, so the lookups can always send and exit even once nobody is
+	// waiting for them
+	oldIPChan := make(chan lookup, 1)
+	newIPChan := make(chan lookup, 1)
 
-	errChan := make(chan error)
-	oldIPChan := make(chan string)
-	newIPChan := make(chan string)
+	recordCtx, cancelRecord := context.WithTimeout(ctx, timeouts.Record)
+	defer cancelRecord()
+	ipCtx, cancelIP := context.WithTimeout(ctx, timeouts.IP)
+	defer cancelIP()
 
-	go getNewIP(newIPChan, errChan)
+	go func() {
+		state, err := GetRecord(recordCtx, zone, records, domain, id)
+		oldIPChan <- lookup{state: state, err: err}
+	}()
+	go func() {
+		ip, err := ips.PublicIP(ipCtx)
+		newIPChan <- lookup{ip: ip, err: err}
+	}()
 
-	go getOldIP(oldIPChan, zone, client, errChan, domain)
+	old := wait(recordCtx, oldIPChan)
+	new := wait(ipCtx, newIPChan)
 
-	// has errors that need to be manually handled, so lets assess this first
-	oldIP := <-oldIPChan
-	newIP := <-newIPChan
+	var oldErr, newErr error
+	if old.err != nil {
+		oldErr = fmt.Errorf("getting IP from DNS: %w", old.err)
+	}
+	if new.err != nil {
+		newErr = fmt.Errorf("getting public IP: %w", new.err)
+	}
+	return old.state, new.ip, multierr.Join(oldErr, newErr)
+}
 
+// wait returns the lookup sent on c, or ctx's error once it is done. A
+// lookup that finished in time is kept even if ctx is done by now, as it is
+// when the other lookup used up its whole timeout
+func wait(ctx context.Context, c <-chan lookup) lookup {
 	select {
-	case e := <-errChan:
-		log.Println(e)
-		return "", "", e
-	default:
-		return oldIP, newIP, nil
+	case l := <-c:
+		return l
+	case <-ctx.Done():
+		select {
+		case l := <-c:
+			return l
+		default:
+			return lookup{state: RecordState{Owned: -1}, err: ctx.Err()}
+		}
 	}
 }
@@ -0,0 +1,167 @@
+package compare
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/m1k8/DNSUpdate/pkg/dnsapi"
+	"github.com/m1k8/DNSUpdate/pkg/ns1fake"
+	"github.com/m1k8/DNSUpdate/pkg/provider"
+	api "gopkg.in/ns1/ns1-go.v2/rest"
+	"gopkg.in/ns1/ns1-go.v2/rest/model/data"
+	"gopkg.in/ns1/ns1-go.v2/rest/model/dns"
+)
+
+const (
+	zone   = "example.com"
+	domain = "home.example.com"
+)
+
+var (
+	errDNS = errors.New("dns is down")
+	errIP  = errors.New("ip source is down")
+)
+
+// ipFunc is an IPSource calling itself
+type ipFunc func(ctx context.Context) (string, error)
+
+func (f ipFunc) PublicIP(ctx context.Context) (string, error) {
+	return f(ctx)
+}
+
+func ip(addr string) ipFunc {
+	return func(context.Context) (string, error) { return addr, nil }
+}
+
+// hang blocks until ctx is done, then closes done
+func hang(ctx context.Context, done chan struct{}) error {
+	<-ctx.Done()
+	close(done)
+	return ctx.Err()
+}
+
+// doer sends NS1 requests through to the fake unless fn, if set, answers
+// them instead
+type doer struct {
+	next api.Doer
+	fn   func(*http.Request) (*http.Response, error)
+}
+
+func (d doer) Do(req *http.Request) (*http.Response, error) {
+	if d.fn != nil {
+		return d.fn(req)
+	}
+	return d.next.Do(req)
+}
+
+func TestGetOldNewIPs(t *testing.T) {
+	timeouts := Timeouts{Record: 100 * time.Millisecond, IP: 100 * time.Millisecond}
+	tests := []struct {
+		name   string
+		record bool
+		doer   func(done chan struct{}) func(*http.Request) (*http.Response, error)
+		ips    func(done chan struct{}) IPSource
+
+		oldIP, newIP string
+		errs         []error
+
+		// hung is set if a lookup must be seen to give up
+		hung bool
+	}{
+		{
+			name:   "both found",
+			record: true,
+			ips:    func(chan struct{}) IPSource { return ip("8.8.4.7") },
+			oldIP:  "8.8.4.4",
+			newIP:  "8.8.4.7",
+		},
+		{
+			name:  "record missing",
+			ips:   func(chan struct{}) IPSource { return ip("8.8.4.7") },
+			newIP: "8.8.4.7",
+		},
+		{
+			name: "both lookups fail",
+			doer: func(chan struct{}) func(*http.Request) (*http.Response, error) {
+				return func(*http.Request) (*http.Response, error) { return nil, errDNS }
+			},
+			ips: func(chan struct{}) IPSource {
+				return ipFunc(func(context.Context) (string, error) { return "", errIP })
+			},
+			errs: []error{errDNS, errIP},
+		},
+		{
+			name:   "record lookup times out",
+			record: true,
+			doer: func(done chan struct{}) func(*http.Request) (*http.Response, error) {
+				return func(req *http.Request) (*http.Response, error) {
+					return nil, hang(req.Context(), done)
+				}
+			},
+			ips:   func(chan struct{}) IPSource { return ip("8.8.4.7") },
+			newIP: "8.8.4.7",
+			errs:  []error{context.DeadlineExceeded},
+			hung:  true,
+		},
+		{
+			name:   "ip lookup times out",
+			record: true,
+			ips: func(done chan struct{}) IPSource {
+				return ipFunc(func(ctx context.Context) (string, error) { return "", hang(ctx, done) })
+			},
+			oldIP: "8.8.4.4",
+			errs:  []error{context.DeadlineExceeded},
+			hung:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := ns1fake.New()
+			defer f.Close()
+			f.AddZone(zone)
+			if tt.record {
+				r := dns.NewRecord(zone, domain, "A")
+				a := dns.NewAv4Answer("8.8.4.4")
+				a.Meta = &data.Meta{Note: "home"}
+				r.AddAnswer(a)
+				f.PutRecord(r)
+			}
+
+			done := make(chan struct{})
+			d := doer{next: f.Server.Client()}
+			if tt.doer != nil {
+				d.fn = tt.doer(done)
+			}
+			c := api.NewClient(d, api.SetEndpoint(f.Endpoint()))
+			records := provider.NewNS1("ns1", dnsapi.FromREST(c))
+
+			start := time.Now()
+			state, newIP, err := GetOldNewIPs(context.Background(), &dns.Zone{Zone: zone}, records, tt.ips(done), domain, Identity{Note: "home"}, timeouts)
+			if took := time.Since(start); took > time.Second {
+				t.Errorf("took %s, want it bounded by the timeouts", took)
+			}
+
+			if state.IP() != tt.oldIP || newIP != tt.newIP {
+				t.Errorf("got old %q new %q, want old %q new %q", state.IP(), newIP, tt.oldIP, tt.newIP)
+			}
+			if tt.errs == nil && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			for _, want := range tt.errs {
+				if !errors.Is(err, want) {
+					t.Errorf("error %v doesnt include %v", err, want)
+				}
+			}
+			if tt.hung {
+				select {
+				case <-done:
+				case <-time.After(time.Second):
+					t.Error("the timed out lookup was left running")
+				}
+			}
+		})
+	}
+}
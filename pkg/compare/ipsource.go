@@ -0,0 +1,44 @@
+package compare
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// IPSource finds the public IP of this host
+type IPSource interface {
+	PublicIP(ctx context.Context) (string, error)
+}
+
+// Ipify asks api.ipify.org for the address requests come from
+type Ipify struct {
+	Client *http.Client
+	URL    string
+}
+
+// DefaultIPSource is used when no other IPSource is given
+var DefaultIPSource IPSource = &Ipify{Client: http.DefaultClient, URL: "https://api.ipify.org"}
+
+func (i *Ipify) PublicIP(ctx context.Context) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, i.URL, nil)
+	if err != nil {
+		return "", err
+	}
+	rsp, err := i.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s returned %s", i.URL, rsp.Status)
+	}
+	buf, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		return "", err
+	}
+	return string(bytes.TrimSpace(buf)), nil
+}
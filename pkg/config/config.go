@@ -0,0 +1,1014 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/ns1/ns1-go.v2/rest/model/dns"
+)
+
+// Config is the on-disk configuration of the service
+type Config struct {
+	// Path is the file the config was loaded from
+	Path string `json:"-"`
+
+	APIKey string `json:"api_key"`
+
+	// Endpoint overrides the NS1 API URL, e.g. to point at ns1fake
+	Endpoint string `json:"endpoint"`
+
+	// Faults injects failures into calls to NS1, to see how the service
+	// copes. Never set this in production
+	Faults *Faults `json:"faults"`
+
+	// Providers are DNS hosts other than the NS1 account above, which is
+	// always there as DefaultProvider
+	Providers []Provider `json:"providers"`
+
+	// Domain is shorthand for a single target updating the apex of its zone
+	Domain string `json:"domain"`
+
+	Targets []Target `json:"targets"`
+
+	// Owner marks the records this service creates, and it only changes or
+	// deletes records with its mark. Hosts sharing targets must use the same
+	// owner. Defaults to "dnsupdate"
+	Owner string `json:"owner"`
+
+	// MarkWith is how records are marked: "note" (the default) for the
+	// record's meta note, or "tags" for a DDI tag
+	MarkWith string `json:"mark_with"`
+
+	// Alerts are raised when a detected IP is blocked by policy
+	Alerts *Alerts `json:"alerts"`
+
+	// Snapshots keeps a copy of records before the service changes them
+	Snapshots *Snapshots `json:"snapshots"`
+
+	// Zones declares every record this service owns in a zone, to be kept as
+	// declared
+	Zones []Zone `json:"zones"`
+
+	// StartupDelay is how long to wait before the first check, for hosts
+	// whose network comes up after the service does
+	StartupDelay Duration `json:"startup_delay"`
+
+	// Control is the address of the local control channel. A path on
+	// Linux, a localhost host:port on Windows
+	Control string `json:"control"`
+
+	// ControlToken is where the token needed to use the control channel is
+	// written. Defaults to the config path with ".token" appended
+	ControlToken string `json:"control_token"`
+
+	// LockFile stops two copies of the service running from the same
+	// config. Defaults to the config path with ".lock" appended
+	LockFile string `json:"lock_file"`
+
+	// ManagedFile lists every record and monitoring job the service has
+	// managed from this config, so gc only deletes those. Defaults to the
+	// config path with ".managed" appended
+	ManagedFile string `json:"managed_file"`
+
+	// Lease, if set, elects one of several hosts sharing these targets to
+	// update them, so a second host can run as a hot standby
+	Lease *Lease `json:"lease"`
+
+	// DynDNS, if set, runs a dyndns2 server routers can send their address
+	// to, to be published on their behalf
+	DynDNS *DynDNS `json:"dyndns_server"`
+
+	// Reaper deletes registrations whose ephemeral ttl has run out. It runs
+	// whenever a target or gateway token is ephemeral, in their zones, and
+	// in any zones listed here
+	Reaper *Reaper `json:"reaper"`
+
+	// Gateway, if set, runs an API hosts can register their own address
+	// with, so they dont each need an NS1 key
+	Gateway *Gateway `json:"gateway"`
+}
+
+// Gateway is the API hosts running as agents register with
+type Gateway struct {
+	// Listen, TLSCert and TLSKey are as for DynDNS
+	Listen  string `json:"listen"`
+	TLSCert string `json:"tls_cert"`
+	TLSKey  string `json:"tls_key"`
+
+	// ClientCA is a PEM file of the CA agents' certificates must be issued
+	// by, as made by "dnsupdate ca init". With it, agents must present a
+	// certificate naming the hosts they register, as well as a token.
+	// Needs TLSCert
+	ClientCA string `json:"client_ca"`
+
+	// RevocationList lists the serials of revoked certificates, and is
+	// read again whenever it changes. Defaults to revoked.txt next to
+	// ClientCA
+	RevocationList string `json:"revocation_list"`
+
+	// AuditLog is where each request is logged, as JSON lines. Defaults to
+	// the config path with ".audit" appended
+	AuditLog string `json:"audit_log"`
+
+	Tokens []GatewayToken `json:"tokens"`
+}
+
+// GatewayToken is what one host, or group of hosts, registers with
+type GatewayToken struct {
+	ID string `json:"id"`
+
+	// Secret is at least 16 characters. With Auth "hmac", the default,
+	// requests are signed with it; with "bearer" it is sent as is
+	Secret string `json:"secret"`
+	Auth   string `json:"auth"`
+
+	// Zone and Provider are as for a Target. Every host must be in Zone
+	Zone     string `json:"zone"`
+	Provider string `json:"provider"`
+
+	// Hosts are the hostnames the token may register, where "*" in a
+	// label matches anything, e.g. "*.hosts.example.com"
+	Hosts []string `json:"hosts"`
+
+	// RateLimit defaults to 10 requests a minute
+	RateLimit *RateLimit `json:"rate_limit"`
+
+	Policy *IPPolicy `json:"policy"`
+
+	// Ephemeral makes each registration expire unless the host renews it
+	// within TTL. DeleteOnStop cant be set
+	Ephemeral *Ephemeral `json:"ephemeral"`
+}
+
+// RateLimit allows Requests each Per, in bursts of up to Requests
+type RateLimit struct {
+	Requests int      `json:"requests"`
+	Per      Duration `json:"per"`
+}
+
+// DynDNS is a dyndns2 /nic/update server. Each user may update the hosts
+// listed for it, by domain
+type DynDNS struct {
+	// Listen is the host:port to serve on
+	Listen string `json:"listen"`
+
+	// TLSCert and TLSKey are PEM files to serve HTTPS with. Without them
+	// plain HTTP is served
+	TLSCert string `json:"tls_cert"`
+	TLSKey  string `json:"tls_key"`
+
+	Hosts []DynDNSHost `json:"hosts"`
+	Users []DynDNSUser `json:"users"`
+}
+
+// DynDNSHost is a record routers may point at themselves. Its fields are
+// as for a Target
+type DynDNSHost struct {
+	Zone     string    `json:"zone"`
+	Domain   string    `json:"domain"`
+	Provider string    `json:"provider"`
+	Answer   string    `json:"answer"`
+	Policy   *IPPolicy `json:"policy"`
+}
+
+// DynDNSUser logs in to the dyndns2 server with basic auth
+type DynDNSUser struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+
+	// Hosts are the domains of the hosts the user may update
+	Hosts []string `json:"hosts"`
+}
+
+// DefaultProvider names the NS1 account set up by APIKey and Endpoint
+const DefaultProvider = "ns1"
+
+// Provider is a DNS host targets and zones can publish to, by Name. Type is
+// "ns1", for another NS1 account, "rfc2136" for a server taking dynamic
+// updates, "dyndns2" for a DDNS service, or "gateway" for another copy of
+// the service running as a gateway
+type Provider struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+
+	// APIKey and Endpoint are as for the default NS1 account. For
+	// "dyndns2" and "gateway", Endpoint is the server's URL, e.g.
+	// https://members.dyndns.org
+	APIKey   string `json:"api_key"`
+	Endpoint string `json:"endpoint"`
+
+	// Username and Password log in to a "dyndns2" server
+	Username string `json:"username"`
+	Password string `json:"password"`
+
+	// Token, Secret and Auth are as for the GatewayToken this host uses,
+	// for "gateway"
+	Token  string `json:"token"`
+	Secret string `json:"secret"`
+	Auth   string `json:"auth"`
+
+	// TLSCert and TLSKey are the client certificate presented to a
+	// "gateway" with client_ca set, as issued by "dnsupdate ca issue".
+	// TLSCA is a PEM file of a CA to trust the gateway's own certificate
+	// with, as well as the system's
+	TLSCert string `json:"tls_cert"`
+	TLSKey  string `json:"tls_key"`
+	TLSCA   string `json:"tls_ca"`
+
+	// Server is the host:port updates are sent to, for "rfc2136". The port
+	// defaults to 53
+	Server string `json:"server"`
+
+	// Transport is "udp" (the default), switching to TCP for large
+	// messages, or "tcp"
+	Transport string `json:"transport"`
+
+	// TSIG signs updates, with an algorithm of "hmac-sha256" or
+	// "hmac-sha512" and a base64 secret, as in a BIND key file
+	TSIG *dns.TSIGKey `json:"tsig"`
+}
+
+// Snapshots says where copies of records are kept before each change, and
+// how many. Dir defaults to the config path with ".snapshots" appended, and
+// Keep to 20; a negative Keep turns snapshots off
+type Snapshots struct {
+	Dir  string `json:"dir"`
+	Keep int    `json:"keep"`
+}
+
+// Lease identifies this host in the election for each target
+type Lease struct {
+	// Owner defaults to the hostname
+	Owner    string   `json:"owner"`
+	Duration Duration `json:"duration"`
+}
+
+// Target is a single hostname kept pointing at this host
+type Target struct {
+	Zone     string   `json:"zone"`
+	Domain   string   `json:"domain"`
+	Schedule Schedule `json:"schedule"`
+
+	// Provider names the DNS host the zone is on. Defaults to
+	// DefaultProvider
+	Provider string `json:"provider"`
+
+	// Answer is the meta note marking the answer this target manages, so
+	// any other answers in the record are left alone. Defaults to
+	// "dnsupdate"
+	Answer string `json:"answer"`
+
+	// Damping holds back a new IP until it is stable
+	Damping *Damping `json:"damping"`
+
+	// Policy decides which detected IPs may be published. Without one,
+	// only bogons are rejected
+	Policy *IPPolicy `json:"policy"`
+
+	// Ephemeral makes the target's answer expire if this host stops
+	// renewing it, or be deleted when the service stops
+	Ephemeral *Ephemeral `json:"ephemeral"`
+
+	// Monitor has NS1 monitor the published address. Only for targets on
+	// an NS1 account
+	Monitor *Monitor `json:"monitor"`
+
+	// Failover serves the record only from answers that are up, by their
+	// monitoring jobs. Needs Monitor
+	Failover *Failover `json:"failover"`
+}
+
+// Failover is how a record shared by several hosts fails over between
+// their answers. Every host sharing the record should agree on it, apart
+// from its own priority
+type Failover struct {
+	// Priority of this host's answer. Answers that are up are served
+	// lowest priority first; 0 leaves out the priority filter
+	Priority int `json:"priority"`
+
+	// SelectFirst is how many answers are served, 0 for every one up
+	SelectFirst int `json:"select_first"`
+}
+
+// Monitor is an NS1 monitoring job kept pointed at a target's address
+type Monitor struct {
+	// Type is "tcp", "http" or "ping"
+	Type string `json:"type"`
+
+	// Port is connected to by "tcp". Defaults to the port of the SRV
+	// record
+	Port int `json:"port"`
+
+	// URL is fetched by "http", with {ip} replaced by the published
+	// address, e.g. "http://{ip}/health". Defaults to "http://{ip}/"
+	URL string `json:"url"`
+
+	// Regions the job runs from. Defaults to "lga", "sjc" and "ams"
+	Regions []string `json:"regions"`
+
+	// Every is how often each region checks. Defaults to 1m
+	Every Duration `json:"every"`
+}
+
+// Ephemeral is a registration that doesnt outlive its host
+type Ephemeral struct {
+	// TTL is how long after it was last renewed a reaper deletes the
+	// answer. A target renews it on each check, which must be more often;
+	// a gateway token on each request. At least a minute
+	TTL Duration `json:"ttl"`
+
+	// DeleteOnStop deletes a target's answer when the service is stopped
+	// cleanly. Targets only
+	DeleteOnStop bool `json:"delete_on_stop"`
+}
+
+// Reaper says how often expired registrations are looked for, and where
+type Reaper struct {
+	// Every defaults to 5m
+	Every Duration `json:"every"`
+
+	// Zones are reaped as well as those of ephemeral targets and gateway
+	// tokens, e.g. on a host that doesnt register anything itself
+	Zones []ReapZone `json:"zones"`
+}
+
+// ReapZone is a zone to reap, with Provider as for a Target
+type ReapZone struct {
+	Zone     string `json:"zone"`
+	Provider string `json:"provider"`
+}
+
+// IPPolicy blocks publishing addresses that cant be right. Addresses in Deny
+// are blocked, and if Allow is set, so is any address outside it. Private,
+// reserved and CGNAT addresses are blocked unless AllowBogons is set or they
+// are in Allow. If ExpectedASNs is set, the address must be announced by one
+// of them according to ASNFile, a list of prefixes and AS numbers
+type IPPolicy struct {
+	Allow        []string `json:"allow"`
+	Deny         []string `json:"deny"`
+	AllowBogons  bool     `json:"allow_bogons"`
+	ExpectedASNs []uint32 `json:"expected_asns"`
+	ASNFile      string   `json:"asn_file"`
+}
+
+// Alerts says where to send alerts, as well as the log and status output
+type Alerts struct {
+	// Webhook is a URL each alert is POSTed to as JSON
+	Webhook string `json:"webhook"`
+}
+
+// Damping publishes a new IP only once it has been seen on Checks checks in
+// a row, or for For, whichever comes first. Addresses or CIDR prefixes in
+// Never are never published, and those in Immediate are published straight
+// away
+type Damping struct {
+	Checks    int      `json:"checks"`
+	For       Duration `json:"for"`
+	Never     []string `json:"never"`
+	Immediate []string `json:"immediate"`
+}
+
+// Name identifies the target in logs and status output
+func (t Target) Name() string {
+	return t.Domain
+}
+
+// Drift policies for a Zone
+const (
+	// DriftCorrect puts records that have drifted back as declared
+	DriftCorrect = "correct"
+	// DriftReport only logs and reports them
+	DriftReport = "report"
+)
+
+// Zone is the records this service owns in a zone. Records not listed are
+// never touched
+type Zone struct {
+	Zone string `json:"zone"`
+
+	// Provider is as for a Target
+	Provider string `json:"provider"`
+
+	// Drift is what to do about records that differ from their declaration,
+	// DriftCorrect (the default) or DriftReport
+	Drift string `json:"drift"`
+
+	Schedule Schedule `json:"schedule"`
+	Records  []Record `json:"records"`
+
+	// Policy checks the IP used for "{ip}" in answers
+	Policy *IPPolicy `json:"policy"`
+}
+
+// Record is one declared record. Domain may be relative to the zone, with ""
+// or "@" meaning the apex. Each answer is its rdata separated by spaces, e.g.
+// "10 mail.example.com" for MX, and "{ip}" in an answer is replaced with the
+// detected public IP
+type Record struct {
+	Domain  string   `json:"domain"`
+	Type    string   `json:"type"`
+	TTL     int      `json:"ttl"`
+	Answers []string `json:"answers"`
+}
+
+// FQDN returns the record's domain qualified with zone
+func (r Record) FQDN(zone string) string {
+	switch {
+	case r.Domain == "" || r.Domain == "@":
+		return zone
+	case strings.EqualFold(r.Domain, zone) || strings.HasSuffix(strings.ToLower(r.Domain), "."+strings.ToLower(zone)):
+		return r.Domain
+	}
+	return r.Domain + "." + zone
+}
+
+// Schedule controls how often a target is checked. At most one of Cron and
+// Adaptive may be set; with neither, the target is checked every Every
+type Schedule struct {
+	Every    Duration  `json:"every"`
+	Jitter   Duration  `json:"jitter"`
+	Cron     string    `json:"cron"`
+	Adaptive *Adaptive `json:"adaptive"`
+}
+
+// Adaptive checks every Min after a change or failure, backing off by Factor
+// up to Max while the IP is stable
+type Adaptive struct {
+	Min    Duration `json:"min"`
+	Max    Duration `json:"max"`
+	Factor float64  `json:"factor"`
+}
+
+// Faults is a plan of failures to inject. Requests whose path contains Match
+// (all requests if empty) get the faults in Script in turn, one each, and
+// after that each of Random with its probability
+type Faults struct {
+	Seed   int64   `json:"seed"`
+	Match  string  `json:"match"`
+	Script []Fault `json:"script"`
+	Random []Fault `json:"random"`
+}
+
+// Fault is a single failure. Kind is one of "none", "latency", "drop",
+// "status", "truncate" or "reorder"
+type Fault struct {
+	Kind        string  `json:"kind"`
+	Probability float64 `json:"probability"`
+
+	// Latency is the delay for "latency", and the longest a response is
+	// held for "reorder"
+	Latency Duration `json:"latency"`
+
+	// Status is the HTTP status returned by "status", e.g. 429 or 503
+	Status int `json:"status"`
+
+	// After makes "drop" and "status" happen after NS1 has handled the
+	// request, so the change is made but the caller doesnt find out
+	After bool `json:"after"`
+}
+
+// Duration is a time.Duration that reads and writes as "30s", "5m" etc.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// Load reads and validates the config file at path
+func Load(path string) (*Config, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c := Config{Path: path}
+	if err := json.Unmarshal(buf, &c); err != nil {
+		return nil, err
+	}
+
+	if c.LockFile == "" {
+		c.LockFile = path + ".lock"
+	}
+	if c.ControlToken == "" {
+		c.ControlToken = path + ".token"
+	}
+	if c.ManagedFile == "" {
+		c.ManagedFile = path + ".managed"
+	}
+	if c.Snapshots == nil {
+		c.Snapshots = &Snapshots{}
+	}
+	if c.Snapshots.Dir == "" {
+		c.Snapshots.Dir = path + ".snapshots"
+	}
+	if c.Snapshots.Keep == 0 {
+		c.Snapshots.Keep = 20
+	}
+	if c.Owner == "" {
+		c.Owner = "dnsupdate"
+	}
+	switch c.MarkWith {
+	case "":
+		c.MarkWith = "note"
+	case "note", "tags":
+	default:
+		return nil, errors.New(`config: mark_with must be "note" or "tags"`)
+	}
+	if c.Lease != nil {
+		if c.Lease.Owner == "" {
+			host, err := os.Hostname()
+			if err != nil {
+				return nil, fmt.Errorf("config: lease owner not set and %w", err)
+			}
+			c.Lease.Owner = host
+		}
+		if c.Lease.Duration == 0 {
+			c.Lease.Duration = Duration(5 * time.Minute)
+		}
+		if time.Duration(c.Lease.Duration) < 30*time.Second {
+			return nil, errors.New("config: lease duration must be at least 30s")
+		}
+	}
+
+	if len(c.Targets) == 0 && c.Domain != "" {
+		c.Targets = []Target{{Zone: c.Domain, Domain: c.Domain}}
+	}
+	if len(c.Targets) == 0 && len(c.Zones) == 0 && c.DynDNS == nil && c.Gateway == nil {
+		return nil, errors.New("config: domain, targets, zones, dyndns_server or gateway is required")
+	}
+	for i, t := range c.Targets {
+		if t.Zone == "" {
+			return nil, fmt.Errorf("config: target %d has no zone", i)
+		}
+		if t.Domain == "" {
+			c.Targets[i].Domain = t.Zone
+		}
+	}
+	if err := c.checkZones(); err != nil {
+		return nil, err
+	}
+	if err := c.checkDynDNS(); err != nil {
+		return nil, err
+	}
+	if err := c.checkGateway(); err != nil {
+		return nil, err
+	}
+	if err := c.checkProviders(); err != nil {
+		return nil, err
+	}
+	if err := c.checkReaper(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// checkProviders validates the providers, and that every target and zone
+// uses one that exists
+func (c *Config) checkProviders() error {
+	known := map[string]bool{DefaultProvider: true}
+	// providers that can only set a target's address
+	writeOnly := map[string]bool{}
+	ns1 := map[string]bool{DefaultProvider: true}
+	for i, p := range c.Providers {
+		switch {
+		case p.Name == "":
+			return fmt.Errorf("config: provider %d has no name", i)
+		case known[p.Name]:
+			return fmt.Errorf("config: provider %s is declared twice", p.Name)
+		}
+		known[p.Name] = true
+
+		switch p.Type {
+		case "ns1":
+			if p.APIKey == "" {
+				return fmt.Errorf("config: provider %s: api_key is required", p.Name)
+			}
+			ns1[p.Name] = true
+		case "rfc2136":
+			if p.Server == "" {
+				return fmt.Errorf("config: provider %s: server is required", p.Name)
+			}
+			if _, _, err := net.SplitHostPort(p.Server); err != nil {
+				c.Providers[i].Server = net.JoinHostPort(p.Server, "53")
+			}
+			switch p.Transport {
+			case "", "udp", "tcp":
+			default:
+				return fmt.Errorf(`config: provider %s: transport must be "udp" or "tcp"`, p.Name)
+			}
+		case "dyndns2":
+			if p.Endpoint == "" || p.Username == "" || p.Password == "" {
+				return fmt.Errorf("config: provider %s: endpoint, username and password are required", p.Name)
+			}
+			if u, err := url.Parse(p.Endpoint); err != nil || u.Host == "" {
+				return fmt.Errorf("config: provider %s: endpoint must be a URL", p.Name)
+			}
+			writeOnly[p.Name] = true
+		case "gateway":
+			if p.Endpoint == "" || p.Secret == "" {
+				return fmt.Errorf("config: provider %s: endpoint and secret are required", p.Name)
+			}
+			if u, err := url.Parse(p.Endpoint); err != nil || u.Host == "" {
+				return fmt.Errorf("config: provider %s: endpoint must be a URL", p.Name)
+			}
+			if err := checkAuth(&c.Providers[i].Auth, p.Token); err != nil {
+				return fmt.Errorf("config: provider %s: %w", p.Name, err)
+			}
+			if (p.TLSCert == "") != (p.TLSKey == "") {
+				return fmt.Errorf("config: provider %s: tls_cert and tls_key must be set together", p.Name)
+			}
+			writeOnly[p.Name] = true
+		default:
+			return fmt.Errorf("config: provider %s: unknown type %q", p.Name, p.Type)
+		}
+	}
+
+	// the default account is needed by anything using it
+	var needDefault bool
+	use := func(what string, name *string) error {
+		if *name == "" {
+			*name = DefaultProvider
+		}
+		if !known[*name] {
+			return fmt.Errorf("config: %s: no provider %q", what, *name)
+		}
+		if *name == DefaultProvider {
+			needDefault = true
+		}
+		return nil
+	}
+	// a ttl is kept in a TXT record next to the registration
+	expiring := func(what, provider string, e *Ephemeral) error {
+		if e != nil && e.TTL > 0 && writeOnly[provider] {
+			return fmt.Errorf("config: %s: provider %s cant hold an ephemeral ttl", what, provider)
+		}
+		return nil
+	}
+	for i := range c.Targets {
+		t := &c.Targets[i]
+		if err := use("target "+t.Name(), &t.Provider); err != nil {
+			return err
+		}
+		if err := expiring("target "+t.Name(), t.Provider, t.Ephemeral); err != nil {
+			return err
+		}
+		if c.Lease != nil && !ns1[t.Provider] {
+			return fmt.Errorf("config: target %s: lease is kept in the zone's NS1 account, and provider %s isnt one", t.Name(), t.Provider)
+		}
+	}
+	if c.DynDNS != nil {
+		for i := range c.DynDNS.Hosts {
+			h := &c.DynDNS.Hosts[i]
+			if err := use("dyndns host "+h.Domain, &h.Provider); err != nil {
+				return err
+			}
+		}
+	}
+	if c.Gateway != nil {
+		for i := range c.Gateway.Tokens {
+			t := &c.Gateway.Tokens[i]
+			if err := use("gateway token "+t.ID, &t.Provider); err != nil {
+				return err
+			}
+			if err := expiring("gateway token "+t.ID, t.Provider, t.Ephemeral); err != nil {
+				return err
+			}
+		}
+	}
+	for i := range c.Zones {
+		z := &c.Zones[i]
+		if err := use("zone "+z.Zone, &z.Provider); err != nil {
+			return err
+		}
+		if writeOnly[z.Provider] {
+			return fmt.Errorf("config: zone %s: provider %s can only be used by targets", z.Zone, z.Provider)
+		}
+		if c.Lease != nil && !ns1[z.Provider] {
+			return fmt.Errorf("config: zone %s: lease is kept in the zone's NS1 account, and provider %s isnt one", z.Zone, z.Provider)
+		}
+	}
+	if c.Reaper != nil {
+		for i := range c.Reaper.Zones {
+			z := &c.Reaper.Zones[i]
+			if z.Zone == "" {
+				return fmt.Errorf("config: reaper: zone %d has no name", i)
+			}
+			if err := use("reaper zone "+z.Zone, &z.Provider); err != nil {
+				return err
+			}
+			if writeOnly[z.Provider] {
+				return fmt.Errorf("config: reaper zone %s: provider %s cant list its records", z.Zone, z.Provider)
+			}
+		}
+	}
+	if needDefault && c.APIKey == "" {
+		return errors.New("config: api_key is required")
+	}
+	return c.checkMonitors(ns1)
+}
+
+// checkDynDNS validates the dyndns2 server. A host cant also be a target,
+// as both would manage the same answer
+func (c *Config) checkDynDNS() error {
+	d := c.DynDNS
+	if d == nil {
+		return nil
+	}
+	if d.Listen == "" {
+		return errors.New("config: dyndns_server: listen is required")
+	}
+	if (d.TLSCert == "") != (d.TLSKey == "") {
+		return errors.New("config: dyndns_server: tls_cert and tls_key must be set together")
+	}
+
+	targets := map[string]bool{}
+	for _, t := range c.Targets {
+		targets[strings.ToLower(t.Domain)] = true
+	}
+	hosts := map[string]bool{}
+	for i, h := range d.Hosts {
+		domain := strings.ToLower(strings.TrimSuffix(h.Domain, "."))
+		switch {
+		case h.Zone == "" || domain == "":
+			return fmt.Errorf("config: dyndns_server: host %d needs a zone and domain", i)
+		case domain != strings.ToLower(h.Zone) && !strings.HasSuffix(domain, "."+strings.ToLower(h.Zone)):
+			return fmt.Errorf("config: dyndns_server: host %s is not in zone %s", h.Domain, h.Zone)
+		case targets[domain]:
+			return fmt.Errorf("config: dyndns_server: host %s is also a target", h.Domain)
+		case hosts[domain]:
+			return fmt.Errorf("config: dyndns_server: host %s is declared twice", h.Domain)
+		}
+		hosts[domain] = true
+	}
+
+	users := map[string]bool{}
+	for i, u := range d.Users {
+		switch {
+		case u.Username == "" || u.Password == "":
+			return fmt.Errorf("config: dyndns_server: user %d needs a username and password", i)
+		case users[u.Username]:
+			return fmt.Errorf("config: dyndns_server: user %s is declared twice", u.Username)
+		}
+		users[u.Username] = true
+		for _, h := range u.Hosts {
+			if !hosts[strings.ToLower(strings.TrimSuffix(h, "."))] {
+				return fmt.Errorf("config: dyndns_server: user %s: no host %s", u.Username, h)
+			}
+		}
+	}
+	return nil
+}
+
+// checkGateway validates the gateway, filling in defaults
+func (c *Config) checkGateway() error {
+	g := c.Gateway
+	if g == nil {
+		return nil
+	}
+	if g.Listen == "" {
+		return errors.New("config: gateway: listen is required")
+	}
+	if (g.TLSCert == "") != (g.TLSKey == "") {
+		return errors.New("config: gateway: tls_cert and tls_key must be set together")
+	}
+	if g.ClientCA != "" && g.TLSCert == "" {
+		return errors.New("config: gateway: client_ca needs tls_cert and tls_key")
+	}
+	if g.ClientCA != "" && g.RevocationList == "" {
+		g.RevocationList = filepath.Join(filepath.Dir(g.ClientCA), "revoked.txt")
+	}
+	if g.AuditLog == "" {
+		g.AuditLog = c.Path + ".audit"
+	}
+
+	ids := map[string]bool{}
+	for i := range g.Tokens {
+		t := &g.Tokens[i]
+		switch {
+		case t.ID == "":
+			return fmt.Errorf("config: gateway: token %d has no id", i)
+		case ids[t.ID]:
+			return fmt.Errorf("config: gateway: token %s is declared twice", t.ID)
+		case len(t.Secret) < 16:
+			return fmt.Errorf("config: gateway: token %s: secret must be at least 16 characters", t.ID)
+		case t.Zone == "":
+			return fmt.Errorf("config: gateway: token %s: zone is required", t.ID)
+		case len(t.Hosts) == 0:
+			return fmt.Errorf("config: gateway: token %s: hosts is required", t.ID)
+		}
+		ids[t.ID] = true
+		if err := checkAuth(&t.Auth, t.ID); err != nil {
+			return fmt.Errorf("config: gateway: token %s: %w", t.ID, err)
+		}
+		// the secret itself is sent with bearer auth, so it needs TLS
+		if t.Auth == "bearer" && g.TLSCert == "" {
+			return fmt.Errorf(`config: gateway: token %s: auth "bearer" needs tls_cert and tls_key`, t.ID)
+		}
+		zone := strings.ToLower(strings.TrimSuffix(t.Zone, "."))
+		for _, h := range t.Hosts {
+			h = strings.ToLower(strings.TrimSuffix(h, "."))
+			if !strings.HasSuffix(h, "."+zone) {
+				return fmt.Errorf("config: gateway: token %s: %s is not in zone %s", t.ID, h, t.Zone)
+			}
+		}
+		if t.RateLimit == nil {
+			t.RateLimit = &RateLimit{Requests: 10, Per: Duration(time.Minute)}
+		}
+		if t.RateLimit.Requests <= 0 || t.RateLimit.Per <= 0 {
+			return fmt.Errorf("config: gateway: token %s: rate_limit needs requests and per", t.ID)
+		}
+	}
+	return nil
+}
+
+// checkMonitors validates the monitoring jobs of targets and their
+// failover, filling in defaults. ns1 is whether each provider is an NS1 account.
+// A job is named after the target's answer, so a monitored target must set
+// its own: with the default, every host sharing the record would fight over
+// one job
+func (c *Config) checkMonitors(ns1 map[string]bool) error {
+	jobs := map[string]bool{}
+	for i := range c.Targets {
+		t := &c.Targets[i]
+		m := t.Monitor
+		if m == nil {
+			continue
+		}
+		if !ns1[t.Provider] {
+			return fmt.Errorf("config: target %s: monitor needs an NS1 account, not provider %s", t.Name(), t.Provider)
+		}
+		if t.Answer == "" {
+			return fmt.Errorf("config: target %s: monitor needs an answer of the host's own, not the default shared by every host", t.Name())
+		}
+		at := t.Provider
+		if at == "" {
+			at = DefaultProvider
+		}
+		job := strings.ToLower(at+" "+strings.TrimSuffix(t.Domain, ".")) + " " + t.Answer
+		if jobs[job] {
+			return fmt.Errorf("config: target %s: another target monitors answer %s of the same record", t.Name(), t.Answer)
+		}
+		jobs[job] = true
+		switch m.Type {
+		case "tcp":
+			if m.Port < 0 || m.Port > 65535 {
+				return fmt.Errorf("config: target %s: monitor port must be 1 to 65535", t.Name())
+			}
+		case "http":
+			if m.URL == "" {
+				m.URL = "http://{ip}/"
+			}
+			if u, err := url.Parse(strings.ReplaceAll(m.URL, "{ip}", "192.0.2.1")); err != nil || u.Host == "" {
+				return fmt.Errorf("config: target %s: monitor url must be a URL", t.Name())
+			}
+		case "ping":
+		default:
+			return fmt.Errorf(`config: target %s: monitor type must be "tcp", "http" or "ping"`, t.Name())
+		}
+		if len(m.Regions) == 0 {
+			m.Regions = []string{"lga", "sjc", "ams"}
+		}
+		if m.Every == 0 {
+			m.Every = Duration(time.Minute)
+		}
+		if time.Duration(m.Every) < 30*time.Second {
+			return fmt.Errorf("config: target %s: monitor every must be at least 30s", t.Name())
+		}
+	}
+	for _, t := range c.Targets {
+		f := t.Failover
+		switch {
+		case f == nil:
+		case t.Monitor == nil:
+			return fmt.Errorf("config: target %s: failover needs a monitor", t.Name())
+		case f.Priority < 0:
+			return fmt.Errorf("config: target %s: failover priority cant be negative", t.Name())
+		case f.SelectFirst < 0:
+			return fmt.Errorf("config: target %s: failover select_first cant be negative", t.Name())
+		}
+	}
+	return nil
+}
+
+// checkReaper validates the ephemeral targets and gateway tokens, and the
+// reaper, filling in defaults
+func (c *Config) checkReaper() error {
+	check := func(what string, e *Ephemeral) error {
+		switch {
+		case e == nil:
+		case e.TTL < 0 || (e.TTL > 0 && time.Duration(e.TTL) < time.Minute):
+			return fmt.Errorf("config: %s: ephemeral ttl must be at least 1m", what)
+		case e.TTL == 0 && !e.DeleteOnStop:
+			return fmt.Errorf("config: %s: ephemeral needs a ttl or delete_on_stop", what)
+		}
+		return nil
+	}
+	for _, t := range c.Targets {
+		if err := check("target "+t.Name(), t.Ephemeral); err != nil {
+			return err
+		}
+	}
+	if c.Gateway != nil {
+		for _, t := range c.Gateway.Tokens {
+			if err := check("gateway token "+t.ID, t.Ephemeral); err != nil {
+				return err
+			}
+			if t.Ephemeral != nil && (t.Ephemeral.DeleteOnStop || t.Ephemeral.TTL == 0) {
+				return fmt.Errorf("config: gateway token %s: ephemeral needs a ttl, and cant delete on stop", t.ID)
+			}
+		}
+	}
+	if c.Reaper == nil {
+		c.Reaper = &Reaper{}
+	}
+	if c.Reaper.Every == 0 {
+		c.Reaper.Every = Duration(5 * time.Minute)
+	}
+	if time.Duration(c.Reaper.Every) < 10*time.Second {
+		return errors.New("config: reaper: every must be at least 10s")
+	}
+	return nil
+}
+
+// checkAuth checks a gateway auth method, defaulting it to "hmac", which
+// needs the token's id
+func checkAuth(auth *string, id string) error {
+	switch *auth {
+	case "":
+		*auth = "hmac"
+		fallthrough
+	case "hmac":
+		if id == "" {
+			return errors.New(`token is required with auth "hmac"`)
+		}
+	case "bearer":
+	default:
+		return errors.New(`auth must be "hmac" or "bearer"`)
+	}
+	return nil
+}
+
+// checkZones validates the declared zones, filling in defaults
+func (c *Config) checkZones() error {
+	targets := map[string]bool{}
+	for _, t := range c.Targets {
+		targets[strings.ToLower(t.Domain)] = true
+	}
+
+	for i := range c.Zones {
+		z := &c.Zones[i]
+		if z.Zone == "" {
+			return fmt.Errorf("config: zone %d has no name", i)
+		}
+		switch z.Drift {
+		case "":
+			z.Drift = DriftCorrect
+		case DriftCorrect, DriftReport:
+		default:
+			return fmt.Errorf("config: zone %s: drift must be %q or %q", z.Zone, DriftCorrect, DriftReport)
+		}
+
+		seen := map[string]bool{}
+		for j := range z.Records {
+			r := &z.Records[j]
+			r.Type = strings.ToUpper(r.Type)
+			name := r.FQDN(z.Zone)
+			if r.Type == "" {
+				return fmt.Errorf("config: zone %s: record %s has no type", z.Zone, name)
+			}
+			if len(r.Answers) == 0 {
+				return fmt.Errorf("config: zone %s: record %s %s has no answers", z.Zone, name, r.Type)
+			}
+			key := strings.ToLower(name) + " " + r.Type
+			if seen[key] {
+				return fmt.Errorf("config: zone %s: record %s %s is declared twice", z.Zone, name, r.Type)
+			}
+			seen[key] = true
+			// targets manage their own A record
+			if r.Type == "A" && targets[strings.ToLower(name)] {
+				return fmt.Errorf("config: zone %s: record %s A is also a target", z.Zone, name)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckGateway(t *testing.T) {
+	token := func(auth string) GatewayToken {
+		return GatewayToken{ID: "ci", Secret: "0123456789abcdef", Auth: auth, Zone: "example.com", Hosts: []string{"*.ci.example.com"}}
+	}
+	tests := []struct {
+		name    string
+		gateway Gateway
+		wantErr string
+	}{
+		{name: "hmac without tls", gateway: Gateway{Listen: ":8246", Tokens: []GatewayToken{token("")}}},
+		{name: "bearer with tls", gateway: Gateway{Listen: ":8246", TLSCert: "cert.pem", TLSKey: "key.pem", Tokens: []GatewayToken{token("bearer")}}},
+		{name: "bearer without tls", gateway: Gateway{Listen: ":8246", Tokens: []GatewayToken{token("bearer")}}, wantErr: `auth "bearer" needs tls_cert`},
+		{name: "cert without key", gateway: Gateway{Listen: ":8246", TLSCert: "cert.pem"}, wantErr: "must be set together"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := tt.gateway
+			c := &Config{Path: "dnsupdate.json", Gateway: &g}
+			err := c.checkGateway()
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("got error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckMonitors(t *testing.T) {
+	target := func(domain, answer string) Target {
+		return Target{Zone: "example.com", Domain: domain, Answer: answer, Monitor: &Monitor{Type: "tcp"}}
+	}
+	tests := []struct {
+		name    string
+		targets []Target
+		wantErr string
+	}{
+		{name: "own answer", targets: []Target{target("www.example.com", "home")}},
+		{name: "answer per record", targets: []Target{target("www.example.com", "home"), target("home.example.com", "home")}},
+		{name: "default answer", targets: []Target{target("www.example.com", "")}, wantErr: "monitor needs an answer"},
+		{name: "same answer twice", targets: []Target{target("www.example.com", "home"), target("WWW.example.com.", "home")}, wantErr: "another target monitors answer home"},
+		{name: "unmonitored default answer", targets: []Target{{Zone: "example.com", Domain: "www.example.com"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Config{Targets: tt.targets}
+			err := c.checkMonitors(map[string]bool{DefaultProvider: true, "": true})
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("got error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckProvidersLease(t *testing.T) {
+	providers := []Provider{
+		{Name: "other", Type: "ns1", APIKey: "key"},
+		{Name: "bind", Type: "rfc2136", Server: "ns.example.com"},
+		{Name: "router", Type: "dyndns2", Endpoint: "https://dyn.example.com", Username: "u", Password: "p"},
+	}
+	target := func(provider string) Target {
+		return Target{Zone: "example.com", Domain: "home.example.com", Provider: provider}
+	}
+	tests := []struct {
+		name    string
+		apiKey  string
+		targets []Target
+		zones   []Zone
+		wantErr string
+	}{
+		{name: "default account", apiKey: "key", targets: []Target{target("")}},
+		{name: "another ns1 account", targets: []Target{target("other")}},
+		{name: "rfc2136 target", targets: []Target{target("bind")}, wantErr: "lease is kept in the zone's NS1 account, and provider bind isnt one"},
+		{name: "dyndns2 target", targets: []Target{target("router")}, wantErr: "provider router isnt one"},
+		{name: "rfc2136 zone", zones: []Zone{{Zone: "example.com", Provider: "bind"}}, wantErr: "zone example.com: lease is kept"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Config{APIKey: tt.apiKey, Providers: providers, Targets: tt.targets, Zones: tt.zones, Lease: &Lease{Owner: "a"}}
+			err := c.checkProviders()
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("got error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
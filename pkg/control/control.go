@@ -0,0 +1,200 @@
+package control
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Request is a single command sent over the control channel
+type Request struct {
+	Token   string   `json:"token"`
+	Command string   `json:"command"`
+	Args    []string `json:"args,omitempty"`
+}
+
+// Response is the reply to a Request
+type Response struct {
+	OK    bool            `json:"ok"`
+	Error string          `json:"error,omitempty"`
+	Data  json.RawMessage `json:"data,omitempty"`
+}
+
+// Handler runs a Request and returns a value to be sent back to the caller
+type Handler func(ctx context.Context, req Request) (interface{}, error)
+
+var (
+	// ErrUnknownCommand is returned by handlers for commands they dont recognise
+	ErrUnknownCommand = errors.New("unknown command")
+	// ErrBadToken is returned to callers that dont present the server's token
+	ErrBadToken = errors.New("bad control token")
+)
+
+// IOTimeout bounds reading a request, and writing its reply, so a client
+// that connects and sends nothing, or stops reading, cant tie up a
+// connection for long
+const IOTimeout = 5 * time.Second
+
+// Server accepts control connections on a local socket. Each request must
+// carry the token the server wrote to its token file, so only users able to
+// read that file can control the service
+type Server struct {
+	ln      net.Listener
+	token   string
+	handler Handler
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+
+	mu sync.Mutex
+	// waiting is each connection whose request hasnt been read yet, which
+	// Close closes rather than waits for
+	waiting map[net.Conn]bool
+}
+
+// Listen opens the control channel at addr, and writes a newly generated
+// token to tokenFile. The token is only written once addr is bound, so an
+// instance already listening there keeps its clients. Serve must be called
+// to start handling requests
+func Listen(addr, tokenFile string, h Handler) (*Server, error) {
+	ln, err := listen(addr)
+	if err != nil {
+		return nil, err
+	}
+	token, err := newToken(tokenFile)
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Server{ln: ln, token: token, handler: h, ctx: ctx, cancel: cancel, waiting: map[net.Conn]bool{}}, nil
+}
+
+// Serve accepts connections until Close is called
+func (s *Server) Serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			if s.ctx.Err() == nil {
+				log.Println("Control channel stopped - " + err.Error())
+			}
+			return
+		}
+		s.mu.Lock()
+		if s.ctx.Err() != nil {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		s.waiting[conn] = true
+		s.wg.Add(1)
+		s.mu.Unlock()
+		go s.serveConn(conn)
+	}
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer s.wg.Done()
+	defer conn.Close()
+
+	var req Request
+	conn.SetDeadline(time.Now().Add(IOTimeout))
+	err := json.NewDecoder(bufio.NewReader(conn)).Decode(&req)
+	s.mu.Lock()
+	delete(s.waiting, conn)
+	s.mu.Unlock()
+	if err != nil {
+		json.NewEncoder(conn).Encode(Response{Error: err.Error()})
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(req.Token), []byte(s.token)) != 1 {
+		json.NewEncoder(conn).Encode(Response{Error: ErrBadToken.Error()})
+		return
+	}
+	// the handler takes as long as it takes, until Close cancels it
+	conn.SetDeadline(time.Time{})
+
+	res := Response{OK: true}
+	data, err := s.handler(s.ctx, req)
+	if err != nil {
+		res.OK = false
+		res.Error = err.Error()
+	}
+	if data != nil {
+		buf, mErr := json.Marshal(data)
+		if mErr != nil {
+			res.OK = false
+			res.Error = mErr.Error()
+		} else {
+			res.Data = buf
+		}
+	}
+	conn.SetDeadline(time.Now().Add(IOTimeout))
+	json.NewEncoder(conn).Encode(res)
+}
+
+// Close stops accepting connections, drops those yet to send a request, and
+// waits for in-flight requests
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.cancel()
+	for conn := range s.waiting {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	err := s.ln.Close()
+	s.wg.Wait()
+	return err
+}
+
+// Call sends req to the control channel at addr, using the token in
+// tokenFile, and waits up to timeout for the reply
+func Call(addr, tokenFile string, req Request, timeout time.Duration) (*Response, error) {
+	token, err := os.ReadFile(tokenFile)
+	if err != nil {
+		return nil, err
+	}
+	req.Token = strings.TrimSpace(string(token))
+
+	conn, err := dial(addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, err
+	}
+
+	var res Response
+	if err := json.NewDecoder(conn).Decode(&res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+func newToken(path string) (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(buf)
+
+	// remove any old file first, so its permissions are not reused
+	os.Remove(path)
+	if err := os.WriteFile(path, []byte(token+"\n"), 0600); err != nil {
+		return "", err
+	}
+	return token, nil
+}
@@ -0,0 +1,38 @@
+//go:build !windows
+
+package control
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// DefaultAddress is the control socket used when none is configured
+var DefaultAddress = filepath.Join(os.TempDir(), "dnsupdate.sock")
+
+func listen(addr string) (net.Listener, error) {
+	// a socket left behind by a crashed instance would stop us binding
+	if fi, err := os.Stat(addr); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if c, err := net.Dial("unix", addr); err == nil {
+			c.Close()
+			return nil, &net.OpError{Op: "listen", Net: "unix", Err: os.ErrExist}
+		}
+		os.Remove(addr)
+	}
+
+	ln, err := net.Listen("unix", addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(addr, 0600); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+func dial(addr string, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout("unix", addr, timeout)
+}
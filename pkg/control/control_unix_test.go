@@ -0,0 +1,112 @@
+//go:build !windows
+
+package control
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func echo(ctx context.Context, req Request) (interface{}, error) {
+	if req.Command != "echo" {
+		return nil, ErrUnknownCommand
+	}
+	return req.Args, nil
+}
+
+func TestCall(t *testing.T) {
+	dir := t.TempDir()
+	addr, tokenFile := filepath.Join(dir, "ctl.sock"), filepath.Join(dir, "token")
+	s, err := Listen(addr, tokenFile, echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve()
+	defer s.Close()
+
+	tests := []struct {
+		name      string
+		tokenFile string
+		req       Request
+		wantOK    bool
+		wantError string
+	}{
+		{name: "ok", tokenFile: tokenFile, req: Request{Command: "echo", Args: []string{"hi"}}, wantOK: true},
+		{name: "unknown command", tokenFile: tokenFile, req: Request{Command: "nope"}, wantError: ErrUnknownCommand.Error()},
+		{name: "bad token", req: Request{Command: "echo"}, wantError: ErrBadToken.Error()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.tokenFile == "" {
+				tt.tokenFile = filepath.Join(dir, "wrong")
+				os.WriteFile(tt.tokenFile, []byte("wrong\n"), 0600)
+			}
+			res, err := Call(addr, tt.tokenFile, tt.req, time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.OK != tt.wantOK || res.Error != tt.wantError {
+				t.Errorf("got ok %v error %q, want ok %v error %q", res.OK, res.Error, tt.wantOK, tt.wantError)
+			}
+		})
+	}
+}
+
+func TestListenKeepsRunningInstanceToken(t *testing.T) {
+	dir := t.TempDir()
+	addr, tokenFile := filepath.Join(dir, "ctl.sock"), filepath.Join(dir, "token")
+	s, err := Listen(addr, tokenFile, echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve()
+	defer s.Close()
+	before, _ := os.ReadFile(tokenFile)
+
+	if second, err := Listen(addr, tokenFile, echo); err == nil {
+		second.Close()
+		t.Fatal("a second instance should not be able to listen on the same socket")
+	}
+	after, _ := os.ReadFile(tokenFile)
+	if string(before) != string(after) {
+		t.Error("a second instance overwrote the running instance's token")
+	}
+	if res, err := Call(addr, tokenFile, Request{Command: "echo"}, time.Second); err != nil || !res.OK {
+		t.Errorf("running instance's clients locked out: %v %+v", err, res)
+	}
+}
+
+func TestCloseWithIdleClient(t *testing.T) {
+	dir := t.TempDir()
+	addr, tokenFile := filepath.Join(dir, "ctl.sock"), filepath.Join(dir, "token")
+	s, err := Listen(addr, tokenFile, echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve()
+
+	// connects and never sends a request
+	conn, err := dial(addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// let the server accept it
+	if res, err := Call(addr, tokenFile, Request{Command: "echo"}, time.Second); err != nil || !res.OK {
+		t.Fatalf("call alongside the idle client: %v %+v", err, res)
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		s.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close is held up by a client that sends nothing")
+	}
+}
@@ -0,0 +1,27 @@
+//go:build windows
+
+package control
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// DefaultAddress is the control port used when none is configured
+var DefaultAddress = "127.0.0.1:47611"
+
+func listen(addr string) (net.Listener, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return nil, errors.New("control address must be a loopback address")
+	}
+	return net.Listen("tcp", addr)
+}
+
+func dial(addr string, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout("tcp", addr, timeout)
+}
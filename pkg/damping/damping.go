@@ -0,0 +1,122 @@
+package damping
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/m1k8/DNSUpdate/pkg/config"
+	"github.com/m1k8/DNSUpdate/pkg/ippolicy"
+)
+
+// Decision is whether a newly detected address should be published
+type Decision struct {
+	Publish bool
+
+	// Reason is why it isnt, if it isnt
+	Reason string
+}
+
+// Damper holds back a new address until it has been seen on enough checks in
+// a row, or for long enough, so a brief failover to a backup link doesnt
+// rewrite DNS twice. It is not safe for concurrent use
+type Damper struct {
+	checks    int
+	window    time.Duration
+	never     []netip.Prefix
+	immediate []netip.Prefix
+
+	candidate string
+	seen      int
+	since     time.Time
+}
+
+// New builds a damper from cfg. A nil cfg publishes every address at once
+func New(cfg *config.Damping) (*Damper, error) {
+	d := &Damper{}
+	if cfg == nil {
+		return d, nil
+	}
+	if cfg.Checks < 0 {
+		return nil, fmt.Errorf("damping checks must not be negative")
+	}
+	d.checks = cfg.Checks
+	d.window = time.Duration(cfg.For)
+
+	var err error
+	if d.never, err = ippolicy.ParsePrefixes(cfg.Never); err != nil {
+		return nil, fmt.Errorf("damping never: %w", err)
+	}
+	if d.immediate, err = ippolicy.ParsePrefixes(cfg.Immediate); err != nil {
+		return nil, fmt.Errorf("damping immediate: %w", err)
+	}
+	return d, nil
+}
+
+// Observe records that ip was detected at now while published is in DNS, and
+// decides whether ip should be published. Nothing needs deciding when they
+// are the same, and any address held back is forgotten
+func (d *Damper) Observe(ip, published string, now time.Time) Decision {
+	if ip == published {
+		d.Reset()
+		return Decision{}
+	}
+
+	if a, err := netip.ParseAddr(ip); err == nil {
+		a = a.Unmap()
+		if ippolicy.Contains(d.never, a) {
+			d.Reset()
+			return Decision{Reason: ip + " is never published"}
+		}
+		if ippolicy.Contains(d.immediate, a) {
+			d.Reset()
+			return Decision{Publish: true}
+		}
+	}
+
+	// nothing to flap back to
+	if published == "" {
+		d.Reset()
+		return Decision{Publish: true}
+	}
+
+	if ip != d.candidate {
+		d.candidate, d.seen, d.since = ip, 0, now
+	}
+	d.seen++
+
+	switch {
+	case d.checks == 0 && d.window == 0,
+		d.checks > 0 && d.seen >= d.checks,
+		d.window > 0 && now.Sub(d.since) >= d.window:
+		d.Reset()
+		return Decision{Publish: true}
+	}
+	return Decision{Reason: d.waiting()}
+}
+
+func (d *Damper) waiting() string {
+	var parts []string
+	if d.checks > 0 {
+		parts = append(parts, fmt.Sprintf("seen on %d of %d checks", d.seen, d.checks))
+	}
+	if d.window > 0 {
+		parts = append(parts, fmt.Sprintf("stable at %s", d.since.Add(d.window).Format(time.RFC3339)))
+	}
+	return fmt.Sprintf("holding %s until it is stable, %s", d.candidate, strings.Join(parts, " or "))
+}
+
+// Due is when an address being held back will have been seen for long
+// enough, or zero if there isnt one or only checks are counted
+func (d *Damper) Due() time.Time {
+	if d.candidate == "" || d.window == 0 {
+		return time.Time{}
+	}
+	return d.since.Add(d.window)
+}
+
+// Reset forgets any address being held back
+func (d *Damper) Reset() {
+	d.candidate, d.seen, d.since = "", 0, time.Time{}
+}
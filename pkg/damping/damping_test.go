@@ -0,0 +1,201 @@
+package damping
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m1k8/DNSUpdate/pkg/clock"
+	"github.com/m1k8/DNSUpdate/pkg/config"
+)
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     *config.Damping
+		wantErr string
+	}{
+		{name: "none"},
+		{name: "checks and window", cfg: &config.Damping{Checks: 3, For: config.Duration(time.Minute)}},
+		{name: "prefixes", cfg: &config.Damping{Never: []string{"10.0.0.0/8"}, Immediate: []string{"8.8.4.0/24"}}},
+		{name: "negative checks", cfg: &config.Damping{Checks: -1}, wantErr: "must not be negative"},
+		{name: "bad never", cfg: &config.Damping{Never: []string{"10.0.0.0/33"}}, wantErr: "damping never"},
+		{name: "bad immediate", cfg: &config.Damping{Immediate: []string{"not an address"}}, wantErr: "damping immediate"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := New(tt.cfg)
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("got error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// step is one check: ip is detected after waiting, while published is in
+// DNS
+type step struct {
+	wait      time.Duration
+	ip        string
+	published string
+
+	publish bool
+	// held is part of the reason an address is held back, if it is
+	held string
+}
+
+func TestObserve(t *testing.T) {
+	const (
+		home   = "8.8.4.4"
+		backup = "8.8.8.8"
+		other  = "8.8.4.7"
+	)
+	tests := []struct {
+		name  string
+		cfg   *config.Damping
+		steps []step
+	}{
+		{
+			name: "no damping",
+			steps: []step{
+				{ip: backup, published: home, publish: true},
+				{ip: home, published: backup, publish: true},
+			},
+		},
+		{
+			name: "nothing published yet",
+			cfg:  &config.Damping{Checks: 3},
+			steps: []step{
+				{ip: home, publish: true},
+			},
+		},
+		{
+			name: "unchanged",
+			cfg:  &config.Damping{Checks: 3},
+			steps: []step{
+				{ip: home, published: home},
+			},
+		},
+		{
+			name: "held for checks",
+			cfg:  &config.Damping{Checks: 3},
+			steps: []step{
+				{ip: backup, published: home, held: "seen on 1 of 3 checks"},
+				{ip: backup, published: home, held: "seen on 2 of 3 checks"},
+				{ip: backup, published: home, publish: true},
+			},
+		},
+		{
+			name: "flap back before the checks are up",
+			cfg:  &config.Damping{Checks: 3},
+			steps: []step{
+				{ip: backup, published: home, held: "seen on 1 of 3 checks"},
+				{ip: backup, published: home, held: "seen on 2 of 3 checks"},
+				// the link recovers, so the backup is forgotten
+				{ip: home, published: home},
+				{ip: backup, published: home, held: "seen on 1 of 3 checks"},
+			},
+		},
+		{
+			name: "a different address starts over",
+			cfg:  &config.Damping{Checks: 2},
+			steps: []step{
+				{ip: backup, published: home, held: "holding 8.8.8.8"},
+				{ip: other, published: home, held: "holding 8.8.4.7 until it is stable, seen on 1 of 2"},
+				{ip: other, published: home, publish: true},
+			},
+		},
+		{
+			name: "held for a window",
+			cfg:  &config.Damping{For: config.Duration(10 * time.Minute)},
+			steps: []step{
+				{ip: backup, published: home, held: "stable at 2024-01-01T00:10:00Z"},
+				{wait: 5 * time.Minute, ip: backup, published: home, held: "stable at 2024-01-01T00:10:00Z"},
+				{wait: 5 * time.Minute, ip: backup, published: home, publish: true},
+			},
+		},
+		{
+			name: "flap back within the window",
+			cfg:  &config.Damping{For: config.Duration(10 * time.Minute)},
+			steps: []step{
+				{ip: backup, published: home, held: "stable at 2024-01-01T00:10:00Z"},
+				{wait: 5 * time.Minute, ip: home, published: home},
+				// the window starts again from when the backup is next seen
+				{wait: 5 * time.Minute, ip: backup, published: home, held: "stable at 2024-01-01T00:20:00Z"},
+				{wait: 9 * time.Minute, ip: backup, published: home, held: "stable at 2024-01-01T00:20:00Z"},
+				{wait: time.Minute, ip: backup, published: home, publish: true},
+			},
+		},
+		{
+			name: "checks or window, whichever first",
+			cfg:  &config.Damping{Checks: 5, For: config.Duration(10 * time.Minute)},
+			steps: []step{
+				{ip: backup, published: home, held: "seen on 1 of 5 checks or stable at 2024-01-01T00:10:00Z"},
+				{wait: 10 * time.Minute, ip: backup, published: home, publish: true},
+			},
+		},
+		{
+			name: "never",
+			cfg:  &config.Damping{Never: []string{"8.8.8.0/24"}},
+			steps: []step{
+				{ip: backup, published: home, held: "8.8.8.8 is never published"},
+				{wait: time.Hour, ip: backup, published: home, held: "never published"},
+			},
+		},
+		{
+			name: "immediate skips the wait",
+			cfg:  &config.Damping{Checks: 3, Immediate: []string{"8.8.4.0/24"}},
+			steps: []step{
+				{ip: backup, published: home, held: "seen on 1 of 3 checks"},
+				{ip: other, published: backup, publish: true},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := New(tt.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+			for i, s := range tt.steps {
+				c.Advance(s.wait)
+				got := d.Observe(s.ip, s.published, c.Now())
+				if got.Publish != s.publish {
+					t.Fatalf("check %d: publish %v, want %v (%s)", i, got.Publish, s.publish, got.Reason)
+				}
+				if s.held == "" && got.Reason != "" {
+					t.Errorf("check %d: held back, %s", i, got.Reason)
+				}
+				if !strings.Contains(got.Reason, s.held) {
+					t.Errorf("check %d: reason %q, want it to say %q", i, got.Reason, s.held)
+				}
+			}
+		})
+	}
+}
+
+func TestDue(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	window, _ := New(&config.Damping{For: config.Duration(10 * time.Minute)})
+	if !window.Due().IsZero() {
+		t.Error("nothing held back should have no due time")
+	}
+	window.Observe("8.8.8.8", "8.8.4.4", start)
+	if want := start.Add(10 * time.Minute); !window.Due().Equal(want) {
+		t.Errorf("due at %s, want %s", window.Due(), want)
+	}
+	window.Reset()
+	if !window.Due().IsZero() {
+		t.Error("reset should forget the held back address")
+	}
+
+	checks, _ := New(&config.Damping{Checks: 3})
+	checks.Observe("8.8.8.8", "8.8.4.4", start)
+	if !checks.Due().IsZero() {
+		t.Error("counting checks alone should have no due time")
+	}
+}
@@ -0,0 +1,96 @@
+package dnsapi
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	api "gopkg.in/ns1/ns1-go.v2/rest"
+	"gopkg.in/ns1/ns1-go.v2/rest/model/data"
+	"gopkg.in/ns1/ns1-go.v2/rest/model/dns"
+	"gopkg.in/ns1/ns1-go.v2/rest/model/monitor"
+)
+
+// Records is the part of *rest.RecordsService the service uses, with Get
+// also taking a context, which the vendored client has no way to do
+type Records interface {
+	Get(zone, domain, t string) (*dns.Record, *http.Response, error)
+	GetContext(ctx context.Context, zone, domain, t string) (*dns.Record, *http.Response, error)
+	Create(r *dns.Record) (*http.Response, error)
+	Update(r *dns.Record) (*http.Response, error)
+	Delete(zone, domain, t string) (*http.Response, error)
+}
+
+// Zones is the part of *rest.ZonesService the service uses
+type Zones interface {
+	Get(zone string) (*dns.Zone, *http.Response, error)
+	List() ([]*dns.Zone, *http.Response, error)
+}
+
+// Jobs is the part of *rest.JobsService the service uses
+type Jobs interface {
+	List() ([]*monitor.Job, *http.Response, error)
+	Get(id string) (*monitor.Job, *http.Response, error)
+	Create(j *monitor.Job) (*http.Response, error)
+	Update(j *monitor.Job) (*http.Response, error)
+	Delete(id string) (*http.Response, error)
+}
+
+// DataSources is the part of *rest.DataSourcesService the service uses
+type DataSources interface {
+	List() ([]*data.Source, *http.Response, error)
+	Create(s *data.Source) (*http.Response, error)
+}
+
+// DataFeeds is the part of *rest.DataFeedsService the service uses
+type DataFeeds interface {
+	List(sourceID string) ([]*data.Feed, *http.Response, error)
+	Create(sourceID string, f *data.Feed) (*http.Response, error)
+	Delete(sourceID, feedID string) (*http.Response, error)
+}
+
+// Client groups the services, so they can be passed around together
+type Client struct {
+	Records Records
+	Zones   Zones
+	Jobs    Jobs
+
+	DataSources DataSources
+	DataFeeds   DataFeeds
+}
+
+// FromREST wraps an NS1 client
+func FromREST(c *api.Client) *Client {
+	return &Client{
+		Records: records{c.Records, c},
+		Zones:   c.Zones,
+		Jobs:    c.Jobs,
+
+		DataSources: c.DataSources,
+		DataFeeds:   c.DataFeeds,
+	}
+}
+
+// records adds GetContext to a *rest.RecordsService
+type records struct {
+	*api.RecordsService
+	client *api.Client
+}
+
+// GetContext is Get, with the request cancelled once ctx is done
+func (r records) GetContext(ctx context.Context, zone, domain, t string) (*dns.Record, *http.Response, error) {
+	req, err := r.client.NewRequest(http.MethodGet, fmt.Sprintf("zones/%s/%s/%s", zone, domain, t), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	var rec dns.Record
+	res, err := r.client.Do(req.WithContext(ctx), &rec)
+	if err != nil {
+		// as Get does
+		if restErr, ok := err.(*api.Error); ok && restErr.Message == "record not found" {
+			return nil, res, api.ErrRecordMissing
+		}
+		return nil, res, err
+	}
+	return &rec, res, nil
+}
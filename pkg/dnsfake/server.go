@@ -0,0 +1,278 @@
+// Package dnsfake is an in-memory authoritative DNS server that answers
+// queries, zone transfers and RFC 2136 updates over UDP and TCP, with TSIG.
+// It stands in for BIND or Knot, so the rfc2136 provider can be run without
+// a real server.
+package dnsfake
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/m1k8/DNSUpdate/pkg/dnswire"
+)
+
+// perMessage is how many records go in each message of a zone transfer, so
+// transfers of even small zones take several messages
+const perMessage = 20
+
+// Server is a running fake DNS server
+type Server struct {
+	udp net.PacketConn
+	tcp net.Listener
+	wg  sync.WaitGroup
+
+	mu          sync.Mutex
+	zones       map[string]*zone
+	keys        map[string]*dnswire.Key
+	requireKey  bool
+	noTransfers bool
+	log         []string
+	now         func() time.Time
+}
+
+// New starts a server with no zones on a free localhost port, for both UDP
+// and TCP
+func New() *Server {
+	s := &Server{
+		zones: map[string]*zone{},
+		keys:  map[string]*dnswire.Key{},
+		now:   time.Now,
+	}
+
+	var err error
+	for i := 0; i < 10; i++ {
+		if s.udp, err = net.ListenPacket("udp", "127.0.0.1:0"); err != nil {
+			panic(fmt.Sprintf("dnsfake: %v", err))
+		}
+		if s.tcp, err = net.Listen("tcp", s.udp.LocalAddr().String()); err == nil {
+			break
+		}
+		s.udp.Close()
+	}
+	if err != nil {
+		panic(fmt.Sprintf("dnsfake: %v", err))
+	}
+
+	s.wg.Add(2)
+	go s.serveUDP()
+	go s.serveTCP()
+	return s
+}
+
+// Addr is the host:port the server listens on
+func (s *Server) Addr() string {
+	return s.udp.LocalAddr().String()
+}
+
+// Close stops the server
+func (s *Server) Close() {
+	s.udp.Close()
+	s.tcp.Close()
+	s.wg.Wait()
+}
+
+// AddKey adds a TSIG key requests may be signed with. algorithm and secret
+// are as for dnswire.NewKey
+func (s *Server) AddKey(name, algorithm, secret string) error {
+	k, err := dnswire.NewKey(name, algorithm, secret)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys[k.Name] = k
+	return nil
+}
+
+// RequireKey makes updates that arent signed with a known key fail with
+// REFUSED. By default any update is accepted
+func (s *Server) RequireKey(require bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requireKey = require
+}
+
+// RefuseTransfers makes zone transfers fail with REFUSED, as servers that
+// only allow updates do
+func (s *Server) RefuseTransfers(refuse bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.noTransfers = refuse
+}
+
+// SetClock changes the clock signatures are checked and made with
+func (s *Server) SetClock(now func() time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.now = now
+}
+
+// Requests returns every request made so far, as "OPCODE name TYPE", e.g.
+// "UPDATE example.com SOA"
+func (s *Server) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.log...)
+}
+
+// ResetRequests clears the request log
+func (s *Server) ResetRequests() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.log = nil
+}
+
+func (s *Server) serveUDP() {
+	defer s.wg.Done()
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := s.udp.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		for _, rsp := range s.handle(append([]byte(nil), buf[:n]...), false) {
+			s.udp.WriteTo(rsp, addr)
+		}
+	}
+}
+
+func (s *Server) serveTCP() {
+	defer s.wg.Done()
+	var conns sync.WaitGroup
+	defer conns.Wait()
+	for {
+		conn, err := s.tcp.Accept()
+		if err != nil {
+			return
+		}
+		conns.Add(1)
+		go func() {
+			defer conns.Done()
+			defer conn.Close()
+			for {
+				conn.SetDeadline(time.Now().Add(10 * time.Second))
+				req, err := dnswire.ReadTCP(conn)
+				if err != nil {
+					return
+				}
+				for _, rsp := range s.handle(req, true) {
+					if dnswire.WriteTCP(conn, rsp) != nil {
+						return
+					}
+				}
+			}
+		}()
+	}
+}
+
+// handle answers a request, returning the packed and signed responses
+func (s *Server) handle(raw []byte, tcp bool) [][]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	req, err := dnswire.Unpack(raw)
+	if err != nil || req.Response {
+		return nil
+	}
+	rsp := &dnswire.Msg{Header: dnswire.Header{ID: req.ID, Response: true, Opcode: req.Opcode}}
+	rsp.Question = req.Question
+	if len(req.Question) == 1 {
+		q := req.Question[0]
+		s.log = append(s.log, fmt.Sprintf("%s %s %s", opcodeName(req.Opcode), q.Name, dnswire.TypeName(q.Type)))
+	}
+
+	// check the signature before anything else
+	var key *dnswire.Key
+	var mac []byte
+	if req.TSIG != nil {
+		key = s.keys[dnswire.CanonicalName(req.TSIG.Key)]
+		if key == nil {
+			return s.reject(rsp, &dnswire.Key{Name: req.TSIG.Key, Algorithm: req.TSIG.Algorithm}, nil, dnswire.RcodeBadKey)
+		}
+		if mac, err = key.Verify(nil, raw, false, s.now()); err != nil {
+			var tsigErr *dnswire.TSIGError
+			if !errors.As(err, &tsigErr) {
+				rsp.Rcode = dnswire.RcodeFormErr
+				return s.pack([]*dnswire.Msg{rsp}, nil, nil, tcp)
+			}
+			return s.reject(rsp, key, req.TSIG.MAC, tsigErr.Rcode)
+		}
+	}
+
+	var msgs []*dnswire.Msg
+	switch {
+	case len(req.Question) != 1:
+		rsp.Rcode = dnswire.RcodeFormErr
+	case req.Opcode == dnswire.OpcodeUpdate:
+		if key == nil && s.requireKey {
+			rsp.Rcode = dnswire.RcodeRefused
+			break
+		}
+		rsp.Rcode = s.update(req)
+	case req.Opcode != dnswire.OpcodeQuery:
+		rsp.Rcode = dnswire.RcodeNotImp
+	case req.Question[0].Type == dnswire.TypeAXFR:
+		if !tcp {
+			rsp.Rcode = dnswire.RcodeFormErr
+			break
+		}
+		msgs = s.transfer(rsp)
+	default:
+		s.query(rsp)
+	}
+	if msgs == nil {
+		msgs = []*dnswire.Msg{rsp}
+	}
+	return s.pack(msgs, key, mac, tcp)
+}
+
+// pack packs msgs, signing them if the request was signed with key
+func (s *Server) pack(msgs []*dnswire.Msg, key *dnswire.Key, mac []byte, tcp bool) [][]byte {
+	var out [][]byte
+	for i, m := range msgs {
+		b, err := m.Pack()
+		if err == nil && !tcp && len(b) > dnswire.MaxUDPSize {
+			m.Truncated = true
+			m.Answer, m.Authority, m.Additional = nil, nil, nil
+			b, err = m.Pack()
+		}
+		if err != nil {
+			return nil
+		}
+		if key != nil {
+			if b, mac, err = key.Sign(dnswire.Prior(mac), b, i > 0, s.now()); err != nil {
+				return nil
+			}
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+// reject answers a request whose signature failed with NOTAUTH, and the TSIG
+// error in a TSIG record. That is unsigned unless the error is BADTIME,
+// which is signed after the request's mac
+func (s *Server) reject(rsp *dnswire.Msg, key *dnswire.Key, mac []byte, tsigErr int) [][]byte {
+	rsp.Rcode = dnswire.RcodeNotAuth
+	b, err := rsp.Pack()
+	if err != nil {
+		return nil
+	}
+	if b, err = key.Reject(dnswire.Prior(mac), b, tsigErr, s.now()); err != nil {
+		return nil
+	}
+	return [][]byte{b}
+}
+
+func opcodeName(op int) string {
+	switch op {
+	case dnswire.OpcodeQuery:
+		return "QUERY"
+	case dnswire.OpcodeUpdate:
+		return "UPDATE"
+	}
+	return fmt.Sprintf("OPCODE%d", op)
+}
@@ -0,0 +1,176 @@
+package dnsfake
+
+import (
+	"bytes"
+
+	"github.com/m1k8/DNSUpdate/pkg/dnswire"
+)
+
+// update applies an RFC 2136 UPDATE, returning the rcode. Nothing is changed
+// unless every prerequisite holds and every update is well formed
+func (s *Server) update(req *dnswire.Msg) int {
+	q := req.Question[0]
+	if q.Type != dnswire.TypeSOA || q.Class != dnswire.ClassINET {
+		return dnswire.RcodeFormErr
+	}
+	z := s.zones[dnswire.CanonicalName(q.Name)]
+	if z == nil {
+		return dnswire.RcodeNotAuth
+	}
+
+	if rcode := z.prerequisites(req.Answer); rcode != dnswire.RcodeSuccess {
+		return rcode
+	}
+	for _, rr := range req.Authority {
+		if rcode := z.prescan(rr); rcode != dnswire.RcodeSuccess {
+			return rcode
+		}
+	}
+	for _, rr := range req.Authority {
+		z.apply(rr)
+	}
+	z.serial++
+	return dnswire.RcodeSuccess
+}
+
+// prerequisites checks the prerequisite section, as RFC 2136 3.2
+func (z *zone) prerequisites(prereqs []dnswire.RR) int {
+	want := map[rrKey][][]byte{}
+	for _, rr := range prereqs {
+		if rr.TTL != 0 {
+			return dnswire.RcodeFormErr
+		}
+		if !dnswire.InZone(rr.Name, z.name) {
+			return dnswire.RcodeNotZone
+		}
+		k := key(rr.Name, rr.Type)
+		switch rr.Class {
+		case dnswire.ClassANY:
+			switch {
+			case len(rr.Data) != 0:
+				return dnswire.RcodeFormErr
+			case rr.Type == dnswire.TypeANY:
+				if !z.inUse(rr.Name) {
+					return dnswire.RcodeNXDomain
+				}
+			case len(z.rrsets[k]) == 0:
+				return dnswire.RcodeNXRRSet
+			}
+		case dnswire.ClassNONE:
+			switch {
+			case len(rr.Data) != 0:
+				return dnswire.RcodeFormErr
+			case rr.Type == dnswire.TypeANY:
+				if z.inUse(rr.Name) {
+					return dnswire.RcodeYXDomain
+				}
+			case len(z.rrsets[k]) > 0:
+				return dnswire.RcodeYXRRSet
+			}
+		case dnswire.ClassINET:
+			want[k] = append(want[k], rr.Data)
+		default:
+			return dnswire.RcodeFormErr
+		}
+	}
+
+	// value dependent: the RRset must be exactly as given
+	for k, datas := range want {
+		have := z.rrsets[k]
+		if len(have) != len(unique(datas)) {
+			return dnswire.RcodeNXRRSet
+		}
+		for _, d := range datas {
+			found := false
+			for _, rr := range have {
+				found = found || bytes.Equal(rr.Data, d)
+			}
+			if !found {
+				return dnswire.RcodeNXRRSet
+			}
+		}
+	}
+	return dnswire.RcodeSuccess
+}
+
+func unique(datas [][]byte) [][]byte {
+	var out [][]byte
+	for _, d := range datas {
+		dup := false
+		for _, o := range out {
+			dup = dup || bytes.Equal(o, d)
+		}
+		if !dup {
+			out = append(out, d)
+		}
+	}
+	return out
+}
+
+// prescan checks an update is well formed, as RFC 2136 3.4.1
+func (z *zone) prescan(rr dnswire.RR) int {
+	if !dnswire.InZone(rr.Name, z.name) {
+		return dnswire.RcodeNotZone
+	}
+	switch rr.Class {
+	case dnswire.ClassINET:
+		if rr.Type == dnswire.TypeANY || rr.Type == dnswire.TypeAXFR || rr.Type == dnswire.TypeTSIG {
+			return dnswire.RcodeFormErr
+		}
+	case dnswire.ClassANY:
+		if rr.TTL != 0 || len(rr.Data) != 0 || rr.Type == dnswire.TypeAXFR {
+			return dnswire.RcodeFormErr
+		}
+	case dnswire.ClassNONE:
+		if rr.TTL != 0 || rr.Type == dnswire.TypeANY || rr.Type == dnswire.TypeAXFR {
+			return dnswire.RcodeFormErr
+		}
+	default:
+		return dnswire.RcodeFormErr
+	}
+	return dnswire.RcodeSuccess
+}
+
+// apply makes one update, as RFC 2136 3.4.2. The apex SOA and NS records are
+// never deleted, and the SOA is never replaced
+func (z *zone) apply(rr dnswire.RR) {
+	apex := dnswire.CanonicalName(rr.Name) == z.name
+	protected := func(t uint16) bool {
+		return apex && (t == dnswire.TypeSOA || t == dnswire.TypeNS)
+	}
+	k := key(rr.Name, rr.Type)
+
+	switch rr.Class {
+	case dnswire.ClassINET:
+		if rr.Type != dnswire.TypeSOA {
+			z.add(rr)
+		}
+	case dnswire.ClassANY:
+		if rr.Type != dnswire.TypeANY {
+			if !protected(rr.Type) {
+				delete(z.rrsets, k)
+			}
+			return
+		}
+		for other := range z.rrsets {
+			if other.name == k.name && !protected(other.t) {
+				delete(z.rrsets, other)
+			}
+		}
+	case dnswire.ClassNONE:
+		if protected(rr.Type) {
+			return
+		}
+		set := z.rrsets[k][:0]
+		for _, have := range z.rrsets[k] {
+			if !bytes.Equal(have.Data, rr.Data) {
+				set = append(set, have)
+			}
+		}
+		if len(set) == 0 {
+			delete(z.rrsets, k)
+		} else {
+			z.rrsets[k] = set
+		}
+	}
+}
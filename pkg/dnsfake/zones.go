@@ -0,0 +1,198 @@
+package dnsfake
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/m1k8/DNSUpdate/pkg/dnswire"
+)
+
+type rrKey struct {
+	name string
+	t    uint16
+}
+
+type zone struct {
+	name   string
+	serial uint32
+	rrsets map[rrKey][]dnswire.RR
+}
+
+// AddZone adds an empty zone, with an SOA and NS record at its apex
+func (s *Server) AddZone(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	z := &zone{name: dnswire.CanonicalName(name), serial: 1, rrsets: map[rrKey][]dnswire.RR{}}
+	ns, _ := dnswire.PackRdata(dnswire.TypeNS, []string{"ns1." + z.name})
+	z.add(dnswire.RR{Name: z.name, Type: dnswire.TypeNS, Class: dnswire.ClassINET, TTL: 3600, Data: ns})
+	s.zones[z.name] = z
+}
+
+// Add adds a record to the zone holding name, with rdata written as for
+// dnswire.PackRdata
+func (s *Server) Add(name, t string, ttl uint32, rdata ...string) error {
+	typ, ok := dnswire.ParseType(t)
+	if !ok {
+		return fmt.Errorf("dnsfake: type %s not supported", t)
+	}
+	data, err := dnswire.PackRdata(typ, rdata)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	z := s.find(name)
+	if z == nil {
+		return fmt.Errorf("dnsfake: no zone for %s", name)
+	}
+	z.add(dnswire.RR{Name: name, Type: typ, Class: dnswire.ClassINET, TTL: ttl, Data: data})
+	z.serial++
+	return nil
+}
+
+// Lookup returns the rdata of each record of type t at name, written as for
+// dnswire.PackRdata with the fields separated by spaces
+func (s *Server) Lookup(name, t string) []string {
+	typ, ok := dnswire.ParseType(t)
+	if !ok {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	z := s.find(name)
+	if z == nil {
+		return nil
+	}
+	var out []string
+	for _, rr := range z.rrsets[key(name, typ)] {
+		fields, err := dnswire.UnpackRdata(typ, rr.Data)
+		if err != nil {
+			continue
+		}
+		out = append(out, strings.Join(fields, " "))
+	}
+	sort.Strings(out)
+	return out
+}
+
+// find returns the zone holding name, or nil
+func (s *Server) find(name string) *zone {
+	var best *zone
+	for _, z := range s.zones {
+		if dnswire.InZone(name, z.name) && (best == nil || len(z.name) > len(best.name)) {
+			best = z
+		}
+	}
+	return best
+}
+
+func key(name string, t uint16) rrKey {
+	return rrKey{name: dnswire.CanonicalName(name), t: t}
+}
+
+// add adds rr to its RRset, replacing a record with the same rdata. Every
+// record in an RRset has the TTL of the last added
+func (z *zone) add(rr dnswire.RR) {
+	k := key(rr.Name, rr.Type)
+	set := z.rrsets[k]
+	for i := range set {
+		set[i].TTL = rr.TTL
+		if bytes.Equal(set[i].Data, rr.Data) {
+			return
+		}
+	}
+	z.rrsets[k] = append(set, rr)
+}
+
+func (z *zone) soa() dnswire.RR {
+	data, _ := dnswire.PackRdata(dnswire.TypeSOA, []string{
+		"ns1." + z.name, "hostmaster." + z.name, fmt.Sprint(z.serial), "3600", "600", "86400", "300",
+	})
+	return dnswire.RR{Name: z.name, Type: dnswire.TypeSOA, Class: dnswire.ClassINET, TTL: 3600, Data: data}
+}
+
+// inUse reports whether name has any records
+func (z *zone) inUse(name string) bool {
+	name = dnswire.CanonicalName(name)
+	if name == z.name {
+		return true
+	}
+	for k := range z.rrsets {
+		if k.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// sorted returns every record but the SOA, in a stable order
+func (z *zone) sorted() []dnswire.RR {
+	keys := make([]rrKey, 0, len(z.rrsets))
+	for k := range z.rrsets {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].name != keys[j].name {
+			return keys[i].name < keys[j].name
+		}
+		return keys[i].t < keys[j].t
+	})
+	var rrs []dnswire.RR
+	for _, k := range keys {
+		rrs = append(rrs, z.rrsets[k]...)
+	}
+	return rrs
+}
+
+// query answers a standard query
+func (s *Server) query(rsp *dnswire.Msg) {
+	q := rsp.Question[0]
+	z := s.find(q.Name)
+	if z == nil {
+		rsp.Rcode = dnswire.RcodeRefused
+		return
+	}
+	rsp.Authoritative = true
+	if q.Type == dnswire.TypeSOA && dnswire.CanonicalName(q.Name) == z.name {
+		rsp.Answer = []dnswire.RR{z.soa()}
+		return
+	}
+	rsp.Answer = append([]dnswire.RR(nil), z.rrsets[key(q.Name, q.Type)]...)
+	if len(rsp.Answer) == 0 && !z.inUse(q.Name) {
+		rsp.Rcode = dnswire.RcodeNXDomain
+	}
+}
+
+// transfer answers an AXFR, returning every message of it
+func (s *Server) transfer(rsp *dnswire.Msg) []*dnswire.Msg {
+	z := s.zones[dnswire.CanonicalName(rsp.Question[0].Name)]
+	switch {
+	case z == nil:
+		rsp.Rcode = dnswire.RcodeNotAuth
+		return nil
+	case s.noTransfers:
+		rsp.Rcode = dnswire.RcodeRefused
+		return nil
+	}
+	rsp.Authoritative = true
+
+	rrs := append([]dnswire.RR{z.soa()}, z.sorted()...)
+	rrs = append(rrs, z.soa())
+	var msgs []*dnswire.Msg
+	for len(rrs) > 0 {
+		n := perMessage
+		if n > len(rrs) {
+			n = len(rrs)
+		}
+		m := *rsp
+		if len(msgs) > 0 {
+			m.Question = nil
+		}
+		m.Answer = rrs[:n]
+		rrs = rrs[n:]
+		msgs = append(msgs, &m)
+	}
+	return msgs
+}
@@ -0,0 +1,283 @@
+package dnswire
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// MaxUDPSize is the largest message sent or expected over UDP, as no EDNS0
+// is used
+const MaxUDPSize = 512
+
+// RcodeError is a response with an rcode other than NOERROR
+type RcodeError struct {
+	Rcode int
+}
+
+func (e *RcodeError) Error() string {
+	return RcodeName(e.Rcode)
+}
+
+// Client sends messages to a single server
+type Client struct {
+	// Server is the host:port to send to
+	Server string
+
+	// TCP sends every message over TCP. Otherwise UDP is used, switching to
+	// TCP for messages too big for it and truncated responses
+	TCP bool
+
+	// Key, if set, signs every request, and every response must be signed
+	// with it
+	Key *Key
+
+	// Timeout bounds each exchange. Defaults to 10s
+	Timeout time.Duration
+
+	// Now is the clock signatures are made and checked with. Defaults to
+	// time.Now
+	Now func() time.Time
+}
+
+func (c *Client) timeout() time.Duration {
+	if c.Timeout == 0 {
+		return 10 * time.Second
+	}
+	return c.Timeout
+}
+
+func (c *Client) now() time.Time {
+	if c.Now == nil {
+		return time.Now()
+	}
+	return c.Now()
+}
+
+// Exchange sends m, with a new ID, and returns the response. A response
+// with an rcode other than NOERROR is returned along with an *RcodeError
+func (c *Client) Exchange(m *Msg) (*Msg, error) {
+	return c.ExchangeContext(context.Background(), m)
+}
+
+// ExchangeContext is Exchange, given up with ctx's error once ctx is done
+func (c *Client) ExchangeContext(ctx context.Context, m *Msg) (*Msg, error) {
+	req, mac, err := c.pack(m)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw []byte
+	if c.TCP || len(req) > MaxUDPSize {
+		raw, err = c.exchangeTCP(ctx, req)
+	} else {
+		raw, err = c.exchangeUDP(ctx, req, m.ID)
+		if err == nil && len(raw) > 2 && raw[2]&0x02 != 0 {
+			raw, err = c.exchangeTCP(ctx, req)
+		}
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	return c.read(raw, m.ID, Prior(mac), false)
+}
+
+// pack gives m a new ID, packs and signs it, returning the MAC
+func (c *Client) pack(m *Msg) ([]byte, []byte, error) {
+	var id [2]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, nil, err
+	}
+	m.ID = binary.BigEndian.Uint16(id[:])
+	req, err := m.Pack()
+	if err != nil {
+		return nil, nil, err
+	}
+	if c.Key == nil {
+		return req, nil, nil
+	}
+	return c.Key.Sign(nil, req, false, c.now())
+}
+
+// read unpacks and checks a response to the request with id
+func (c *Client) read(raw []byte, id uint16, prefix []byte, timersOnly bool) (*Msg, error) {
+	rsp, err := Unpack(raw)
+	if err != nil {
+		return nil, err
+	}
+	if !rsp.Response || rsp.ID != id {
+		return nil, errors.New("response doesnt match the request")
+	}
+	if c.Key != nil {
+		if _, err := c.Key.Verify(prefix, raw, timersOnly, c.now()); err != nil {
+			// a server that cant check the request replies unsigned
+			if errors.Is(err, ErrUnsigned) && rsp.Rcode != RcodeSuccess {
+				return rsp, &RcodeError{Rcode: rsp.Rcode}
+			}
+			return nil, err
+		}
+	}
+	if rsp.Rcode != RcodeSuccess {
+		return rsp, &RcodeError{Rcode: rsp.Rcode}
+	}
+	return rsp, nil
+}
+
+func (c *Client) exchangeUDP(ctx context.Context, req []byte, id uint16) ([]byte, error) {
+	conn, stop, err := c.dial(ctx, "udp")
+	if err != nil {
+		return nil, err
+	}
+	defer stop()
+	defer conn.Close()
+	if _, err := conn.Write(req); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// ignore stray replies, e.g. late ones to an earlier request
+		if n >= 12 && binary.BigEndian.Uint16(buf) == id {
+			return append([]byte(nil), buf[:n]...), nil
+		}
+	}
+}
+
+func (c *Client) exchangeTCP(ctx context.Context, req []byte) ([]byte, error) {
+	conn, stop, err := c.dial(ctx, "tcp")
+	if err != nil {
+		return nil, err
+	}
+	defer stop()
+	defer conn.Close()
+	if err := WriteTCP(conn, req); err != nil {
+		return nil, err
+	}
+	return ReadTCP(conn)
+}
+
+// dial connects to the server, with a deadline of the timeout or ctx's,
+// whichever is sooner. Until stop is called, the deadline is brought forward
+// to now if ctx is done first, so a blocked read or write returns at once
+func (c *Client) dial(ctx context.Context, network string) (conn net.Conn, stop func(), err error) {
+	d := net.Dialer{Timeout: c.timeout()}
+	conn, err = d.DialContext(ctx, network, c.Server)
+	if err != nil {
+		return nil, nil, err
+	}
+	deadline := time.Now().Add(c.timeout())
+	if t, ok := ctx.Deadline(); ok && t.Before(deadline) {
+		deadline = t
+	}
+	conn.SetDeadline(deadline)
+
+	if ctx.Done() == nil {
+		return conn, func() {}, nil
+	}
+	stopped := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-stopped:
+		}
+	}()
+	return conn, func() { close(stopped) }, nil
+}
+
+// Transfer fetches every record in zone with AXFR, over TCP. The zone's SOA
+// record is returned first
+func (c *Client) Transfer(zone string) ([]RR, error) {
+	m := &Msg{Question: []Question{{Name: zone, Type: TypeAXFR, Class: ClassINET}}}
+	req, mac, err := c.pack(m)
+	if err != nil {
+		return nil, err
+	}
+	conn, stop, err := c.dial(context.Background(), "tcp")
+	if err != nil {
+		return nil, err
+	}
+	defer stop()
+	defer conn.Close()
+	if err := WriteTCP(conn, req); err != nil {
+		return nil, err
+	}
+
+	var rrs []RR
+	prefix := Prior(mac)
+	for first := true; ; first = false {
+		raw, err := ReadTCP(conn)
+		if err != nil {
+			return nil, err
+		}
+		rsp, err := Unpack(raw)
+		if err != nil {
+			return nil, err
+		}
+
+		// later messages may be left unsigned, and are then covered by the
+		// next signature
+		if c.Key != nil && rsp.TSIG == nil && !first && rsp.Rcode == RcodeSuccess {
+			if rsp.ID != m.ID {
+				return nil, errors.New("response doesnt match the request")
+			}
+			prefix = append(prefix, raw...)
+		} else {
+			if _, err := c.read(raw, m.ID, prefix, !first); err != nil {
+				return nil, err
+			}
+			if c.Key != nil {
+				prefix = Prior(rsp.TSIG.MAC)
+			}
+		}
+
+		for _, rr := range rsp.Answer {
+			if rr.Type == TypeSOA && len(rrs) > 0 {
+				if c.Key != nil && rsp.TSIG == nil {
+					return nil, errors.New("zone transfer ends unsigned")
+				}
+				return rrs, nil
+			}
+			if len(rrs) == 0 && rr.Type != TypeSOA {
+				return nil, fmt.Errorf("zone transfer of %s doesnt start with SOA", zone)
+			}
+			rrs = append(rrs, rr)
+		}
+		if len(rsp.Answer) == 0 {
+			return nil, fmt.Errorf("zone transfer of %s ended early", zone)
+		}
+	}
+}
+
+// WriteTCP writes msg with the length prefix used over TCP
+func WriteTCP(w io.Writer, msg []byte) error {
+	if len(msg) > 0xffff {
+		return errors.New("message too long")
+	}
+	_, err := w.Write(append(appendUint16(nil, uint16(len(msg))), msg...))
+	return err
+}
+
+// ReadTCP reads a message written by WriteTCP
+func ReadTCP(r io.Reader) ([]byte, error) {
+	var n [2]byte
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(n[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
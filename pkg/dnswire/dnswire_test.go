@@ -0,0 +1,316 @@
+package dnswire
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.Join(strings.Fields(s), ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// compressed is a response for the MX of example.com, whose answer's owner
+// and exchange both point back at the question's name
+const compressed = `
+	0001 8400 0001 0001 0000 0000
+	07 6578616d706c65 03 636f6d 00  000f 0001
+	c00c  000f 0001 0000003c 0009  000a 04 6d61696c c00c
+`
+
+func TestUnpackCompressed(t *testing.T) {
+	m, err := Unpack(unhex(t, compressed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Msg{
+		Header:   Header{ID: 1, Response: true, Authoritative: true},
+		Question: []Question{{Name: "example.com", Type: TypeMX, Class: ClassINET}},
+		Answer: []RR{{
+			Name: "example.com", Type: TypeMX, Class: ClassINET, TTL: 60,
+			Data: unhex(t, "000a 04 6d61696c 07 6578616d706c65 03 636f6d 00"),
+		}},
+	}
+	if !reflect.DeepEqual(m, want) {
+		t.Fatalf("unpacked %+v, want %+v", m, want)
+	}
+	fields, err := UnpackRdata(TypeMX, m.Answer[0].Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"10", "mail.example.com"}; !reflect.DeepEqual(fields, want) {
+		t.Errorf("rdata %q, want %q", fields, want)
+	}
+
+	// packed again, the names are written out in full and read back the same
+	b, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.IndexByte(b, 0xc0) >= 0 {
+		t.Errorf("packed %x, want no compression pointers", b)
+	}
+	again, err := Unpack(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(again, m) {
+		t.Errorf("round trip gave %+v, want %+v", again, m)
+	}
+}
+
+func TestPackRoundTrip(t *testing.T) {
+	soa, err := PackRdata(TypeSOA, []string{"ns1.example.com.", "hostmaster.example.com.", "1", "7200", "900", "1209600", "300"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &Msg{
+		Header:   Header{ID: 0xbeef, Opcode: OpcodeUpdate},
+		Question: []Question{{Name: "example.com", Type: TypeSOA, Class: ClassINET}},
+		Answer:   []RR{{Name: "example.com", Type: TypeSOA, Class: ClassINET, TTL: 3600, Data: soa}},
+		Authority: []RR{
+			{Name: "www.example.com", Type: TypeA, Class: ClassANY},
+			{Name: "www.example.com", Type: TypeA, Class: ClassINET, TTL: 300, Data: []byte{8, 8, 4, 4}},
+		},
+		Additional: []RR{{Name: ".", Type: TypeTXT, Class: ClassINET, Data: []byte("\x02hi")}},
+	}
+	b, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := Unpack(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, m) {
+		t.Errorf("round trip gave %+v, want %+v", got, m)
+	}
+
+	for _, name := range []string{"a..example.com", strings.Repeat("a", 64) + ".example.com", strings.Repeat("abcdefg.", 32) + "com"} {
+		m := &Msg{Question: []Question{{Name: name, Type: TypeA, Class: ClassINET}}}
+		if _, err := m.Pack(); err == nil {
+			t.Errorf("packing %q should fail", name)
+		}
+	}
+}
+
+func TestUnpackMalformed(t *testing.T) {
+	tests := []struct {
+		name    string
+		msg     string
+		wantErr string
+	}{
+		{name: "short header", msg: "0001 8400 0001 0000 0000", wantErr: "too short"},
+		{name: "missing question", msg: "0001 8400 0001 0000 0000 0000", wantErr: "bad name"},
+		{name: "question without type", msg: "0001 8400 0001 0000 0000 0000  03 636f6d 00 00", wantErr: "too short"},
+		{name: "label past the end", msg: "0001 8400 0001 0000 0000 0000  07 6578616d", wantErr: "too short"},
+		{name: "reserved label type", msg: "0001 8400 0001 0000 0000 0000  40 00 0001 0001", wantErr: "bad label"},
+		{name: "pointer loop", msg: "0001 8400 0001 0000 0000 0000  c00c 0001 0001", wantErr: "bad name"},
+		{name: "pointer past the end", msg: "0001 8400 0001 0000 0000 0000  c0ff 0001 0001", wantErr: "bad name"},
+		{name: "half a pointer", msg: "0001 8400 0001 0000 0000 0000  c0", wantErr: "too short"},
+		{name: "rr without ttl", msg: "0001 8400 0000 0001 0000 0000  00 0001 0001 0000", wantErr: "too short"},
+		{name: "rdata past the end", msg: "0001 8400 0000 0001 0000 0000  00 0001 0001 0000003c 0004 0808", wantErr: "too short"},
+		{name: "rdata longer than its name", msg: "0001 8400 0000 0001 0000 0000  00 0005 0001 0000003c 0003 00 0000", wantErr: "bad rdata length"},
+		{name: "name running out of rdata", msg: "0001 8400 0000 0001 0000 0000  00 000f 0001 0000003c 0002 000a", wantErr: "bad name"},
+		{name: "tsig not last", msg: `0001 8400 0000 0000 0000 0002
+			00 00fa 00ff 00000000 001d  0b 686d61632d736861323536 00 000065920080 012c 0000 0001 0000 0000
+			00 0001 0001 0000003c 0004 08080404`, wantErr: "TSIG record is not last"},
+		{name: "tsig outside additional", msg: `0001 8400 0000 0001 0000 0000
+			00 00fa 00ff 00000000 001d  0b 686d61632d736861323536 00 000065920080 012c 0000 0001 0000 0000`, wantErr: "TSIG record is not last"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Unpack(unhex(t, tt.msg))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("got error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestUnpackTruncated(t *testing.T) {
+	k, err := NewKey("update-key", "hmac-sha256", "c2VjcmV0LWtleS1mb3ItZG5zdXBkYXRlLXRlc3RzIQ==")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, _, err := k.Sign(nil, unhex(t, compressed), false, time.Unix(1704067200, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Unpack(signed); err != nil {
+		t.Fatal(err)
+	}
+	// every section count promises more than a cut message holds
+	for i := range signed {
+		if _, err := Unpack(signed[:i]); err == nil {
+			t.Errorf("unpacking the first %d of %d bytes should fail", i, len(signed))
+		}
+	}
+}
+
+func TestParseTSIG(t *testing.T) {
+	want := &TSIG{
+		Key:        "update-key",
+		Algorithm:  "hmac-sha256",
+		TimeSigned: 0x123456789a,
+		Fudge:      Fudge,
+		MAC:        []byte{1, 2, 3, 4},
+		OriginalID: 0xbeef,
+		Error:      RcodeBadTime,
+		Other:      []byte{0, 0, 0x12, 0x34, 0x56, 0x78},
+	}
+	rr := want.rr()
+	got, err := parseTSIG(rr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parsed %+v, want %+v", got, want)
+	}
+
+	const alg = "0b 686d61632d736861323536 00"
+	tests := []struct {
+		name string
+		data string
+	}{
+		{name: "empty"},
+		{name: "bad algorithm", data: "0b 686d6163"},
+		{name: "no time", data: alg + "0000"},
+		{name: "no mac size", data: alg + "000065920080 012c"},
+		{name: "mac past the end", data: alg + "000065920080 012c 0020 0102"},
+		{name: "no error", data: alg + "000065920080 012c 0000 beef"},
+		{name: "other past the end", data: alg + "000065920080 012c 0000 beef 0000 0004 01"},
+		{name: "trailing bytes", data: alg + "000065920080 012c 0000 beef 0000 0000 ff"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseTSIG(RR{Name: "update-key", Type: TypeTSIG, Class: ClassANY, Data: unhex(t, tt.data)})
+			if err == nil || !strings.Contains(err.Error(), "bad TSIG record") {
+				t.Fatalf("got error %v, want a bad TSIG record", err)
+			}
+		})
+	}
+}
+
+// TestTSIGKnownAnswer checks MACs worked out by hand from RFC 8945 section
+// 4.3.3: HMAC-SHA256 over the unsigned message, then the key name, class
+// ANY, TTL 0, the algorithm name, the time signed, fudge, error and other
+// data. A timers only MAC, as for the later messages of a zone transfer,
+// covers the prior MAC, the message and only the time signed and fudge
+func TestTSIGKnownAnswer(t *testing.T) {
+	// an UPDATE of example.com adding www.example.com A 8.8.4.4
+	msg := unhex(t, `
+		1234 2800 0001 0000 0001 0000
+		07 6578616d706c65 03 636f6d 00  0006 0001
+		03 777777 07 6578616d706c65 03 636f6d 00  0001 0001 0000012c 0004 08080404
+	`)
+	// the secret is "secret-key-for-dnsupdate-tests!"
+	k, err := NewKey("update-key", "hmac-sha256", "c2VjcmV0LWtleS1mb3ItZG5zdXBkYXRlLXRlc3RzIQ==")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	m, err := Unpack(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if packed, err := m.Pack(); err != nil || !bytes.Equal(packed, msg) {
+		t.Fatalf("packed %x, %v, want %x", packed, err, msg)
+	}
+
+	signed, mac, err := k.Sign(nil, msg, false, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantMAC := unhex(t, "d514370a2f3c8f6ae54108d9c0883cb5c2963134c261036cfe3bba825933b9ce")
+	if !bytes.Equal(mac, wantMAC) {
+		t.Fatalf("MAC %x, want %x", mac, wantMAC)
+	}
+	// the TSIG record is appended as is and counted in additional
+	wantSigned := append(append([]byte(nil), msg...), unhex(t, `
+		0a 7570646174652d6b6579 00  00fa 00ff 00000000 003d
+		0b 686d61632d736861323536 00  000065920080 012c 0020
+	`)...)
+	wantSigned = append(wantSigned, wantMAC...)
+	wantSigned = append(wantSigned, unhex(t, "1234 0000 0000")...)
+	wantSigned[11] = 1
+	if !bytes.Equal(signed, wantSigned) {
+		t.Errorf("signed\n%x, want\n%x", signed, wantSigned)
+	}
+	if got, err := k.Verify(nil, signed, false, now); err != nil || !bytes.Equal(got, wantMAC) {
+		t.Errorf("verified %x, %v, want %x", got, err, wantMAC)
+	}
+
+	_, timers, err := k.Sign(Prior(mac), msg, true, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := unhex(t, "a1cfd589f614a1d486ef55032055b247e57e2d074900c30cc66eddf23d4cfe52"); !bytes.Equal(timers, want) {
+		t.Errorf("timers only MAC %x, want %x", timers, want)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	const secret = "c2VjcmV0LWtleS1mb3ItZG5zdXBkYXRlLXRlc3RzIQ=="
+	k, _ := NewKey("update-key", "hmac-sha256", secret)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	msg := unhex(t, compressed)
+	signed, _, err := k.Sign(nil, msg, false, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// change the answer's TTL
+	tampered := append([]byte(nil), signed...)
+	tampered[38] ^= 0xff
+	otherName, _ := NewKey("other-key", "hmac-sha256", secret)
+	otherAlg, _ := NewKey("update-key", "hmac-sha512", secret)
+	otherSecret, _ := NewKey("update-key", "hmac-sha256", "b3RoZXI=")
+	rejected, err := k.Reject(nil, msg, RcodeBadKey, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		k     *Key
+		msg   []byte
+		now   time.Time
+		rcode int
+		err   error
+	}{
+		{name: "good", k: k, msg: signed, now: now},
+		{name: "within fudge", k: k, msg: signed, now: now.Add(Fudge * time.Second)},
+		{name: "unsigned", k: k, msg: msg, now: now, err: ErrUnsigned},
+		{name: "tampered", k: k, msg: tampered, now: now, rcode: RcodeBadSig},
+		{name: "other key name", k: otherName, msg: signed, now: now, rcode: RcodeBadKey},
+		{name: "other algorithm", k: otherAlg, msg: signed, now: now, rcode: RcodeBadKey},
+		{name: "other secret", k: otherSecret, msg: signed, now: now, rcode: RcodeBadSig},
+		{name: "too late", k: k, msg: signed, now: now.Add((Fudge + 1) * time.Second), rcode: RcodeBadTime},
+		{name: "too early", k: k, msg: signed, now: now.Add(-(Fudge + 1) * time.Second), rcode: RcodeBadTime},
+		{name: "rejected", k: k, msg: rejected, now: now, rcode: RcodeBadKey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.k.Verify(nil, tt.msg, false, tt.now)
+			var te *TSIGError
+			switch {
+			case tt.rcode != 0:
+				if !errors.As(err, &te) || te.Rcode != tt.rcode {
+					t.Errorf("got error %v, want TSIG %s", err, RcodeName(tt.rcode))
+				}
+			case err != tt.err:
+				t.Errorf("got error %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
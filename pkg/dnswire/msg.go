@@ -0,0 +1,424 @@
+package dnswire
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Record types
+const (
+	TypeA     uint16 = 1
+	TypeNS    uint16 = 2
+	TypeCNAME uint16 = 5
+	TypeSOA   uint16 = 6
+	TypePTR   uint16 = 12
+	TypeMX    uint16 = 15
+	TypeTXT   uint16 = 16
+	TypeAAAA  uint16 = 28
+	TypeSRV   uint16 = 33
+	TypeTSIG  uint16 = 250
+	TypeAXFR  uint16 = 252
+	TypeANY   uint16 = 255
+	TypeCAA   uint16 = 257
+)
+
+// Classes. In an UPDATE, NONE and ANY say what a prerequisite or update
+// means rather than where it applies
+const (
+	ClassINET uint16 = 1
+	ClassNONE uint16 = 254
+	ClassANY  uint16 = 255
+)
+
+// Opcodes
+const (
+	OpcodeQuery  = 0
+	OpcodeUpdate = 5
+)
+
+// Response codes, including those RFC 2136 adds for UPDATE and RFC 8945 for
+// TSIG
+const (
+	RcodeSuccess  = 0
+	RcodeFormErr  = 1
+	RcodeServFail = 2
+	RcodeNXDomain = 3
+	RcodeNotImp   = 4
+	RcodeRefused  = 5
+	RcodeYXDomain = 6
+	RcodeYXRRSet  = 7
+	RcodeNXRRSet  = 8
+	RcodeNotAuth  = 9
+	RcodeNotZone  = 10
+	RcodeBadSig   = 16
+	RcodeBadKey   = 17
+	RcodeBadTime  = 18
+)
+
+var rcodeNames = map[int]string{
+	RcodeSuccess:  "NOERROR",
+	RcodeFormErr:  "FORMERR",
+	RcodeServFail: "SERVFAIL",
+	RcodeNXDomain: "NXDOMAIN",
+	RcodeNotImp:   "NOTIMP",
+	RcodeRefused:  "REFUSED",
+	RcodeYXDomain: "YXDOMAIN",
+	RcodeYXRRSet:  "YXRRSET",
+	RcodeNXRRSet:  "NXRRSET",
+	RcodeNotAuth:  "NOTAUTH",
+	RcodeNotZone:  "NOTZONE",
+	RcodeBadSig:   "BADSIG",
+	RcodeBadKey:   "BADKEY",
+	RcodeBadTime:  "BADTIME",
+}
+
+// RcodeName returns the mnemonic for rcode, e.g. "NXRRSET"
+func RcodeName(rcode int) string {
+	if n, ok := rcodeNames[rcode]; ok {
+		return n
+	}
+	return fmt.Sprintf("RCODE%d", rcode)
+}
+
+var errShort = errors.New("dns message too short")
+
+// Header is the fixed part of a message, less the section counts
+type Header struct {
+	ID                 uint16
+	Response           bool
+	Opcode             int
+	Authoritative      bool
+	Truncated          bool
+	RecursionDesired   bool
+	RecursionAvailable bool
+	Rcode              int
+}
+
+// Question asks for the records of Type at Name. In an UPDATE it is the zone
+// being updated
+type Question struct {
+	Name  string
+	Type  uint16
+	Class uint16
+}
+
+// RR is a resource record. Data is its rdata in wire format, with any names
+// in it uncompressed
+type RR struct {
+	Name  string
+	Type  uint16
+	Class uint16
+	TTL   uint32
+	Data  []byte
+}
+
+// Msg is a DNS message. In an UPDATE, Question is the zone, Answer the
+// prerequisites and Authority the updates. A TSIG record is not kept in
+// Additional, but in TSIG, as it is added and checked by Key
+type Msg struct {
+	Header
+	Question   []Question
+	Answer     []RR
+	Authority  []RR
+	Additional []RR
+
+	// TSIG is the signature read from the end of the message, if any
+	TSIG *TSIG
+
+	// tsigOffset is where the TSIG record starts in the packed message
+	tsigOffset int
+}
+
+// Pack encodes the message, uncompressed
+func (m *Msg) Pack() ([]byte, error) {
+	b := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(b[0:], m.ID)
+	var flags uint16
+	if m.Response {
+		flags |= 1 << 15
+	}
+	flags |= uint16(m.Opcode&0xf) << 11
+	if m.Authoritative {
+		flags |= 1 << 10
+	}
+	if m.Truncated {
+		flags |= 1 << 9
+	}
+	if m.RecursionDesired {
+		flags |= 1 << 8
+	}
+	if m.RecursionAvailable {
+		flags |= 1 << 7
+	}
+	flags |= uint16(m.Rcode & 0xf)
+	binary.BigEndian.PutUint16(b[2:], flags)
+	binary.BigEndian.PutUint16(b[4:], uint16(len(m.Question)))
+	binary.BigEndian.PutUint16(b[6:], uint16(len(m.Answer)))
+	binary.BigEndian.PutUint16(b[8:], uint16(len(m.Authority)))
+	binary.BigEndian.PutUint16(b[10:], uint16(len(m.Additional)))
+
+	var err error
+	for _, q := range m.Question {
+		if b, err = appendName(b, q.Name); err != nil {
+			return nil, err
+		}
+		b = appendUint16(b, q.Type)
+		b = appendUint16(b, q.Class)
+	}
+	for _, section := range [][]RR{m.Answer, m.Authority, m.Additional} {
+		for _, rr := range section {
+			if b, err = appendRR(b, rr); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return b, nil
+}
+
+func appendRR(b []byte, rr RR) ([]byte, error) {
+	b, err := appendName(b, rr.Name)
+	if err != nil {
+		return nil, err
+	}
+	if len(rr.Data) > 0xffff {
+		return nil, fmt.Errorf("rdata of %s too long", rr.Name)
+	}
+	b = appendUint16(b, rr.Type)
+	b = appendUint16(b, rr.Class)
+	b = appendUint32(b, rr.TTL)
+	b = appendUint16(b, uint16(len(rr.Data)))
+	return append(b, rr.Data...), nil
+}
+
+// Unpack decodes a message. A TSIG record at the end is decoded into TSIG
+func Unpack(b []byte) (*Msg, error) {
+	if len(b) < 12 {
+		return nil, errShort
+	}
+	m := &Msg{}
+	m.ID = binary.BigEndian.Uint16(b[0:])
+	flags := binary.BigEndian.Uint16(b[2:])
+	m.Response = flags&(1<<15) != 0
+	m.Opcode = int(flags>>11) & 0xf
+	m.Authoritative = flags&(1<<10) != 0
+	m.Truncated = flags&(1<<9) != 0
+	m.RecursionDesired = flags&(1<<8) != 0
+	m.RecursionAvailable = flags&(1<<7) != 0
+	m.Rcode = int(flags & 0xf)
+
+	counts := [4]int{}
+	for i := range counts {
+		counts[i] = int(binary.BigEndian.Uint16(b[4+2*i:]))
+	}
+
+	off := 12
+	for i := 0; i < counts[0]; i++ {
+		name, next, err := readName(b, off)
+		if err != nil {
+			return nil, err
+		}
+		if next+4 > len(b) {
+			return nil, errShort
+		}
+		m.Question = append(m.Question, Question{
+			Name:  name,
+			Type:  binary.BigEndian.Uint16(b[next:]),
+			Class: binary.BigEndian.Uint16(b[next+2:]),
+		})
+		off = next + 4
+	}
+
+	sections := []*[]RR{&m.Answer, &m.Authority, &m.Additional}
+	for s, section := range sections {
+		for i := 0; i < counts[s+1]; i++ {
+			start := off
+			rr, next, err := readRR(b, off)
+			if err != nil {
+				return nil, err
+			}
+			off = next
+			if rr.Type == TypeTSIG {
+				if s != 2 || i != counts[3]-1 {
+					return nil, errors.New("TSIG record is not last")
+				}
+				if m.TSIG, err = parseTSIG(rr); err != nil {
+					return nil, err
+				}
+				m.tsigOffset = start
+				continue
+			}
+			*section = append(*section, rr)
+		}
+	}
+	return m, nil
+}
+
+func readRR(b []byte, off int) (RR, int, error) {
+	name, off, err := readName(b, off)
+	if err != nil {
+		return RR{}, 0, err
+	}
+	if off+10 > len(b) {
+		return RR{}, 0, errShort
+	}
+	rr := RR{
+		Name:  name,
+		Type:  binary.BigEndian.Uint16(b[off:]),
+		Class: binary.BigEndian.Uint16(b[off+2:]),
+		TTL:   binary.BigEndian.Uint32(b[off+4:]),
+	}
+	n := int(binary.BigEndian.Uint16(b[off+8:]))
+	off += 10
+	if off+n > len(b) {
+		return RR{}, 0, errShort
+	}
+	if rr.Data, err = expandRdata(b, off, n, rr.Type); err != nil {
+		return RR{}, 0, fmt.Errorf("%s: %w", name, err)
+	}
+	return rr, off + n, nil
+}
+
+// expandRdata copies the n bytes of rdata at off, uncompressing any names in
+// it, so the rdata can be used away from the message. Empty rdata, as in
+// update deletes and prerequisites, is left empty whatever the type
+func expandRdata(b []byte, off, n int, t uint16) ([]byte, error) {
+	if n == 0 {
+		return nil, nil
+	}
+	end := off + n
+	var out []byte
+	name := func() error {
+		s, next, err := readName(b, off)
+		if err != nil {
+			return err
+		}
+		if out, err = appendName(out, s); err != nil {
+			return err
+		}
+		off = next
+		return nil
+	}
+	fixed := func(k int) error {
+		if off+k > end {
+			return errShort
+		}
+		out = append(out, b[off:off+k]...)
+		off += k
+		return nil
+	}
+
+	var err error
+	switch t {
+	case TypeNS, TypeCNAME, TypePTR:
+		err = name()
+	case TypeMX:
+		if err = fixed(2); err == nil {
+			err = name()
+		}
+	case TypeSRV:
+		if err = fixed(6); err == nil {
+			err = name()
+		}
+	case TypeSOA:
+		if err = name(); err == nil {
+			if err = name(); err == nil {
+				err = fixed(20)
+			}
+		}
+	default:
+		return append([]byte(nil), b[off:end]...), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if off != end {
+		return nil, errors.New("bad rdata length")
+	}
+	return out, nil
+}
+
+// appendName encodes name, which may or may not end in a dot, without
+// compression
+func appendName(b []byte, name string) ([]byte, error) {
+	name = strings.TrimSuffix(name, ".")
+	start := len(b)
+	if name != "" {
+		for _, l := range strings.Split(name, ".") {
+			if l == "" || len(l) > 63 {
+				return nil, fmt.Errorf("bad name %q", name)
+			}
+			b = append(b, byte(len(l)))
+			b = append(b, l...)
+		}
+	}
+	b = append(b, 0)
+	if len(b)-start > 255 {
+		return nil, fmt.Errorf("name %q too long", name)
+	}
+	return b, nil
+}
+
+// readName decodes the name at off, following compression pointers, and
+// returns it without a trailing dot along with the offset after it. The
+// root is returned as "."
+func readName(b []byte, off int) (string, int, error) {
+	var labels []string
+	next := -1
+	for hops := 0; ; hops++ {
+		if off >= len(b) || hops > 127 {
+			return "", 0, errors.New("bad name")
+		}
+		n := int(b[off])
+		switch {
+		case n == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			if len(labels) == 0 {
+				return ".", next, nil
+			}
+			return strings.Join(labels, "."), next, nil
+		case n&0xc0 == 0xc0:
+			if off+1 >= len(b) {
+				return "", 0, errShort
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(b[off:]) & 0x3fff)
+		case n&0xc0 != 0:
+			return "", 0, errors.New("bad label")
+		default:
+			if off+1+n > len(b) {
+				return "", 0, errShort
+			}
+			labels = append(labels, string(b[off+1:off+1+n]))
+			off += 1 + n
+		}
+	}
+}
+
+// CanonicalName lowercases name and ends it with a dot, for comparing names
+func CanonicalName(name string) string {
+	name = strings.ToLower(name)
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	return name
+}
+
+// InZone reports whether name is zone or below it
+func InZone(name, zone string) bool {
+	name, zone = CanonicalName(name), CanonicalName(zone)
+	return name == zone || zone == "." || strings.HasSuffix(name, "."+zone)
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
@@ -0,0 +1,226 @@
+package dnswire
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+var typeNames = map[uint16]string{
+	TypeA:     "A",
+	TypeNS:    "NS",
+	TypeCNAME: "CNAME",
+	TypeSOA:   "SOA",
+	TypePTR:   "PTR",
+	TypeMX:    "MX",
+	TypeTXT:   "TXT",
+	TypeAAAA:  "AAAA",
+	TypeSRV:   "SRV",
+	TypeTSIG:  "TSIG",
+	TypeAXFR:  "AXFR",
+	TypeANY:   "ANY",
+	TypeCAA:   "CAA",
+}
+
+// TypeName returns the mnemonic for t, e.g. "AAAA"
+func TypeName(t uint16) string {
+	if n, ok := typeNames[t]; ok {
+		return n
+	}
+	return fmt.Sprintf("TYPE%d", t)
+}
+
+// ParseType returns the type named s, if its rdata can be read and written
+func ParseType(s string) (uint16, bool) {
+	s = strings.ToUpper(s)
+	for t, n := range typeNames {
+		if n == s && Supported(t) {
+			return t, true
+		}
+	}
+	return 0, false
+}
+
+// Supported reports whether PackRdata and UnpackRdata handle t
+func Supported(t uint16) bool {
+	switch t {
+	case TypeA, TypeNS, TypeCNAME, TypeSOA, TypePTR, TypeMX, TypeTXT, TypeAAAA, TypeSRV, TypeCAA:
+		return true
+	}
+	return false
+}
+
+// PackRdata encodes the fields of an answer of type t, written as NS1 does,
+// e.g. ["10", "mail.example.com"] for MX. A TXT answer may be a single field
+// of any length; it is split into strings of up to 255 bytes
+func PackRdata(t uint16, fields []string) ([]byte, error) {
+	want := map[uint16]int{
+		TypeA: 1, TypeAAAA: 1, TypeNS: 1, TypeCNAME: 1, TypePTR: 1,
+		TypeMX: 2, TypeSRV: 4, TypeCAA: 3, TypeSOA: 7,
+	}
+	if n, ok := want[t]; ok && len(fields) != n {
+		return nil, fmt.Errorf("%s needs %d fields, not %d", TypeName(t), n, len(fields))
+	}
+
+	var b []byte
+	var err error
+	switch t {
+	case TypeA, TypeAAAA:
+		a, err := netip.ParseAddr(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		if t == TypeA && !a.Is4() || t == TypeAAAA && !a.Is6() {
+			return nil, fmt.Errorf("%q is not a %s address", fields[0], TypeName(t))
+		}
+		return a.AsSlice(), nil
+	case TypeNS, TypeCNAME, TypePTR:
+		return appendName(nil, fields[0])
+	case TypeMX:
+		if b, err = appendNumbers(b, fields[:1], 16); err != nil {
+			return nil, err
+		}
+		return appendName(b, fields[1])
+	case TypeSRV:
+		if b, err = appendNumbers(b, fields[:3], 16); err != nil {
+			return nil, err
+		}
+		return appendName(b, fields[3])
+	case TypeSOA:
+		if b, err = appendName(b, fields[0]); err != nil {
+			return nil, err
+		}
+		if b, err = appendName(b, fields[1]); err != nil {
+			return nil, err
+		}
+		return appendNumbers(b, fields[2:], 32)
+	case TypeCAA:
+		if b, err = appendNumbers(b, fields[:1], 8); err != nil {
+			return nil, err
+		}
+		if len(fields[1]) == 0 || len(fields[1]) > 255 {
+			return nil, fmt.Errorf("bad CAA tag %q", fields[1])
+		}
+		b = append(b, byte(len(fields[1])))
+		b = append(b, fields[1]...)
+		return append(b, fields[2]...), nil
+	case TypeTXT:
+		if len(fields) == 0 {
+			return nil, errors.New("TXT needs some text")
+		}
+		for _, f := range fields {
+			for {
+				chunk := f
+				if len(chunk) > 255 {
+					chunk = f[:255]
+				}
+				b = append(b, byte(len(chunk)))
+				b = append(b, chunk...)
+				f = f[len(chunk):]
+				if f == "" {
+					break
+				}
+			}
+		}
+		return b, nil
+	}
+	return nil, fmt.Errorf("type %s is not supported", TypeName(t))
+}
+
+func appendNumbers(b []byte, fields []string, bits int) ([]byte, error) {
+	for _, f := range fields {
+		v, err := strconv.ParseUint(f, 10, bits)
+		if err != nil {
+			return nil, err
+		}
+		switch bits {
+		case 8:
+			b = append(b, byte(v))
+		case 16:
+			b = appendUint16(b, uint16(v))
+		default:
+			b = appendUint32(b, uint32(v))
+		}
+	}
+	return b, nil
+}
+
+// UnpackRdata decodes rdata of type t, as from Unpack, into fields as NS1
+// writes them. The strings of a TXT record are joined into one field
+func UnpackRdata(t uint16, data []byte) ([]string, error) {
+	short := fmt.Errorf("%s rdata too short", TypeName(t))
+	switch t {
+	case TypeA, TypeAAAA:
+		a, ok := netip.AddrFromSlice(data)
+		if !ok || t == TypeA && !a.Is4() || t == TypeAAAA && !a.Is6() {
+			return nil, fmt.Errorf("bad %s rdata", TypeName(t))
+		}
+		return []string{a.String()}, nil
+	case TypeNS, TypeCNAME, TypePTR:
+		name, _, err := readName(data, 0)
+		if err != nil {
+			return nil, err
+		}
+		return []string{name}, nil
+	case TypeMX:
+		if len(data) < 3 {
+			return nil, short
+		}
+		name, _, err := readName(data, 2)
+		if err != nil {
+			return nil, err
+		}
+		return []string{strconv.Itoa(int(binary.BigEndian.Uint16(data))), name}, nil
+	case TypeSRV:
+		if len(data) < 7 {
+			return nil, short
+		}
+		name, _, err := readName(data, 6)
+		if err != nil {
+			return nil, err
+		}
+		fields := []string{}
+		for i := 0; i < 3; i++ {
+			fields = append(fields, strconv.Itoa(int(binary.BigEndian.Uint16(data[2*i:]))))
+		}
+		return append(fields, name), nil
+	case TypeSOA:
+		mname, off, err := readName(data, 0)
+		if err != nil {
+			return nil, err
+		}
+		rname, off, err := readName(data, off)
+		if err != nil {
+			return nil, err
+		}
+		if len(data) != off+20 {
+			return nil, short
+		}
+		fields := []string{mname, rname}
+		for i := 0; i < 5; i++ {
+			fields = append(fields, strconv.FormatUint(uint64(binary.BigEndian.Uint32(data[off+4*i:])), 10))
+		}
+		return fields, nil
+	case TypeCAA:
+		if len(data) < 2 || len(data) < 2+int(data[1]) {
+			return nil, short
+		}
+		n := int(data[1])
+		return []string{strconv.Itoa(int(data[0])), string(data[2 : 2+n]), string(data[2+n:])}, nil
+	case TypeTXT:
+		var text strings.Builder
+		for off := 0; off < len(data); {
+			n := int(data[off])
+			if off+1+n > len(data) {
+				return nil, short
+			}
+			text.Write(data[off+1 : off+1+n])
+			off += 1 + n
+		}
+		return []string{text.String()}, nil
+	}
+	return nil, fmt.Errorf("type %s is not supported", TypeName(t))
+}
@@ -0,0 +1,237 @@
+package dnswire
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+	"time"
+)
+
+// TSIG algorithms
+const (
+	HmacSHA256 = "hmac-sha256."
+	HmacSHA512 = "hmac-sha512."
+)
+
+// Fudge is how far apart the signer's and verifier's clocks may be
+const Fudge = 300
+
+// ErrUnsigned is returned by Verify for a message without a TSIG record
+var ErrUnsigned = errors.New("message is not signed")
+
+// TSIG is a transaction signature, as read from a message
+type TSIG struct {
+	Key        string
+	Algorithm  string
+	TimeSigned uint64
+	Fudge      uint16
+	MAC        []byte
+	OriginalID uint16
+	Error      int
+	Other      []byte
+}
+
+// TSIGError is a signature that didnt verify, or that the other side
+// rejected. Rcode is BADSIG, BADKEY or BADTIME
+type TSIGError struct {
+	Rcode int
+}
+
+func (e *TSIGError) Error() string {
+	return "TSIG " + RcodeName(e.Rcode)
+}
+
+// Key signs and verifies messages with TSIG (RFC 8945)
+type Key struct {
+	Name      string
+	Algorithm string
+	secret    []byte
+	hash      func() hash.Hash
+}
+
+// NewKey returns the key called name. algorithm is "hmac-sha256" or
+// "hmac-sha512", with or without a trailing dot, and secret is base64, as in
+// a BIND key file
+func NewKey(name, algorithm, secret string) (*Key, error) {
+	if name == "" {
+		return nil, errors.New("TSIG key has no name")
+	}
+	k := &Key{Name: CanonicalName(name), Algorithm: CanonicalName(algorithm)}
+	switch k.Algorithm {
+	case HmacSHA256:
+		k.hash = sha256.New
+	case HmacSHA512:
+		k.hash = sha512.New
+	default:
+		return nil, fmt.Errorf("TSIG algorithm %q is not supported, use hmac-sha256 or hmac-sha512", algorithm)
+	}
+	var err error
+	if k.secret, err = base64.StdEncoding.DecodeString(secret); err != nil {
+		return nil, fmt.Errorf("TSIG secret: %w", err)
+	}
+	if len(k.secret) == 0 {
+		return nil, errors.New("TSIG secret is empty")
+	}
+	return k, nil
+}
+
+// Prior returns what a signature following one with mac covers first: mac,
+// preceded by its length. A response is signed after the request, and each
+// message of a zone transfer after the one before
+func Prior(mac []byte) []byte {
+	return append(appendUint16(nil, uint16(len(mac))), mac...)
+}
+
+// Sign appends a TSIG record to msg, a packed message, and returns the signed
+// message and its MAC. The MAC covers prefix, from Prior, msg and the TSIG
+// variables, or only its timers if timersOnly, for the later messages of a
+// zone transfer
+func (k *Key) Sign(prefix, msg []byte, timersOnly bool, now time.Time) ([]byte, []byte, error) {
+	return k.sign(prefix, msg, timersOnly, now, RcodeSuccess)
+}
+
+func (k *Key) sign(prefix, msg []byte, timersOnly bool, now time.Time, tsigErr int) ([]byte, []byte, error) {
+	if len(msg) < 12 {
+		return nil, nil, errShort
+	}
+	t := TSIG{
+		Key:        k.Name,
+		Algorithm:  k.Algorithm,
+		TimeSigned: uint64(now.Unix()),
+		Fudge:      Fudge,
+		OriginalID: binary.BigEndian.Uint16(msg),
+		Error:      tsigErr,
+	}
+	if tsigErr != RcodeBadSig && tsigErr != RcodeBadKey {
+		t.MAC = k.mac(prefix, msg, &t, timersOnly)
+	}
+
+	signed := append([]byte(nil), msg...)
+	signed, err := appendRR(signed, t.rr())
+	if err != nil {
+		return nil, nil, err
+	}
+	binary.BigEndian.PutUint16(signed[10:], binary.BigEndian.Uint16(msg[10:])+1)
+	return signed, t.MAC, nil
+}
+
+// Verify checks the TSIG record at the end of msg, covering prefix as for
+// Sign, and returns its MAC. An error the signer reported in the record is
+// returned as a *TSIGError, as is a signature that doesnt verify
+func (k *Key) Verify(prefix, msg []byte, timersOnly bool, now time.Time) ([]byte, error) {
+	m, err := Unpack(msg)
+	if err != nil {
+		return nil, err
+	}
+	t := m.TSIG
+	if t == nil {
+		return nil, ErrUnsigned
+	}
+	if CanonicalName(t.Key) != k.Name || CanonicalName(t.Algorithm) != k.Algorithm {
+		return nil, &TSIGError{Rcode: RcodeBadKey}
+	}
+	if t.Error != RcodeSuccess && len(t.MAC) == 0 {
+		return nil, &TSIGError{Rcode: t.Error}
+	}
+
+	stripped := append([]byte(nil), msg[:m.tsigOffset]...)
+	binary.BigEndian.PutUint16(stripped, t.OriginalID)
+	binary.BigEndian.PutUint16(stripped[10:], binary.BigEndian.Uint16(msg[10:])-1)
+	if !hmac.Equal(t.MAC, k.mac(prefix, stripped, t, timersOnly)) {
+		return nil, &TSIGError{Rcode: RcodeBadSig}
+	}
+
+	signed := int64(t.TimeSigned)
+	if d := now.Unix() - signed; d > int64(t.Fudge) || -d > int64(t.Fudge) {
+		return nil, &TSIGError{Rcode: RcodeBadTime}
+	}
+	if t.Error != RcodeSuccess {
+		return nil, &TSIGError{Rcode: t.Error}
+	}
+	return t.MAC, nil
+}
+
+// Reject returns msg, a response, with a TSIG record carrying rcode, as sent
+// when a request's signature cant be checked. Only BADTIME is signed, as the
+// request's MAC was good; it covers prefix as for Sign
+func (k *Key) Reject(prefix, msg []byte, rcode int, now time.Time) ([]byte, error) {
+	signed, _, err := k.sign(prefix, msg, false, now, rcode)
+	return signed, err
+}
+
+func (k *Key) mac(prefix, msg []byte, t *TSIG, timersOnly bool) []byte {
+	h := hmac.New(k.hash, k.secret)
+	h.Write(prefix)
+	h.Write(msg)
+
+	var v []byte
+	if !timersOnly {
+		v, _ = appendName(v, strings.ToLower(k.Name))
+		v = appendUint16(v, ClassANY)
+		v = appendUint32(v, 0)
+		v, _ = appendName(v, k.Algorithm)
+	}
+	v = appendUint48(v, t.TimeSigned)
+	v = appendUint16(v, t.Fudge)
+	if !timersOnly {
+		v = appendUint16(v, uint16(t.Error))
+		v = appendUint16(v, uint16(len(t.Other)))
+		v = append(v, t.Other...)
+	}
+	h.Write(v)
+	return h.Sum(nil)
+}
+
+func (t *TSIG) rr() RR {
+	d, _ := appendName(nil, t.Algorithm)
+	d = appendUint48(d, t.TimeSigned)
+	d = appendUint16(d, t.Fudge)
+	d = appendUint16(d, uint16(len(t.MAC)))
+	d = append(d, t.MAC...)
+	d = appendUint16(d, t.OriginalID)
+	d = appendUint16(d, uint16(t.Error))
+	d = appendUint16(d, uint16(len(t.Other)))
+	d = append(d, t.Other...)
+	return RR{Name: t.Key, Type: TypeTSIG, Class: ClassANY, Data: d}
+}
+
+func parseTSIG(rr RR) (*TSIG, error) {
+	bad := errors.New("bad TSIG record")
+	alg, off, err := readName(rr.Data, 0)
+	if err != nil {
+		return nil, bad
+	}
+	d := rr.Data
+	if off+10 > len(d) {
+		return nil, bad
+	}
+	t := &TSIG{Key: rr.Name, Algorithm: alg}
+	t.TimeSigned = uint64(binary.BigEndian.Uint16(d[off:]))<<32 | uint64(binary.BigEndian.Uint32(d[off+2:]))
+	t.Fudge = binary.BigEndian.Uint16(d[off+6:])
+	n := int(binary.BigEndian.Uint16(d[off+8:]))
+	off += 10
+	if off+n+6 > len(d) {
+		return nil, bad
+	}
+	t.MAC = append([]byte(nil), d[off:off+n]...)
+	off += n
+	t.OriginalID = binary.BigEndian.Uint16(d[off:])
+	t.Error = int(binary.BigEndian.Uint16(d[off+2:]))
+	n = int(binary.BigEndian.Uint16(d[off+4:]))
+	off += 6
+	if off+n != len(d) {
+		return nil, bad
+	}
+	t.Other = append([]byte(nil), d[off:]...)
+	return t, nil
+}
+
+func appendUint48(b []byte, v uint64) []byte {
+	return append(b, byte(v>>40), byte(v>>32), byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
@@ -0,0 +1,170 @@
+// Package dyndns serves the dyndns2 /nic/update protocol routers use to
+// report their address, leaving the checking and updating of records to a
+// Backend
+package dyndns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Path is where updates are accepted
+const Path = "/nic/update"
+
+// MaxHosts is how many hostnames one request may update
+const MaxHosts = 20
+
+// Return codes, as sent back for each hostname
+const (
+	Good     = "good"
+	NoChange = "nochg"
+	BadAuth  = "badauth"
+	NotFQDN  = "notfqdn"
+	NoHost   = "nohost"
+	NumHost  = "numhost"
+	DNSErr   = "dnserr"
+	Fail     = "911"
+)
+
+var (
+	// ErrNoHost is returned by a Backend for a hostname the user may not
+	// update, answered with nohost
+	ErrNoHost = errors.New("hostname not allowed")
+
+	// ErrRejected is returned by a Backend for an address that may not be
+	// published, answered with dnserr
+	ErrRejected = errors.New("address rejected")
+)
+
+// Backend checks and makes the updates a Handler receives
+type Backend interface {
+	// Login reports whether username and password are valid
+	Login(username, password string) bool
+
+	// Update points host at ip for username, reporting whether it changed.
+	// Errors wrapping ErrNoHost or ErrRejected are answered as such, and any
+	// other with 911
+	Update(ctx context.Context, username, host, ip string) (bool, error)
+}
+
+// Handler answers /nic/update requests with b
+func Handler(b Backend) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(Path, func(w http.ResponseWriter, r *http.Request) {
+		serve(b, w, r)
+	})
+	return mux
+}
+
+func serve(b Backend, w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	username, password, ok := r.BasicAuth()
+	if !ok || !b.Login(username, password) {
+		log.Printf("dyndns: %s: %s for %q\n", remoteIP(r), BadAuth, username)
+		w.Header().Set("WWW-Authenticate", `Basic realm="dnsupdate"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintln(w, BadAuth)
+		return
+	}
+
+	var hosts []string
+	for _, h := range strings.Split(r.FormValue("hostname"), ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			hosts = append(hosts, h)
+		}
+	}
+	switch {
+	case len(hosts) == 0:
+		fmt.Fprintln(w, NotFQDN)
+		return
+	case len(hosts) > MaxHosts:
+		fmt.Fprintln(w, NumHost)
+		return
+	}
+
+	// without myip, the address the request came from is used
+	ip, err := parseIP(r.FormValue("myip"))
+	if err == nil && ip == "" {
+		ip, err = parseIP(remoteIP(r))
+	}
+	for _, host := range hosts {
+		code := DNSErr
+		if err == nil {
+			code = update(r.Context(), b, username, host, ip)
+		} else {
+			log.Printf("dyndns: %s %s: %v\n", username, host, err)
+		}
+		if code == Good || code == NoChange {
+			code += " " + ip
+		}
+		fmt.Fprintln(w, code)
+	}
+}
+
+// update makes one update, returning the code to answer with
+func update(ctx context.Context, b Backend, username, host, ip string) string {
+	if !fqdn(host) {
+		return NotFQDN
+	}
+	changed, err := b.Update(ctx, username, host, ip)
+	switch {
+	case err == nil && changed:
+		log.Printf("dyndns: %s set %s to %s\n", username, host, ip)
+		return Good
+	case err == nil:
+		return NoChange
+	}
+	log.Printf("dyndns: %s %s: %v\n", username, host, err)
+	switch {
+	case errors.Is(err, ErrNoHost):
+		return NoHost
+	case errors.Is(err, ErrRejected):
+		return DNSErr
+	}
+	return Fail
+}
+
+// parseIP picks the IPv4 address out of myip, which may also list an IPv6
+// one, separated by a comma. It returns "" if myip is empty
+func parseIP(myip string) (string, error) {
+	if myip == "" {
+		return "", nil
+	}
+	for _, s := range strings.Split(myip, ",") {
+		if ip := net.ParseIP(strings.TrimSpace(s)); ip != nil && ip.To4() != nil {
+			return ip.To4().String(), nil
+		}
+	}
+	return "", fmt.Errorf("%w: no IPv4 address in %q", ErrRejected, myip)
+}
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func fqdn(host string) bool {
+	host = strings.TrimSuffix(host, ".")
+	if len(host) > 253 || !strings.Contains(host, ".") {
+		return false
+	}
+	for _, label := range strings.Split(host, ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+	}
+	return true
+}
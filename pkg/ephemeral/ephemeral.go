@@ -0,0 +1,259 @@
+// Package ephemeral expires registrations that stop being renewed, such as
+// a laptop or test VM that registered its name and went away. Each
+// registration has a stamp, a TXT record next to it holding when it was last
+// seen and for how long it lives, and a reaper deletes the answers whose
+// stamp has run out. Stamps are marked like any other record, so a reaper
+// only ever deletes what its owner created
+package ephemeral
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/m1k8/DNSUpdate/pkg/compare"
+	"github.com/m1k8/DNSUpdate/pkg/owner"
+	"github.com/m1k8/DNSUpdate/pkg/plan"
+	"github.com/m1k8/DNSUpdate/pkg/provider"
+	"gopkg.in/ns1/ns1-go.v2/rest/model/dns"
+)
+
+// RecordPrefix starts the name of the TXT record holding a stamp. It is
+// followed by a digest of the answer's note and then the hostname, as in
+// _dnsupdate-expiry-1a2b3c4d.home.example.com, so hosts sharing a record
+// each have a stamp of their own
+const RecordPrefix = "_dnsupdate-expiry-"
+
+// TTL of stamp records, which are only read by the service
+const TTL = 60
+
+// Stamp is when a registration was last seen, and how long after that it
+// expires
+type Stamp struct {
+	Seen time.Time
+	TTL  time.Duration
+
+	// Answer is the note of the answer registered, so only it is deleted
+	// from a record holding others
+	Answer string
+}
+
+// Expires returns when the registration expires unless renewed
+func (s Stamp) Expires() time.Time {
+	return s.Seen.Add(s.TTL)
+}
+
+// String formats s as held in its TXT record
+func (s Stamp) String() string {
+	return fmt.Sprintf("seen=%s ttl=%s answer=%s", s.Seen.UTC().Format(time.RFC3339), s.TTL, s.Answer)
+}
+
+// Parse reads a stamp from its TXT record's text. The answer is last, as a
+// note may have spaces in it
+func Parse(text string) (Stamp, error) {
+	var s Stamp
+	rest := text
+	for _, field := range []string{"seen=", "ttl=", "answer="} {
+		if !strings.HasPrefix(rest, field) {
+			return Stamp{}, fmt.Errorf("bad stamp %q, no %s", text, strings.TrimSuffix(field, "="))
+		}
+		rest = rest[len(field):]
+		value := rest
+		if field != "answer=" {
+			value, rest, _ = strings.Cut(rest, " ")
+		}
+		var err error
+		switch field {
+		case "seen=":
+			s.Seen, err = time.Parse(time.RFC3339, value)
+		case "ttl=":
+			s.TTL, err = time.ParseDuration(value)
+		case "answer=":
+			s.Answer = value
+		}
+		if err != nil {
+			return Stamp{}, fmt.Errorf("bad stamp %q: %w", text, err)
+		}
+	}
+	return s, nil
+}
+
+// Name returns the name of the stamp record of the answer of domain with
+// the note answer
+func Name(domain, answer string) string {
+	sum := sha256.Sum256([]byte(answer))
+	return RecordPrefix + hex.EncodeToString(sum[:4]) + "." + strings.TrimSuffix(domain, ".")
+}
+
+// Host returns the hostname a stamp record is for, or false if name isnt a
+// stamp's
+func Host(name string) (string, bool) {
+	if len(name) <= len(RecordPrefix) || !strings.EqualFold(name[:len(RecordPrefix)], RecordPrefix) {
+		return "", false
+	}
+	digest, host, ok := strings.Cut(name[len(RecordPrefix):], ".")
+	if _, err := hex.DecodeString(digest); !ok || err != nil || len(digest) != 8 || host == "" {
+		return "", false
+	}
+	return host, true
+}
+
+// Renew plans writing s as the stamp of the answer of domain it names,
+// marked with m. A stamp record that isnt marked is refused, with an error
+// wrapping owner.ErrNotOwned
+func Renew(ctx context.Context, at provider.Provider, m owner.Marker, zone, domain string, s Stamp) (*plan.Plan, error) {
+	p := &plan.Plan{Target: domain}
+	name := Name(domain, s.Answer)
+	old, err := at.Record(ctx, zone, name, "TXT")
+	switch {
+	case errors.Is(err, provider.ErrRecordMissing):
+		r := dns.NewRecord(zone, name, "TXT")
+		r.TTL = TTL
+		r.AddAnswer(dns.NewTXTAnswer(s.String()))
+		m.Mark(r)
+		p.Add(plan.Change{Action: plan.Create, Provider: at.Name(), After: r})
+	case err != nil:
+		return nil, err
+	case !m.Owns(old):
+		p.Refuse("update %s TXT: %s", name, owner.ErrNotOwned)
+		return p, fmt.Errorf("%s TXT: %w", name, owner.ErrNotOwned)
+	default:
+		r := plan.CopyRecord(old)
+		r.Answers = []*dns.Answer{dns.NewTXTAnswer(s.String())}
+		p.Add(plan.Change{Action: plan.Update, Provider: at.Name(), Before: old, After: r})
+	}
+	return p, nil
+}
+
+// Release plans deleting the answer identified by id from domain's A
+// record, or the whole record and its SRV record if no other answers are
+// left, and then the answer's stamp. Records that arent marked with m are
+// refused, and missing ones skipped
+func Release(ctx context.Context, at provider.Provider, m owner.Marker, zone, domain string, id compare.Identity) (*plan.Plan, error) {
+	return release(ctx, at, m, zone, domain, []compare.Identity{id})
+}
+
+// release plans releasing the answers identified by ids together, so they
+// are all deleted by one change to domain's A record
+func release(ctx context.Context, at provider.Provider, m owner.Marker, zone, domain string, ids []compare.Identity) (*plan.Plan, error) {
+	p := &plan.Plan{Target: domain}
+	name := at.Name()
+
+	r, err := at.Record(ctx, zone, domain, "A")
+	switch {
+	case errors.Is(err, provider.ErrRecordMissing):
+	case err != nil:
+		return nil, err
+	case !m.Owns(r):
+		p.Refuse("delete %s A: %s", domain, owner.ErrNotOwned)
+		return p, nil
+	default:
+		after := plan.CopyRecord(r)
+		for _, id := range ids {
+			if state := compare.NewRecordState(after, id); state.Answer() != nil {
+				after.Answers = append(after.Answers[:state.Owned:state.Owned], after.Answers[state.Owned+1:]...)
+			}
+		}
+		switch {
+		case len(after.Answers) == len(r.Answers):
+		case len(after.Answers) > 0:
+			p.Add(plan.Change{Action: plan.Update, Provider: name, Before: r, After: after})
+		default:
+			p.Add(plan.Change{Action: plan.Delete, Provider: name, Before: r})
+			if err := releaseOwned(ctx, p, at, m, zone, domain, "SRV"); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, id := range ids {
+		if err := releaseOwned(ctx, p, at, m, zone, Name(domain, id.Note), "TXT"); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// releaseOwned adds the deletion of a record to p, if it exists and is
+// marked with m
+func releaseOwned(ctx context.Context, p *plan.Plan, at provider.Provider, m owner.Marker, zone, domain, t string) error {
+	if !provider.Supports(at, t) {
+		return nil
+	}
+	r, err := at.Record(ctx, zone, domain, t)
+	switch {
+	case errors.Is(err, provider.ErrRecordMissing):
+	case err != nil:
+		return err
+	case m.Owns(r):
+		p.Add(plan.Change{Action: plan.Delete, Provider: at.Name(), Before: r})
+	}
+	return nil
+}
+
+// Reap plans releasing every registration in zone whose stamp, marked with
+// m, expired before now. A stamp that cant be read is skipped, and returned
+// in bad
+func Reap(ctx context.Context, at provider.Provider, m owner.Marker, zone string, now time.Time) (p *plan.Plan, bad []error, err error) {
+	p = &plan.Plan{Target: "reaper"}
+	z, err := at.Zone(zone)
+	if err != nil {
+		return nil, nil, err
+	}
+	// expired answers are released by host, so those sharing a record
+	// are deleted from it by the same change
+	var hosts []string
+	expired := map[string][]compare.Identity{}
+	for _, zr := range z.Records {
+		host, ok := Host(zr.Domain)
+		if !ok || !strings.EqualFold(zr.Type, "TXT") {
+			continue
+		}
+		if owned, known := m.OwnsSummary(zr); known && !owned {
+			continue
+		}
+		r, err := at.Record(ctx, zone, zr.Domain, "TXT")
+		if errors.Is(err, provider.ErrRecordMissing) {
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if !m.Owns(r) {
+			continue
+		}
+		if len(r.Answers) != 1 || len(r.Answers[0].Rdata) == 0 {
+			bad = append(bad, fmt.Errorf("%s TXT: not a stamp", zr.Domain))
+			continue
+		}
+		s, err := Parse(strings.Join(r.Answers[0].Rdata, ""))
+		if err != nil {
+			bad = append(bad, fmt.Errorf("%s TXT: %w", zr.Domain, err))
+			continue
+		}
+		if !strings.EqualFold(Name(host, s.Answer), zr.Domain) {
+			bad = append(bad, fmt.Errorf("%s TXT: stamp is for answer %q, named otherwise", zr.Domain, s.Answer))
+			continue
+		}
+		if !s.Expires().Before(now) {
+			continue
+		}
+		key := strings.ToLower(strings.TrimSuffix(host, "."))
+		if _, ok := expired[key]; !ok {
+			hosts = append(hosts, host)
+		}
+		expired[key] = append(expired[key], compare.Identity{Note: s.Answer})
+	}
+	for _, host := range hosts {
+		released, err := release(ctx, at, m, zone, host, expired[strings.ToLower(strings.TrimSuffix(host, "."))])
+		if err != nil {
+			return nil, nil, err
+		}
+		p.Changes = append(p.Changes, released.Changes...)
+		p.Refused = append(p.Refused, released.Refused...)
+	}
+	return p, bad, nil
+}
@@ -0,0 +1,277 @@
+package ephemeral
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/m1k8/DNSUpdate/pkg/compare"
+	"github.com/m1k8/DNSUpdate/pkg/dnsapi"
+	"github.com/m1k8/DNSUpdate/pkg/ns1fake"
+	"github.com/m1k8/DNSUpdate/pkg/owner"
+	"github.com/m1k8/DNSUpdate/pkg/plan"
+	"github.com/m1k8/DNSUpdate/pkg/provider"
+	"gopkg.in/ns1/ns1-go.v2/rest/model/dns"
+)
+
+const (
+	zone   = "example.com"
+	domain = "home.example.com"
+)
+
+var (
+	marker = owner.Marker{Owner: "dnsupdate"}
+	start  = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+)
+
+// newProvider returns an NS1 provider backed by a fake holding a marked A
+// record of domain with an answer for each note
+func newProvider(t *testing.T, notes ...string) (*ns1fake.Server, provider.Provider) {
+	t.Helper()
+	f := ns1fake.New()
+	t.Cleanup(f.Close)
+	f.AddZone(zone)
+	if len(notes) > 0 {
+		r := dns.NewRecord(zone, domain, "A")
+		for i, note := range notes {
+			a := dns.NewAv4Answer("8.8.4." + string(rune('1'+i)))
+			a.Meta.Note = note
+			r.AddAnswer(a)
+		}
+		marker.Mark(r)
+		f.PutRecord(r)
+	}
+	return f, provider.NewNS1(provider.Default, dnsapi.FromREST(f.Client()))
+}
+
+func apply(t *testing.T, p *plan.Plan, at provider.Provider) {
+	t.Helper()
+	if err := p.Apply(provider.Registry{at.Name(): at}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// notes returns the notes of the answers left in domain's A record, or nil
+// if there is no record
+func notes(f *ns1fake.Server) []string {
+	r := f.Record(zone, domain, "A")
+	if r == nil {
+		return nil
+	}
+	var got []string
+	for _, a := range r.Answers {
+		got = append(got, compare.NoteOf(a))
+	}
+	sort.Strings(got)
+	return got
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		text    string
+		want    Stamp
+		wantErr bool
+	}{
+		{text: "seen=2024-01-01T00:00:00Z ttl=1h0m0s answer=laptop", want: Stamp{Seen: start, TTL: time.Hour, Answer: "laptop"}},
+		{text: "seen=2024-01-01T00:00:00Z ttl=5m0s answer=my laptop", want: Stamp{Seen: start, TTL: 5 * time.Minute, Answer: "my laptop"}},
+		{text: "seen=2024-01-01T00:00:00Z ttl=1h0m0s", wantErr: true},
+		{text: "seen=yesterday ttl=1h0m0s answer=laptop", wantErr: true},
+		{text: "seen=2024-01-01T00:00:00Z ttl=long answer=laptop", wantErr: true},
+		{text: "laptop", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			got, err := Parse(tt.text)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want one %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+			if got.String() != tt.text {
+				t.Errorf("formats as %q, want %q", got.String(), tt.text)
+			}
+		})
+	}
+}
+
+func TestName(t *testing.T) {
+	laptop, vm := Name(domain, "laptop"), Name(domain+".", "vm")
+	if laptop == vm || laptop == Name(domain, "vm") {
+		t.Errorf("answers with different notes share the stamp %s", laptop)
+	}
+	if laptop != Name(domain+".", "laptop") {
+		t.Errorf("a trailing dot changes the stamp's name")
+	}
+	tests := []struct {
+		name string
+		host string
+		ok   bool
+	}{
+		{name: laptop, host: domain, ok: true},
+		{name: vm, host: domain, ok: true},
+		{name: domain},
+		{name: RecordPrefix + domain},
+		{name: RecordPrefix + "nothex00." + domain},
+		{name: RecordPrefix + "1a2b3c4d."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host, ok := Host(tt.name)
+			if host != tt.host || ok != tt.ok {
+				t.Errorf("got %q %v, want %q %v", host, ok, tt.host, tt.ok)
+			}
+		})
+	}
+}
+
+func TestReap(t *testing.T) {
+	tests := []struct {
+		name string
+		// lived is how long each answer's stamp had been kept renewed
+		// when the reaper runs an hour after start
+		lived map[string]time.Duration
+
+		want []string
+		// stamps is the notes whose stamps are left
+		stamps []string
+	}{
+		{
+			name:   "one answer of a shared record expires",
+			lived:  map[string]time.Duration{"laptop": 0, "vm": time.Hour},
+			want:   []string{"vm"},
+			stamps: []string{"vm"},
+		},
+		{
+			name:   "none expire",
+			lived:  map[string]time.Duration{"laptop": time.Hour, "vm": time.Hour},
+			want:   []string{"laptop", "vm"},
+			stamps: []string{"laptop", "vm"},
+		},
+		{
+			name:  "all expire",
+			lived: map[string]time.Duration{"laptop": 0, "vm": 0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var all []string
+			for note := range tt.lived {
+				all = append(all, note)
+			}
+			sort.Strings(all)
+			f, at := newProvider(t, all...)
+			for _, note := range all {
+				p, err := Renew(context.Background(), at, marker, zone, domain, Stamp{Seen: start.Add(tt.lived[note]), TTL: 30 * time.Minute, Answer: note})
+				if err != nil {
+					t.Fatal(err)
+				}
+				apply(t, p, at)
+			}
+
+			p, bad, err := Reap(context.Background(), at, marker, zone, start.Add(time.Hour))
+			if err != nil || len(bad) > 0 {
+				t.Fatalf("reaping: %v %v", err, bad)
+			}
+			apply(t, p, at)
+			if got := notes(f); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("answers left %v, want %v", got, tt.want)
+			}
+			var stamps []string
+			for _, note := range all {
+				if f.Record(zone, Name(domain, note), "TXT") != nil {
+					stamps = append(stamps, note)
+				}
+			}
+			if !reflect.DeepEqual(stamps, tt.stamps) {
+				t.Errorf("stamps left %v, want %v", stamps, tt.stamps)
+			}
+		})
+	}
+}
+
+func TestRenewKeepsOthersStamps(t *testing.T) {
+	f, at := newProvider(t, "laptop", "vm")
+	for _, s := range []Stamp{
+		{Seen: start, TTL: time.Hour, Answer: "laptop"},
+		{Seen: start, TTL: time.Hour, Answer: "vm"},
+		{Seen: start.Add(time.Minute), TTL: time.Hour, Answer: "laptop"},
+	} {
+		p, err := Renew(context.Background(), at, marker, zone, domain, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		apply(t, p, at)
+	}
+	for note, seen := range map[string]time.Time{"laptop": start.Add(time.Minute), "vm": start} {
+		r := f.Record(zone, Name(domain, note), "TXT")
+		if r == nil {
+			t.Fatalf("no stamp for %s", note)
+		}
+		s, err := Parse(r.Answers[0].Rdata[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !s.Seen.Equal(seen) || s.Answer != note {
+			t.Errorf("stamp for %s is %+v, want seen at %s", note, s, seen)
+		}
+	}
+
+	// another owner's stamp is refused
+	r := f.Record(zone, Name(domain, "vm"), "TXT")
+	r.Meta.Note = ""
+	r.Tags = nil
+	f.PutRecord(r)
+	if _, err := Renew(context.Background(), at, marker, zone, domain, Stamp{Seen: start, TTL: time.Hour, Answer: "vm"}); err == nil {
+		t.Error("renewing an unmarked stamp should be refused")
+	}
+}
+
+func TestRelease(t *testing.T) {
+	tests := []struct {
+		name  string
+		notes []string
+		note  string
+
+		want []string
+	}{
+		{name: "one of several answers", notes: []string{"laptop", "vm"}, note: "laptop", want: []string{"vm"}},
+		{name: "the last answer", notes: []string{"laptop"}, note: "laptop"},
+		{name: "an answer not in the record", notes: []string{"vm"}, note: "laptop", want: []string{"vm"}},
+		{name: "a missing record", note: "laptop"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, at := newProvider(t, tt.notes...)
+			for _, note := range append(tt.notes, tt.note) {
+				p, err := Renew(context.Background(), at, marker, zone, domain, Stamp{Seen: start, TTL: time.Hour, Answer: note})
+				if err != nil {
+					t.Fatal(err)
+				}
+				apply(t, p, at)
+			}
+
+			p, err := Release(context.Background(), at, marker, zone, domain, compare.Identity{Note: tt.note})
+			if err != nil {
+				t.Fatal(err)
+			}
+			apply(t, p, at)
+			if got := notes(f); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("answers left %v, want %v", got, tt.want)
+			}
+			if f.Record(zone, Name(domain, tt.note), "TXT") != nil {
+				t.Error("the released answer's stamp should be deleted")
+			}
+			for _, note := range tt.want {
+				if f.Record(zone, Name(domain, note), "TXT") == nil {
+					t.Errorf("the stamp of %s should be kept", note)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,248 @@
+package faults
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/m1k8/DNSUpdate/pkg/config"
+	api "gopkg.in/ns1/ns1-go.v2/rest"
+)
+
+// Kinds of fault
+const (
+	None     = "none"
+	Latency  = "latency"
+	Drop     = "drop"
+	Status   = "status"
+	Truncate = "truncate"
+	Reorder  = "reorder"
+)
+
+// defaultHold is how long "reorder" holds a response when no latency is set
+const defaultHold = time.Second
+
+// injector applies a plan to requests passing through it
+type injector struct {
+	next api.Doer
+	plan config.Faults
+
+	mu   sync.Mutex
+	rand *rand.Rand
+	step int
+
+	// closed and replaced each time a response is returned, to release
+	// responses held by "reorder"
+	returned chan struct{}
+}
+
+// New returns a Decorator that injects the faults in plan
+func New(plan config.Faults) (api.Decorator, error) {
+	for _, f := range append(append([]config.Fault(nil), plan.Script...), plan.Random...) {
+		if err := validate(f); err != nil {
+			return nil, err
+		}
+	}
+
+	seed := plan.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+
+	return func(d api.Doer) api.Doer {
+		return &injector{
+			next:     d,
+			plan:     plan,
+			rand:     rand.New(rand.NewSource(seed)),
+			returned: make(chan struct{}),
+		}
+	}, nil
+}
+
+func validate(f config.Fault) error {
+	switch f.Kind {
+	case None, Latency, Drop, Truncate, Reorder:
+	case Status:
+		if f.Status < 400 || f.Status > 599 {
+			return fmt.Errorf("faults: status %d is not an error", f.Status)
+		}
+	default:
+		return fmt.Errorf("faults: unknown kind '%s'", f.Kind)
+	}
+	if f.Probability < 0 || f.Probability > 1 {
+		return fmt.Errorf("faults: probability %v is not between 0 and 1", f.Probability)
+	}
+	return nil
+}
+
+// pick chooses the faults for the next request
+func (in *injector) pick(r *http.Request) []config.Fault {
+	if in.plan.Match != "" && !strings.Contains(r.URL.Path, in.plan.Match) {
+		return nil
+	}
+
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if in.step < len(in.plan.Script) {
+		in.step++
+		return []config.Fault{in.plan.Script[in.step-1]}
+	}
+
+	var picked []config.Fault
+	for _, f := range in.plan.Random {
+		if in.rand.Float64() < f.Probability {
+			picked = append(picked, f)
+		}
+	}
+	return picked
+}
+
+func (in *injector) Do(r *http.Request) (*http.Response, error) {
+	faults := in.pick(r)
+	for _, f := range faults {
+		log.Printf("Injecting %s fault into %s %s\n", f.Kind, r.Method, r.URL.Path)
+	}
+
+	for _, f := range faults {
+		switch {
+		case f.Kind == Latency:
+			if err := sleep(r, time.Duration(f.Latency)); err != nil {
+				return nil, err
+			}
+		case f.Kind == Drop && !f.After:
+			return nil, dropped()
+		case f.Kind == Status && !f.After:
+			return statusResponse(r, f.Status), nil
+		}
+	}
+
+	resp, err := in.next.Do(r)
+	if err != nil {
+		in.release()
+		return resp, err
+	}
+
+	for _, f := range faults {
+		switch f.Kind {
+		case Drop:
+			resp.Body.Close()
+			in.release()
+			return nil, dropped()
+		case Status:
+			resp.Body.Close()
+			in.release()
+			return statusResponse(r, f.Status), nil
+		case Truncate:
+			resp.Body = truncate(resp.Body)
+		case Reorder:
+			in.hold(r, time.Duration(f.Latency))
+		}
+	}
+	in.release()
+	return resp, nil
+}
+
+// hold delays a response until another request returns, or for at most d,
+// so that concurrent requests see their responses out of order
+func (in *injector) hold(r *http.Request, d time.Duration) {
+	if d == 0 {
+		d = defaultHold
+	}
+	in.mu.Lock()
+	returned := in.returned
+	in.mu.Unlock()
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-returned:
+	case <-timer.C:
+	case <-r.Context().Done():
+	}
+}
+
+func (in *injector) release() {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	close(in.returned)
+	in.returned = make(chan struct{})
+}
+
+func sleep(r *http.Request, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-r.Context().Done():
+		return r.Context().Err()
+	}
+}
+
+func dropped() error {
+	return &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}
+}
+
+// statusResponse builds an error response the way NS1 would send it
+func statusResponse(r *http.Request, code int) *http.Response {
+	body, _ := json.Marshal(map[string]string{"message": strings.ToLower(http.StatusText(code))})
+	resp := &http.Response{
+		Status:        strconv.Itoa(code) + " " + http.StatusText(code),
+		StatusCode:    code,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"application/json"}},
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       r,
+	}
+	if code == http.StatusTooManyRequests {
+		resp.Header.Set("X-Ratelimit-Limit", "100")
+		resp.Header.Set("X-Ratelimit-Remaining", "0")
+		resp.Header.Set("X-Ratelimit-Period", "1")
+		resp.Header.Set("Retry-After", "1")
+	}
+	return resp
+}
+
+// truncatedBody returns the first half of a body, then an unexpected EOF
+type truncatedBody struct {
+	io.Reader
+	closer io.Closer
+}
+
+func truncate(body io.ReadCloser) io.ReadCloser {
+	buf, err := ioutil.ReadAll(body)
+	if err != nil {
+		return body
+	}
+	half := bytes.NewReader(buf[:len(buf)/2])
+	return &truncatedBody{
+		Reader: io.MultiReader(half, errReader{io.ErrUnexpectedEOF}),
+		closer: body,
+	}
+}
+
+func (t *truncatedBody) Close() error {
+	return t.closer.Close()
+}
+
+type errReader struct {
+	err error
+}
+
+func (e errReader) Read([]byte) (int, error) {
+	return 0, e.err
+}
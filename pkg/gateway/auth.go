@@ -0,0 +1,143 @@
+package gateway
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Ways a token can authenticate requests
+const (
+	// AuthHMAC signs each request with the token's secret, which is never
+	// sent
+	AuthHMAC = "hmac"
+	// AuthBearer sends the secret itself, so needs TLS
+	AuthBearer = "bearer"
+)
+
+// MaxSkew is how far a signed request's time may be from the gateway's
+const MaxSkew = 5 * time.Minute
+
+// hmacScheme names the Authorization scheme of signed requests
+const hmacScheme = "DNSUpdate-HMAC-SHA256"
+
+var errUnauthorized = errors.New("bad or missing credentials")
+
+// Sign adds an Authorization header to req signing its method, path, the
+// time, a random nonce and body with secret, for the token id. The nonce
+// keeps two identical requests in the same second from looking replayed
+func Sign(req *http.Request, id, secret string, body []byte, now time.Time) {
+	ts := strconv.FormatInt(now.Unix(), 10)
+	b := make([]byte, 12)
+	rand.Read(b)
+	nonce := hex.EncodeToString(b)
+	sig := signature(secret, req.Method, req.URL.EscapedPath(), ts, nonce, body)
+	req.Header.Set("Authorization", fmt.Sprintf("%s token=%s, time=%s, nonce=%s, signature=%s", hmacScheme, id, ts, nonce, sig))
+}
+
+// signature is the base64 HMAC-SHA256 of
+//
+//	METHOD\nPATH\nTIME\nNONCE\nhex(sha256(body))
+func signature(secret, method, path, ts, nonce string, body []byte) string {
+	sum := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n%s", method, path, ts, nonce, hex.EncodeToString(sum[:]))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// signed is the parts of a signed request's Authorization header
+type signed struct {
+	token     string
+	time      time.Time
+	ts        string
+	nonce     string
+	signature string
+}
+
+func parseSigned(header string) (signed, bool) {
+	rest, ok := cutPrefix(header, hmacScheme+" ")
+	if !ok {
+		return signed{}, false
+	}
+	var s signed
+	for _, part := range strings.Split(rest, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			return signed{}, false
+		}
+		switch k {
+		case "token":
+			s.token = v
+		case "time":
+			s.ts = v
+		case "nonce":
+			s.nonce = v
+		case "signature":
+			s.signature = v
+		}
+	}
+	unix, err := strconv.ParseInt(s.ts, 10, 64)
+	if err != nil || s.token == "" || s.nonce == "" || s.signature == "" {
+		return signed{}, false
+	}
+	s.time = time.Unix(unix, 0)
+	return s, true
+}
+
+// authenticate returns the token req was made with, checking a signature
+// against body and now
+func authenticate(req *http.Request, body []byte, tokens []Token, now time.Time) (Token, signed, error) {
+	header := req.Header.Get("Authorization")
+	if bearer, ok := cutPrefix(header, "Bearer "); ok {
+		// every token is compared, so the time taken doesnt say which matched,
+		// and by digest, so it doesnt say how long the secret is either
+		got := sha256.Sum256([]byte(bearer))
+		var found *Token
+		for i, t := range tokens {
+			want := sha256.Sum256([]byte(t.Secret))
+			if t.Auth == AuthBearer && subtle.ConstantTimeCompare(want[:], got[:]) == 1 {
+				found = &tokens[i]
+			}
+		}
+		if found == nil {
+			return Token{}, signed{}, errUnauthorized
+		}
+		return *found, signed{}, nil
+	}
+
+	s, ok := parseSigned(header)
+	if !ok {
+		return Token{}, signed{}, errUnauthorized
+	}
+	for _, t := range tokens {
+		if t.ID != s.token || t.Auth != AuthHMAC {
+			continue
+		}
+		want := signature(t.Secret, req.Method, req.URL.EscapedPath(), s.ts, s.nonce, body)
+		if !hmac.Equal([]byte(want), []byte(s.signature)) {
+			return Token{}, signed{}, errUnauthorized
+		}
+		if d := now.Sub(s.time); d > MaxSkew || d < -MaxSkew {
+			return Token{}, signed{}, fmt.Errorf("request time is %s off, check the clock", d.Round(time.Second))
+		}
+		return t, s, nil
+	}
+	return Token{}, signed{}, errUnauthorized
+}
+
+// cutPrefix is strings.CutPrefix, which is too new for go 1.18
+func cutPrefix(s, prefix string) (string, bool) {
+	if !strings.HasPrefix(s, prefix) {
+		return s, false
+	}
+	return s[len(prefix):], true
+}
@@ -0,0 +1,122 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Doer sends HTTP requests, as *http.Client does
+type Doer interface {
+	Do(*http.Request) (*http.Response, error)
+}
+
+// APIError is a response from the gateway that isnt a success
+type APIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	if e.Message == "" {
+		return http.StatusText(e.StatusCode)
+	}
+	return e.Message
+}
+
+// Client calls a gateway with a token
+type Client struct {
+	// Endpoint is the gateway's URL, e.g. https://gateway.example.com:8246
+	Endpoint string
+
+	// Token is the token's ID, and Secret and Auth as configured for it on
+	// the gateway
+	Token  string
+	Secret string
+	Auth   string
+
+	Doer Doer
+
+	// Now is the clock requests are signed with. Defaults to time.Now
+	Now func() time.Time
+}
+
+// Lookup returns the address registered for host, or an *APIError with
+// status 404 if there isnt one. The request is cancelled once ctx is done
+func (c *Client) Lookup(ctx context.Context, host string) (string, error) {
+	var h Host
+	if err := c.do(ctx, http.MethodGet, host, nil, &h); err != nil {
+		return "", err
+	}
+	return h.IP, nil
+}
+
+// Register points host at ip, or at the address the gateway sees the
+// request come from if ip is empty. The request is cancelled once ctx is
+// done
+func (c *Client) Register(ctx context.Context, host, ip string) (Host, error) {
+	var h Host
+	err := c.do(ctx, http.MethodPut, host, Host{Hostname: host, IP: ip}, &h)
+	return h, err
+}
+
+// Deregister removes host's registration. The request is cancelled once
+// ctx is done
+func (c *Client) Deregister(ctx context.Context, host string) error {
+	return c.do(ctx, http.MethodDelete, host, nil, nil)
+}
+
+func (c *Client) do(ctx context.Context, method, host string, in, out interface{}) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+	u := strings.TrimSuffix(c.Endpoint, "/") + Prefix + url.PathEscape(host)
+	req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.Auth == AuthBearer {
+		req.Header.Set("Authorization", "Bearer "+c.Secret)
+	} else {
+		now := time.Now()
+		if c.Now != nil {
+			now = c.Now()
+		}
+		Sign(req, c.Token, c.Secret, body, now)
+	}
+
+	res, err := c.Doer.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	raw, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		var e Error
+		json.Unmarshal(raw, &e)
+		return &APIError{StatusCode: res.StatusCode, Message: e.Error}
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(raw, out); err != nil {
+		return fmt.Errorf("bad response from gateway: %w", err)
+	}
+	return nil
+}
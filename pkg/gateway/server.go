@@ -0,0 +1,393 @@
+// Package gateway is a small JSON API hosts register their own address with,
+// so a gateway holding the only NS1 key can publish records for many hosts.
+// Each host has a token, scoped to hostname patterns and rate limited, and
+// every request is written to an audit log. Over mutual TLS, the client
+// certificate must name the host too. Client calls the API, for hosts
+// running as agents of a gateway
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/m1k8/DNSUpdate/pkg/clock"
+)
+
+// Prefix is the path each host's record is at, followed by its hostname
+const Prefix = "/v1/hosts/"
+
+// maxBody bounds a request body
+const maxBody = 4096
+
+var (
+	// ErrNotFound is returned by a Backend for a host with no record, or
+	// none registered by the token
+	ErrNotFound = errors.New("not registered")
+
+	// ErrConflict is returned by a Backend for a record the token may not
+	// change, as another token or somebody else owns it
+	ErrConflict = errors.New("record is owned by someone else")
+
+	// ErrRejected is returned by a Backend for an address that may not be
+	// published
+	ErrRejected = errors.New("address rejected")
+)
+
+// Token is what one host authenticates with, and may do
+type Token struct {
+	ID string
+
+	// Secret signs requests, or is sent as is, depending on Auth
+	Secret string
+	Auth   string
+
+	// Hosts are the hostname patterns the token may register. Each label
+	// of a pattern is matched as by path.Match, so *.hosts.example.com
+	// matches web-1.hosts.example.com but not a.b.hosts.example.com
+	Hosts []string
+
+	// Requests are allowed each Per, in bursts of up to Requests
+	Requests int
+	Per      time.Duration
+}
+
+// Allows reports whether the token may register host
+func (t Token) Allows(host string) bool {
+	for _, p := range t.Hosts {
+		if Match(p, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// CertAllows reports whether a client certificate may register host, as
+// one of its DNS SANs is host or a pattern matching it
+func CertAllows(cert *x509.Certificate, host string) bool {
+	for _, name := range cert.DNSNames {
+		if Match(name, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// validHostname reports whether host is a plain hostname: dot separated
+// labels of letters, digits and hyphens, not starting or ending with a
+// hyphen, with an optional trailing dot. Glob characters are never allowed,
+// so a host cant be a pattern itself
+func validHostname(host string) bool {
+	host = strings.TrimSuffix(host, ".")
+	if host == "" || len(host) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(host, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Match reports whether host matches pattern, label by label, ignoring case
+// and any trailing dot
+func Match(pattern, host string) bool {
+	ps := strings.Split(strings.ToLower(strings.TrimSuffix(pattern, ".")), ".")
+	hs := strings.Split(strings.ToLower(strings.TrimSuffix(host, ".")), ".")
+	if len(ps) != len(hs) {
+		return false
+	}
+	for i := range ps {
+		if ok, err := path.Match(ps[i], hs[i]); !ok || err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Backend looks up and changes records for the gateway. Errors wrapping
+// ErrNotFound, ErrConflict or ErrRejected are answered as such, and any
+// other as a bad gateway
+type Backend interface {
+	// Tokens returns every token, as currently configured
+	Tokens() []Token
+
+	// Lookup returns the address t registered for host
+	Lookup(ctx context.Context, t Token, host string) (string, error)
+
+	// Register points host at ip for t, reporting whether it changed
+	Register(ctx context.Context, t Token, host, ip string) (bool, error)
+
+	// Deregister removes what t registered for host
+	Deregister(ctx context.Context, t Token, host string) error
+}
+
+// Host is a host's registration, as sent and returned by the API
+type Host struct {
+	Hostname string `json:"hostname"`
+
+	// IP defaults to the address the request came from
+	IP string `json:"ip,omitempty"`
+
+	Changed bool `json:"changed,omitempty"`
+}
+
+// Error is the body of every response that isnt a success
+type Error struct {
+	Error string `json:"error"`
+}
+
+// Entry is one line of the audit log
+type Entry struct {
+	Time     time.Time `json:"time"`
+	Token    string    `json:"token,omitempty"`
+	Cert     string    `json:"cert,omitempty"`
+	Remote   string    `json:"remote"`
+	Method   string    `json:"method"`
+	Hostname string    `json:"hostname,omitempty"`
+	IP       string    `json:"ip,omitempty"`
+	Status   int       `json:"status"`
+	Changed  bool      `json:"changed,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// Server answers the API with a Backend
+type Server struct {
+	backend Backend
+	clock   clock.Clock
+
+	auditMu sync.Mutex
+	audit   io.Writer
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	// seen is each signature used, until it is too old to be accepted
+	// anyway, so a signed request cant be replayed
+	seen map[string]time.Time
+}
+
+// NewServer returns a Server writing its audit log, as JSON lines, to audit
+func NewServer(b Backend, audit io.Writer, c clock.Clock) *Server {
+	return &Server{
+		backend: b,
+		clock:   c,
+		audit:   audit,
+		buckets: map[string]*bucket{},
+		seen:    map[string]time.Time{},
+	}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e := Entry{Time: s.clock.Now(), Remote: remoteIP(r), Method: r.Method}
+	var cert *x509.Certificate
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		cert = r.TLS.PeerCertificates[0]
+		e.Cert = fmt.Sprintf("%x", cert.SerialNumber)
+	}
+	defer func() {
+		s.write(e)
+	}()
+	reply := func(status int, v interface{}) {
+		e.Status = status
+		if err, ok := v.(error); ok {
+			e.Error = err.Error()
+			v = Error{Error: err.Error()}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(v)
+	}
+
+	host, ok := cutPrefix(r.URL.Path, Prefix)
+	if !ok || host == "" || strings.Contains(host, "/") {
+		reply(http.StatusNotFound, errors.New("no such endpoint"))
+		return
+	}
+	e.Hostname = host
+	// checked before any pattern, which would otherwise match a host such
+	// as *.hosts.example.com label for label
+	if !validHostname(host) {
+		reply(http.StatusBadRequest, errors.New("hostname may only have letters, digits and hyphens"))
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBody+1))
+	if err != nil || len(body) > maxBody {
+		reply(http.StatusBadRequest, errors.New("body too large or unreadable"))
+		return
+	}
+
+	t, sig, err := authenticate(r, body, s.backend.Tokens(), s.clock.Now())
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="dnsupdate"`)
+		reply(http.StatusUnauthorized, err)
+		return
+	}
+	e.Token = t.ID
+	if sig.signature != "" && !s.fresh(sig) {
+		reply(http.StatusUnauthorized, errors.New("request replayed"))
+		return
+	}
+	if wait, ok := s.allow(t); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds()+1)))
+		reply(http.StatusTooManyRequests, errors.New("rate limit exceeded"))
+		return
+	}
+	if !t.Allows(host) {
+		reply(http.StatusForbidden, errors.New("token may not register "+host))
+		return
+	}
+	if cert != nil && !CertAllows(cert, host) {
+		reply(http.StatusForbidden, errors.New("certificate is not for "+host))
+		return
+	}
+
+	ctx := r.Context()
+	switch r.Method {
+	case http.MethodGet:
+		ip, err := s.backend.Lookup(ctx, t, host)
+		if err != nil {
+			reply(status(err), err)
+			return
+		}
+		e.IP = ip
+		reply(http.StatusOK, Host{Hostname: host, IP: ip})
+
+	case http.MethodPut:
+		var h Host
+		if len(bytes.TrimSpace(body)) > 0 {
+			if err := json.Unmarshal(body, &h); err != nil {
+				reply(http.StatusBadRequest, err)
+				return
+			}
+		}
+		if h.IP == "" {
+			h.IP = e.Remote
+		}
+		e.IP = h.IP
+		if ip := net.ParseIP(h.IP); ip == nil || ip.To4() == nil {
+			reply(http.StatusUnprocessableEntity, errors.New("ip must be an IPv4 address"))
+			return
+		}
+		changed, err := s.backend.Register(ctx, t, host, h.IP)
+		if err != nil {
+			reply(status(err), err)
+			return
+		}
+		e.Changed = changed
+		reply(http.StatusOK, Host{Hostname: host, IP: h.IP, Changed: changed})
+
+	case http.MethodDelete:
+		if err := s.backend.Deregister(ctx, t, host); err != nil {
+			reply(status(err), err)
+			return
+		}
+		e.Changed = true
+		reply(http.StatusOK, Host{Hostname: host, Changed: true})
+
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		reply(http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
+
+func status(err error) int {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrConflict):
+		return http.StatusConflict
+	case errors.Is(err, ErrRejected):
+		return http.StatusUnprocessableEntity
+	}
+	return http.StatusBadGateway
+}
+
+// write adds e to the audit log. Failing to is logged, but doesnt fail the
+// request, which has already been answered
+func (s *Server) write(e Entry) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	s.auditMu.Lock()
+	defer s.auditMu.Unlock()
+	if _, err := s.audit.Write(append(b, '\n')); err != nil {
+		log.Println("Error writing gateway audit log - " + err.Error())
+	}
+}
+
+// fresh reports whether a signature hasnt been seen before, remembering it
+func (s *Server) fresh(sig signed) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.clock.Now()
+	for k, expires := range s.seen {
+		if now.After(expires) {
+			delete(s.seen, k)
+		}
+	}
+	if _, ok := s.seen[sig.signature]; ok {
+		return false
+	}
+	s.seen[sig.signature] = sig.time.Add(MaxSkew)
+	return true
+}
+
+// bucket is a token bucket, refilled continuously
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// allow takes a request from t's bucket, or says how long until it can
+func (s *Server) allow(t Token) (time.Duration, bool) {
+	if t.Requests <= 0 || t.Per <= 0 {
+		return 0, true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.clock.Now()
+	b := s.buckets[t.ID]
+	if b == nil {
+		b = &bucket{tokens: float64(t.Requests), last: now}
+		s.buckets[t.ID] = b
+	}
+	rate := float64(t.Requests) / t.Per.Seconds()
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > float64(t.Requests) {
+		b.tokens = float64(t.Requests)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / rate * float64(time.Second)), false
+	}
+	b.tokens--
+	return 0, true
+}
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
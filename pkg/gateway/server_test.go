@@ -0,0 +1,72 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/m1k8/DNSUpdate/pkg/clock"
+)
+
+// backend registers every host it is asked to
+type backend struct {
+	tokens     []Token
+	registered []string
+}
+
+func (b *backend) Tokens() []Token { return b.tokens }
+
+func (b *backend) Lookup(ctx context.Context, t Token, host string) (string, error) {
+	return "", ErrNotFound
+}
+
+func (b *backend) Register(ctx context.Context, t Token, host, ip string) (bool, error) {
+	b.registered = append(b.registered, host)
+	return true, nil
+}
+
+func (b *backend) Deregister(ctx context.Context, t Token, host string) error {
+	return nil
+}
+
+func TestServeHostnames(t *testing.T) {
+	tests := []struct {
+		host   string
+		status int
+	}{
+		{host: "web-1.hosts.example.com", status: http.StatusOK},
+		{host: "WEB-1.hosts.example.com.", status: http.StatusOK},
+		{host: "a.b.hosts.example.com", status: http.StatusForbidden},
+		{host: "web-1.example.com", status: http.StatusForbidden},
+		// a pattern of its own would be published as a wildcard record
+		{host: "*.hosts.example.com", status: http.StatusBadRequest},
+		{host: "web-?.hosts.example.com", status: http.StatusBadRequest},
+		{host: "[a-z]eb.hosts.example.com", status: http.StatusBadRequest},
+		{host: "-web.hosts.example.com", status: http.StatusBadRequest},
+		{host: "web..hosts.example.com", status: http.StatusBadRequest},
+		{host: "web_1.hosts.example.com", status: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			b := &backend{tokens: []Token{{ID: "ci", Secret: "0123456789abcdef", Auth: AuthBearer, Hosts: []string{"*.hosts.example.com"}}}}
+			var audit bytes.Buffer
+			s := NewServer(b, &audit, clock.NewFake(time.Now()))
+
+			req := httptest.NewRequest(http.MethodPut, Prefix+url.PathEscape(tt.host), bytes.NewBufferString(`{"ip": "8.8.4.7"}`))
+			req.Header.Set("Authorization", "Bearer 0123456789abcdef")
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, req)
+
+			if w.Code != tt.status {
+				t.Errorf("got status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if registered := len(b.registered) > 0; registered != (tt.status == http.StatusOK) {
+				t.Errorf("registered %v", b.registered)
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package ippolicy
+
+import (
+	"bufio"
+	"fmt"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Table maps prefixes to the AS announcing them, for longest prefix lookups
+type Table struct {
+	// by prefix length, then masked prefix
+	byLen map[int]map[netip.Prefix]uint32
+}
+
+// LoadTable reads a prefix file. Each line is a prefix and an AS number,
+// either "203.0.113.0/24 64500" or, as in CAIDA's pfx2as files,
+// "203.0.113.0 24 64500". Blank lines and lines starting with # are skipped.
+// An AS set such as "64500_64501" counts as its first AS
+func LoadTable(path string) (*Table, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	t := &Table{byLen: map[int]map[netip.Prefix]uint32{}}
+	sc := bufio.NewScanner(f)
+	line := 0
+	for sc.Scan() {
+		line++
+		text := strings.TrimSpace(sc.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		var prefix, asField string
+		switch len(fields) {
+		case 2:
+			prefix, asField = fields[0], fields[1]
+		case 3:
+			prefix, asField = fields[0]+"/"+fields[1], fields[2]
+		default:
+			return nil, fmt.Errorf("%s:%d: want a prefix and an AS number", path, line)
+		}
+
+		p, err := netip.ParsePrefix(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		asField = strings.TrimPrefix(strings.ToUpper(asField), "AS")
+		set := strings.FieldsFunc(asField, func(r rune) bool { return r == '_' || r == ',' })
+		if len(set) == 0 {
+			return nil, fmt.Errorf("%s:%d: no AS number", path, line)
+		}
+		asn, err := strconv.ParseUint(set[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: bad AS number: %w", path, line, err)
+		}
+
+		p = p.Masked()
+		if t.byLen[p.Bits()] == nil {
+			t.byLen[p.Bits()] = map[netip.Prefix]uint32{}
+		}
+		t.byLen[p.Bits()][p] = uint32(asn)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Lookup returns the AS announcing the most specific prefix containing a
+func (t *Table) Lookup(a netip.Addr) (uint32, bool) {
+	for bits := a.BitLen(); bits >= 0; bits-- {
+		m := t.byLen[bits]
+		if m == nil {
+			continue
+		}
+		p, err := a.Prefix(bits)
+		if err != nil {
+			continue
+		}
+		if asn, ok := m[p]; ok {
+			return asn, true
+		}
+	}
+	return 0, false
+}
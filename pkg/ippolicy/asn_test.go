@@ -0,0 +1,51 @@
+package ippolicy
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadTable(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		lookup  string
+		asn     uint32
+		wantErr string
+	}{
+		{name: "prefix", file: "203.0.113.0/24 64500\n", lookup: "203.0.113.9", asn: 64500},
+		{name: "pfx2as", file: "# comment\n\n203.0.113.0 24 64500\n", lookup: "203.0.113.9", asn: 64500},
+		{name: "as set", file: "203.0.113.0/24 64500_64501\n", lookup: "203.0.113.9", asn: 64500},
+		{name: "longest prefix", file: "203.0.0.0/16 64500\n203.0.113.0/24 AS64501\n", lookup: "203.0.113.9", asn: 64501},
+		{name: "bare AS", file: "203.0.113.0/24 64500\n203.0.114.0/24 AS\n", wantErr: ":2: no AS number"},
+		{name: "only separators", file: "203.0.113.0/24 _,\n", wantErr: ":1: no AS number"},
+		{name: "bad AS", file: "203.0.113.0/24 ASx\n", wantErr: ":1: bad AS number"},
+		{name: "bad prefix", file: "203.0.113/24 64500\n", wantErr: ":1: "},
+		{name: "missing AS", file: "203.0.113.0/24\n", wantErr: ":1: want a prefix and an AS number"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "pfx2as")
+			if err := os.WriteFile(path, []byte(tt.file), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			table, err := LoadTable(path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), path+tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, path+tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			asn, ok := table.Lookup(netip.MustParseAddr(tt.lookup))
+			if !ok || asn != tt.asn {
+				t.Errorf("Lookup(%s) = %d, %v, want %d", tt.lookup, asn, ok, tt.asn)
+			}
+		})
+	}
+}
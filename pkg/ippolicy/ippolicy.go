@@ -0,0 +1,156 @@
+package ippolicy
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/m1k8/DNSUpdate/pkg/config"
+)
+
+// bogons are ranges that should never be published as a public address:
+// private, shared (CGNAT), loopback, link local, documentation, benchmarking,
+// multicast and reserved space
+var bogons = mustPrefixes(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.0.2.0/24",
+	"192.88.99.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"198.51.100.0/24",
+	"203.0.113.0/24",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+)
+
+func mustPrefixes(list ...string) []netip.Prefix {
+	prefixes, err := ParsePrefixes(list)
+	if err != nil {
+		panic(err)
+	}
+	return prefixes
+}
+
+// Violation is an address the policy wont allow to be published
+type Violation struct {
+	IP     string
+	Reason string
+}
+
+func (v *Violation) Error() string {
+	return fmt.Sprintf("policy blocks %q: %s", v.IP, v.Reason)
+}
+
+// Policy decides whether a detected address may be published
+type Policy struct {
+	allow       []netip.Prefix
+	deny        []netip.Prefix
+	allowBogons bool
+	asns        map[uint32]bool
+	table       *Table
+}
+
+// New builds a policy from cfg. A nil cfg only rejects bogons
+func New(cfg *config.IPPolicy) (*Policy, error) {
+	p := &Policy{}
+	if cfg == nil {
+		return p, nil
+	}
+
+	var err error
+	if p.allow, err = ParsePrefixes(cfg.Allow); err != nil {
+		return nil, fmt.Errorf("policy allow: %w", err)
+	}
+	if p.deny, err = ParsePrefixes(cfg.Deny); err != nil {
+		return nil, fmt.Errorf("policy deny: %w", err)
+	}
+	p.allowBogons = cfg.AllowBogons
+
+	if len(cfg.ExpectedASNs) > 0 {
+		if cfg.ASNFile == "" {
+			return nil, fmt.Errorf("policy expected_asns needs an asn_file")
+		}
+		if p.table, err = LoadTable(cfg.ASNFile); err != nil {
+			return nil, fmt.Errorf("policy asn_file: %w", err)
+		}
+		p.asns = map[uint32]bool{}
+		for _, asn := range cfg.ExpectedASNs {
+			p.asns[asn] = true
+		}
+	}
+	return p, nil
+}
+
+// Check returns a *Violation if ip must not be published. Only well formed
+// IPv4 addresses can be, as they go in an A record
+func (p *Policy) Check(ip string) error {
+	a, err := netip.ParseAddr(ip)
+	if err != nil {
+		return &Violation{IP: ip, Reason: "not an IP address"}
+	}
+	a = a.Unmap()
+	if !a.Is4() {
+		return &Violation{IP: ip, Reason: "not an IPv4 address"}
+	}
+
+	if Contains(p.deny, a) {
+		return &Violation{IP: ip, Reason: "in a denied range"}
+	}
+	allowed := Contains(p.allow, a)
+	if len(p.allow) > 0 && !allowed {
+		return &Violation{IP: ip, Reason: "not in an allowed range"}
+	}
+	// listing a bogon range under allow, e.g. for a lab, allows it
+	if !p.allowBogons && !allowed && Contains(bogons, a) {
+		return &Violation{IP: ip, Reason: "a private, reserved or CGNAT address"}
+	}
+
+	if p.asns != nil {
+		asn, ok := p.table.Lookup(a)
+		if !ok {
+			return &Violation{IP: ip, Reason: "not in the ASN prefix file"}
+		}
+		if !p.asns[asn] {
+			return &Violation{IP: ip, Reason: fmt.Sprintf("announced by AS%d, which isnt expected", asn)}
+		}
+	}
+	return nil
+}
+
+// ParsePrefixes reads addresses and CIDR prefixes, an address standing for
+// itself alone
+func ParsePrefixes(list []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(list))
+	for _, s := range list {
+		if strings.Contains(s, "/") {
+			p, err := netip.ParsePrefix(s)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, p.Masked())
+			continue
+		}
+		a, err := netip.ParseAddr(s)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(a, a.BitLen()))
+	}
+	return prefixes, nil
+}
+
+// Contains reports whether any of prefixes contains a
+func Contains(prefixes []netip.Prefix, a netip.Addr) bool {
+	for _, p := range prefixes {
+		if p.Contains(a) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,232 @@
+package lease
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/m1k8/DNSUpdate/pkg/clock"
+	"github.com/m1k8/DNSUpdate/pkg/dnsapi"
+	api "gopkg.in/ns1/ns1-go.v2/rest"
+	"gopkg.in/ns1/ns1-go.v2/rest/model/dns"
+)
+
+// RecordPrefix is prepended to a hostname to name the TXT record holding its
+// lease
+const RecordPrefix = "_dnsupdate-lease."
+
+// after writing the lease we wait this long and read it back, since NS1 has
+// no compare-and-swap and another host may have written at the same time
+const confirmDelay = 2 * time.Second
+
+// Lease elects one of several hosts to update a hostname. The holder's ID and
+// the lease expiry are kept in a TXT record next to the hostname; the holder
+// renews it well before it expires, and a standby takes over once it has
+// expired
+type Lease struct {
+	records  dnsapi.Records
+	zone     string
+	domain   string
+	owner    string
+	duration time.Duration
+	clock    clock.Clock
+	acquired chan struct{}
+
+	mu      sync.Mutex
+	holder  string
+	expires time.Time
+}
+
+// New returns a lease on domain in zone for owner, timed by c. Run must be
+// called to take part in the election
+func New(records dnsapi.Records, zone, domain, owner string, duration time.Duration, c clock.Clock) *Lease {
+	return &Lease{
+		records:  records,
+		zone:     zone,
+		domain:   domain,
+		owner:    owner,
+		duration: duration,
+		clock:    c,
+		acquired: make(chan struct{}, 1),
+	}
+}
+
+// Run tries to take or renew the lease every third of its duration, until
+// quit is closed
+func (l *Lease) Run(quit <-chan struct{}) {
+	ticker := l.clock.NewTicker(l.duration / 3)
+	defer ticker.Stop()
+	for {
+		l.renew(quit)
+		select {
+		case <-ticker.C():
+		case <-quit:
+			return
+		}
+	}
+}
+
+// Held reports whether we hold the lease and it has not expired
+func (l *Lease) Held() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.holder == l.owner && l.clock.Now().Before(l.expires)
+}
+
+// Holder returns the last known holder of the lease and when it expires
+func (l *Lease) Holder() (string, time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.holder, l.expires
+}
+
+// Acquired is signalled each time we take over the lease
+func (l *Lease) Acquired() <-chan struct{} {
+	return l.acquired
+}
+
+// Release deletes the lease record if we hold it, so a standby can take over
+// without waiting for it to expire
+func (l *Lease) Release() {
+	if !l.Held() {
+		return
+	}
+	if _, err := l.records.Delete(l.zone, l.recordName(), "TXT"); err != nil && err != api.ErrRecordMissing {
+		log.Printf("%s: error releasing lease - %s\n", l.domain, err.Error())
+		return
+	}
+	l.set("", time.Time{})
+}
+
+func (l *Lease) recordName() string {
+	name := RecordPrefix + l.domain
+	if !strings.HasSuffix(strings.ToLower(name), "."+strings.ToLower(l.zone)) {
+		name += "." + l.zone
+	}
+	return name
+}
+
+// renew takes or renews the lease, giving up on confirming it if quit is
+// closed
+func (l *Lease) renew(quit <-chan struct{}) {
+	wasHeld := l.Held()
+
+	holder, expires, exists, err := l.read()
+	if err != nil {
+		log.Printf("%s: error reading lease - %s\n", l.domain, err.Error())
+		return
+	}
+
+	now := l.clock.Now()
+	if exists && holder != l.owner && now.Before(expires) {
+		if wasHeld {
+			log.Printf("%s: lost lease to %s\n", l.domain, holder)
+		}
+		l.set(holder, expires)
+		return
+	}
+
+	expires = now.Add(l.duration)
+	if err := l.write(expires, exists); err != nil {
+		log.Printf("%s: error writing lease - %s\n", l.domain, err.Error())
+		return
+	}
+
+	if holder != l.owner {
+		// someone else may have taken an expired lease at the same time
+		timer := l.clock.NewTimer(confirmDelay)
+		select {
+		case <-timer.C():
+		case <-quit:
+			timer.Stop()
+			return
+		}
+		holder, expires, _, err = l.read()
+		if err != nil {
+			log.Printf("%s: error confirming lease - %s\n", l.domain, err.Error())
+			return
+		}
+	}
+	l.set(holder, expires)
+
+	if holder == l.owner && !wasHeld {
+		log.Printf("%s: acquired lease until %s\n", l.domain, expires.Format(time.RFC3339))
+		select {
+		case l.acquired <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (l *Lease) set(holder string, expires time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.holder = holder
+	l.expires = expires
+}
+
+func (l *Lease) read() (holder string, expires time.Time, exists bool, err error) {
+	rec, _, err := l.records.Get(l.zone, l.recordName(), "TXT")
+	if err == api.ErrRecordMissing {
+		return "", time.Time{}, false, nil
+	}
+	if err != nil {
+		return "", time.Time{}, false, err
+	}
+	if len(rec.Answers) == 0 || len(rec.Answers[0].Rdata) == 0 {
+		return "", time.Time{}, true, nil
+	}
+
+	holder, expires, err = parse(rec.Answers[0].Rdata[0])
+	// a lease we cant read is treated as expired, so it gets overwritten
+	if err != nil {
+		log.Printf("%s: ignoring bad lease - %s\n", l.domain, err.Error())
+		return "", time.Time{}, true, nil
+	}
+	return holder, expires, true, nil
+}
+
+func (l *Lease) write(expires time.Time, exists bool) error {
+	rec := dns.NewRecord(l.zone, l.recordName(), "TXT")
+	rec.TTL = 60
+	rec.AddAnswer(dns.NewTXTAnswer(format(l.owner, expires)))
+
+	if exists {
+		_, err := l.records.Update(rec)
+		return err
+	}
+	_, err := l.records.Create(rec)
+	return err
+}
+
+func format(owner string, expires time.Time) string {
+	return fmt.Sprintf("owner=%s expires=%s", owner, expires.UTC().Format(time.RFC3339))
+}
+
+func parse(txt string) (string, time.Time, error) {
+	var owner string
+	var expires time.Time
+	for _, field := range strings.Fields(txt) {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "owner":
+			owner = kv[1]
+		case "expires":
+			t, err := time.Parse(time.RFC3339, kv[1])
+			if err != nil {
+				return "", time.Time{}, err
+			}
+			expires = t
+		}
+	}
+	if owner == "" || expires.IsZero() {
+		return "", time.Time{}, errors.New("missing owner or expires in '" + txt + "'")
+	}
+	return owner, expires, nil
+}
@@ -0,0 +1,130 @@
+package lease
+
+import (
+	"testing"
+	"time"
+
+	"github.com/m1k8/DNSUpdate/pkg/clock"
+	"github.com/m1k8/DNSUpdate/pkg/dnsapi"
+	"github.com/m1k8/DNSUpdate/pkg/ns1fake"
+)
+
+const (
+	zone     = "example.com"
+	domain   = "home.example.com"
+	duration = time.Minute
+)
+
+// renewNow runs one renewal, moving c on past the confirm delay until it
+// is done
+func renewNow(t *testing.T, l *Lease, c *clock.Fake) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		l.renew(nil)
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(5 * time.Millisecond):
+			c.Advance(confirmDelay)
+		}
+	}
+}
+
+func newLeases(t *testing.T) (*ns1fake.Server, *clock.Fake, *Lease, *Lease) {
+	t.Helper()
+	f := ns1fake.New()
+	t.Cleanup(f.Close)
+	f.AddZone(zone)
+	c := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	records := dnsapi.FromREST(f.Client()).Records
+	return f, c, New(records, zone, domain, "a", duration, c), New(records, zone, domain, "b", duration, c)
+}
+
+func TestElection(t *testing.T) {
+	_, c, a, b := newLeases(t)
+
+	renewNow(t, a, c)
+	if !a.Held() {
+		t.Fatal("a should hold a free lease")
+	}
+	select {
+	case <-a.Acquired():
+	default:
+		t.Error("a should signal it acquired the lease")
+	}
+
+	renewNow(t, b, c)
+	if b.Held() {
+		t.Fatal("b should stand by while a holds the lease")
+	}
+	if holder, _ := b.Holder(); holder != "a" {
+		t.Errorf("b sees holder %q, want a", holder)
+	}
+
+	// a stops renewing, so b takes over once the lease expires
+	c.Advance(duration)
+	if a.Held() {
+		t.Error("a should not hold an expired lease")
+	}
+	renewNow(t, b, c)
+	if !b.Held() {
+		t.Fatal("b should take over an expired lease")
+	}
+
+	renewNow(t, a, c)
+	if a.Held() {
+		t.Error("a should stand by once b has taken over")
+	}
+}
+
+func TestRenewKeepsLease(t *testing.T) {
+	f, c, a, b := newLeases(t)
+
+	renewNow(t, a, c)
+	for i := 0; i < 5; i++ {
+		c.Advance(duration / 3)
+		renewNow(t, a, c)
+		renewNow(t, b, c)
+		if !a.Held() || b.Held() {
+			t.Fatalf("renewal %d: a held %v, b held %v; want a only", i, a.Held(), b.Held())
+		}
+	}
+
+	a.Release()
+	if f.Record(zone, RecordPrefix+domain, "TXT") != nil {
+		t.Error("release should delete the lease record")
+	}
+	renewNow(t, b, c)
+	if !b.Held() {
+		t.Error("b should take a released lease")
+	}
+}
+
+func TestParse(t *testing.T) {
+	expires := time.Date(2024, 1, 1, 0, 1, 0, 0, time.UTC)
+	tests := []struct {
+		txt     string
+		owner   string
+		wantErr bool
+	}{
+		{txt: format("a", expires), owner: "a"},
+		{txt: "expires=2024-01-01T00:01:00Z owner=a extra", owner: "a"},
+		{txt: "owner=a", wantErr: true},
+		{txt: "owner=a expires=soon", wantErr: true},
+		{txt: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		owner, got, err := parse(tt.txt)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parse(%q) error = %v, want error %v", tt.txt, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && (owner != tt.owner || !got.Equal(expires)) {
+			t.Errorf("parse(%q) = %s, %s", tt.txt, owner, got)
+		}
+	}
+}
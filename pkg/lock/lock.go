@@ -0,0 +1,53 @@
+package lock
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ErrLocked is returned by Acquire when another process holds the lock
+var ErrLocked = errors.New("already locked by another process")
+
+// Lock is an exclusive lock on a file, held until Release or the process
+// exits
+type Lock struct {
+	f *os.File
+}
+
+// Acquire takes the lock at path without waiting. The file holds the PID of
+// the process holding it, which is included in the error if it is taken
+func Acquire(path string) (*Lock, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := lockFile(f); err != nil {
+		buf := make([]byte, 32)
+		n, _ := f.Read(buf)
+		f.Close()
+		if errors.Is(err, ErrLocked) {
+			if pid := strings.TrimSpace(string(buf[:n])); pid != "" {
+				return nil, fmt.Errorf("%s: %w (pid %s)", path, ErrLocked, pid)
+			}
+			return nil, fmt.Errorf("%s: %w", path, ErrLocked)
+		}
+		return nil, err
+	}
+
+	if err := f.Truncate(0); err == nil {
+		fmt.Fprintf(f, "%d\n", os.Getpid())
+	}
+	return &Lock{f: f}, nil
+}
+
+// Release gives up the lock. The file is left in place, as removing it would
+// let a process that opened it just before stop holding a lock on a file
+// nobody else can see
+func (l *Lock) Release() error {
+	l.f.Truncate(0)
+	unlockFile(l.f)
+	return l.f.Close()
+}
@@ -0,0 +1,129 @@
+package monitoring
+
+import (
+	"fmt"
+
+	"github.com/m1k8/DNSUpdate/pkg/dnsapi"
+	"gopkg.in/ns1/ns1-go.v2/rest/model/data"
+	"gopkg.in/ns1/ns1-go.v2/rest/model/monitor"
+)
+
+// SourceType is the type of data source NS1 feeds its monitoring jobs'
+// results into
+const SourceType = "nsone_monitoring"
+
+// SourceName is the name given to the data source, if the account doesnt
+// have one
+const SourceName = "dnsupdate monitoring"
+
+// Feeds links jobs to answers, through a feed for each job in the account's
+// monitoring data source. An answer's "up" meta pointing at the feed is up
+// while the job is
+type Feeds struct {
+	sources dnsapi.DataSources
+	feeds   dnsapi.DataFeeds
+
+	// source is the ID of the data source, once found or created
+	source string
+}
+
+// NewFeeds returns the feeds of an account
+func NewFeeds(sources dnsapi.DataSources, feeds dnsapi.DataFeeds) *Feeds {
+	return &Feeds{sources: sources, feeds: feeds}
+}
+
+// Link returns the feed of job j, creating it and the data source if
+// needed
+func (f *Feeds) Link(j *monitor.Job) (*data.FeedPtr, error) {
+	if err := f.findSource(true); err != nil {
+		return nil, err
+	}
+	feed, err := f.find(j.ID)
+	if err != nil {
+		return nil, err
+	}
+	if feed == nil {
+		feed = data.NewFeed(j.Name, data.Config{"jobid": j.ID})
+		if _, err := f.feeds.Create(f.source, feed); err != nil {
+			return nil, fmt.Errorf("create feed %s: %w", j.Name, err)
+		}
+	}
+	return &data.FeedPtr{FeedID: feed.ID}, nil
+}
+
+// Unlink deletes the feeds of the job with id jobID
+func (f *Feeds) Unlink(jobID string) error {
+	if err := f.findSource(false); err != nil || f.source == "" {
+		return err
+	}
+	list, err := f.list()
+	if err != nil {
+		return err
+	}
+	for _, feed := range list {
+		if feedJob(feed) != jobID {
+			continue
+		}
+		if res, err := f.feeds.Delete(f.source, feed.ID); err != nil && !missing(res, err) {
+			return fmt.Errorf("delete feed %s: %w", feed.Name, err)
+		}
+	}
+	return nil
+}
+
+// findSource looks up the monitoring data source, creating it if create is
+// set and there isnt one
+func (f *Feeds) findSource(create bool) error {
+	if f.source != "" {
+		return nil
+	}
+	list, _, err := f.sources.List()
+	if err != nil {
+		return fmt.Errorf("list data sources: %w", err)
+	}
+	for _, s := range list {
+		if s.Type == SourceType {
+			f.source = s.ID
+			return nil
+		}
+	}
+	if !create {
+		return nil
+	}
+	s := data.NewSource(SourceName, SourceType)
+	if _, err := f.sources.Create(s); err != nil {
+		return fmt.Errorf("create data source: %w", err)
+	}
+	f.source = s.ID
+	return nil
+}
+
+// find returns the feed of the job with id jobID, or nil if there isnt one
+func (f *Feeds) find(jobID string) (*data.Feed, error) {
+	list, err := f.list()
+	if err != nil {
+		return nil, err
+	}
+	for _, feed := range list {
+		if feedJob(feed) == jobID {
+			return feed, nil
+		}
+	}
+	return nil, nil
+}
+
+func (f *Feeds) list() ([]*data.Feed, error) {
+	list, _, err := f.feeds.List(f.source)
+	if err != nil {
+		// the source may have been deleted, so look for it again next time
+		f.source = ""
+		return nil, fmt.Errorf("list feeds: %w", err)
+	}
+	return list, nil
+}
+
+// feedJob returns the ID of the job a feed is of
+func feedJob(feed *data.Feed) string {
+	id, _ := feed.Config["jobid"].(string)
+	return id
+}
@@ -0,0 +1,267 @@
+// Package monitoring keeps an NS1 monitoring job pointed at a target's
+// published address. Jobs are found by name, and carry the owner's mark in
+// their notes, so only jobs the service created are ever changed or deleted
+package monitoring
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/m1k8/DNSUpdate/pkg/dnsapi"
+	"github.com/m1k8/DNSUpdate/pkg/owner"
+	api "gopkg.in/ns1/ns1-go.v2/rest"
+	"gopkg.in/ns1/ns1-go.v2/rest/model/monitor"
+)
+
+// Types of job
+const (
+	TCP  = "tcp"
+	HTTP = "http"
+	PING = "ping"
+)
+
+// NamePrefix is prepended to a hostname to name its job
+const NamePrefix = "dnsupdate "
+
+// Global is the key of a job's overall status, as opposed to a region's
+const Global = "global"
+
+// timeouts for the checks, in milliseconds for tcp and http and seconds
+// for ping
+const (
+	connectTimeout  = 2000
+	responseTimeout = 5000
+	pingTimeout     = 2
+	pingCount       = 4
+	pingInterval    = 0
+)
+
+// Spec is the job wanted for a target
+type Spec struct {
+	Type string
+
+	// Port is connected to by TCP
+	Port int
+
+	// URL is fetched by HTTP, with {ip} replaced by the address
+	URL string
+
+	Regions   []string
+	Frequency time.Duration
+}
+
+// config returns the job's config for a host at ip
+func (s Spec) config(ip string) monitor.Config {
+	switch s.Type {
+	case TCP:
+		return *monitor.NewTCPConfig(ip, s.Port, connectTimeout, responseTimeout, "", false)
+	case HTTP:
+		return *monitor.NewHTTPConfig(strings.ReplaceAll(s.URL, "{ip}", ip), "GET", "dnsupdate", "", connectTimeout)
+	}
+	return *monitor.NewPINGConfig(ip, pingTimeout, pingCount, pingInterval)
+}
+
+// Name returns the name of the job of domain's answer, so hosts sharing a
+// record each have their own. answer is the answer's note, or empty for the
+// default
+func Name(domain, answer string) string {
+	name := NamePrefix + strings.TrimSuffix(domain, ".")
+	if answer != "" {
+		name += " " + answer
+	}
+	return name
+}
+
+// Monitor is the job of one target
+type Monitor struct {
+	jobs   dnsapi.Jobs
+	spec   Spec
+	name   string
+	marker owner.Marker
+
+	// id of the job, once found or created
+	id string
+}
+
+// New returns the monitor for domain's answer, using jobs, with its job
+// marked by m
+func New(jobs dnsapi.Jobs, spec Spec, domain, answer string, m owner.Marker) *Monitor {
+	return &Monitor{jobs: jobs, spec: spec, name: Name(domain, answer), marker: m}
+}
+
+// Ensure creates the job checking ip, or updates it if it checks anything
+// else, and returns it. A job of the same name that isnt marked is left
+// alone, with an error wrapping owner.ErrNotOwned
+func (m *Monitor) Ensure(ip string) (*monitor.Job, error) {
+	j, err := m.find()
+	if err != nil {
+		return nil, err
+	}
+	want := m.job(ip)
+	if j == nil {
+		if _, err := m.jobs.Create(want); err != nil {
+			return nil, fmt.Errorf("create job %s: %w", m.name, err)
+		}
+		m.id = want.ID
+		return want, nil
+	}
+	if same(j, want) {
+		return j, nil
+	}
+	want.ID, want.Status = j.ID, j.Status
+	// settings the service doesnt manage, such as notifications, are kept
+	want.NotifyListID, want.Rules = j.NotifyListID, j.Rules
+	if _, err := m.jobs.Update(want); err != nil {
+		return nil, fmt.Errorf("update job %s: %w", m.name, err)
+	}
+	return want, nil
+}
+
+// find returns the job, or nil if there isnt one
+func (m *Monitor) find() (*monitor.Job, error) {
+	if m.id != "" {
+		j, res, err := m.jobs.Get(m.id)
+		switch {
+		case err == nil && j.Name == m.name:
+			return j, m.owned(j)
+		case err != nil && !missing(res, err):
+			return nil, fmt.Errorf("get job %s: %w", m.name, err)
+		}
+		// deleted or renamed by hand, so look for it again
+		m.id = ""
+	}
+	j, err := Find(m.jobs, m.name)
+	if j != nil {
+		m.id = j.ID
+		err = m.owned(j)
+	}
+	return j, err
+}
+
+func (m *Monitor) owned(j *monitor.Job) error {
+	if !m.marker.OwnsNote(j.Notes) {
+		return fmt.Errorf("job %s: %w", m.name, owner.ErrNotOwned)
+	}
+	return nil
+}
+
+// job returns the job wanted for ip
+func (m *Monitor) job(ip string) *monitor.Job {
+	return &monitor.Job{
+		Name:        m.name,
+		Type:        m.spec.Type,
+		Config:      m.spec.config(ip),
+		Regions:     m.spec.Regions,
+		Frequency:   int(m.spec.Frequency / time.Second),
+		Active:      true,
+		Policy:      "quorum",
+		RegionScope: "fixed",
+		Notes:       m.marker.Note(),
+	}
+}
+
+// same reports whether job j already does what want would
+func same(j, want *monitor.Job) bool {
+	if j.Type != want.Type || j.Frequency != want.Frequency || !j.Active || !sameRegions(j.Regions, want.Regions) {
+		return false
+	}
+	// numbers come back from the API as floats, so compare as text
+	for k, v := range want.Config {
+		if fmt.Sprint(j.Config[k]) != fmt.Sprint(v) {
+			return false
+		}
+	}
+	return true
+}
+
+func sameRegions(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a, b = append([]string(nil), a...), append([]string(nil), b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Find returns the job called name, or nil if there isnt one
+func Find(jobs dnsapi.Jobs, name string) (*monitor.Job, error) {
+	list, _, err := jobs.List()
+	if err != nil {
+		return nil, fmt.Errorf("list jobs: %w", err)
+	}
+	for _, j := range list {
+		if j.Name == name {
+			return j, nil
+		}
+	}
+	return nil, nil
+}
+
+// Delete deletes the job of domain's answer, if there is one and it is
+// marked with m, and with feeds, if not nil, the feeds linking it to answers
+func Delete(jobs dnsapi.Jobs, feeds *Feeds, domain, answer string, m owner.Marker) error {
+	name := Name(domain, answer)
+	j, err := Find(jobs, name)
+	if err != nil || j == nil {
+		return err
+	}
+	if !m.OwnsNote(j.Notes) {
+		return fmt.Errorf("job %s: %w", name, owner.ErrNotOwned)
+	}
+	if feeds != nil {
+		if err := feeds.Unlink(j.ID); err != nil {
+			return err
+		}
+	}
+	if res, err := jobs.Delete(j.ID); err != nil && !missing(res, err) {
+		return fmt.Errorf("delete job %s: %w", name, err)
+	}
+	return nil
+}
+
+// State is a job's overall status, such as "up", "down" or "pending", and
+// since when. Without a global status, the job is up if any region says so
+func State(j *monitor.Job) (string, time.Time) {
+	if s := j.Status[Global]; s != nil {
+		return s.Status, unix(s.Since)
+	}
+	regions := make([]string, 0, len(j.Status))
+	for r := range j.Status {
+		regions = append(regions, r)
+	}
+	sort.Strings(regions)
+	var state string
+	var since time.Time
+	for _, r := range regions {
+		s := j.Status[r]
+		if s != nil && (state == "" || s.Status == "up" && state != "up") {
+			state, since = s.Status, unix(s.Since)
+		}
+	}
+	return state, since
+}
+
+func unix(s int) time.Time {
+	if s == 0 {
+		return time.Time{}
+	}
+	return time.Unix(int64(s), 0)
+}
+
+func missing(res *http.Response, err error) bool {
+	var restErr *api.Error
+	if errors.As(err, &restErr) && restErr.Resp != nil {
+		return restErr.Resp.StatusCode == http.StatusNotFound
+	}
+	return res != nil && res.StatusCode == http.StatusNotFound
+}
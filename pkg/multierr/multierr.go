@@ -0,0 +1,65 @@
+package multierr
+
+import (
+	"errors"
+	"strings"
+)
+
+// Errors is several errors reported together. errors.Is and errors.As match
+// against each of them
+type Errors []error
+
+// Join returns the non-nil errors in errs as one error, or nil if there are
+// none. A single error is returned as is
+func Join(errs ...error) error {
+	var joined Errors
+	for _, err := range errs {
+		if err == nil {
+			continue
+		}
+		if more, ok := err.(Errors); ok {
+			joined = append(joined, more...)
+			continue
+		}
+		joined = append(joined, err)
+	}
+
+	switch len(joined) {
+	case 0:
+		return nil
+	case 1:
+		return joined[0]
+	}
+	return joined
+}
+
+func (e Errors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (e Errors) Is(target error) bool {
+	for _, err := range e {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e Errors) As(target interface{}) bool {
+	for _, err := range e {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// Unwrap returns the errors, for Go versions whose errors package supports it
+func (e Errors) Unwrap() []error {
+	return e
+}
@@ -0,0 +1,208 @@
+package ns1fake
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+
+	"gopkg.in/ns1/ns1-go.v2/rest/model/data"
+)
+
+// Feed returns a copy of a data feed, or nil if it does not exist
+func (s *Server) Feed(sourceID, feedID string) *data.Feed {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, ok := s.feeds[sourceID][feedID]
+	if !ok {
+		return nil
+	}
+	var out data.Feed
+	clone(&out, f)
+	return &out
+}
+
+// Sources returns a copy of every data source, sorted by ID
+func (s *Server) Sources() []*data.Source {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sourceList()
+}
+
+func (s *Server) sourceList() []*data.Source {
+	ids := make([]string, 0, len(s.sources))
+	for id := range s.sources {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	list := make([]*data.Source, 0, len(ids))
+	for _, id := range ids {
+		var src data.Source
+		clone(&src, s.sources[id])
+		src.Feeds = s.feedList(id)
+		list = append(list, &src)
+	}
+	return list
+}
+
+func (s *Server) feedList(sourceID string) []*data.Feed {
+	ids := make([]string, 0, len(s.feeds[sourceID]))
+	for id := range s.feeds[sourceID] {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	list := make([]*data.Feed, 0, len(ids))
+	for _, id := range ids {
+		var f data.Feed
+		clone(&f, s.feeds[sourceID][id])
+		list = append(list, &f)
+	}
+	return list
+}
+
+// serveSources handles data/sources and data/sources/ID
+func (s *Server) serveSources(w http.ResponseWriter, r *http.Request, parts []string) {
+	id := ""
+	if len(parts) > 0 {
+		id = parts[0]
+	}
+
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		writeJSON(w, s.sourceList())
+
+	case id == "" && r.Method == http.MethodPut:
+		var src data.Source
+		if err := json.NewDecoder(r.Body).Decode(&src); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if src.Type == "" {
+			writeError(w, http.StatusBadRequest, "sourcetype is required")
+			return
+		}
+		src.ID = s.newID()
+		src.Status = "ok"
+		src.Feeds = nil
+		s.sources[src.ID] = &src
+		s.feeds[src.ID] = map[string]*data.Feed{}
+		writeJSON(w, &src)
+
+	case id == "":
+		writeError(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+
+	default:
+		src, ok := s.sources[id]
+		if !ok {
+			writeError(w, http.StatusNotFound, "source not found")
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			var out data.Source
+			clone(&out, src)
+			out.Feeds = s.feedList(id)
+			writeJSON(w, &out)
+		case http.MethodPost:
+			body, _ := io.ReadAll(r.Body)
+			if err := merge(src, body); err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			src.ID = id
+			writeJSON(w, src)
+		case http.MethodDelete:
+			delete(s.sources, id)
+			delete(s.feeds, id)
+			writeJSON(w, map[string]string{})
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+		}
+	}
+}
+
+// serveFeeds handles data/feeds/SOURCE and data/feeds/SOURCE/ID
+func (s *Server) serveFeeds(w http.ResponseWriter, r *http.Request, parts []string) {
+	if len(parts) == 0 {
+		writeError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+	sourceID := parts[0]
+	feeds, ok := s.feeds[sourceID]
+	if !ok {
+		writeError(w, http.StatusNotFound, "source not found")
+		return
+	}
+
+	if len(parts) == 1 {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, s.feedList(sourceID))
+		case http.MethodPut:
+			var f data.Feed
+			if err := json.NewDecoder(r.Body).Decode(&f); err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			f.ID = s.newID()
+			feeds[f.ID] = &f
+			writeJSON(w, &f)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+		}
+		return
+	}
+
+	id := parts[1]
+	f, ok := feeds[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "feed not found")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, f)
+	case http.MethodPost:
+		body, _ := io.ReadAll(r.Body)
+		// as in NS1, the data of a feed can only be changed by publishing
+		d := f.Data
+		if err := merge(f, body); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		f.ID, f.Data = id, d
+		writeJSON(w, f)
+	case http.MethodDelete:
+		delete(feeds, id)
+		writeJSON(w, map[string]string{})
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+	}
+}
+
+// servePublish handles feed/SOURCE, which publishes data to the feeds of a
+// source keyed by their "label" config
+func (s *Server) servePublish(w http.ResponseWriter, r *http.Request, parts []string) {
+	if len(parts) != 1 || r.Method != http.MethodPost {
+		writeError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+	feeds, ok := s.feeds[parts[0]]
+	if !ok {
+		writeError(w, http.StatusNotFound, "source not found")
+		return
+	}
+
+	var published map[string]data.Meta
+	if err := json.NewDecoder(r.Body).Decode(&published); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	for _, f := range feeds {
+		label, _ := f.Config["label"].(string)
+		if d, ok := published[label]; ok {
+			f.Data = d
+		}
+	}
+	writeJSON(w, map[string]string{})
+}
@@ -0,0 +1,118 @@
+package ns1fake
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+
+	"gopkg.in/ns1/ns1-go.v2/rest/model/monitor"
+)
+
+// Job returns a copy of a monitoring job, or nil if it does not exist
+func (s *Server) Job(id string) *monitor.Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j, ok := s.jobs[id]
+	if !ok {
+		return nil
+	}
+	var out monitor.Job
+	clone(&out, j)
+	return &out
+}
+
+// Jobs returns a copy of every monitoring job, sorted by ID
+func (s *Server) Jobs() []*monitor.Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.jobList()
+}
+
+// SetJobStatus sets a job's status in region, such as "up" or "down".
+// "global" is the overall status
+func (s *Server) SetJobStatus(id, region, status string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j, ok := s.jobs[id]
+	if !ok {
+		return
+	}
+	if j.Status == nil {
+		j.Status = map[string]*monitor.Status{}
+	}
+	j.Status[region] = &monitor.Status{Since: int(time.Now().Unix()), Status: status}
+}
+
+func (s *Server) jobList() []*monitor.Job {
+	ids := make([]string, 0, len(s.jobs))
+	for id := range s.jobs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	list := make([]*monitor.Job, 0, len(ids))
+	for _, id := range ids {
+		var j monitor.Job
+		clone(&j, s.jobs[id])
+		list = append(list, &j)
+	}
+	return list
+}
+
+// serveJobs handles monitoring/jobs and monitoring/jobs/ID
+func (s *Server) serveJobs(w http.ResponseWriter, r *http.Request, parts []string) {
+	id := ""
+	if len(parts) > 0 {
+		id = parts[0]
+	}
+
+	switch {
+	case r.Method == http.MethodGet && id == "":
+		writeJSON(w, s.jobList())
+
+	case r.Method == http.MethodPut:
+		var j monitor.Job
+		if err := json.NewDecoder(r.Body).Decode(&j); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if j.Type == "" {
+			writeError(w, http.StatusBadRequest, "job_type is required")
+			return
+		}
+		j.ID = s.newID()
+		j.Status = map[string]*monitor.Status{
+			"global": {Since: int(time.Now().Unix()), Status: "pending"},
+		}
+		s.jobs[j.ID] = &j
+		writeJSON(w, &j)
+
+	case id == "":
+		writeError(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+
+	default:
+		j, ok := s.jobs[id]
+		if !ok {
+			writeError(w, http.StatusNotFound, "job not found")
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, j)
+		case http.MethodPost:
+			body, _ := io.ReadAll(r.Body)
+			if err := merge(j, body); err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			j.ID = id
+			writeJSON(w, j)
+		case http.MethodDelete:
+			delete(s.jobs, id)
+			writeJSON(w, map[string]string{})
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+		}
+	}
+}
@@ -0,0 +1,226 @@
+// Package ns1fake is an in-memory fake of the parts of the NS1 REST API this
+// project uses: zones, records, monitoring jobs, data sources and data feeds.
+// Point a client at it with rest.SetEndpoint(s.Endpoint()) to run the
+// service without a network or an NS1 account.
+package ns1fake
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	api "gopkg.in/ns1/ns1-go.v2/rest"
+	"gopkg.in/ns1/ns1-go.v2/rest/model/data"
+	"gopkg.in/ns1/ns1-go.v2/rest/model/dns"
+	"gopkg.in/ns1/ns1-go.v2/rest/model/monitor"
+)
+
+const (
+	// DefaultRateLimit and DefaultRatePeriod are sent in the X-Ratelimit-*
+	// headers unless changed with SetRateLimit
+	DefaultRateLimit  = 100
+	DefaultRatePeriod = time.Second
+)
+
+// Server is a running fake NS1 API
+type Server struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	apiKey  string
+	zones   map[string]*zone
+	jobs    map[string]*monitor.Job
+	sources map[string]*data.Source
+	feeds   map[string]map[string]*data.Feed
+	nextID  int
+	log     []string
+
+	rateLimit   int
+	ratePeriod  time.Duration
+	rateUsed    int
+	rateResetAt time.Time
+}
+
+type zone struct {
+	zone    *dns.Zone
+	records map[string]*dns.Record
+}
+
+// New starts a fake with no zones
+func New() *Server {
+	s := &Server{
+		zones:      map[string]*zone{},
+		jobs:       map[string]*monitor.Job{},
+		sources:    map[string]*data.Source{},
+		feeds:      map[string]map[string]*data.Feed{},
+		rateLimit:  DefaultRateLimit,
+		ratePeriod: DefaultRatePeriod,
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// Endpoint is the base URL to give rest.SetEndpoint
+func (s *Server) Endpoint() string {
+	return s.URL + "/v1/"
+}
+
+// Client returns an NS1 client pointed at the fake
+func (s *Server) Client(options ...func(*api.Client)) *api.Client {
+	options = append([]func(*api.Client){api.SetEndpoint(s.Endpoint())}, options...)
+	return api.NewClient(s.Server.Client(), options...)
+}
+
+// RequireAPIKey makes every request without key fail with 401. By default
+// any key is accepted
+func (s *Server) RequireAPIKey(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.apiKey = key
+}
+
+// SetRateLimit changes the limit sent in the X-Ratelimit-* headers. Once
+// limit requests have been made in a period, further requests get 429
+func (s *Server) SetRateLimit(limit int, period time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rateLimit = limit
+	s.ratePeriod = period
+	s.rateUsed = 0
+	s.rateResetAt = time.Time{}
+}
+
+// Requests returns every request made so far, as "METHOD /path"
+func (s *Server) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.log...)
+}
+
+// ResetRequests clears the request log
+func (s *Server) ResetRequests() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.log = nil
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.log = append(s.log, r.Method+" "+r.URL.Path)
+	if !s.rate(w) {
+		writeError(w, http.StatusTooManyRequests, "rate limit exceeded")
+		return
+	}
+	if s.apiKey != "" && r.Header.Get("X-NSONE-Key") != s.apiKey {
+		writeError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/"), "/")
+	parts := strings.Split(path, "/")
+	switch {
+	case parts[0] == "zones":
+		s.serveZones(w, r, parts[1:])
+	case len(parts) >= 2 && parts[0] == "monitoring" && parts[1] == "jobs":
+		s.serveJobs(w, r, parts[2:])
+	case len(parts) >= 2 && parts[0] == "data" && parts[1] == "sources":
+		s.serveSources(w, r, parts[2:])
+	case len(parts) >= 2 && parts[0] == "data" && parts[1] == "feeds":
+		s.serveFeeds(w, r, parts[2:])
+	case parts[0] == "feed":
+		s.servePublish(w, r, parts[1:])
+	default:
+		writeError(w, http.StatusNotFound, "Not Found")
+	}
+}
+
+// rate sets the X-Ratelimit-* headers and reports whether the request is
+// within the limit
+func (s *Server) rate(w http.ResponseWriter) bool {
+	now := time.Now()
+	if now.After(s.rateResetAt) {
+		s.rateUsed = 0
+		s.rateResetAt = now.Add(s.ratePeriod)
+	}
+	s.rateUsed++
+
+	remaining := s.rateLimit - s.rateUsed
+	if remaining < 0 {
+		remaining = 0
+	}
+	period := int(s.ratePeriod / time.Second)
+	if period < 1 {
+		period = 1
+	}
+	w.Header().Set("X-Ratelimit-Limit", strconv.Itoa(s.rateLimit))
+	w.Header().Set("X-Ratelimit-Remaining", strconv.Itoa(remaining))
+	w.Header().Set("X-Ratelimit-Period", strconv.Itoa(period))
+	return s.rateUsed <= s.rateLimit
+}
+
+func (s *Server) newID() string {
+	s.nextID++
+	return fmt.Sprintf("%024x", s.nextID)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError sends an error body in the form NS1 uses, which the client
+// matches on to return errors such as rest.ErrRecordMissing
+func writeError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"message": message})
+}
+
+// merge applies the fields present in body over current, the way NS1
+// handles POST updates
+func merge(current interface{}, body []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return err
+	}
+
+	buf, err := json.Marshal(current)
+	if err != nil {
+		return err
+	}
+	var merged map[string]json.RawMessage
+	if err := json.Unmarshal(buf, &merged); err != nil {
+		return err
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+
+	buf, err = json.Marshal(merged)
+	if err != nil {
+		return err
+	}
+	// decoding over current would reuse what its pointers and slices hold,
+	// so a replaced answer could keep fields of the one before it
+	fresh := reflect.New(reflect.TypeOf(current).Elem())
+	if err := json.Unmarshal(buf, fresh.Interface()); err != nil {
+		return err
+	}
+	reflect.ValueOf(current).Elem().Set(fresh.Elem())
+	return nil
+}
+
+// clone deep copies v through JSON, so callers never share state with the
+// server
+func clone(dst, src interface{}) {
+	buf, _ := json.Marshal(src)
+	json.Unmarshal(buf, dst)
+}
@@ -0,0 +1,34 @@
+package ns1fake
+
+import (
+	"testing"
+
+	"gopkg.in/ns1/ns1-go.v2/rest/model/dns"
+)
+
+func TestUpdateReplacesAnswers(t *testing.T) {
+	s := New()
+	defer s.Close()
+	s.AddZone("example.com")
+	r := dns.NewRecord("example.com", "home.example.com", "A")
+	home := dns.NewAv4Answer("8.8.4.4")
+	home.Meta.Note = "home"
+	r.AddAnswer(home)
+	r.AddAnswer(dns.NewAv4Answer("8.8.8.8"))
+	s.PutRecord(r)
+
+	// the answer now first has no note, so none should be left over from
+	// the answer that was there before
+	r = s.Record("example.com", "home.example.com", "A")
+	r.Answers = []*dns.Answer{dns.NewAv4Answer("8.8.8.8")}
+	if _, err := s.Client().Records.Update(r); err != nil {
+		t.Fatal(err)
+	}
+	got := s.Record("example.com", "home.example.com", "A")
+	if len(got.Answers) != 1 || got.Answers[0].Rdata[0] != "8.8.8.8" {
+		t.Fatalf("answers are %v, want only 8.8.8.8", got.Answers)
+	}
+	if a := got.Answers[0]; a.Meta != nil && a.Meta.Note != nil {
+		t.Errorf("answer kept the note %v of the one it replaced", a.Meta.Note)
+	}
+}
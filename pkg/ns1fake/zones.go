@@ -0,0 +1,289 @@
+package ns1fake
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"gopkg.in/ns1/ns1-go.v2/rest/model/dns"
+)
+
+// AddZone creates an empty zone
+func (s *Server) AddZone(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.addZone(dns.NewZone(name))
+}
+
+func (s *Server) addZone(z *dns.Zone) {
+	z.ID = s.newID()
+	if z.TTL == 0 {
+		z.TTL = 3600
+	}
+	z.DNSServers = []string{"dns1.p01.nsone.net", "dns2.p01.nsone.net"}
+	s.zones[strings.ToLower(z.Zone)] = &zone{zone: z, records: map[string]*dns.Record{}}
+}
+
+// PutRecord creates or replaces a record, creating its zone if needed
+func (s *Server) PutRecord(r *dns.Record) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	z, ok := s.zones[strings.ToLower(r.Zone)]
+	if !ok {
+		s.addZone(dns.NewZone(r.Zone))
+		z = s.zones[strings.ToLower(r.Zone)]
+	}
+
+	var rec dns.Record
+	clone(&rec, r)
+	rec.Domain = fqdn(rec.Zone, rec.Domain)
+	s.assignIDs(&rec)
+	z.records[recordKey(rec.Domain, rec.Type)] = &rec
+}
+
+// Record returns a copy of a record, or nil if it does not exist
+func (s *Server) Record(zoneName, domain, t string) *dns.Record {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	z, ok := s.zones[strings.ToLower(zoneName)]
+	if !ok {
+		return nil
+	}
+	r, ok := z.records[recordKey(fqdn(zoneName, domain), t)]
+	if !ok {
+		return nil
+	}
+	var rec dns.Record
+	clone(&rec, r)
+	return &rec
+}
+
+// Records returns a copy of every record in a zone, sorted by domain and type
+func (s *Server) Records(zoneName string) []*dns.Record {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	z, ok := s.zones[strings.ToLower(zoneName)]
+	if !ok {
+		return nil
+	}
+	recs := make([]*dns.Record, 0, len(z.records))
+	for _, r := range z.records {
+		var rec dns.Record
+		clone(&rec, r)
+		recs = append(recs, &rec)
+	}
+	sort.Slice(recs, func(i, j int) bool {
+		return recordKey(recs[i].Domain, recs[i].Type) < recordKey(recs[j].Domain, recs[j].Type)
+	})
+	return recs
+}
+
+func (s *Server) assignIDs(r *dns.Record) {
+	if r.ID == "" {
+		r.ID = s.newID()
+	}
+	for _, a := range r.Answers {
+		if a.ID == "" {
+			a.ID = s.newID()
+		}
+	}
+}
+
+func fqdn(zone, domain string) string {
+	domain = strings.TrimSuffix(domain, ".")
+	if !strings.HasSuffix(strings.ToLower(domain), strings.ToLower(zone)) {
+		domain = domain + "." + zone
+	}
+	return domain
+}
+
+func recordKey(domain, t string) string {
+	return strings.ToLower(domain) + "/" + strings.ToUpper(t)
+}
+
+// serveZones handles zones, zones/ZONE and zones/ZONE/DOMAIN/TYPE
+func (s *Server) serveZones(w http.ResponseWriter, r *http.Request, parts []string) {
+	switch len(parts) {
+	case 0:
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+			return
+		}
+		names := make([]string, 0, len(s.zones))
+		for name := range s.zones {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		list := make([]*dns.Zone, 0, len(names))
+		for _, name := range names {
+			list = append(list, s.zones[name].zone)
+		}
+		writeJSON(w, list)
+
+	case 1:
+		s.serveZone(w, r, parts[0])
+
+	case 3:
+		s.serveRecord(w, r, parts[0], parts[1], parts[2])
+
+	default:
+		writeError(w, http.StatusNotFound, "Not Found")
+	}
+}
+
+func (s *Server) serveZone(w http.ResponseWriter, r *http.Request, name string) {
+	key := strings.ToLower(name)
+	z, ok := s.zones[key]
+
+	switch r.Method {
+	case http.MethodGet:
+		if !ok {
+			writeError(w, http.StatusNotFound, "zone not found")
+			return
+		}
+		writeJSON(w, z.withRecords())
+
+	case http.MethodPut:
+		if ok {
+			writeError(w, http.StatusBadRequest, "zone already exists")
+			return
+		}
+		var nz dns.Zone
+		if err := json.NewDecoder(r.Body).Decode(&nz); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		nz.Zone = name
+		s.addZone(&nz)
+		writeJSON(w, s.zones[key].withRecords())
+
+	case http.MethodPost:
+		if !ok {
+			writeError(w, http.StatusNotFound, "zone not found")
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		if err := merge(z.zone, body); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeJSON(w, z.withRecords())
+
+	case http.MethodDelete:
+		if !ok {
+			writeError(w, http.StatusNotFound, "zone not found")
+			return
+		}
+		delete(s.zones, key)
+		writeJSON(w, map[string]string{})
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+	}
+}
+
+// withRecords returns the zone with its record summary filled in, as
+// returned by GET zones/ZONE
+func (z *zone) withRecords() *dns.Zone {
+	var out dns.Zone
+	clone(&out, z.zone)
+
+	keys := make([]string, 0, len(z.records))
+	for k := range z.records {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		rec := z.records[k]
+		zr := &dns.ZoneRecord{
+			Domain: rec.Domain,
+			ID:     rec.ID,
+			Link:   rec.Link,
+			TTL:    rec.TTL,
+			Type:   rec.Type,
+			Tags:   rec.Tags,
+		}
+		for _, a := range rec.Answers {
+			zr.ShortAns = append(zr.ShortAns, strings.Join(a.Rdata, " "))
+		}
+		out.Records = append(out.Records, zr)
+	}
+	return &out
+}
+
+func (s *Server) serveRecord(w http.ResponseWriter, r *http.Request, zoneName, domain, t string) {
+	z, ok := s.zones[strings.ToLower(zoneName)]
+	if !ok {
+		if r.Method == http.MethodGet || r.Method == http.MethodDelete {
+			writeError(w, http.StatusNotFound, "record not found")
+		} else {
+			writeError(w, http.StatusNotFound, "zone not found")
+		}
+		return
+	}
+
+	key := recordKey(fqdn(zoneName, domain), t)
+	rec, exists := z.records[key]
+
+	switch r.Method {
+	case http.MethodGet:
+		if !exists {
+			writeError(w, http.StatusNotFound, "record not found")
+			return
+		}
+		writeJSON(w, rec)
+
+	case http.MethodPut:
+		if exists {
+			writeError(w, http.StatusBadRequest, "record already exists")
+			return
+		}
+		var nr dns.Record
+		if err := json.NewDecoder(r.Body).Decode(&nr); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if len(nr.Answers) == 0 && nr.Link == "" {
+			writeError(w, http.StatusBadRequest, "record must have at least one answer")
+			return
+		}
+		nr.Zone = z.zone.Zone
+		nr.Domain = fqdn(zoneName, domain)
+		nr.Type = strings.ToUpper(t)
+		nr.ID = ""
+		s.assignIDs(&nr)
+		z.records[key] = &nr
+		writeJSON(w, &nr)
+
+	case http.MethodPost:
+		if !exists {
+			writeError(w, http.StatusNotFound, "record not found")
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		id := rec.ID
+		if err := merge(rec, body); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		rec.ID = id
+		s.assignIDs(rec)
+		writeJSON(w, rec)
+
+	case http.MethodDelete:
+		if !exists {
+			writeError(w, http.StatusNotFound, "record not found")
+			return
+		}
+		delete(z.records, key)
+		writeJSON(w, map[string]string{})
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+	}
+}
@@ -0,0 +1,411 @@
+package owner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/m1k8/DNSUpdate/pkg/compare"
+	"github.com/m1k8/DNSUpdate/pkg/config"
+	"github.com/m1k8/DNSUpdate/pkg/plan"
+	"github.com/m1k8/DNSUpdate/pkg/provider"
+	"gopkg.in/ns1/ns1-go.v2/rest/model/data"
+	"gopkg.in/ns1/ns1-go.v2/rest/model/dns"
+)
+
+// TagKey is the DDI tag holding the owner, when records are marked with tags
+const TagKey = "dnsupdate-owner"
+
+// ErrNotOwned is returned when a change is needed to a record the service
+// didnt create and hasnt adopted
+var ErrNotOwned = errors.New("record is not managed by this service, adopt it first")
+
+// Marker marks the records a service manages, so it never changes records
+// somebody else made. Records are marked with their meta note, or with a
+// DDI tag if Tags is set
+type Marker struct {
+	Owner string
+	Tags  bool
+}
+
+func (m Marker) note() string {
+	return "dnsupdate owner=" + m.Owner
+}
+
+// Mark marks r as managed. Any note already on r is kept
+func (m Marker) Mark(r *dns.Record) {
+	if m.Tags {
+		if r.Tags == nil {
+			r.Tags = map[string]string{}
+		}
+		r.Tags[TagKey] = m.Owner
+		return
+	}
+
+	if r.Meta == nil {
+		r.Meta = &data.Meta{}
+	}
+	note, _ := r.Meta.Note.(string)
+	switch {
+	case note == "":
+		r.Meta.Note = m.note()
+	case !m.hasNote(note):
+		r.Meta.Note = note + " " + m.note()
+	}
+}
+
+// Owns reports whether r is marked as managed
+func (m Marker) Owns(r *dns.Record) bool {
+	if m.Tags {
+		return r.Tags[TagKey] == m.Owner
+	}
+	if r.Meta == nil {
+		return false
+	}
+	note, _ := r.Meta.Note.(string)
+	return m.hasNote(note)
+}
+
+// OwnsSummary reports whether a record in a zone's record list is marked, if
+// that can be told without fetching the record; known is false otherwise
+func (m Marker) OwnsSummary(zr *dns.ZoneRecord) (owned, known bool) {
+	if !m.Tags {
+		return false, false
+	}
+	return zr.Tags[TagKey] == m.Owner, true
+}
+
+// Note returns the mark, for things marked by a note of their own rather
+// than a record's meta, such as monitoring jobs
+func (m Marker) Note() string {
+	return m.note()
+}
+
+// OwnsNote reports whether a note carries the mark
+func (m Marker) OwnsNote(note string) bool {
+	return m.hasNote(note)
+}
+
+func (m Marker) hasNote(note string) bool {
+	return strings.Contains(" "+note+" ", " "+m.note()+" ")
+}
+
+// Key names a record. An empty Provider means the default one
+type Key struct {
+	Provider string `json:"provider"`
+	Zone     string `json:"zone"`
+	Domain   string `json:"domain"`
+	Type     string `json:"type"`
+}
+
+func (k Key) String() string {
+	return k.Domain + " " + k.Type
+}
+
+func (k Key) normal() Key {
+	if k.Provider == "" {
+		k.Provider = provider.Default
+	}
+	return Key{
+		Provider: k.Provider,
+		Zone:     strings.ToLower(k.Zone),
+		Domain:   strings.ToLower(strings.TrimSuffix(k.Domain, ".")),
+		Type:     strings.ToUpper(k.Type),
+	}
+}
+
+// Set is a set of records
+type Set map[Key]bool
+
+// NewSet returns a set of keys
+func NewSet(keys ...Key) Set {
+	s := Set{}
+	for _, k := range keys {
+		s.Add(k)
+	}
+	return s
+}
+
+func (s Set) Add(k Key) {
+	s[k.normal()] = true
+}
+
+func (s Set) Has(k Key) bool {
+	return s[k.normal()]
+}
+
+func (s Set) Remove(k Key) {
+	delete(s, k.normal())
+}
+
+// Minus returns the keys in s that arent in other
+func (s Set) Minus(other Set) []Key {
+	var keys []Key
+	for k := range s {
+		if !other.Has(k) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		return a.Provider+" "+a.Zone+" "+a.String() < b.Provider+" "+b.Zone+" "+b.String()
+	})
+	return keys
+}
+
+// Managed returns every record cfg has the service manage: the A and SRV
+// records of each target and dyndns host, and each declared zone record
+func Managed(cfg *config.Config) Set {
+	s := Set{}
+	for _, t := range cfg.Targets {
+		s.Add(Key{Provider: t.Provider, Zone: t.Zone, Domain: t.Domain, Type: "A"})
+		s.Add(Key{Provider: t.Provider, Zone: t.Zone, Domain: t.Domain, Type: "SRV"})
+	}
+	if cfg.DynDNS != nil {
+		for _, h := range cfg.DynDNS.Hosts {
+			s.Add(Key{Provider: h.Provider, Zone: h.Zone, Domain: h.Domain, Type: "A"})
+			s.Add(Key{Provider: h.Provider, Zone: h.Zone, Domain: h.Domain, Type: "SRV"})
+		}
+	}
+	for _, z := range cfg.Zones {
+		for _, r := range z.Records {
+			s.Add(Key{Provider: z.Provider, Zone: z.Zone, Domain: r.FQDN(z.Zone), Type: r.Type})
+		}
+	}
+	return s
+}
+
+// Answers is the notes of the answers a config manages in each A record of
+// its targets and dyndns hosts. Such a record may hold other hosts' answers,
+// and manually added ones, beside them
+type Answers map[Key][]string
+
+// Add adds note to the answers of k
+func (a Answers) Add(k Key, note string) {
+	k = k.normal()
+	for _, n := range a[k] {
+		if n == note {
+			return
+		}
+	}
+	a[k] = append(a[k], note)
+}
+
+// Get returns the notes of the answers of k, and whether k has any
+func (a Answers) Get(k Key) ([]string, bool) {
+	notes, ok := a[k.normal()]
+	return notes, ok
+}
+
+// Has reports whether note is among the answers of k
+func (a Answers) Has(k Key, note string) bool {
+	notes, _ := a.Get(k)
+	return contains(notes, note)
+}
+
+// Remove drops every answer of k
+func (a Answers) Remove(k Key) {
+	delete(a, k.normal())
+}
+
+// Minus returns the answers in a that arent in other
+func (a Answers) Minus(other Answers) Answers {
+	out := Answers{}
+	for k, notes := range a {
+		for _, n := range notes {
+			if !other.Has(k, n) {
+				out.Add(k, n)
+			}
+		}
+	}
+	return out
+}
+
+func contains(notes []string, note string) bool {
+	for _, n := range notes {
+		if n == note {
+			return true
+		}
+	}
+	return false
+}
+
+// ManagedAnswers returns the answers cfg has the service manage in the A
+// records of its targets and dyndns hosts
+func ManagedAnswers(cfg *config.Config) Answers {
+	a := Answers{}
+	add := func(at, zone, domain, note string) {
+		if note == "" {
+			note = compare.DefaultNote
+		}
+		a.Add(Key{Provider: at, Zone: zone, Domain: domain, Type: "A"}, note)
+	}
+	for _, t := range cfg.Targets {
+		add(t.Provider, t.Zone, t.Domain, t.Answer)
+	}
+	if cfg.DynDNS != nil {
+		for _, h := range cfg.DynDNS.Hosts {
+			add(h.Provider, h.Zone, h.Domain, h.Answer)
+		}
+	}
+	return a
+}
+
+// Zones returns every zone cfg manages records in, as keys with only the
+// provider and zone set
+func Zones(cfg *config.Config) []Key {
+	seen := Set{}
+	var zones []Key
+	add := func(k Key) {
+		if !seen.Has(k) {
+			seen.Add(k)
+			zones = append(zones, k)
+		}
+	}
+	for _, t := range cfg.Targets {
+		add(Key{Provider: t.Provider, Zone: t.Zone})
+	}
+	if cfg.DynDNS != nil {
+		for _, h := range cfg.DynDNS.Hosts {
+			add(Key{Provider: h.Provider, Zone: h.Zone})
+		}
+	}
+	for _, z := range cfg.Zones {
+		add(Key{Provider: z.Provider, Zone: z.Zone})
+	}
+	return zones
+}
+
+// Collect plans the deletion of each record in candidates that is marked as
+// managed. Unmarked and missing records are left alone. Only the answers
+// listed in answers are dropped from an A record there, which is deleted
+// once none are left, and its SRV record only along with it, so other
+// hosts' and manually added answers stay
+func Collect(ctx context.Context, providers provider.Registry, m Marker, candidates []Key, answers Answers) (*plan.Plan, error) {
+	p := &plan.Plan{Target: "garbage collection"}
+	// whether each shared A record looked at is gone once the plan is
+	// applied
+	gone := map[Key]bool{}
+	var srvs []Key
+	for _, k := range candidates {
+		a := k
+		a.Type = "A"
+		if _, shared := answers.Get(a); shared && strings.EqualFold(k.Type, "SRV") {
+			srvs = append(srvs, k)
+			continue
+		}
+		gone[k.normal()] = false
+		r, err := get(ctx, providers, k)
+		if errors.Is(err, provider.ErrRecordMissing) {
+			gone[k.normal()] = true
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("get %s: %w", k, err)
+		}
+		if !m.Owns(r) {
+			continue
+		}
+		notes, shared := answers.Get(k)
+		if !shared {
+			p.Add(plan.Change{Action: plan.Delete, Provider: k.Provider, Before: r})
+			continue
+		}
+		after := plan.CopyRecord(r)
+		after.Answers = nil
+		for _, ans := range r.Answers {
+			if ans != nil && !contains(notes, compare.NoteOf(ans)) {
+				after.Answers = append(after.Answers, ans)
+			}
+		}
+		switch {
+		case len(after.Answers) == len(r.Answers):
+		case len(after.Answers) > 0:
+			p.Add(plan.Change{Action: plan.Update, Provider: k.Provider, Before: r, After: after})
+		default:
+			p.Add(plan.Change{Action: plan.Delete, Provider: k.Provider, Before: r})
+			gone[k.normal()] = true
+		}
+	}
+	for _, k := range srvs {
+		a := k
+		a.Type = "A"
+		done, seen := gone[a.normal()]
+		if !seen {
+			_, err := get(ctx, providers, a)
+			if err != nil && !errors.Is(err, provider.ErrRecordMissing) {
+				return nil, fmt.Errorf("get %s: %w", a, err)
+			}
+			done = err != nil
+		}
+		if !done {
+			continue
+		}
+		r, err := get(ctx, providers, k)
+		if errors.Is(err, provider.ErrRecordMissing) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("get %s: %w", k, err)
+		}
+		if m.Owns(r) {
+			p.Add(plan.Change{Action: plan.Delete, Provider: k.Provider, Before: r})
+		}
+	}
+	return p, nil
+}
+
+// Unmanaged returns every record in zone not in managed, skipping those known
+// from the zone's record list not to be marked. zone must include its record
+// list, as from Provider.Zone at the provider named at
+func Unmanaged(at string, zone *dns.Zone, m Marker, managed Set) []Key {
+	var keys []Key
+	for _, zr := range zone.Records {
+		k := Key{Provider: at, Zone: zone.Zone, Domain: zr.Domain, Type: zr.Type}
+		if managed.Has(k) {
+			continue
+		}
+		if owned, known := m.OwnsSummary(zr); known && !owned {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// Adopt plans marking each record in keys that exists but isnt marked, so
+// the service may then change it. prepare, if not nil, may make further
+// changes to each record being adopted
+func Adopt(ctx context.Context, providers provider.Registry, m Marker, keys []Key, prepare func(Key, *dns.Record)) (*plan.Plan, error) {
+	p := &plan.Plan{Target: "adopt"}
+	for _, k := range keys {
+		r, err := get(ctx, providers, k)
+		if errors.Is(err, provider.ErrRecordMissing) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("get %s: %w", k, err)
+		}
+		if m.Owns(r) {
+			continue
+		}
+		after := plan.CopyRecord(r)
+		m.Mark(after)
+		if prepare != nil {
+			prepare(k, after)
+		}
+		p.Add(plan.Change{Action: plan.Update, Provider: k.Provider, Before: r, After: after})
+	}
+	return p, nil
+}
+
+// get fetches the record k names from its provider
+func get(ctx context.Context, providers provider.Registry, k Key) (*dns.Record, error) {
+	p, err := providers.Get(k.Provider)
+	if err != nil {
+		return nil, err
+	}
+	return p.Record(ctx, k.Zone, k.Domain, k.Type)
+}
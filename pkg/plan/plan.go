@@ -0,0 +1,261 @@
+package plan
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/m1k8/DNSUpdate/pkg/provider"
+	"gopkg.in/ns1/ns1-go.v2/rest/model/dns"
+)
+
+// Action is what a Change does to a record
+type Action string
+
+const (
+	Create Action = "create"
+	Update Action = "update"
+	Delete Action = "delete"
+)
+
+// Change is one record mutation. Before is nil for a Create, and After is
+// nil for a Delete. Provider names where the record is published, empty
+// meaning the default
+type Change struct {
+	Action   Action      `json:"action"`
+	Provider string      `json:"provider,omitempty"`
+	Before   *dns.Record `json:"before,omitempty"`
+	After    *dns.Record `json:"after,omitempty"`
+}
+
+// Record returns the record the change is made to
+func (c Change) Record() *dns.Record {
+	if c.After != nil {
+		return c.After
+	}
+	return c.Before
+}
+
+// Plan is the record changes worked out for a target, before any are made.
+// Applying a plan makes exactly the changes it shows
+type Plan struct {
+	Target  string   `json:"target"`
+	Changes []Change `json:"changes"`
+
+	// Refused is each change that was needed but left out, and why
+	Refused []string `json:"refused,omitempty"`
+}
+
+// Add appends a change to the plan
+func (p *Plan) Add(c Change) {
+	p.Changes = append(p.Changes, c)
+}
+
+// Refuse notes a change that is needed but wont be made
+func (p *Plan) Refuse(format string, args ...interface{}) {
+	p.Refused = append(p.Refused, fmt.Sprintf(format, args...))
+}
+
+// Empty reports whether the plan has nothing to do
+func (p *Plan) Empty() bool {
+	return p == nil || len(p.Changes) == 0
+}
+
+// Apply makes the changes in order, each with its provider from providers,
+// stopping at the first that fails. Created and updated records are
+// refreshed from the provider's reply, so After then holds any IDs it
+// assigned
+func (p *Plan) Apply(providers provider.Registry) error {
+	for _, c := range p.Changes {
+		r := c.Record()
+		dst, err := providers.Get(c.Provider)
+		if err != nil {
+			return fmt.Errorf("%s %s %s: %w", c.Action, r.Domain, r.Type, err)
+		}
+		switch c.Action {
+		case Create, Update:
+			err = dst.Upsert(c.After)
+		case Delete:
+			err = dst.Delete(r.Zone, r.Domain, r.Type)
+		default:
+			err = fmt.Errorf("unknown action %q", c.Action)
+		}
+		if err != nil {
+			return fmt.Errorf("%s %s %s: %w", c.Action, r.Domain, r.Type, err)
+		}
+	}
+	return nil
+}
+
+// CopyRecord copies r deeply enough that the copy can be changed for a plan
+// without changing r
+func CopyRecord(r *dns.Record) *dns.Record {
+	c := *r
+	if r.Meta != nil {
+		m := *r.Meta
+		c.Meta = &m
+	}
+	if r.Tags != nil {
+		c.Tags = make(map[string]string, len(r.Tags))
+		for k, v := range r.Tags {
+			c.Tags[k] = v
+		}
+	}
+	c.Answers = make([]*dns.Answer, len(r.Answers))
+	for i, a := range r.Answers {
+		if a == nil {
+			continue
+		}
+		ac := *a
+		if a.Meta != nil {
+			m := *a.Meta
+			ac.Meta = &m
+		}
+		ac.Rdata = append([]string(nil), a.Rdata...)
+		c.Answers[i] = &ac
+	}
+	return &c
+}
+
+// Same reports whether a and b have the same TTL, meta, tags, filters and
+// answers, the parts of a record a plan shows
+func Same(a, b *dns.Record) bool {
+	da, db := describe(a), describe(b)
+	if len(da) != len(db) {
+		return false
+	}
+	for i := range da {
+		if da[i] != db[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Write prints the plan as a diff of each record, with lines removed marked
+// "-" and added marked "+"
+func (p *Plan) Write(w io.Writer) error {
+	if p.Empty() && len(p.Refused) == 0 {
+		_, err := fmt.Fprintf(w, "%s: no changes\n", p.Target)
+		return err
+	}
+	for _, r := range p.Refused {
+		if _, err := fmt.Fprintf(w, "%s: refused: %s\n", p.Target, r); err != nil {
+			return err
+		}
+	}
+	for _, c := range p.Changes {
+		r := c.Record()
+		where := "zone " + r.Zone
+		if c.Provider != "" && c.Provider != provider.Default {
+			where += " at " + c.Provider
+		}
+		if _, err := fmt.Fprintf(w, "%s: %s %s %s (%s)\n", p.Target, c.Action, r.Type, r.Domain, where); err != nil {
+			return err
+		}
+		for _, l := range diff(describe(c.Before), describe(c.After)) {
+			if _, err := fmt.Fprintf(w, "    %s\n", l); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (p *Plan) String() string {
+	var b strings.Builder
+	p.Write(&b)
+	return b.String()
+}
+
+// describe renders the parts of a record that a plan can change, one per line
+func describe(r *dns.Record) []string {
+	if r == nil {
+		return nil
+	}
+	lines := []string{fmt.Sprintf("ttl %d", r.TTL)}
+	if r.Meta != nil {
+		if m := compact(r.Meta); m != "{}" {
+			lines = append(lines, "meta "+m)
+		}
+	}
+	if len(r.Tags) > 0 {
+		lines = append(lines, "tags "+compact(r.Tags))
+	}
+	for _, f := range r.Filters {
+		l := "filter " + f.Type
+		if len(f.Config) > 0 {
+			l += " " + compact(f.Config)
+		}
+		if f.Disabled {
+			l += " (disabled)"
+		}
+		lines = append(lines, l)
+	}
+	for _, a := range r.Answers {
+		if a == nil {
+			continue
+		}
+		l := "answer " + a.String()
+		if a.RegionName != "" {
+			l += " region " + a.RegionName
+		}
+		if a.Meta != nil {
+			if m := compact(a.Meta); m != "{}" {
+				l += " meta " + m
+			}
+		}
+		lines = append(lines, l)
+	}
+	return lines
+}
+
+// compact renders v as single line JSON, with map keys sorted
+func compact(v interface{}) string {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(buf)
+}
+
+// diff returns the lines of after, with those not in before marked "+", and
+// the lines of before not in after marked "-"
+func diff(before, after []string) []string {
+	// longest common subsequence; records are only a few lines long
+	n, m := len(before), len(after)
+	lcs := make([][]int, n+1)
+	for i := range lcs {
+		lcs[i] = make([]int, m+1)
+	}
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			if before[i] == after[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var out []string
+	i, j := 0, 0
+	for i < n || j < m {
+		switch {
+		case i < n && j < m && before[i] == after[j]:
+			out = append(out, "  "+before[i])
+			i++
+			j++
+		case i < n && (j == m || lcs[i+1][j] >= lcs[i][j+1]):
+			out = append(out, "- "+before[i])
+			i++
+		default:
+			out = append(out, "+ "+after[j])
+			j++
+		}
+	}
+	return out
+}
@@ -0,0 +1,318 @@
+package provider
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/m1k8/DNSUpdate/pkg/clock"
+	api "gopkg.in/ns1/ns1-go.v2/rest"
+	"gopkg.in/ns1/ns1-go.v2/rest/model/data"
+	"gopkg.in/ns1/ns1-go.v2/rest/model/dns"
+)
+
+// dyndns2Agent is sent as the User-Agent, as the protocol asks clients to
+// identify themselves
+const dyndns2Agent = "m1k8 - DNSUpdate - 1.0"
+
+// how long nothing is sent after a 911, doubling with each one in a row
+const (
+	dyndns2MinHold = 30 * time.Minute
+	dyndns2MaxHold = 24 * time.Hour
+)
+
+// ErrNoDelete is returned when a dyndns2 record would be deleted, which the
+// protocol has no way to do
+var ErrNoDelete = errors.New("dyndns2 cant delete records, it is left as it is")
+
+// DynDNSError is a return code other than good or nochg
+type DynDNSError struct {
+	Code string
+}
+
+var dyndnsCodes = map[string]string{
+	"badauth":  "username or password rejected",
+	"!donator": "needs a paid account",
+	"notfqdn":  "hostname isnt a fully qualified domain name",
+	"nohost":   "hostname doesnt exist in this account",
+	"numhost":  "too many hostnames",
+	"abuse":    "hostname blocked for abuse",
+	"badagent": "user agent rejected",
+	"dnserr":   "server DNS error",
+	"911":      "server problem or maintenance",
+}
+
+func (e *DynDNSError) Error() string {
+	if e.Code == "" {
+		return "empty response"
+	}
+	if desc, ok := dyndnsCodes[e.Code]; ok {
+		return e.Code + ": " + desc
+	}
+	return "unknown return code " + e.Code
+}
+
+// HeldError means the server asked not to be sent anything for a while, so
+// nothing was. Until is zero if that lasts until the service is reloaded
+type HeldError struct {
+	Op    string
+	Until time.Time
+	Err   *DynDNSError
+}
+
+func (e *HeldError) Error() string {
+	if e.Until.IsZero() {
+		return fmt.Sprintf("%s: not sent until the service is reloaded, after %v", e.Op, e.Err)
+	}
+	return fmt.Sprintf("%s: not sent until %s, after %v", e.Op, e.Until.Format(time.RFC3339), e.Err)
+}
+
+func (e *HeldError) Unwrap() error {
+	return e.Err
+}
+
+// DynDNS2 publishes A records with the dyndns2 protocol many registrars and
+// DDNS services speak. The protocol can only set a hostname's address, not
+// read it, so each record is known from the last update sent; until then it
+// is reported missing, and the first check after starting sends the address
+// whether or not it has changed
+type DynDNS2 struct {
+	name     string
+	endpoint string
+	username string
+	password string
+	doer     api.Doer
+	clock    clock.Clock
+
+	mu   sync.Mutex
+	sent map[string]sentRecord
+	// abused hostnames are never sent again
+	abused map[string]bool
+	// after a 911 nothing is sent until heldUntil, and hold doubles
+	heldUntil time.Time
+	hold      time.Duration
+	heldBy    *DynDNSError
+}
+
+// sentRecord is what was last sent for a hostname, with the parts of the
+// record the protocol has no room for
+type sentRecord struct {
+	zone       string
+	ip         string
+	ttl        int
+	note       interface{}
+	answerNote interface{}
+	tags       map[string]string
+}
+
+// newSent keeps what a write-only provider needs to report r, an A record
+// with one answer, as it was sent
+func newSent(r *dns.Record) sentRecord {
+	s := sentRecord{zone: r.Zone, ip: r.Answers[0].Rdata[0], ttl: r.TTL, tags: r.Tags}
+	if r.Answers[0].Meta != nil {
+		s.answerNote = r.Answers[0].Meta.Note
+	}
+	if r.Meta != nil {
+		s.note = r.Meta.Note
+	}
+	return s
+}
+
+// oneAddress returns the address of r, which must be an A record with a
+// single answer, as a write-only provider called kind can only set those
+func oneAddress(kind string, r *dns.Record) (string, error) {
+	if !strings.EqualFold(r.Type, "A") {
+		return "", fmt.Errorf("%s can only set A records", kind)
+	}
+	if len(r.Answers) != 1 || len(r.Answers[0].Rdata) != 1 {
+		return "", fmt.Errorf("%s records hold exactly one address", kind)
+	}
+	ip := r.Answers[0].Rdata[0]
+	if parsed := net.ParseIP(ip); parsed == nil || parsed.To4() == nil {
+		return "", fmt.Errorf("%q is not an IPv4 address", ip)
+	}
+	return ip, nil
+}
+
+// record rebuilds the record, as at domain
+func (s sentRecord) record(domain string) *dns.Record {
+	r := dns.NewRecord(s.zone, domain, "A")
+	r.TTL = s.ttl
+	if s.note != nil {
+		r.Meta = &data.Meta{Note: s.note}
+	}
+	if s.tags != nil {
+		r.Tags = map[string]string{}
+		for k, v := range s.tags {
+			r.Tags[k] = v
+		}
+	}
+	a := dns.NewAv4Answer(s.ip)
+	a.Meta.Note = s.answerNote
+	r.AddAnswer(a)
+	return r
+}
+
+// NewDynDNS2 returns a provider called name, sending updates to endpoint
+// with doer. endpoint is a URL such as https://members.dyndns.org, to which
+// /nic/update is added if it has no path
+func NewDynDNS2(name, endpoint, username, password string, doer api.Doer, c clock.Clock) *DynDNS2 {
+	if u, err := url.Parse(endpoint); err == nil && strings.Trim(u.Path, "/") == "" {
+		u.Path = "/nic/update"
+		endpoint = u.String()
+	}
+	return &DynDNS2{
+		name:     name,
+		endpoint: endpoint,
+		username: username,
+		password: password,
+		doer:     doer,
+		clock:    c,
+		sent:     map[string]sentRecord{},
+		abused:   map[string]bool{},
+	}
+}
+
+func (p *DynDNS2) Name() string {
+	return p.name
+}
+
+// Supports reports that only A records can be set
+func (p *DynDNS2) Supports(t string) bool {
+	return strings.EqualFold(t, "A")
+}
+
+// Zone returns zone without its records, as they cant be listed
+func (p *DynDNS2) Zone(zone string) (*dns.Zone, error) {
+	return &dns.Zone{Zone: zone}, nil
+}
+
+// Zones isnt possible with dyndns2
+func (p *DynDNS2) Zones() ([]string, error) {
+	return nil, errors.New("dyndns2 servers cant list their zones")
+}
+
+// Record returns the A record as last sent, or ErrRecordMissing if nothing
+// has been sent since starting
+func (p *DynDNS2) Record(ctx context.Context, zone, domain, t string) (*dns.Record, error) {
+	p.mu.Lock()
+	s, ok := p.sent[hostKey(domain)]
+	p.mu.Unlock()
+	if !ok || !p.Supports(t) {
+		return nil, ErrRecordMissing
+	}
+	return s.record(domain), nil
+}
+
+// Upsert sends the address of an A record with a single answer
+func (p *DynDNS2) Upsert(r *dns.Record) error {
+	op := "update " + r.Domain + " " + r.Type
+	ip, err := oneAddress("dyndns2", r)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	host := hostKey(r.Domain)
+	if err := p.held(op, host); err != nil {
+		return err
+	}
+
+	code, status, err := p.send(host, ip)
+	if err != nil {
+		return &NetworkError{Op: op, Err: err}
+	}
+	// some servers send the code with a status other than 200
+	_, known := dyndnsCodes[code]
+	if status != http.StatusOK && !known {
+		return &APIError{Op: op, Provider: p.name, StatusCode: status, Err: errors.New(http.StatusText(status))}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch code {
+	case "good", "nochg":
+		p.hold = 0
+		p.sent[host] = newSent(r)
+		return nil
+	case "abuse":
+		p.abused[host] = true
+	case "911":
+		p.hold *= 2
+		if p.hold < dyndns2MinHold {
+			p.hold = dyndns2MinHold
+		}
+		if p.hold > dyndns2MaxHold {
+			p.hold = dyndns2MaxHold
+		}
+		p.heldUntil = p.clock.Now().Add(p.hold)
+		p.heldBy = &DynDNSError{Code: code}
+	}
+	return &APIError{Op: op, Provider: p.name, StatusCode: status, Err: &DynDNSError{Code: code}}
+}
+
+// Delete forgets the record, but cant remove it from the server
+func (p *DynDNS2) Delete(zone, domain, t string) error {
+	p.mu.Lock()
+	delete(p.sent, hostKey(domain))
+	p.mu.Unlock()
+	return fmt.Errorf("delete %s %s: %w", domain, t, ErrNoDelete)
+}
+
+// held returns a HeldError if host must not be sent right now
+func (p *DynDNS2) held(op, host string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.abused[host] {
+		return &HeldError{Op: op, Err: &DynDNSError{Code: "abuse"}}
+	}
+	if p.clock.Now().Before(p.heldUntil) {
+		return &HeldError{Op: op, Until: p.heldUntil, Err: p.heldBy}
+	}
+	return nil
+}
+
+// send makes the update request, returning the return code for host and
+// the HTTP status
+func (p *DynDNS2) send(host, ip string) (string, int, error) {
+	u, err := url.Parse(p.endpoint)
+	if err != nil {
+		return "", 0, err
+	}
+	q := u.Query()
+	q.Set("hostname", host)
+	q.Set("myip", ip)
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", 0, err
+	}
+	req.SetBasicAuth(p.username, p.password)
+	req.Header.Set("User-Agent", dyndns2Agent)
+	res, err := p.doer.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer res.Body.Close()
+
+	// one line per hostname, with the code first, e.g. "good 192.0.2.1"
+	line, err := bufio.NewReader(io.LimitReader(res.Body, 4096)).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", 0, err
+	}
+	if fields := strings.Fields(line); len(fields) > 0 {
+		return fields[0], res.StatusCode, nil
+	}
+	return "", res.StatusCode, nil
+}
+
+func hostKey(domain string) string {
+	return strings.ToLower(strings.TrimSuffix(domain, "."))
+}
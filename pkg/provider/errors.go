@@ -0,0 +1,42 @@
+package provider
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrConflict means a record changed between being read and being written,
+// so the write was not made. The caller should read it again and replan
+var ErrConflict = errors.New("record changed since it was read")
+
+// NetworkError means a provider could not be reached at all, typically
+// because the network is not up yet
+type NetworkError struct {
+	Op  string
+	Err error
+}
+
+func (e *NetworkError) Error() string {
+	return fmt.Sprintf("%s: network unavailable: %v", e.Op, e.Err)
+}
+
+func (e *NetworkError) Unwrap() error {
+	return e.Err
+}
+
+// APIError means a provider answered, but not with what we asked for.
+// StatusCode is the HTTP status, or the DNS rcode
+type APIError struct {
+	Op         string
+	Provider   string
+	StatusCode int
+	Err        error
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%s: %s returned %d: %v", e.Op, e.Provider, e.StatusCode, e.Err)
+}
+
+func (e *APIError) Unwrap() error {
+	return e.Err
+}
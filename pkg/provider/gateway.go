@@ -0,0 +1,110 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/m1k8/DNSUpdate/pkg/gateway"
+	"gopkg.in/ns1/ns1-go.v2/rest/model/dns"
+)
+
+// Gateway publishes A records through a gateway, for a host running as its
+// agent. The gateway only holds addresses, so the rest of each record is
+// known from the last update sent; until then it is reported missing, and
+// the first check after starting registers the address again
+type Gateway struct {
+	name   string
+	client *gateway.Client
+
+	mu   sync.Mutex
+	sent map[string]sentRecord
+}
+
+// NewGateway returns a provider called name using c
+func NewGateway(name string, c *gateway.Client) *Gateway {
+	return &Gateway{name: name, client: c, sent: map[string]sentRecord{}}
+}
+
+func (p *Gateway) Name() string {
+	return p.name
+}
+
+// Supports reports that only A records can be set
+func (p *Gateway) Supports(t string) bool {
+	return strings.EqualFold(t, "A")
+}
+
+// Zone returns zone without its records, as they cant be listed
+func (p *Gateway) Zone(zone string) (*dns.Zone, error) {
+	return &dns.Zone{Zone: zone}, nil
+}
+
+// Zones isnt possible through a gateway
+func (p *Gateway) Zones() ([]string, error) {
+	return nil, errors.New("gateways cant list their zones")
+}
+
+// Record returns the A record as last sent, with the address the gateway
+// now has for it
+func (p *Gateway) Record(ctx context.Context, zone, domain, t string) (*dns.Record, error) {
+	p.mu.Lock()
+	s, ok := p.sent[hostKey(domain)]
+	p.mu.Unlock()
+	if !ok || !p.Supports(t) {
+		return nil, ErrRecordMissing
+	}
+
+	ip, err := p.client.Lookup(ctx, domain)
+	if err := p.classify("get "+domain+" "+t, err); err != nil {
+		return nil, err
+	}
+	s.ip = ip
+	return s.record(domain), nil
+}
+
+// Upsert registers the address of an A record with a single answer
+func (p *Gateway) Upsert(r *dns.Record) error {
+	op := "update " + r.Domain + " " + r.Type
+	ip, err := oneAddress("gateway", r)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if _, err := p.client.Register(context.Background(), r.Domain, ip); err != nil {
+		return p.classify(op, err)
+	}
+	p.mu.Lock()
+	p.sent[hostKey(r.Domain)] = newSent(r)
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *Gateway) Delete(zone, domain, t string) error {
+	p.mu.Lock()
+	delete(p.sent, hostKey(domain))
+	p.mu.Unlock()
+	if !p.Supports(t) {
+		return ErrRecordMissing
+	}
+	return p.classify("delete "+domain+" "+t, p.client.Deregister(context.Background(), domain))
+}
+
+// classify wraps an error from the gateway in a NetworkError or APIError,
+// depending on whether a response was received. A host that isnt
+// registered is ErrRecordMissing
+func (p *Gateway) classify(op string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var apiErr *gateway.APIError
+	if !errors.As(err, &apiErr) {
+		return &NetworkError{Op: op, Err: err}
+	}
+	if apiErr.StatusCode == http.StatusNotFound {
+		return ErrRecordMissing
+	}
+	return &APIError{Op: op, Provider: p.name, StatusCode: apiErr.StatusCode, Err: err}
+}
@@ -0,0 +1,134 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/m1k8/DNSUpdate/pkg/dnsapi"
+	api "gopkg.in/ns1/ns1-go.v2/rest"
+	"gopkg.in/ns1/ns1-go.v2/rest/model/dns"
+)
+
+// NS1 publishes records to an NS1 account
+type NS1 struct {
+	name    string
+	records dnsapi.Records
+	zones   dnsapi.Zones
+	jobs    dnsapi.Jobs
+	sources dnsapi.DataSources
+	feeds   dnsapi.DataFeeds
+}
+
+// NewNS1 returns a provider called name using c
+func NewNS1(name string, c *dnsapi.Client) *NS1 {
+	return &NS1{name: name, records: c.Records, zones: c.Zones, jobs: c.Jobs, sources: c.DataSources, feeds: c.DataFeeds}
+}
+
+func (p *NS1) Name() string {
+	return p.name
+}
+
+// Records returns the account's records, for what is kept in the zone
+// outside of providers, such as leases
+func (p *NS1) Records() dnsapi.Records {
+	return p.records
+}
+
+// Jobs returns the account's monitoring jobs
+func (p *NS1) Jobs() dnsapi.Jobs {
+	return p.jobs
+}
+
+// DataSources returns the account's data sources
+func (p *NS1) DataSources() dnsapi.DataSources {
+	return p.sources
+}
+
+// DataFeeds returns the account's data feeds
+func (p *NS1) DataFeeds() dnsapi.DataFeeds {
+	return p.feeds
+}
+
+func (p *NS1) Zone(zone string) (*dns.Zone, error) {
+	z, res, err := p.zones.Get(zone)
+	if err := p.classify("get zone "+zone, res, err); err != nil {
+		return nil, err
+	}
+	return z, nil
+}
+
+func (p *NS1) Zones() ([]string, error) {
+	zones, res, err := p.zones.List()
+	if err := p.classify("list zones", res, err); err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(zones))
+	for _, z := range zones {
+		names = append(names, z.Zone)
+	}
+	return names, nil
+}
+
+func (p *NS1) Record(ctx context.Context, zone, domain, t string) (*dns.Record, error) {
+	r, res, err := p.records.GetContext(ctx, zone, domain, t)
+	if err := p.classify("get "+domain+" "+t, res, err); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Upsert creates r if it has no ID, and updates it otherwise. A record
+// created since it was found missing is not overwritten, as it may not be
+// ours: ErrConflict is returned instead. An update of a record that has
+// since gone falls back to creating it. NS1 keeps any field an update
+// leaves out
+func (p *NS1) Upsert(r *dns.Record) error {
+	op := "update " + r.Domain + " " + r.Type
+	var res *http.Response
+	var err error
+	if r.ID == "" {
+		op = "create " + r.Domain + " " + r.Type
+		res, err = p.records.Create(r)
+		if errors.Is(err, api.ErrRecordExists) {
+			err = fmt.Errorf("%w (%s)", ErrConflict, err)
+		}
+	} else {
+		res, err = p.records.Update(r)
+		if errors.Is(err, api.ErrRecordMissing) {
+			op = "create " + r.Domain + " " + r.Type
+			res, err = p.records.Create(r)
+		}
+	}
+	return p.classify(op, res, err)
+}
+
+func (p *NS1) Delete(zone, domain, t string) error {
+	res, err := p.records.Delete(zone, domain, t)
+	return p.classify("delete "+domain+" "+t, res, err)
+}
+
+// classify wraps an error from the NS1 client in a NetworkError or APIError,
+// depending on whether a response was received. Missing records are
+// returned as they are, as callers look for them
+func (p *NS1) classify(op string, res *http.Response, err error) error {
+	if err == nil {
+		if res != nil && res.StatusCode != http.StatusOK {
+			return &APIError{Op: op, Provider: p.name, StatusCode: res.StatusCode, Err: errors.New(res.Status)}
+		}
+		return nil
+	}
+	if errors.Is(err, api.ErrRecordMissing) {
+		return err
+	}
+
+	var restErr *api.Error
+	if errors.As(err, &restErr) && restErr.Resp != nil {
+		return &APIError{Op: op, Provider: p.name, StatusCode: restErr.Resp.StatusCode, Err: err}
+	}
+	if res == nil {
+		return &NetworkError{Op: op, Err: err}
+	}
+	return &APIError{Op: op, Provider: p.name, StatusCode: res.StatusCode, Err: err}
+}
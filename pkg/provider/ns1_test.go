@@ -0,0 +1,55 @@
+package provider
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/m1k8/DNSUpdate/pkg/dnsapi"
+	"github.com/m1k8/DNSUpdate/pkg/ns1fake"
+	"gopkg.in/ns1/ns1-go.v2/rest/model/dns"
+)
+
+func TestNS1Upsert(t *testing.T) {
+	const zone, domain = "example.com", "home.example.com"
+	record := func(ip, id string) *dns.Record {
+		r := dns.NewRecord(zone, domain, "A")
+		r.ID = id
+		r.AddAnswer(dns.NewAv4Answer(ip))
+		return r
+	}
+	tests := []struct {
+		name     string
+		existing *dns.Record
+		upsert   *dns.Record
+		wantErr  error
+		wantIP   string
+	}{
+		{name: "create", upsert: record("8.8.4.7", ""), wantIP: "8.8.4.7"},
+		{name: "update", existing: record("8.8.4.4", ""), upsert: record("8.8.4.7", "set below"), wantIP: "8.8.4.7"},
+		{name: "update of a deleted record creates it", upsert: record("8.8.4.7", "gone"), wantIP: "8.8.4.7"},
+		{name: "create of a record made since", existing: record("8.8.4.4", ""), upsert: record("8.8.4.7", ""), wantErr: ErrConflict, wantIP: "8.8.4.4"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := ns1fake.New()
+			defer f.Close()
+			f.AddZone(zone)
+			if tt.existing != nil {
+				f.PutRecord(tt.existing)
+				if tt.upsert.ID != "" {
+					tt.upsert.ID = f.Record(zone, domain, "A").ID
+				}
+			}
+
+			p := NewNS1("ns1", dnsapi.FromREST(f.Client()))
+			err := p.Upsert(tt.upsert)
+			if tt.wantErr == nil && err != nil || !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			got := f.Record(zone, domain, "A")
+			if got == nil || len(got.Answers) != 1 || got.Answers[0].Rdata[0] != tt.wantIP {
+				t.Errorf("record is %v, want %s", got, tt.wantIP)
+			}
+		})
+	}
+}
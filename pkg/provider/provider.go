@@ -0,0 +1,80 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/m1k8/DNSUpdate/pkg/config"
+	"github.com/m1k8/DNSUpdate/pkg/dnsapi"
+	api "gopkg.in/ns1/ns1-go.v2/rest"
+	"gopkg.in/ns1/ns1-go.v2/rest/model/dns"
+)
+
+// Default is the name of the NS1 provider set up from the top of the config
+const Default = config.DefaultProvider
+
+// ErrRecordMissing is returned, perhaps wrapped, for a record that doesnt
+// exist
+var ErrRecordMissing = api.ErrRecordMissing
+
+// Provider is a DNS host records are published to. Records are described
+// with the NS1 models the rest of the service uses, and providers for other
+// hosts translate to and from them
+type Provider interface {
+	// Name identifies the provider in the config, plans and snapshots
+	Name() string
+
+	// Zone returns zone with a summary of each record in it
+	Zone(zone string) (*dns.Zone, error)
+
+	// Zones lists the zones the provider holds
+	Zones() ([]string, error)
+
+	// Record returns a record in full, or ErrRecordMissing. The lookup is
+	// abandoned once ctx is done
+	Record(ctx context.Context, zone, domain, t string) (*dns.Record, error)
+
+	// Upsert creates r, or replaces the record with its zone, domain and
+	// type. r is then refreshed with what the provider stored, e.g. the IDs
+	// it assigned
+	Upsert(r *dns.Record) error
+
+	// Delete removes a record
+	Delete(zone, domain, t string) error
+}
+
+// Limited is implemented by providers that can only hold some record types
+type Limited interface {
+	Supports(t string) bool
+}
+
+// Monitoring is implemented by providers that can monitor the addresses
+// they publish, such as NS1, and feed the results into their answers
+type Monitoring interface {
+	Jobs() dnsapi.Jobs
+	DataSources() dnsapi.DataSources
+	DataFeeds() dnsapi.DataFeeds
+}
+
+// Supports reports whether p can hold records of type t
+func Supports(p Provider, t string) bool {
+	if l, ok := p.(Limited); ok {
+		return l.Supports(t)
+	}
+	return true
+}
+
+// Registry is every provider in the config, by name
+type Registry map[string]Provider
+
+// Get returns the named provider, or the default one if name is empty
+func (r Registry) Get(name string) (Provider, error) {
+	if name == "" {
+		name = Default
+	}
+	p, ok := r[name]
+	if !ok {
+		return nil, fmt.Errorf("no provider %q", name)
+	}
+	return p, nil
+}
@@ -0,0 +1,379 @@
+package provider
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/m1k8/DNSUpdate/pkg/dnswire"
+	"gopkg.in/ns1/ns1-go.v2/rest/model/data"
+	"gopkg.in/ns1/ns1-go.v2/rest/model/dns"
+)
+
+// MetaPrefix names the TXT record the rfc2136 provider keeps next to each
+// record it writes, holding the record's note, tags and answer notes, which
+// DNS has no room for. Those of home.example.com A are in
+// _dnsupdate-a.home.example.com
+const MetaPrefix = "_dnsupdate-"
+
+// rfc2136TTL is used for records written without a TTL
+const rfc2136TTL = 600
+
+// RFC2136 publishes records to a server that takes RFC 2136 dynamic
+// updates, such as BIND or Knot. Each update carries prerequisites, so a
+// record is only created if it doesnt exist and only replaced if it is as it
+// was when read
+type RFC2136 struct {
+	name   string
+	client *dnswire.Client
+
+	mu sync.Mutex
+	// read is each RRset as last read or written, by rrsetKey, so it can
+	// be required to be unchanged when it is replaced
+	read map[string]rrset
+}
+
+type rrset struct {
+	id  string
+	rrs []dnswire.RR
+}
+
+// recordMeta is what is kept in the MetaPrefix TXT record
+type recordMeta struct {
+	Note    string            `json:"note,omitempty"`
+	Tags    map[string]string `json:"tags,omitempty"`
+	Answers map[string]string `json:"answers,omitempty"`
+}
+
+// NewRFC2136 returns a provider called name sending updates with c
+func NewRFC2136(name string, c *dnswire.Client) *RFC2136 {
+	return &RFC2136{name: name, client: c, read: map[string]rrset{}}
+}
+
+func (p *RFC2136) Name() string {
+	return p.name
+}
+
+// Zone transfers the zone. If the server refuses transfers, the zone is
+// returned without its record list once its SOA has been found, so only
+// targets can use it and garbage collection finds nothing
+func (p *RFC2136) Zone(zone string) (*dns.Zone, error) {
+	rrs, err := p.client.Transfer(zone)
+	var rcodeErr *dnswire.RcodeError
+	if errors.As(err, &rcodeErr) && (rcodeErr.Rcode == dnswire.RcodeRefused || rcodeErr.Rcode == dnswire.RcodeNotAuth) {
+		if _, err := p.query(context.Background(), zone, dnswire.TypeSOA); err != nil {
+			return nil, p.classify("get zone "+zone, err)
+		}
+		return &dns.Zone{Zone: zone}, nil
+	}
+	if err != nil {
+		return nil, p.classify("get zone "+zone, err)
+	}
+
+	type group struct {
+		name string
+		t    uint16
+		rrs  []dnswire.RR
+	}
+	var order []string
+	groups := map[string]*group{}
+	metas := map[string]recordMeta{}
+	for _, rr := range rrs {
+		if strings.HasPrefix(strings.ToLower(rr.Name), MetaPrefix) && rr.Type == dnswire.TypeTXT {
+			if m, ok := parseMeta([]dnswire.RR{rr}); ok {
+				metas[dnswire.CanonicalName(rr.Name)] = m
+			}
+			continue
+		}
+		if rr.Type == dnswire.TypeSOA || !dnswire.Supported(rr.Type) {
+			continue
+		}
+		k := rrsetKey(rr.Name, rr.Type)
+		if groups[k] == nil {
+			groups[k] = &group{name: rr.Name, t: rr.Type}
+			order = append(order, k)
+		}
+		groups[k].rrs = append(groups[k].rrs, rr)
+	}
+
+	z := &dns.Zone{Zone: zone}
+	for _, k := range order {
+		g := groups[k]
+		zr := &dns.ZoneRecord{Domain: g.name, Type: dnswire.TypeName(g.t), TTL: int(g.rrs[0].TTL)}
+		for _, rr := range g.rrs {
+			fields, err := dnswire.UnpackRdata(rr.Type, rr.Data)
+			if err != nil {
+				return nil, fmt.Errorf("get zone %s: %s: %w", zone, g.name, err)
+			}
+			zr.ShortAns = append(zr.ShortAns, strings.Join(fields, " "))
+		}
+		if m, ok := metas[dnswire.CanonicalName(metaName(g.name, g.t))]; ok {
+			zr.Tags = m.Tags
+		}
+		z.Records = append(z.Records, zr)
+	}
+	return z, nil
+}
+
+// Zones isnt possible over DNS
+func (p *RFC2136) Zones() ([]string, error) {
+	return nil, errors.New("rfc2136 servers cant list their zones")
+}
+
+func (p *RFC2136) Record(ctx context.Context, zone, domain, t string) (*dns.Record, error) {
+	op := "get " + domain + " " + t
+	typ, ok := dnswire.ParseType(t)
+	if !ok {
+		return nil, fmt.Errorf("%s: type not supported", op)
+	}
+	rrs, err := p.query(ctx, domain, typ)
+	if err != nil {
+		return nil, p.classify(op, err)
+	}
+	if len(rrs) == 0 {
+		return nil, ErrRecordMissing
+	}
+	metaRRs, err := p.query(ctx, metaName(domain, typ), dnswire.TypeTXT)
+	if err != nil {
+		return nil, p.classify(op, err)
+	}
+	meta, _ := parseMeta(metaRRs)
+
+	r := dns.NewRecord(zone, domain, dnswire.TypeName(typ))
+	r.TTL = int(rrs[0].TTL)
+	for _, rr := range rrs {
+		fields, err := dnswire.UnpackRdata(typ, rr.Data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		a := dns.NewAnswer(fields)
+		if note, ok := meta.Answers[a.String()]; ok {
+			a.Meta = &data.Meta{Note: note}
+		}
+		r.AddAnswer(a)
+	}
+	if meta.Note != "" {
+		r.Meta = &data.Meta{Note: meta.Note}
+	}
+	r.Tags = meta.Tags
+	r.ID = p.remember(domain, typ, rrs)
+	return r, nil
+}
+
+// query returns the records of type t at name. A name that doesnt exist has
+// none
+func (p *RFC2136) query(ctx context.Context, name string, t uint16) ([]dnswire.RR, error) {
+	rsp, err := p.client.ExchangeContext(ctx, &dnswire.Msg{
+		Question: []dnswire.Question{{Name: name, Type: t, Class: dnswire.ClassINET}},
+	})
+	var rcodeErr *dnswire.RcodeError
+	if errors.As(err, &rcodeErr) && rcodeErr.Rcode == dnswire.RcodeNXDomain {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var rrs []dnswire.RR
+	for _, rr := range rsp.Answer {
+		if rr.Type == t && dnswire.CanonicalName(rr.Name) == dnswire.CanonicalName(name) {
+			rrs = append(rrs, rr)
+		}
+	}
+	return rrs, nil
+}
+
+// Upsert replaces the record, and its meta, in a single update. A record
+// without an ID must not exist yet, and one read by this provider must not
+// have changed since; otherwise ErrConflict is returned
+func (p *RFC2136) Upsert(r *dns.Record) error {
+	op := "update " + r.Domain + " " + r.Type
+	typ, ok := dnswire.ParseType(r.Type)
+	if !ok {
+		return fmt.Errorf("%s: type not supported", op)
+	}
+	ttl := uint32(r.TTL)
+	if ttl == 0 {
+		ttl = rfc2136TTL
+	}
+
+	var rrs []dnswire.RR
+	meta := recordMeta{Tags: r.Tags}
+	if r.Meta != nil {
+		meta.Note, _ = r.Meta.Note.(string)
+	}
+	for _, a := range r.Answers {
+		if a == nil {
+			continue
+		}
+		d, err := dnswire.PackRdata(typ, a.Rdata)
+		if err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+		rrs = append(rrs, dnswire.RR{Name: r.Domain, Type: typ, Class: dnswire.ClassINET, TTL: ttl, Data: d})
+		if a.Meta != nil {
+			if note, _ := a.Meta.Note.(string); note != "" {
+				if meta.Answers == nil {
+					meta.Answers = map[string]string{}
+				}
+				meta.Answers[a.String()] = note
+			}
+		}
+	}
+	if len(rrs) == 0 {
+		return fmt.Errorf("%s: no answers", op)
+	}
+
+	m := p.updateMsg(r.Zone)
+	m.Answer = p.prerequisites(r, typ)
+	m.Authority = append(m.Authority, dnswire.RR{Name: r.Domain, Type: typ, Class: dnswire.ClassANY})
+	m.Authority = append(m.Authority, rrs...)
+	metaRRs, err := packMeta(metaName(r.Domain, typ), ttl, meta)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	m.Authority = append(m.Authority, dnswire.RR{Name: metaName(r.Domain, typ), Type: dnswire.TypeTXT, Class: dnswire.ClassANY})
+	m.Authority = append(m.Authority, metaRRs...)
+
+	if _, err := p.client.Exchange(m); err != nil {
+		return p.classify(op, err)
+	}
+	r.ID = p.remember(r.Domain, typ, rrs)
+	return nil
+}
+
+// prerequisites returns what must hold for r to be written: its RRset must
+// not exist if r has no ID, and must be as last read if it was read here
+// with that ID. Otherwise it need only exist
+func (p *RFC2136) prerequisites(r *dns.Record, typ uint16) []dnswire.RR {
+	if r.ID == "" {
+		return []dnswire.RR{{Name: r.Domain, Type: typ, Class: dnswire.ClassNONE}}
+	}
+	p.mu.Lock()
+	read, ok := p.read[rrsetKey(r.Domain, typ)]
+	p.mu.Unlock()
+	if !ok || read.id != r.ID {
+		return []dnswire.RR{{Name: r.Domain, Type: typ, Class: dnswire.ClassANY}}
+	}
+	prereqs := make([]dnswire.RR, 0, len(read.rrs))
+	for _, rr := range read.rrs {
+		prereqs = append(prereqs, dnswire.RR{Name: rr.Name, Type: rr.Type, Class: dnswire.ClassINET, Data: rr.Data})
+	}
+	return prereqs
+}
+
+// Delete removes the record and its meta. A record that doesnt exist returns
+// ErrRecordMissing
+func (p *RFC2136) Delete(zone, domain, t string) error {
+	op := "delete " + domain + " " + t
+	typ, ok := dnswire.ParseType(t)
+	if !ok {
+		return fmt.Errorf("%s: type not supported", op)
+	}
+	m := p.updateMsg(zone)
+	m.Answer = []dnswire.RR{{Name: domain, Type: typ, Class: dnswire.ClassANY}}
+	m.Authority = []dnswire.RR{
+		{Name: domain, Type: typ, Class: dnswire.ClassANY},
+		{Name: metaName(domain, typ), Type: dnswire.TypeTXT, Class: dnswire.ClassANY},
+	}
+	_, err := p.client.Exchange(m)
+	var rcodeErr *dnswire.RcodeError
+	if errors.As(err, &rcodeErr) && rcodeErr.Rcode == dnswire.RcodeNXRRSet {
+		return ErrRecordMissing
+	}
+	if err != nil {
+		return p.classify(op, err)
+	}
+	p.mu.Lock()
+	delete(p.read, rrsetKey(domain, typ))
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *RFC2136) updateMsg(zone string) *dnswire.Msg {
+	return &dnswire.Msg{
+		Header:   dnswire.Header{Opcode: dnswire.OpcodeUpdate},
+		Question: []dnswire.Question{{Name: zone, Type: dnswire.TypeSOA, Class: dnswire.ClassINET}},
+	}
+}
+
+// remember keeps rrs as the RRset last seen at name, and returns the ID
+// standing for it
+func (p *RFC2136) remember(name string, t uint16, rrs []dnswire.RR) string {
+	datas := make([]string, 0, len(rrs))
+	for _, rr := range rrs {
+		datas = append(datas, hex.EncodeToString(rr.Data))
+	}
+	sort.Strings(datas)
+	sum := sha256.Sum256([]byte(fmt.Sprint(rrs[0].TTL, datas)))
+	id := hex.EncodeToString(sum[:8])
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.read[rrsetKey(name, t)] = rrset{id: id, rrs: rrs}
+	return id
+}
+
+// classify wraps an error from the server in a NetworkError or APIError.
+// Failed prerequisites are reported as ErrConflict
+func (p *RFC2136) classify(op string, err error) error {
+	var rcodeErr *dnswire.RcodeError
+	if errors.As(err, &rcodeErr) {
+		switch rcodeErr.Rcode {
+		case dnswire.RcodeYXRRSet, dnswire.RcodeNXRRSet, dnswire.RcodeYXDomain, dnswire.RcodeNXDomain:
+			err = fmt.Errorf("%w (%s)", ErrConflict, err)
+		}
+		return &APIError{Op: op, Provider: p.name, StatusCode: rcodeErr.Rcode, Err: err}
+	}
+	var tsigErr *dnswire.TSIGError
+	if errors.As(err, &tsigErr) {
+		return &APIError{Op: op, Provider: p.name, StatusCode: tsigErr.Rcode, Err: err}
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return &NetworkError{Op: op, Err: err}
+	}
+	return fmt.Errorf("%s: %w", op, err)
+}
+
+func rrsetKey(name string, t uint16) string {
+	return dnswire.CanonicalName(name) + " " + dnswire.TypeName(t)
+}
+
+func metaName(domain string, t uint16) string {
+	return MetaPrefix + strings.ToLower(dnswire.TypeName(t)) + "." + strings.TrimSuffix(domain, ".")
+}
+
+// packMeta returns the TXT record holding m, or none if m is empty
+func packMeta(name string, ttl uint32, m recordMeta) ([]dnswire.RR, error) {
+	if m.Note == "" && len(m.Tags) == 0 && len(m.Answers) == 0 {
+		return nil, nil
+	}
+	buf, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	d, err := dnswire.PackRdata(dnswire.TypeTXT, []string{string(buf)})
+	if err != nil {
+		return nil, err
+	}
+	return []dnswire.RR{{Name: name, Type: dnswire.TypeTXT, Class: dnswire.ClassINET, TTL: ttl, Data: d}}, nil
+}
+
+func parseMeta(rrs []dnswire.RR) (recordMeta, bool) {
+	var m recordMeta
+	if len(rrs) != 1 {
+		return m, false
+	}
+	text, err := dnswire.UnpackRdata(dnswire.TypeTXT, rrs[0].Data)
+	if err != nil || json.Unmarshal([]byte(text[0]), &m) != nil {
+		return recordMeta{}, false
+	}
+	return m, true
+}
@@ -0,0 +1,243 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/m1k8/DNSUpdate/pkg/dnsfake"
+	"github.com/m1k8/DNSUpdate/pkg/dnswire"
+	"gopkg.in/ns1/ns1-go.v2/rest/model/data"
+	"gopkg.in/ns1/ns1-go.v2/rest/model/dns"
+)
+
+const (
+	// secret and otherSecret are base64, as in a BIND key file
+	secret      = "c2VjcmV0LWtleS1mb3ItdGVzdHM="
+	otherSecret = "b3RoZXItc2VjcmV0LWtleQ=="
+)
+
+// newRFC2136 returns a provider sending updates for example.com to a fake
+// server, signed with key if it is set
+func newRFC2136(t *testing.T, key *dnswire.Key) (*dnsfake.Server, *RFC2136) {
+	t.Helper()
+	s := dnsfake.New()
+	t.Cleanup(s.Close)
+	s.AddZone("example.com")
+	return s, NewRFC2136("bind", &dnswire.Client{Server: s.Addr(), Key: key, Timeout: 5 * time.Second})
+}
+
+func aRecord(domain string, ips ...string) *dns.Record {
+	r := dns.NewRecord("example.com", domain, "A")
+	for _, ip := range ips {
+		r.AddAnswer(dns.NewAv4Answer(ip))
+	}
+	return r
+}
+
+func TestRFC2136TSIG(t *testing.T) {
+	type key struct{ name, algorithm, secret string }
+	tests := []struct {
+		name       string
+		server     *key
+		client     *key
+		requireKey bool
+		skew       time.Duration
+
+		// rcode is that of the APIError returned, or 0 if the update
+		// should be made
+		rcode int
+	}{
+		{name: "hmac-sha256", server: &key{"update.", "hmac-sha256", secret}, client: &key{"update.", "hmac-sha256", secret}, requireKey: true},
+		{name: "hmac-sha512", server: &key{"update.", "hmac-sha512", secret}, client: &key{"update.", "hmac-sha512.", secret}, requireKey: true},
+		{name: "unsigned", server: &key{"update.", "hmac-sha256", secret}, requireKey: true, rcode: dnswire.RcodeRefused},
+		{name: "unsigned without a key required"},
+		{name: "wrong secret", server: &key{"update.", "hmac-sha256", secret}, client: &key{"update.", "hmac-sha256", otherSecret}, rcode: dnswire.RcodeBadSig},
+		{name: "unknown key", server: &key{"update.", "hmac-sha256", secret}, client: &key{"other.", "hmac-sha256", secret}, rcode: dnswire.RcodeBadKey},
+		{name: "clocks apart", server: &key{"update.", "hmac-sha256", secret}, client: &key{"update.", "hmac-sha256", secret}, skew: time.Hour, rcode: dnswire.RcodeBadTime},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var k *dnswire.Key
+			if tt.client != nil {
+				var err error
+				if k, err = dnswire.NewKey(tt.client.name, tt.client.algorithm, tt.client.secret); err != nil {
+					t.Fatal(err)
+				}
+			}
+			s, p := newRFC2136(t, k)
+			if tt.server != nil {
+				if err := s.AddKey(tt.server.name, tt.server.algorithm, tt.server.secret); err != nil {
+					t.Fatal(err)
+				}
+			}
+			s.RequireKey(tt.requireKey)
+			s.SetClock(func() time.Time { return time.Now().Add(tt.skew) })
+
+			err := p.Upsert(aRecord("home.example.com", "8.8.4.7"))
+			var apiErr *APIError
+			switch {
+			case tt.rcode == 0 && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case tt.rcode != 0 && (!errors.As(err, &apiErr) || apiErr.StatusCode != tt.rcode):
+				t.Fatalf("got error %v, want %s", err, dnswire.RcodeName(tt.rcode))
+			}
+			got := s.Lookup("home.example.com", "A")
+			if want := tt.rcode == 0; (len(got) == 1) != want {
+				t.Errorf("record is %v, want it made %v", got, want)
+			}
+			if tt.rcode == 0 {
+				// the response must verify too, so reading it back is signed both ways
+				if _, err := p.Record(context.Background(), "example.com", "home.example.com", "A"); err != nil {
+					t.Errorf("reading the record back: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestRFC2136FallsBackToTCP(t *testing.T) {
+	s, p := newRFC2136(t, nil)
+	// more answers than fit in 512 bytes
+	var ips []string
+	for i := 1; i <= 40; i++ {
+		ip := fmt.Sprintf("8.8.4.%d", i)
+		ips = append(ips, ip)
+		if err := s.Add("home.example.com", "A", 600, ip); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r, err := p.Record(context.Background(), "example.com", "home.example.com", "A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Answers) != len(ips) {
+		t.Errorf("got %d answers, want all %d", len(r.Answers), len(ips))
+	}
+	var queries int
+	for _, req := range s.Requests() {
+		if req == "QUERY home.example.com A" {
+			queries++
+		}
+	}
+	if queries != 2 {
+		t.Errorf("record was queried %d times, want over UDP and again over TCP", queries)
+	}
+
+	// an update too big for UDP is sent over TCP
+	s.ResetRequests()
+	r.ID = ""
+	if err := p.Delete("example.com", "home.example.com", "A"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Upsert(r); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Lookup("home.example.com", "A"); len(got) != len(ips) {
+		t.Errorf("got %d answers after the update, want %d", len(got), len(ips))
+	}
+}
+
+func TestRFC2136Prerequisites(t *testing.T) {
+	tests := []struct {
+		name string
+		// existing is the record on the server to start with
+		existing []string
+		// read is set if the record is read before it is written
+		read bool
+		// changed is added on the server after the record is read
+		changed string
+		delete  bool
+
+		wantErr error
+		want    []string
+	}{
+		{name: "create", want: []string{"8.8.4.7"}},
+		{name: "create of a record that exists", existing: []string{"8.8.4.4"}, wantErr: ErrConflict, want: []string{"8.8.4.4"}},
+		{name: "replace as read", existing: []string{"8.8.4.4"}, read: true, want: []string{"8.8.4.7"}},
+		{name: "replace of a record changed since read", existing: []string{"8.8.4.4"}, read: true, changed: "8.8.8.8", wantErr: ErrConflict, want: []string{"8.8.4.4", "8.8.8.8"}},
+		{name: "delete", existing: []string{"8.8.4.4"}, delete: true},
+		{name: "delete of a missing record", delete: true, wantErr: ErrRecordMissing},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, p := newRFC2136(t, nil)
+			for _, ip := range tt.existing {
+				if err := s.Add("home.example.com", "A", 600, ip); err != nil {
+					t.Fatal(err)
+				}
+			}
+			r := aRecord("home.example.com", "8.8.4.7")
+			if tt.read {
+				got, err := p.Record(context.Background(), "example.com", "home.example.com", "A")
+				if err != nil {
+					t.Fatal(err)
+				}
+				r.ID = got.ID
+			}
+			if tt.changed != "" {
+				if err := s.Add("home.example.com", "A", 600, tt.changed); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var err error
+			if tt.delete {
+				err = p.Delete("example.com", "home.example.com", "A")
+			} else {
+				err = p.Upsert(r)
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if got := s.Lookup("home.example.com", "A"); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("record is %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRFC2136Meta(t *testing.T) {
+	s, p := newRFC2136(t, nil)
+	r := aRecord("home.example.com", "8.8.4.7", "8.8.8.8")
+	r.Meta = &data.Meta{Note: "dnsupdate owner=home"}
+	r.Tags = map[string]string{"owner": "home"}
+	r.Answers[0].Meta.Note = "home"
+	if err := p.Upsert(r); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Lookup(MetaPrefix+"a.home.example.com", "TXT"); len(got) != 1 {
+		t.Fatalf("meta is %v, want one TXT record", got)
+	}
+
+	got, err := p.Record(context.Background(), "example.com", "home.example.com", "A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Meta == nil || got.Meta.Note != "dnsupdate owner=home" {
+		t.Errorf("record meta is %v, want the note kept", got.Meta)
+	}
+	if !reflect.DeepEqual(got.Tags, r.Tags) {
+		t.Errorf("tags are %v, want %v", got.Tags, r.Tags)
+	}
+	notes := map[string]interface{}{}
+	for _, a := range got.Answers {
+		if a.Meta != nil && a.Meta.Note != nil {
+			notes[a.String()] = a.Meta.Note
+		}
+	}
+	if want := map[string]interface{}{"8.8.4.7": "home"}; !reflect.DeepEqual(notes, want) {
+		t.Errorf("answer notes are %v, want %v", notes, want)
+	}
+
+	if err := p.Delete("example.com", "home.example.com", "A"); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Lookup(MetaPrefix+"a.home.example.com", "TXT"); len(got) != 0 {
+		t.Errorf("meta is %v, want it deleted with the record", got)
+	}
+}
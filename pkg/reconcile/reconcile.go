@@ -0,0 +1,161 @@
+package reconcile
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/m1k8/DNSUpdate/pkg/config"
+	"github.com/m1k8/DNSUpdate/pkg/owner"
+	"github.com/m1k8/DNSUpdate/pkg/plan"
+	"github.com/m1k8/DNSUpdate/pkg/provider"
+	"gopkg.in/ns1/ns1-go.v2/rest/model/dns"
+)
+
+// IPPlaceholder in a declared answer is replaced with the detected public IP
+const IPPlaceholder = "{ip}"
+
+// DefaultTTL is used for declared records without one
+const DefaultTTL = 600
+
+// NeedsIP reports whether any record declared in z uses the public IP
+func NeedsIP(z config.Zone) bool {
+	for _, r := range z.Records {
+		for _, a := range r.Answers {
+			if strings.Contains(a, IPPlaceholder) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Desired returns the records declared in z, with ip in place of
+// IPPlaceholder
+func Desired(z config.Zone, ip string) []*dns.Record {
+	records := make([]*dns.Record, 0, len(z.Records))
+	for _, d := range z.Records {
+		r := dns.NewRecord(z.Zone, d.FQDN(z.Zone), d.Type)
+		r.TTL = d.TTL
+		if r.TTL == 0 {
+			r.TTL = DefaultTTL
+		}
+		for _, a := range d.Answers {
+			r.AddAnswer(dns.NewAnswer(rdata(d.Type, strings.ReplaceAll(a, IPPlaceholder, ip))))
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+// rdata splits a declared answer into its fields. TXT data is kept whole, as
+// it may contain spaces
+func rdata(t, answer string) []string {
+	switch t {
+	case "TXT", "SPF":
+		return []string{answer}
+	}
+	return strings.Fields(answer)
+}
+
+// Plan works out the changes needed to make the published records in zone
+// match desired. zone must include its record list, as from Provider.Zone;
+// only records that differ are fetched in full. Records not in desired are
+// left alone, and so are records in desired that arent marked with m;
+// changes to those are refused
+func Plan(zone *dns.Zone, records provider.Provider, desired []*dns.Record, m owner.Marker) (*plan.Plan, error) {
+	published := map[string]*dns.ZoneRecord{}
+	for _, zr := range zone.Records {
+		published[key(zr.Domain, zr.Type)] = zr
+	}
+
+	p := &plan.Plan{Target: zone.Zone}
+	at := records.Name()
+	for _, want := range desired {
+		zr, ok := published[key(want.Domain, want.Type)]
+		if !ok {
+			m.Mark(want)
+			p.Add(plan.Change{Action: plan.Create, Provider: at, After: want})
+			continue
+		}
+		if zr.TTL == want.TTL && sameAnswers(zr.ShortAns, want.Answers) {
+			continue
+		}
+
+		have, err := records.Record(context.Background(), zone.Zone, want.Domain, want.Type)
+		if errors.Is(err, provider.ErrRecordMissing) {
+			// deleted since the zone was read
+			m.Mark(want)
+			p.Add(plan.Change{Action: plan.Create, Provider: at, After: want})
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("get %s %s: %w", want.Domain, want.Type, err)
+		}
+		if !m.Owns(have) {
+			p.Refuse("update %s %s: %s", want.Domain, want.Type, owner.ErrNotOwned)
+			continue
+		}
+		if after := merge(have, want); after != nil {
+			p.Add(plan.Change{Action: plan.Update, Provider: at, Before: have, After: after})
+		}
+	}
+	return p, nil
+}
+
+// merge returns have with the TTL and answers of want, or nil if it already
+// has them. Answers that are kept keep their ID and meta
+func merge(have, want *dns.Record) *dns.Record {
+	haveAns := make([]string, 0, len(have.Answers))
+	byRdata := map[string]*dns.Answer{}
+	for _, a := range have.Answers {
+		if a == nil {
+			continue
+		}
+		haveAns = append(haveAns, a.String())
+		byRdata[a.String()] = a
+	}
+	if have.TTL == want.TTL && sameAnswers(haveAns, want.Answers) {
+		return nil
+	}
+
+	after := *have
+	after.TTL = want.TTL
+	after.Answers = make([]*dns.Answer, 0, len(want.Answers))
+	for _, w := range want.Answers {
+		if a, ok := byRdata[w.String()]; ok {
+			c := *a
+			after.Answers = append(after.Answers, &c)
+			continue
+		}
+		after.Answers = append(after.Answers, w)
+	}
+	return &after
+}
+
+// sameAnswers compares published short answers with declared ones, ignoring
+// order
+func sameAnswers(short []string, answers []*dns.Answer) bool {
+	if len(short) != len(answers) {
+		return false
+	}
+	want := make([]string, len(answers))
+	for i, a := range answers {
+		want[i] = strings.Join(a.Rdata, " ")
+	}
+	have := append([]string(nil), short...)
+	sort.Strings(have)
+	sort.Strings(want)
+	for i := range have {
+		if !strings.EqualFold(have[i], want[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func key(domain, t string) string {
+	return strings.ToLower(strings.TrimSuffix(domain, ".")) + " " + strings.ToUpper(t)
+}
@@ -0,0 +1,233 @@
+package reconcile
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/m1k8/DNSUpdate/pkg/config"
+	"github.com/m1k8/DNSUpdate/pkg/dnsapi"
+	"github.com/m1k8/DNSUpdate/pkg/ns1fake"
+	"github.com/m1k8/DNSUpdate/pkg/owner"
+	"github.com/m1k8/DNSUpdate/pkg/provider"
+	"gopkg.in/ns1/ns1-go.v2/rest/model/dns"
+)
+
+const zone = "example.com"
+
+var marker = owner.Marker{Owner: "dnsupdate"}
+
+func record(domain, t string, ttl int, marked bool, answers ...string) *dns.Record {
+	r := dns.NewRecord(zone, domain, t)
+	r.TTL = ttl
+	for _, a := range answers {
+		r.AddAnswer(dns.NewAnswer(rdata(t, a)))
+	}
+	if marked {
+		marker.Mark(r)
+	}
+	return r
+}
+
+// published returns the TTL and answers of each record in the zone, by
+// "<domain> <type>"
+func published(f *ns1fake.Server) map[string]string {
+	got := map[string]string{}
+	for _, r := range f.Records(zone) {
+		var answers []string
+		for _, a := range r.Answers {
+			answers = append(answers, a.String())
+		}
+		sort.Strings(answers)
+		got[r.Domain+" "+r.Type] = fmt.Sprintf("%d %s", r.TTL, strings.Join(answers, ", "))
+	}
+	return got
+}
+
+func TestPlan(t *testing.T) {
+	declared := []config.Record{
+		{Domain: "www", Type: "A", TTL: 300, Answers: []string{IPPlaceholder}},
+		{Domain: "@", Type: "MX", Answers: []string{"10 mail.example.com"}},
+		{Domain: "_spf", Type: "TXT", Answers: []string{"v=spf1 ip4:{ip} -all"}},
+	}
+	tests := []struct {
+		name     string
+		existing []*dns.Record
+
+		actions []string
+		refused int
+		// want is the published records once the plan is applied, as from
+		// published
+		want map[string]string
+	}{
+		{
+			name:    "create",
+			actions: []string{"create www.example.com A", "create example.com MX", "create _spf.example.com TXT"},
+			want: map[string]string{
+				"www.example.com A":    "300 8.8.4.4",
+				"example.com MX":       "600 10 mail.example.com",
+				"_spf.example.com TXT": "600 v=spf1 ip4:8.8.4.4 -all",
+			},
+		},
+		{
+			name: "as declared",
+			existing: []*dns.Record{
+				record("www.example.com", "A", 300, true, "8.8.4.4"),
+				record("example.com", "MX", 600, true, "10 mail.example.com"),
+				record("_spf.example.com", "TXT", 600, true, "v=spf1 ip4:8.8.4.4 -all"),
+			},
+			want: map[string]string{
+				"www.example.com A":    "300 8.8.4.4",
+				"example.com MX":       "600 10 mail.example.com",
+				"_spf.example.com TXT": "600 v=spf1 ip4:8.8.4.4 -all",
+			},
+		},
+		{
+			name: "update answers and ttl",
+			existing: []*dns.Record{
+				record("www.example.com", "A", 300, true, "8.8.8.8"),
+				record("example.com", "MX", 300, true, "10 mail.example.com"),
+				record("_spf.example.com", "TXT", 600, true, "v=spf1 ip4:8.8.4.4 -all"),
+			},
+			actions: []string{"update www.example.com A", "update example.com MX"},
+			want: map[string]string{
+				"www.example.com A":    "300 8.8.4.4",
+				"example.com MX":       "600 10 mail.example.com",
+				"_spf.example.com TXT": "600 v=spf1 ip4:8.8.4.4 -all",
+			},
+		},
+		{
+			name: "extra answers dropped",
+			existing: []*dns.Record{
+				record("www.example.com", "A", 300, true, "8.8.4.4", "8.8.8.8"),
+				record("example.com", "MX", 600, true, "10 mail.example.com"),
+				record("_spf.example.com", "TXT", 600, true, "v=spf1 ip4:8.8.4.4 -all"),
+			},
+			actions: []string{"update www.example.com A"},
+			want: map[string]string{
+				"www.example.com A":    "300 8.8.4.4",
+				"example.com MX":       "600 10 mail.example.com",
+				"_spf.example.com TXT": "600 v=spf1 ip4:8.8.4.4 -all",
+			},
+		},
+		{
+			name: "unmarked record refused",
+			existing: []*dns.Record{
+				record("www.example.com", "A", 300, false, "8.8.8.8"),
+				record("example.com", "MX", 600, true, "10 mail.example.com"),
+				record("_spf.example.com", "TXT", 600, true, "v=spf1 ip4:8.8.4.4 -all"),
+			},
+			refused: 1,
+			want: map[string]string{
+				"www.example.com A":    "300 8.8.8.8",
+				"example.com MX":       "600 10 mail.example.com",
+				"_spf.example.com TXT": "600 v=spf1 ip4:8.8.4.4 -all",
+			},
+		},
+		{
+			// deleting records no longer declared is left to gc, which
+			// knows which ones this config managed
+			name: "undeclared records left alone",
+			existing: []*dns.Record{
+				record("www.example.com", "A", 300, true, "8.8.4.4"),
+				record("example.com", "MX", 600, true, "10 mail.example.com"),
+				record("_spf.example.com", "TXT", 600, true, "v=spf1 ip4:8.8.4.4 -all"),
+				record("old.example.com", "A", 300, true, "8.8.8.8"),
+				record("hand.example.com", "CNAME", 300, false, "www.example.com"),
+			},
+			want: map[string]string{
+				"www.example.com A":      "300 8.8.4.4",
+				"example.com MX":         "600 10 mail.example.com",
+				"_spf.example.com TXT":   "600 v=spf1 ip4:8.8.4.4 -all",
+				"old.example.com A":      "300 8.8.8.8",
+				"hand.example.com CNAME": "300 www.example.com",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := ns1fake.New()
+			defer f.Close()
+			f.AddZone(zone)
+			for _, r := range tt.existing {
+				f.PutRecord(r)
+			}
+			at := provider.NewNS1(provider.Default, dnsapi.FromREST(f.Client()))
+			z, err := at.Zone(zone)
+			if err != nil {
+				t.Fatal(err)
+			}
+			before := map[string]string{}
+			for _, r := range f.Records(zone) {
+				for _, a := range r.Answers {
+					before[r.Domain+" "+a.String()] = a.ID
+				}
+			}
+
+			p, err := Plan(z, at, Desired(config.Zone{Zone: zone, Records: declared}, "8.8.4.4"), marker)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var actions []string
+			for _, c := range p.Changes {
+				r := c.Record()
+				actions = append(actions, string(c.Action)+" "+r.Domain+" "+r.Type)
+				if c.After != nil && !marker.Owns(c.After) {
+					t.Errorf("%s %s %s would not be marked", c.Action, r.Domain, r.Type)
+				}
+			}
+			if !reflect.DeepEqual(actions, tt.actions) {
+				t.Errorf("planned %v, want %v", actions, tt.actions)
+			}
+			if len(p.Refused) != tt.refused {
+				t.Errorf("refused %v, want %d", p.Refused, tt.refused)
+			}
+
+			if err := p.Apply(provider.Registry{provider.Default: at}); err != nil {
+				t.Fatal(err)
+			}
+			if got := published(f); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("published %v, want %v", got, tt.want)
+			}
+			// answers kept by an update keep their IDs
+			for _, r := range f.Records(zone) {
+				for _, a := range r.Answers {
+					if id, ok := before[r.Domain+" "+a.String()]; ok && id != a.ID {
+						t.Errorf("%s answer %s has ID %q, want %q kept", r.Domain, a, a.ID, id)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestDesired(t *testing.T) {
+	z := config.Zone{Zone: zone, Records: []config.Record{
+		{Domain: "@", Type: "A", Answers: []string{IPPlaceholder}},
+		{Domain: "www.example.com", Type: "CNAME", TTL: 60, Answers: []string{"example.com"}},
+		{Domain: "txt", Type: "TXT", Answers: []string{"two words {ip}"}},
+	}}
+	if !NeedsIP(z) {
+		t.Error("a record with the placeholder needs the IP")
+	}
+	if NeedsIP(config.Zone{Zone: zone, Records: z.Records[1:2]}) {
+		t.Error("a record without the placeholder doesnt need the IP")
+	}
+
+	var got []string
+	for _, r := range Desired(z, "8.8.4.4") {
+		for _, a := range r.Answers {
+			got = append(got, fmt.Sprintf("%s %s %d %q", r.Domain, r.Type, r.TTL, a.Rdata))
+		}
+	}
+	want := []string{
+		`example.com A 600 ["8.8.4.4"]`,
+		`www.example.com CNAME 60 ["example.com"]`,
+		`txt.example.com TXT 600 ["two words 8.8.4.4"]`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("desired %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,42 @@
+package schedule
+
+import (
+	"errors"
+	"time"
+)
+
+// Adaptive checks every Min after a change or failure, then backs off by
+// Factor each time the IP is found unchanged, up to Max
+type Adaptive struct {
+	Min, Max time.Duration
+	Factor   float64
+
+	current time.Duration
+}
+
+func NewAdaptive(min, max time.Duration, factor float64) (*Adaptive, error) {
+	if factor == 0 {
+		factor = 2
+	}
+	switch {
+	case min <= 0:
+		return nil, errors.New("schedule: adaptive min must be positive")
+	case max < min:
+		return nil, errors.New("schedule: adaptive max must not be less than min")
+	case factor < 1:
+		return nil, errors.New("schedule: adaptive factor must be at least 1")
+	}
+	return &Adaptive{Min: min, Max: max, Factor: factor, current: min}, nil
+}
+
+func (a *Adaptive) Next(now time.Time, last Outcome) time.Time {
+	if last == Unchanged {
+		a.current = time.Duration(float64(a.current) * a.Factor)
+		if a.current > a.Max {
+			a.current = a.Max
+		}
+	} else {
+		a.current = a.Min
+	}
+	return now.Add(a.current)
+}
@@ -0,0 +1,50 @@
+package schedule
+
+import (
+	"time"
+
+	"github.com/m1k8/DNSUpdate/pkg/clock"
+)
+
+// WatchClock reports wall clock jumps larger than threshold, such as after
+// the machine resumes from sleep or its clock is corrected. Timers run on the
+// monotonic clock, which on most platforms stops while suspended, so a check
+// due during a sleep would otherwise be late by however long the sleep was.
+//
+// The returned channel receives the size of each jump, and is closed once
+// done is.
+func WatchClock(c clock.Clock, done <-chan struct{}, every, threshold time.Duration) <-chan time.Duration {
+	jumps := make(chan time.Duration, 1)
+	go func() {
+		defer close(jumps)
+		ticker := c.NewTicker(every)
+		defer ticker.Stop()
+
+		prev := c.Now()
+		for {
+			select {
+			case <-ticker.C():
+				now := c.Now()
+				// Round(0) strips the monotonic reading, leaving wall time
+				wall := now.Round(0).Sub(prev.Round(0))
+				mono := now.Sub(prev)
+				prev = now
+
+				jump := wall - mono
+				if jump < 0 {
+					jump = -jump
+				}
+				if jump > threshold {
+					select {
+					case jumps <- wall - mono:
+					default:
+					}
+				}
+
+			case <-done:
+				return
+			}
+		}
+	}()
+	return jumps
+}
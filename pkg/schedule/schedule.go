@@ -0,0 +1,93 @@
+package schedule
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/m1k8/DNSUpdate/pkg/config"
+)
+
+// DefaultInterval is used when a target has no schedule configured
+const DefaultInterval = 30 * time.Minute
+
+// Outcome is the result of the previous check, which adaptive schedules use
+// to decide how soon to check again
+type Outcome int
+
+const (
+	Unchanged Outcome = iota
+	Changed
+	Failed
+)
+
+// Schedule decides when the next check should run
+type Schedule interface {
+	// Next returns the time of the check following one that finished at now
+	Next(now time.Time, last Outcome) time.Time
+}
+
+// New builds the Schedule described by cfg
+func New(cfg config.Schedule) (Schedule, error) {
+	var s Schedule
+	switch {
+	case cfg.Cron != "" && cfg.Adaptive != nil:
+		return nil, errors.New("schedule: cron and adaptive cannot be used together")
+	case cfg.Cron != "":
+		c, err := ParseCron(cfg.Cron)
+		if err != nil {
+			return nil, err
+		}
+		s = c
+	case cfg.Adaptive != nil:
+		a, err := NewAdaptive(time.Duration(cfg.Adaptive.Min), time.Duration(cfg.Adaptive.Max), cfg.Adaptive.Factor)
+		if err != nil {
+			return nil, err
+		}
+		s = a
+	default:
+		every := time.Duration(cfg.Every)
+		if every == 0 {
+			every = DefaultInterval
+		}
+		if every < 0 {
+			return nil, errors.New("schedule: every must be positive")
+		}
+		s = Interval(every)
+	}
+
+	if cfg.Jitter < 0 {
+		return nil, errors.New("schedule: jitter must be positive")
+	}
+	if cfg.Jitter > 0 {
+		s = WithJitter(s, time.Duration(cfg.Jitter))
+	}
+	return s, nil
+}
+
+// Interval checks at a fixed period
+type Interval time.Duration
+
+func (i Interval) Next(now time.Time, _ Outcome) time.Time {
+	return now.Add(time.Duration(i))
+}
+
+type jittered struct {
+	s      Schedule
+	jitter time.Duration
+	rand   *rand.Rand
+}
+
+// WithJitter delays each of s's checks by a random amount up to jitter, so
+// that many hosts started together dont all call NS1 at once
+func WithJitter(s Schedule, jitter time.Duration) Schedule {
+	return &jittered{
+		s:      s,
+		jitter: jitter,
+		rand:   rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (j *jittered) Next(now time.Time, last Outcome) time.Time {
+	return j.s.Next(now, last).Add(time.Duration(j.rand.Int63n(int64(j.jitter))))
+}
@@ -0,0 +1,237 @@
+package schedule
+
+import (
+	"strings"
+	"testing"
+	"time"
+	// DST cases need the zone database, which a minimal host may lack
+	_ "time/tzdata"
+
+	"github.com/m1k8/DNSUpdate/pkg/clock"
+	"github.com/m1k8/DNSUpdate/pkg/config"
+)
+
+func TestParseCron(t *testing.T) {
+	tests := []struct {
+		expr    string
+		wantErr string
+	}{
+		{expr: "*/15 * * * *"},
+		{expr: "@hourly"},
+		{expr: " @daily "},
+		{expr: "0 9-17 * * 1-5"},
+		{expr: "1,2,3 * * * *"},
+		{expr: "5/10 * * * *"},
+		{expr: "0 0 * * 7"},
+		{expr: "0 0 29 2 *"},
+		{expr: "", wantErr: "expected 5 fields"},
+		{expr: "* * * *", wantErr: "expected 5 fields"},
+		{expr: "@fortnightly", wantErr: "expected 5 fields"},
+		{expr: "60 * * * *", wantErr: "out of range 0-59"},
+		{expr: "* 24 * * *", wantErr: "out of range 0-23"},
+		{expr: "* * 0 * *", wantErr: "out of range 1-31"},
+		{expr: "* * * 13 *", wantErr: "out of range 1-12"},
+		{expr: "* * * * 8", wantErr: "out of range 0-7"},
+		{expr: "5-1 * * * *", wantErr: "out of range"},
+		{expr: "*/0 * * * *", wantErr: "bad step"},
+		{expr: "a * * * *", wantErr: "bad value"},
+		{expr: "1-b * * * *", wantErr: "bad range"},
+		{expr: "0 0 31 2 *", wantErr: "never matches"},
+		{expr: "0 0 30 2 *", wantErr: "never matches"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			_, err := ParseCron(tt.expr)
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("got error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// clocks go forward at midnight, so 2024-09-08 starts at 01:00
+	santiago, err := time.LoadLocation("America/Santiago")
+	if err != nil {
+		t.Fatal(err)
+	}
+	utc := func(s string) time.Time {
+		tm, err := time.Parse("2006-01-02 15:04", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+	local := func(s string) time.Time {
+		tm, err := time.ParseInLocation("2006-01-02 15:04", s, ny)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+	tests := []struct {
+		name string
+		expr string
+		now  time.Time
+		want time.Time
+	}{
+		{name: "next minute", expr: "* * * * *", now: utc("2024-01-01 10:00").Add(30 * time.Second), want: utc("2024-01-01 10:01")},
+		{name: "not the current minute", expr: "0 * * * *", now: utc("2024-01-01 10:00"), want: utc("2024-01-01 11:00")},
+		{name: "step", expr: "*/15 * * * *", now: utc("2024-01-01 10:16"), want: utc("2024-01-01 10:30")},
+		{name: "into the next month", expr: "0 0 1 * *", now: utc("2024-01-31 12:00"), want: utc("2024-02-01 00:00")},
+		{name: "into the next year", expr: "59 23 31 12 *", now: utc("2024-12-31 23:59"), want: utc("2025-12-31 23:59")},
+		{name: "skips short months", expr: "0 0 31 * *", now: utc("2024-01-31 00:00"), want: utc("2024-03-31 00:00")},
+		{name: "leap day", expr: "0 0 29 2 *", now: utc("2024-03-01 00:00"), want: utc("2028-02-29 00:00")},
+		{name: "weekday", expr: "0 12 * * 1", now: utc("2023-12-31 00:00"), want: utc("2024-01-01 12:00")},
+		{name: "sunday as 7", expr: "0 0 * * 7", now: utc("2024-01-01 00:00"), want: utc("2024-01-07 00:00")},
+		{name: "either day field", expr: "0 0 13 * 5", now: utc("2024-09-01 00:00"), want: utc("2024-09-06 00:00")},
+		{name: "both day fields when one is *", expr: "0 0 13 * *", now: utc("2024-09-01 00:00"), want: utc("2024-09-13 00:00")},
+
+		// 2024-03-10 02:00 EST jumps to 03:00 EDT, and 2024-11-03 02:00 EDT
+		// back to 01:00 EST
+		{name: "daily over spring forward", expr: "0 3 * * *", now: local("2024-03-09 03:00"), want: local("2024-03-10 03:00")},
+		{name: "daily over fall back", expr: "0 3 * * *", now: local("2024-11-02 03:00"), want: local("2024-11-03 03:00")},
+		{name: "hour skipped by spring forward", expr: "30 2 * * *", now: local("2024-03-09 03:00"), want: local("2024-03-11 02:30")},
+		{name: "midnight skipped by spring forward", expr: "0 0 * * *", now: time.Date(2024, 9, 7, 12, 0, 0, 0, santiago), want: time.Date(2024, 9, 9, 0, 0, 0, 0, santiago)},
+		{name: "first hour after a skipped midnight", expr: "0 1 * * *", now: time.Date(2024, 9, 7, 12, 0, 0, 0, santiago), want: time.Date(2024, 9, 8, 1, 0, 0, 0, santiago)},
+		{name: "step over spring forward", expr: "*/15 * * * *", now: local("2024-03-10 01:45"), want: local("2024-03-10 03:00")},
+		{name: "step into the repeated hour", expr: "*/15 * * * *", now: time.Date(2024, 11, 3, 5, 45, 0, 0, time.UTC).In(ny), want: time.Date(2024, 11, 3, 6, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := ParseCron(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := c.Next(tt.now, Unchanged); !got.Equal(tt.want) {
+				t.Errorf("got %s, want %s", got, tt.want.In(tt.now.Location()))
+			}
+		})
+	}
+
+	// the day after spring forward is 23 hours on, and after fall back 25
+	c, _ := ParseCron("0 3 * * *")
+	if got := c.Next(local("2024-03-09 03:00"), Unchanged).Sub(local("2024-03-09 03:00")); got != 23*time.Hour {
+		t.Errorf("spring forward: next check %s later, want 23h", got)
+	}
+	if got := c.Next(local("2024-11-02 03:00"), Unchanged).Sub(local("2024-11-02 03:00")); got != 25*time.Hour {
+		t.Errorf("fall back: next check %s later, want 25h", got)
+	}
+}
+
+func TestNew(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		cfg     config.Schedule
+		want    time.Time
+		wantErr string
+	}{
+		{name: "default", want: start.Add(DefaultInterval)},
+		{name: "every", cfg: config.Schedule{Every: config.Duration(5 * time.Minute)}, want: start.Add(5 * time.Minute)},
+		{name: "cron", cfg: config.Schedule{Cron: "@hourly"}, want: start.Add(time.Hour)},
+		{name: "adaptive", cfg: config.Schedule{Adaptive: &config.Adaptive{Min: config.Duration(time.Minute), Max: config.Duration(time.Hour)}}, want: start.Add(2 * time.Minute)},
+		{name: "negative every", cfg: config.Schedule{Every: config.Duration(-time.Minute)}, wantErr: "every must be positive"},
+		{name: "negative jitter", cfg: config.Schedule{Jitter: config.Duration(-time.Minute)}, wantErr: "jitter must be positive"},
+		{name: "cron and adaptive", cfg: config.Schedule{Cron: "@hourly", Adaptive: &config.Adaptive{Min: config.Duration(time.Minute), Max: config.Duration(time.Hour)}}, wantErr: "cannot be used together"},
+		{name: "bad cron", cfg: config.Schedule{Cron: "* * *"}, wantErr: "expected 5 fields"},
+		{name: "adaptive max below min", cfg: config.Schedule{Adaptive: &config.Adaptive{Min: config.Duration(time.Hour), Max: config.Duration(time.Minute)}}, wantErr: "max must not be less than min"},
+		{name: "adaptive factor below 1", cfg: config.Schedule{Adaptive: &config.Adaptive{Min: config.Duration(time.Minute), Max: config.Duration(time.Hour), Factor: 0.5}}, wantErr: "factor must be at least 1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := New(tt.cfg)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := s.Next(start, Unchanged); !got.Equal(tt.want) {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAdaptive(t *testing.T) {
+	a, err := NewAdaptive(time.Minute, 10*time.Minute, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, tt := range []struct {
+		last Outcome
+		want time.Duration
+	}{
+		{Unchanged, 2 * time.Minute},
+		{Unchanged, 4 * time.Minute},
+		{Unchanged, 8 * time.Minute},
+		{Unchanged, 10 * time.Minute},
+		{Unchanged, 10 * time.Minute},
+		{Changed, time.Minute},
+		{Unchanged, 2 * time.Minute},
+		{Failed, time.Minute},
+	} {
+		if got := a.Next(now, tt.last).Sub(now); got != tt.want {
+			t.Errorf("check %d: got %s, want %s", i, got, tt.want)
+		}
+	}
+}
+
+func TestJitter(t *testing.T) {
+	tests := []struct {
+		name   string
+		s      Schedule
+		jitter time.Duration
+		// base is when s alone would next check, from now
+		base func(now time.Time) time.Time
+	}{
+		{name: "interval", s: Interval(time.Minute), jitter: 10 * time.Second, base: func(now time.Time) time.Time { return now.Add(time.Minute) }},
+		{name: "cron", s: mustCron(t, "*/5 * * * *"), jitter: time.Minute, base: func(now time.Time) time.Time {
+			return now.Truncate(5 * time.Minute).Add(5 * time.Minute)
+		}},
+		{name: "one nanosecond", s: Interval(time.Minute), jitter: 1, base: func(now time.Time) time.Time { return now.Add(time.Minute) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+			s := WithJitter(tt.s, tt.jitter)
+			delays := map[time.Duration]bool{}
+			for i := 0; i < 500; i++ {
+				now := c.Now()
+				base := tt.base(now)
+				next := s.Next(now, Unchanged)
+				if d := next.Sub(base); d < 0 || d >= tt.jitter {
+					t.Fatalf("check %d at %s: jittered by %s, want within [0, %s)", i, now, d, tt.jitter)
+				}
+				delays[next.Sub(base)] = true
+				c.Advance(next.Sub(now))
+			}
+			// with 500 draws, a jitter of more than a few nanoseconds should
+			// never give the same delay every time
+			if tt.jitter > 100 && len(delays) < 2 {
+				t.Errorf("every check was delayed by the same %v", delays)
+			}
+		})
+	}
+}
+
+func mustCron(t *testing.T, expr string) *Cron {
+	t.Helper()
+	c, err := ParseCron(expr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
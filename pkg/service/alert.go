@@ -0,0 +1,90 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Alert is raised when the service refuses to publish an IP, so somebody can
+// look into why
+type Alert struct {
+	Time   time.Time `json:"time"`
+	Target string    `json:"target"`
+	IP     string    `json:"ip,omitempty"`
+	Reason string    `json:"reason"`
+}
+
+// alerts sends alerts on to wherever the config says, as well as the log
+type alerts struct {
+	webhook string
+	client  *http.Client
+}
+
+func (a *alerts) send(al Alert) {
+	log.Printf("ALERT %s: %s\n", al.Target, al.Reason)
+	if a == nil || a.webhook == "" {
+		return
+	}
+	if err := a.post(al); err != nil {
+		log.Println("Error sending alert - " + err.Error())
+	}
+}
+
+func (a *alerts) post(al Alert) error {
+	buf, err := json.Marshal(al)
+	if err != nil {
+		return err
+	}
+	rsp, err := a.client.Post(a.webhook, "application/json", bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook returned %s", rsp.Status)
+	}
+	return nil
+}
+
+// alarm is the alert standing for a target or zone, so it is sent once while
+// its cause lasts rather than on every check
+type alarm struct {
+	mu      sync.Mutex
+	current *Alert
+}
+
+func (a *alarm) raise(to *alerts, al Alert) {
+	a.mu.Lock()
+	same := a.current != nil && a.current.IP == al.IP && a.current.Reason == al.Reason
+	if !same {
+		a.current = &al
+	}
+	a.mu.Unlock()
+	if !same {
+		to.send(al)
+	}
+}
+
+func (a *alarm) clear(name string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.current != nil {
+		log.Printf("%s: alert cleared\n", name)
+		a.current = nil
+	}
+}
+
+func (a *alarm) get() *Alert {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.current == nil {
+		return nil
+	}
+	al := *a.current
+	return &al
+}
@@ -0,0 +1,101 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/m1k8/DNSUpdate/pkg/control"
+)
+
+// CheckTimeout bounds how long a check requested over the control channel
+// may take, including time spent waiting for a check already in progress
+const CheckTimeout = 2 * time.Minute
+
+// handle serves requests from the control channel
+func (s *Svc) handle(ctx context.Context, req control.Request) (interface{}, error) {
+	arg := func(i int) string {
+		if i < len(req.Args) {
+			return req.Args[i]
+		}
+		return ""
+	}
+
+	switch req.Command {
+	case "check":
+		ctx, cancel := context.WithTimeout(ctx, CheckTimeout)
+		defer cancel()
+		results, err := s.send(ctx, arg(0), request{})
+		if err != nil {
+			return nil, err
+		}
+		LogResults(results)
+		return results, nil
+
+	case "status":
+		return s.Status(), nil
+
+	case "pause":
+		if err := s.Pause(arg(0)); err != nil {
+			return nil, err
+		}
+		log.Println("Paused " + describe(arg(0)))
+		return s.Status(), nil
+
+	case "resume":
+		if err := s.Resume(arg(0)); err != nil {
+			return nil, err
+		}
+		log.Println("Resumed " + describe(arg(0)))
+		return s.Status(), nil
+
+	case "reload":
+		if err := s.Reload(); err != nil {
+			return nil, err
+		}
+		return s.Status(), nil
+
+	case "publish":
+		ip := net.ParseIP(arg(0))
+		if ip == nil || ip.To4() == nil {
+			return nil, errors.New("publish needs an IPv4 address")
+		}
+		ctx, cancel := context.WithTimeout(ctx, CheckTimeout)
+		defer cancel()
+		results, err := s.Publish(ctx, arg(1), ip.String())
+		if err != nil {
+			return nil, err
+		}
+		LogResults(results)
+		return results, nil
+	}
+	return nil, fmt.Errorf("%w '%s'", control.ErrUnknownCommand, req.Command)
+}
+
+func describe(name string) string {
+	if name == "" {
+		return "all targets"
+	}
+	return name
+}
+
+// LogResults logs the outcome of each result
+func LogResults(results []Result) {
+	for _, res := range results {
+		switch {
+		case res.Error != "":
+			log.Printf("%s: check failed - %s\n", res.Target, res.Error)
+		case res.Skipped != "":
+			log.Printf("%s: check skipped - %s\n", res.Target, res.Skipped)
+		case res.Held != "":
+			log.Printf("%s: check found %s, not published - %s\n", res.Target, res.NewIP, res.Held)
+		case res.Changed:
+			log.Printf("%s: check updated %s -> %s\n", res.Target, res.OldIP, res.NewIP)
+		default:
+			log.Printf("%s: check found no change (%s)\n", res.Target, res.NewIP)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/m1k8/DNSUpdate/pkg/compare"
+	"github.com/m1k8/DNSUpdate/pkg/config"
+	"github.com/m1k8/DNSUpdate/pkg/dyndns"
+	"github.com/m1k8/DNSUpdate/pkg/ippolicy"
+	"github.com/m1k8/DNSUpdate/pkg/owner"
+	"github.com/m1k8/DNSUpdate/pkg/provider"
+	"github.com/m1k8/DNSUpdate/pkg/update"
+	"gopkg.in/ns1/ns1-go.v2/rest/model/dns"
+)
+
+// HostStatus describes one record routers update through the dyndns2
+// server
+type HostStatus struct {
+	Host string `json:"host"`
+	Zone string `json:"zone"`
+
+	// the last update sent for the host, if any
+	User    string    `json:"user,omitempty"`
+	IP      string    `json:"ip,omitempty"`
+	Time    time.Time `json:"time,omitempty"`
+	Changed bool      `json:"changed"`
+	Error   string    `json:"error,omitempty"`
+
+	Alert *Alert `json:"alert,omitempty"`
+}
+
+// dyndnsHosts is every host and user of the dyndns2 server, by lower case
+// domain and username
+type dyndnsHosts struct {
+	hosts map[string]*dyndnsHost
+	users map[string]dyndnsUser
+	order []string
+}
+
+type dyndnsUser struct {
+	password string
+	hosts    map[string]bool
+}
+
+// dyndnsHost is one record, updated by one request at a time
+type dyndnsHost struct {
+	zone     string
+	domain   string
+	provider provider.Provider
+	policy   *ippolicy.Policy
+	alarm    alarm
+
+	mu     sync.Mutex
+	answer compare.Identity
+	last   *HostStatus
+}
+
+func buildDynDNS(cfg *config.DynDNS, providers provider.Registry) (*dyndnsHosts, error) {
+	d := &dyndnsHosts{hosts: map[string]*dyndnsHost{}, users: map[string]dyndnsUser{}}
+	for _, h := range cfg.Hosts {
+		policy, err := ippolicy.New(h.Policy)
+		if err != nil {
+			return nil, &ConfigError{Target: h.Domain, Err: err}
+		}
+		dst, err := providers.Get(h.Provider)
+		if err != nil {
+			return nil, &ConfigError{Target: h.Domain, Err: err}
+		}
+		note := h.Answer
+		if note == "" {
+			note = compare.DefaultNote
+		}
+		k := hostKey(h.Domain)
+		d.hosts[k] = &dyndnsHost{
+			zone:     h.Zone,
+			domain:   h.Domain,
+			provider: dst,
+			policy:   policy,
+			answer:   compare.Identity{Note: note},
+		}
+		d.order = append(d.order, k)
+	}
+	for _, u := range cfg.Users {
+		user := dyndnsUser{password: u.Password, hosts: map[string]bool{}}
+		for _, h := range u.Hosts {
+			user.hosts[hostKey(h)] = true
+		}
+		d.users[u.Username] = user
+	}
+	return d, nil
+}
+
+// pick returns the host with domain name, or every host if name is empty.
+// d may be nil
+func (d *dyndnsHosts) pick(name string) []*dyndnsHost {
+	if d == nil {
+		return nil
+	}
+	var hosts []*dyndnsHost
+	for _, k := range d.order {
+		if name == "" || k == hostKey(name) {
+			hosts = append(hosts, d.hosts[k])
+		}
+	}
+	return hosts
+}
+
+func hostKey(domain string) string {
+	return strings.ToLower(strings.TrimSuffix(domain, "."))
+}
+
+// update points the host at ip for user, reporting whether it changed. It
+// is made as a target's check would be, so the record must be marked as
+// managed, and the address is checked against the host's policy
+func (h *dyndnsHost) update(ctx context.Context, e *env, user, ip string) (changed bool, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	defer func() {
+		st := HostStatus{User: user, IP: ip, Time: e.clock.Now(), Changed: changed}
+		if err != nil {
+			st.Error = err.Error()
+		}
+		h.last = &st
+	}()
+
+	if err := h.policy.Check(ip); err != nil {
+		h.alarm.raise(e.alerts, Alert{Time: e.clock.Now(), Target: h.domain, IP: ip, Reason: err.Error()})
+		return false, fmt.Errorf("%w: %v", dyndns.ErrRejected, err)
+	}
+	h.alarm.clear(h.domain)
+
+	state, err := compare.GetRecord(ctx, &dns.Zone{Zone: h.zone}, h.provider, h.domain, h.answer)
+	if err != nil {
+		return false, err
+	}
+	if a := state.Answer(); a != nil && a.ID != "" {
+		h.answer.ID = a.ID
+	}
+	if state.IP() == ip {
+		return false, nil
+	}
+
+	p, err := update.PlanChange(ctx, ip, h.provider, h.zone, h.domain, state, h.answer, e.marker)
+	if errors.Is(err, owner.ErrNotOwned) {
+		return false, fmt.Errorf("%w: %v", dyndns.ErrNoHost, err)
+	}
+	if err != nil {
+		return false, err
+	}
+	if e.dryRun {
+		log.Printf("dyndns: dry run, not publishing:\n%s", p)
+		return false, nil
+	}
+	if err := e.snapshot(p); err != nil {
+		return false, err
+	}
+	id, err := update.Apply(p, e.providers, h.answer)
+	if err != nil {
+		return false, err
+	}
+	if id != "" {
+		h.answer.ID = id
+	}
+	return true, nil
+}
+
+func (h *dyndnsHost) status() HostStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	st := HostStatus{}
+	if h.last != nil {
+		st = *h.last
+	}
+	st.Host, st.Zone = h.domain, h.zone
+	st.Alert = h.alarm.get()
+	return st
+}
+
+// dyndnsBackend answers the dyndns2 server from the current config, so a
+// reload changes its users and hosts
+type dyndnsBackend struct {
+	s *Svc
+}
+
+func (b dyndnsBackend) current() *env {
+	b.s.mu.RLock()
+	defer b.s.mu.RUnlock()
+	return b.s.env
+}
+
+func (b dyndnsBackend) Login(username, password string) bool {
+	d := b.current().dyndns
+	if d == nil {
+		return false
+	}
+	u, ok := d.users[username]
+	// digests are compared, as ConstantTimeCompare returns at once for
+	// inputs of different lengths, and even for unknown users, so they take
+	// as long to turn away
+	want, got := sha256.Sum256([]byte(u.password)), sha256.Sum256([]byte(password))
+	match := subtle.ConstantTimeCompare(want[:], got[:]) == 1
+	return ok && match
+}
+
+func (b dyndnsBackend) Update(ctx context.Context, username, host, ip string) (bool, error) {
+	e := b.current()
+	if e.dyndns == nil {
+		return false, dyndns.ErrNoHost
+	}
+	k := hostKey(host)
+	h := e.dyndns.hosts[k]
+	if h == nil || !e.dyndns.users[username].hosts[k] {
+		return false, dyndns.ErrNoHost
+	}
+	return h.update(ctx, e, username, ip)
+}
+
+// ListenDynDNS opens the dyndns2 server's listener, if the config has one.
+// It is served from Start until Stop. Its address and certificate are not
+// changed by a reload, but its hosts and users are
+func (s *Svc) ListenDynDNS() error {
+	s.mu.RLock()
+	cfg := s.cfg.DynDNS
+	s.mu.RUnlock()
+	if cfg == nil {
+		return nil
+	}
+	srv, err := listenHTTP("dyndns server", cfg.Listen, cfg.TLSCert, cfg.TLSKey, dyndns.Handler(dyndnsBackend{s: s}))
+	if err != nil {
+		return err
+	}
+	s.servers = append(s.servers, srv)
+	return nil
+}
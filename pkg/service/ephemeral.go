@@ -0,0 +1,188 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/m1k8/DNSUpdate/pkg/clock"
+	"github.com/m1k8/DNSUpdate/pkg/compare"
+	"github.com/m1k8/DNSUpdate/pkg/config"
+	"github.com/m1k8/DNSUpdate/pkg/ephemeral"
+	"github.com/m1k8/DNSUpdate/pkg/owner"
+	"github.com/m1k8/DNSUpdate/pkg/plan"
+	"github.com/m1k8/DNSUpdate/pkg/provider"
+)
+
+// managed is owner.Managed, with the stamp of each ephemeral target, so gc
+// leaves them alone and removing the target deletes its stamp
+func managed(cfg *config.Config) owner.Set {
+	s := owner.Managed(cfg)
+	for _, t := range cfg.Targets {
+		if t.Ephemeral != nil && t.Ephemeral.TTL > 0 {
+			note := t.Answer
+			if note == "" {
+				note = compare.DefaultNote
+			}
+			s.Add(owner.Key{Provider: t.Provider, Zone: t.Zone, Domain: ephemeral.Name(t.Domain, note), Type: "TXT"})
+		}
+	}
+	return s
+}
+
+// renewal is when an ephemeral registration was last stamped, so it is only
+// written again once a quarter of its ttl has passed
+type renewal struct {
+	ttl     time.Duration
+	renewed time.Time
+}
+
+// due reports whether the stamp should be written again at now
+func (r *renewal) due(now time.Time) bool {
+	return now.Sub(r.renewed) >= r.ttl/4
+}
+
+// renew stamps domain as seen at now, if it is due
+func (r *renewal) renew(ctx context.Context, e *env, at provider.Provider, zone, domain, answer string, now time.Time) error {
+	if r.ttl <= 0 || e.dryRun || !r.due(now) {
+		return nil
+	}
+	p, err := ephemeral.Renew(ctx, at, e.marker, zone, domain, ephemeral.Stamp{Seen: now, TTL: r.ttl, Answer: answer})
+	if err != nil {
+		return err
+	}
+	// stamps are the service's own bookkeeping, so arent snapshotted
+	if err := p.Apply(e.providers); err != nil {
+		return err
+	}
+	r.renewed = now
+	return nil
+}
+
+// reaper deletes expired registrations in its zones every so often
+type reaper struct {
+	zones []owner.Key
+	every time.Duration
+	clock clock.Clock
+}
+
+// buildReaper returns the reaper for cfg, or nil if there is nothing to
+// reap
+func buildReaper(cfg *config.Config, c clock.Clock) *reaper {
+	seen := owner.Set{}
+	r := &reaper{every: time.Duration(cfg.Reaper.Every), clock: c}
+	add := func(provider, zone string) {
+		k := owner.Key{Provider: provider, Zone: zone}
+		if !seen.Has(k) {
+			seen.Add(k)
+			r.zones = append(r.zones, k)
+		}
+	}
+	for _, t := range cfg.Targets {
+		if t.Ephemeral != nil && t.Ephemeral.TTL > 0 {
+			add(t.Provider, t.Zone)
+		}
+	}
+	if cfg.Gateway != nil {
+		for _, t := range cfg.Gateway.Tokens {
+			if t.Ephemeral != nil {
+				add(t.Provider, t.Zone)
+			}
+		}
+	}
+	for _, z := range cfg.Reaper.Zones {
+		add(z.Provider, z.Zone)
+	}
+	if len(r.zones) == 0 {
+		return nil
+	}
+	return r
+}
+
+// run reaps every so often until quit is closed
+func (r *reaper) run(e *env, quit <-chan struct{}) {
+	// cancelled on quit, so a reap in progress doesnt hold up Stop
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-quit:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	timer := r.clock.NewTimer(r.every)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C():
+			r.reap(ctx, e)
+			timer.Reset(r.every)
+		case <-quit:
+			return
+		}
+	}
+}
+
+// reap deletes the expired registrations in each zone. The gateway is held
+// off meanwhile, so a host renewing just as it expires isnt lost
+func (r *reaper) reap(ctx context.Context, e *env) {
+	if e.gateway != nil {
+		e.gateway.mu.Lock()
+		defer e.gateway.mu.Unlock()
+	}
+	for _, k := range r.zones {
+		at, err := e.providers.Get(k.Provider)
+		if err != nil {
+			log.Println("Error reaping " + k.Zone + " - " + err.Error())
+			continue
+		}
+		p, bad, err := ephemeral.Reap(ctx, at, e.marker, k.Zone, r.clock.Now())
+		if err != nil {
+			log.Println("Error reaping " + k.Zone + " - " + err.Error())
+			continue
+		}
+		for _, err := range bad {
+			log.Println("Error reaping " + k.Zone + " - " + err.Error())
+		}
+		if err := release(e, p, "expired registrations"); err != nil {
+			log.Println("Error reaping " + k.Zone + " - " + err.Error())
+		}
+	}
+}
+
+// release deletes what p releases, logging it as what, unless in a dry run
+func release(e *env, p *plan.Plan, what string) error {
+	for _, r := range p.Refused {
+		log.Printf("Not deleting %s - %s\n", what, r)
+	}
+	if p.Empty() {
+		return nil
+	}
+	if e.dryRun {
+		log.Printf("Dry run, not deleting %s:\n%s", what, p)
+		return nil
+	}
+	log.Printf("Deleting %s:\n%s", what, p)
+	return e.apply(p)
+}
+
+// releaseOnStop deletes the answers of targets set to delete on stop. It is
+// called once they have stopped, and skips any on standby, as their answer
+// is the other host's
+func releaseOnStop(ctx context.Context, e *env, targets []*target) {
+	for _, t := range targets {
+		if !t.deleteOnStop || t.zone == nil || (t.lease != nil && !t.lease.Held()) {
+			continue
+		}
+		p, err := ephemeral.Release(ctx, t.provider, e.marker, t.zoneName, t.domain, t.answer)
+		if err == nil {
+			err = release(e, p, t.name+" on stop")
+		}
+		if err != nil && !errors.Is(err, provider.ErrRecordMissing) {
+			log.Println("Error deleting " + t.name + " on stop - " + err.Error())
+		}
+	}
+}
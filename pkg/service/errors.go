@@ -0,0 +1,30 @@
+package service
+
+import (
+	"fmt"
+
+	"github.com/m1k8/DNSUpdate/pkg/provider"
+)
+
+// ConfigError is returned by New, and by Reload, when part of the config,
+// named by Target, cant be set up as written. It lasts until the config is
+// fixed, so retrying will not help
+type ConfigError struct {
+	Target string
+	Err    error
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Target, e.Err)
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// NetworkError means a provider could not be reached at all, typically
+// because the network is not up yet
+type NetworkError = provider.NetworkError
+
+// APIError means a provider answered, but not with what we asked for
+type APIError = provider.APIError
@@ -0,0 +1,365 @@
+package service
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/m1k8/DNSUpdate/pkg/ca"
+	"github.com/m1k8/DNSUpdate/pkg/compare"
+	"github.com/m1k8/DNSUpdate/pkg/config"
+	"github.com/m1k8/DNSUpdate/pkg/ephemeral"
+	"github.com/m1k8/DNSUpdate/pkg/gateway"
+	"github.com/m1k8/DNSUpdate/pkg/ippolicy"
+	"github.com/m1k8/DNSUpdate/pkg/owner"
+	"github.com/m1k8/DNSUpdate/pkg/provider"
+	"github.com/m1k8/DNSUpdate/pkg/update"
+	api "gopkg.in/ns1/ns1-go.v2/rest"
+	"gopkg.in/ns1/ns1-go.v2/rest/model/dns"
+)
+
+// gatewayNote marks the answers registered with a token, so one token can
+// never change what another registered
+func gatewayNote(id string) string {
+	return "dnsupdate gateway=" + id
+}
+
+// gatewayTokens is every token of the gateway
+type gatewayTokens struct {
+	tokens []gateway.Token
+	byID   map[string]*gatewayToken
+
+	// mu makes one registration at a time, so two hosts cant both find a
+	// name free and register it
+	mu sync.Mutex
+	// renewals of ephemeral registrations, by token and host
+	renewals map[string]*renewal
+}
+
+type gatewayToken struct {
+	zone     string
+	provider provider.Provider
+	policy   *ippolicy.Policy
+	answer   compare.Identity
+	hosts    []string
+	ttl      time.Duration
+}
+
+func buildGateway(cfg *config.Gateway, providers provider.Registry) (*gatewayTokens, error) {
+	g := &gatewayTokens{byID: map[string]*gatewayToken{}, renewals: map[string]*renewal{}}
+	for _, t := range cfg.Tokens {
+		policy, err := ippolicy.New(t.Policy)
+		if err != nil {
+			return nil, &ConfigError{Target: "gateway token " + t.ID, Err: err}
+		}
+		dst, err := providers.Get(t.Provider)
+		if err != nil {
+			return nil, &ConfigError{Target: "gateway token " + t.ID, Err: err}
+		}
+		g.tokens = append(g.tokens, gateway.Token{
+			ID:       t.ID,
+			Secret:   t.Secret,
+			Auth:     t.Auth,
+			Hosts:    t.Hosts,
+			Requests: t.RateLimit.Requests,
+			Per:      time.Duration(t.RateLimit.Per),
+		})
+		g.byID[t.ID] = &gatewayToken{
+			zone:     t.Zone,
+			provider: dst,
+			policy:   policy,
+			answer:   compare.Identity{Note: gatewayNote(t.ID)},
+			hosts:    t.Hosts,
+		}
+		if t.Ephemeral != nil {
+			g.byID[t.ID].ttl = time.Duration(t.Ephemeral.TTL)
+		}
+	}
+	return g, nil
+}
+
+// claims reports whether k could have been registered through the gateway,
+// or is the stamp of such a registration, so garbage collection leaves it
+// to the hosts that did. g may be nil
+func (g *gatewayTokens) claims(k owner.Key) bool {
+	if g == nil {
+		return false
+	}
+	if host, ok := ephemeral.Host(k.Domain); ok {
+		k.Domain = host
+	}
+	for _, t := range g.byID {
+		if t.provider.Name() != k.Provider || !strings.EqualFold(t.zone, k.Zone) {
+			continue
+		}
+		for _, p := range t.hosts {
+			if gateway.Match(p, k.Domain) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// gatewayBackend makes the gateway's changes with the current config, so a
+// reload changes its tokens
+type gatewayBackend struct {
+	s *Svc
+}
+
+func (b gatewayBackend) current() (*env, *gatewayTokens) {
+	b.s.mu.RLock()
+	defer b.s.mu.RUnlock()
+	return b.s.env, b.s.env.gateway
+}
+
+func (b gatewayBackend) Tokens() []gateway.Token {
+	if _, g := b.current(); g != nil {
+		return g.tokens
+	}
+	return nil
+}
+
+// token returns what t may do, as the config may have been reloaded since
+// it was authenticated
+func (b gatewayBackend) token(t gateway.Token) (*env, *gatewayTokens, *gatewayToken, error) {
+	e, g := b.current()
+	if g == nil || g.byID[t.ID] == nil {
+		return nil, nil, nil, fmt.Errorf("token %s no longer exists", t.ID)
+	}
+	return e, g, g.byID[t.ID], nil
+}
+
+// get reads host's A record, with the token's answer picked out
+func (tok *gatewayToken) get(ctx context.Context, host string) (compare.RecordState, error) {
+	return compare.GetRecord(ctx, &dns.Zone{Zone: tok.zone}, tok.provider, host, tok.answer)
+}
+
+// renew stamps an ephemeral registration as still here. The caller must
+// hold g.mu
+func (g *gatewayTokens) renew(ctx context.Context, e *env, id string, tok *gatewayToken, host string) {
+	if tok.ttl <= 0 {
+		return
+	}
+	key := id + " " + hostKey(host)
+	r := g.renewals[key]
+	if r == nil || r.ttl != tok.ttl {
+		r = &renewal{ttl: tok.ttl}
+		g.renewals[key] = r
+	}
+	if err := r.renew(ctx, e, tok.provider, tok.zone, host, tok.answer.Note, e.clock.Now()); err != nil {
+		log.Printf("gateway token %s: error renewing %s - %s\n", id, host, err.Error())
+	}
+}
+
+// Lookup returns the address t registered for host. As agents look up
+// their address on every check, this renews an ephemeral registration
+func (b gatewayBackend) Lookup(ctx context.Context, t gateway.Token, host string) (string, error) {
+	e, g, tok, err := b.token(t)
+	if err != nil {
+		return "", err
+	}
+	state, err := tok.get(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	if state.Answer() == nil {
+		return "", gateway.ErrNotFound
+	}
+	g.mu.Lock()
+	g.renew(ctx, e, t.ID, tok, host)
+	g.mu.Unlock()
+	return state.IP(), nil
+}
+
+// Register points host at ip, as a target's check would, but only if every
+// answer in the record is the token's
+func (b gatewayBackend) Register(ctx context.Context, t gateway.Token, host, ip string) (bool, error) {
+	e, g, tok, err := b.token(t)
+	if err != nil {
+		return false, err
+	}
+	if err := tok.policy.Check(ip); err != nil {
+		return false, fmt.Errorf("%w: %v", gateway.ErrRejected, err)
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	state, err := tok.get(ctx, host)
+	if err != nil {
+		return false, err
+	}
+	if len(state.Others()) > 0 {
+		return false, fmt.Errorf("%s A: %w", host, gateway.ErrConflict)
+	}
+	if state.IP() == ip {
+		g.renew(ctx, e, t.ID, tok, host)
+		return false, nil
+	}
+
+	p, err := update.PlanChange(ctx, ip, tok.provider, tok.zone, host, state, tok.answer, e.marker)
+	if errors.Is(err, owner.ErrNotOwned) {
+		return false, fmt.Errorf("%w: %v", gateway.ErrConflict, err)
+	}
+	if err != nil {
+		return false, err
+	}
+	p.Target = "gateway token " + t.ID
+	if e.dryRun {
+		log.Printf("Dry run, not registering:\n%s", p)
+		return false, nil
+	}
+	if err := e.apply(p); err != nil {
+		return false, err
+	}
+	g.renew(ctx, e, t.ID, tok, host)
+	return true, nil
+}
+
+// Deregister deletes host's records, and any stamp, if the token registered
+// them
+func (b gatewayBackend) Deregister(ctx context.Context, t gateway.Token, host string) error {
+	e, g, tok, err := b.token(t)
+	if err != nil {
+		return err
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	state, err := tok.get(ctx, host)
+	if err != nil {
+		return err
+	}
+	if state.Answer() == nil {
+		return gateway.ErrNotFound
+	}
+	if len(state.Others()) > 0 || !e.marker.Owns(state.Record) {
+		return fmt.Errorf("%s A: %w", host, gateway.ErrConflict)
+	}
+
+	p, err := ephemeral.Release(ctx, tok.provider, e.marker, tok.zone, host, tok.answer)
+	if err != nil {
+		return err
+	}
+	p.Target = "gateway token " + t.ID
+	delete(g.renewals, t.ID+" "+hostKey(host))
+	if e.dryRun {
+		log.Printf("Dry run, not deregistering:\n%s", p)
+		return nil
+	}
+	return e.apply(p)
+}
+
+// ListenGateway opens the gateway's listener and audit log, if the config
+// has a gateway. It is served from Start until Stop. Its address,
+// certificates and audit log are not changed by a reload, but its tokens
+// are, and the revocation list is read again whenever it changes
+func (s *Svc) ListenGateway() error {
+	s.mu.RLock()
+	cfg := s.cfg.Gateway
+	clock := s.deps.Clock
+	s.mu.RUnlock()
+	if cfg == nil {
+		return nil
+	}
+
+	audit, err := os.OpenFile(cfg.AuditLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("gateway: %w", err)
+	}
+	srv, err := listenHTTP("gateway", cfg.Listen, cfg.TLSCert, cfg.TLSKey, gateway.NewServer(gatewayBackend{s: s}, audit, clock))
+	if err != nil {
+		audit.Close()
+		return err
+	}
+	if cfg.ClientCA != "" {
+		if err := requireClientCerts(srv.http.TLSConfig, cfg.ClientCA, cfg.RevocationList); err != nil {
+			srv.ln.Close()
+			audit.Close()
+			return fmt.Errorf("gateway: %w", err)
+		}
+	}
+	srv.closer = audit
+	s.servers = append(s.servers, srv)
+	return nil
+}
+
+// requireClientCerts makes tc only accept clients with a certificate issued
+// by the CA in caFile and not on the revocation list
+func requireClientCerts(tc *tls.Config, caFile, revocationList string) error {
+	pool, err := loadPool(caFile)
+	if err != nil {
+		return err
+	}
+	revoked, err := ca.LoadRevocations(revocationList)
+	if err != nil {
+		return err
+	}
+	tc.ClientAuth = tls.RequireAndVerifyClientCert
+	tc.ClientCAs = pool
+	tc.VerifyConnection = func(cs tls.ConnectionState) error {
+		cert := cs.PeerCertificates[0]
+		isRevoked, err := revoked.Revoked(cert)
+		if err != nil {
+			log.Println("Error reading revocation list - " + err.Error())
+		}
+		if isRevoked {
+			return fmt.Errorf("certificate %s is revoked", ca.Serial(cert))
+		}
+		return nil
+	}
+	return nil
+}
+
+// gatewayDoer returns doer, or for an agent with a client certificate or
+// its own CA, a client using them
+func gatewayDoer(p config.Provider, doer api.Doer) (api.Doer, error) {
+	if p.TLSCert == "" && p.TLSCA == "" {
+		return doer, nil
+	}
+	tc := &tls.Config{MinVersion: tls.VersionTLS12}
+	if p.TLSCert != "" {
+		pair, err := tls.LoadX509KeyPair(p.TLSCert, p.TLSKey)
+		if err != nil {
+			return nil, err
+		}
+		tc.Certificates = []tls.Certificate{pair}
+	}
+	if p.TLSCA != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		b, err := os.ReadFile(p.TLSCA)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("%s: no PEM certificates", p.TLSCA)
+		}
+		tc.RootCAs = pool
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tc
+	return &http.Client{Timeout: time.Second * 10, Transport: transport}, nil
+}
+
+func loadPool(file string) (*x509.CertPool, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("%s: no PEM certificates", file)
+	}
+	return pool, nil
+}
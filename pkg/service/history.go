@@ -0,0 +1,209 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/m1k8/DNSUpdate/pkg/config"
+	"github.com/m1k8/DNSUpdate/pkg/monitoring"
+	"github.com/m1k8/DNSUpdate/pkg/owner"
+	"github.com/m1k8/DNSUpdate/pkg/provider"
+)
+
+// history is what the service has managed from a config, kept in its
+// managed file. Hosts sharing a zone share the owner, so the mark alone
+// cant say which host made a record or job, and gc only deletes those
+// listed here
+type history struct {
+	records owner.Set
+
+	// answers are the notes of the answers published in shared A records,
+	// so only those are dropped from them
+	answers owner.Answers
+
+	// jobs are set to whether the target failed over
+	jobs map[jobKey]bool
+}
+
+// jobKey names the monitoring job of a target's answer
+type jobKey struct {
+	Provider string `json:"provider"`
+	Zone     string `json:"zone"`
+	Domain   string `json:"domain"`
+	Answer   string `json:"answer,omitempty"`
+}
+
+func (k jobKey) normal() jobKey {
+	if k.Provider == "" {
+		k.Provider = provider.Default
+	}
+	return k
+}
+
+func (k jobKey) String() string {
+	return monitoring.Name(k.Domain, k.Answer)
+}
+
+// historyFile is how history is written
+type historyFile struct {
+	Records []owner.Key   `json:"records"`
+	Answers []answerEntry `json:"answers,omitempty"`
+	Jobs    []jobEntry    `json:"jobs,omitempty"`
+}
+
+type answerEntry struct {
+	owner.Key
+	Notes []string `json:"notes"`
+}
+
+type jobEntry struct {
+	jobKey
+	Failover bool `json:"failover,omitempty"`
+}
+
+// historyMu guards the managed files
+var historyMu sync.Mutex
+
+// loadHistory reads a managed file. One that doesnt exist yet is empty
+func loadHistory(path string) (*history, error) {
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	return readHistory(path)
+}
+
+func readHistory(path string) (*history, error) {
+	h := &history{records: owner.Set{}, answers: owner.Answers{}, jobs: map[jobKey]bool{}}
+	buf, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return h, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var f historyFile
+	if err := json.Unmarshal(buf, &f); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for _, k := range f.Records {
+		h.records.Add(k)
+	}
+	for _, a := range f.Answers {
+		for _, n := range a.Notes {
+			h.answers.Add(a.Key, n)
+		}
+	}
+	for _, j := range f.Jobs {
+		h.jobs[j.jobKey.normal()] = j.Failover
+	}
+	return h, nil
+}
+
+// write replaces the managed file whole, so a crash part way through leaves
+// the old one
+func (h *history) write(path string) error {
+	f := historyFile{Records: h.records.Minus(nil)}
+	for _, k := range f.Records {
+		if notes, ok := h.answers.Get(k); ok {
+			f.Answers = append(f.Answers, answerEntry{k, notes})
+		}
+	}
+	for _, k := range h.sortedJobs() {
+		f.Jobs = append(f.Jobs, jobEntry{k, h.jobs[k]})
+	}
+	buf, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, buf, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (h *history) sortedJobs() []jobKey {
+	keys := make([]jobKey, 0, len(h.jobs))
+	for k := range h.jobs {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		return a.Provider+" "+a.Zone+" "+a.String() < b.Provider+" "+b.Zone+" "+b.String()
+	})
+	return keys
+}
+
+// monitoredJobs returns the monitoring job of each target in cfg with a
+// monitor, set to whether it fails over
+func monitoredJobs(cfg *config.Config) map[jobKey]bool {
+	jobs := map[jobKey]bool{}
+	for _, t := range cfg.Targets {
+		if t.Monitor != nil {
+			jobs[jobKey{t.Provider, t.Zone, t.Domain, t.Answer}.normal()] = t.Failover != nil
+		}
+	}
+	return jobs
+}
+
+// remember adds the records and jobs cfg has the service manage to its
+// managed file, so gc may delete them once they are removed from the config
+func remember(cfg *config.Config) error {
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	h, err := readHistory(cfg.ManagedFile)
+	if err != nil {
+		return err
+	}
+	changed := false
+	for k := range managed(cfg) {
+		if !h.records.Has(k) {
+			h.records.Add(k)
+			changed = true
+		}
+	}
+	for k, notes := range owner.ManagedAnswers(cfg) {
+		for _, n := range notes {
+			if !h.answers.Has(k, n) {
+				h.answers.Add(k, n)
+				changed = true
+			}
+		}
+	}
+	for k, failover := range monitoredJobs(cfg) {
+		if had, ok := h.jobs[k]; !ok || had != failover {
+			h.jobs[k] = failover
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return h.write(cfg.ManagedFile)
+}
+
+// forget drops records and jobs that have been deleted from the managed
+// file, so they are left alone should another host publish them later
+func forget(cfg *config.Config, records []owner.Key, jobs []jobKey) error {
+	if len(records) == 0 && len(jobs) == 0 {
+		return nil
+	}
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	h, err := readHistory(cfg.ManagedFile)
+	if err != nil {
+		return err
+	}
+	for _, k := range records {
+		h.records.Remove(k)
+		h.answers.Remove(k)
+	}
+	for _, k := range jobs {
+		delete(h.jobs, k.normal())
+	}
+	return h.write(cfg.ManagedFile)
+}
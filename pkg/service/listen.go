@@ -0,0 +1,71 @@
+package service
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// httpServer is an HTTP(S) server the service runs alongside its targets,
+// such as the dyndns2 server
+type httpServer struct {
+	name string
+	http *http.Server
+	ln   net.Listener
+	tls  bool
+
+	// closer, if set, is closed once the server has stopped
+	closer io.Closer
+}
+
+// listenHTTP opens a listener on addr for h, serving HTTPS if cert and key
+// are set. They are loaded now, so a bad certificate stops the service
+// starting
+func listenHTTP(name, addr, cert, key string, h http.Handler) (*httpServer, error) {
+	srv := &http.Server{
+		Handler:           h,
+		ReadHeaderTimeout: 10 * time.Second,
+		WriteTimeout:      time.Minute,
+	}
+	if cert != "" {
+		pair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{pair}, MinVersion: tls.VersionTLS12}
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return &httpServer{name: name, http: srv, ln: ln, tls: cert != ""}, nil
+}
+
+func (s *httpServer) serve() {
+	log.Printf("%s listening on %s\n", s.name, s.ln.Addr())
+	var err error
+	if s.tls {
+		err = s.http.ServeTLS(s.ln, "", "")
+	} else {
+		err = s.http.Serve(s.ln)
+	}
+	if err != nil && err != http.ErrServerClosed {
+		log.Printf("%s stopped - %s\n", s.name, err.Error())
+	}
+}
+
+func (s *httpServer) close() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := s.http.Shutdown(ctx); err != nil {
+		log.Printf("Error closing %s - %s\n", s.name, err.Error())
+	}
+	if s.closer != nil {
+		s.closer.Close()
+	}
+}
@@ -0,0 +1,249 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/m1k8/DNSUpdate/pkg/compare"
+	"github.com/m1k8/DNSUpdate/pkg/config"
+	"github.com/m1k8/DNSUpdate/pkg/monitoring"
+	"github.com/m1k8/DNSUpdate/pkg/multierr"
+	"github.com/m1k8/DNSUpdate/pkg/owner"
+	"github.com/m1k8/DNSUpdate/pkg/provider"
+	"github.com/m1k8/DNSUpdate/pkg/update"
+	"gopkg.in/ns1/ns1-go.v2/rest/model/monitor"
+)
+
+// MonitorStatus is the state of a target's NS1 monitoring job
+type MonitorStatus struct {
+	Job    string    `json:"job,omitempty"`
+	Status string    `json:"status,omitempty"`
+	Since  time.Time `json:"since,omitempty"`
+
+	// Feed links the job to the target's answer, when it fails over
+	Feed string `json:"feed,omitempty"`
+
+	// Error is why the job couldnt be kept up to date, if it couldnt
+	Error string `json:"error,omitempty"`
+}
+
+// watcher keeps a target's monitoring job pointed at its address, and if
+// it fails over, its answer's up meta linked to the job
+type watcher struct {
+	monitor *monitoring.Monitor
+
+	// feeds and failover are nil unless the target fails over
+	feeds    *monitoring.Feeds
+	failover *update.Failover
+}
+
+// buildWatcher returns the watcher for t, which is published through at,
+// or nil if it has no monitor
+func buildWatcher(t config.Target, at provider.Provider, m owner.Marker) (*watcher, error) {
+	if t.Monitor == nil {
+		return nil, nil
+	}
+	mp, ok := at.(provider.Monitoring)
+	if !ok || mp.Jobs() == nil {
+		return nil, errors.New("provider " + at.Name() + " cant monitor")
+	}
+	spec := monitoring.Spec{
+		Type:      t.Monitor.Type,
+		Port:      t.Monitor.Port,
+		URL:       t.Monitor.URL,
+		Regions:   t.Monitor.Regions,
+		Frequency: time.Duration(t.Monitor.Every),
+	}
+	if spec.Port == 0 {
+		spec.Port = update.SRVPort
+	}
+	w := &watcher{monitor: monitoring.New(mp.Jobs(), spec, t.Domain, t.Answer, m)}
+	if f := t.Failover; f != nil {
+		w.feeds = monitoring.NewFeeds(mp.DataSources(), mp.DataFeeds())
+		w.failover = &update.Failover{Filters: update.Chain(f.Priority > 0, f.SelectFirst), Priority: f.Priority}
+	}
+	return w, nil
+}
+
+// watch points the target's monitoring job at ip, the address now
+// published, links it to the target's answer if it fails over, and records
+// the job's state
+func (t *target) watch(ctx context.Context, env *env, ip string) {
+	if t.watcher == nil || env.dryRun || ip == "" {
+		return
+	}
+	st := &MonitorStatus{}
+	j, err := t.watcher.monitor.Ensure(ip)
+	if err == nil {
+		st.Job = j.ID
+		st.Status, st.Since = monitoring.State(j)
+		st.Feed, err = t.link(ctx, env, j)
+	}
+	if err != nil {
+		log.Printf("%s: error keeping monitoring job - %s\n", t.name, err.Error())
+		st.Error = err.Error()
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if st.Job == "" && t.monitorStatus != nil {
+		st.Job = t.monitorStatus.Job
+	}
+	t.monitorStatus = st
+}
+
+// link points the up meta of the target's answer at the feed of job j, and
+// serves the record through the failover filters. It returns the feed's ID
+func (t *target) link(ctx context.Context, env *env, j *monitor.Job) (string, error) {
+	w := t.watcher
+	if w.failover == nil {
+		return "", nil
+	}
+	feed, err := w.feeds.Link(j)
+	if err != nil {
+		return "", err
+	}
+	f := *w.failover
+	f.Up = feed
+	p, err := update.PlanFailover(ctx, t.provider, t.zoneName, t.domain, t.answer, f, env.marker)
+	if err != nil || p.Empty() {
+		return feed.FeedID, err
+	}
+	log.Printf("%s: linking answer to monitoring job:\n%s", t.name, p)
+	return feed.FeedID, t.apply(env, p)
+}
+
+// monitored is a target with a monitoring job
+type monitored struct {
+	provider, zone, domain, answer string
+
+	// unlink is set if the target is still there, so its answer must stop
+	// following the job before it is deleted
+	unlink bool
+}
+
+// removedMonitors returns the targets in old whose monitoring job isnt
+// wanted by new
+func removedMonitors(old, new *config.Config) []monitored {
+	kept := map[monitored]*config.Target{}
+	for i, t := range new.Targets {
+		kept[monitored{t.Provider, t.Zone, t.Domain, t.Answer, false}] = &new.Targets[i]
+	}
+	var removed []monitored
+	for _, t := range old.Targets {
+		k := monitored{t.Provider, t.Zone, t.Domain, t.Answer, false}
+		now, ok := kept[k]
+		switch {
+		case t.Monitor == nil:
+		case !ok:
+			removed = append(removed, k)
+		case now.Monitor == nil:
+			k.unlink = t.Failover != nil
+			removed = append(removed, k)
+		}
+	}
+	return removed
+}
+
+// deleteMonitors deletes the monitoring jobs of removed targets, and their
+// feeds, unless in a dry run, and returns those deleted. The answer of a
+// target that is still there is left up for good
+func deleteMonitors(ctx context.Context, e *env, removed []monitored) []jobKey {
+	var deleted []jobKey
+	for _, k := range removed {
+		if e.dryRun {
+			log.Printf("Dry run, not deleting monitoring job of %s\n", k.domain)
+			continue
+		}
+		if err := deleteMonitor(ctx, e, k); err != nil {
+			log.Println("Error deleting monitoring job of " + k.domain + " - " + err.Error())
+			continue
+		}
+		deleted = append(deleted, jobKey{k.provider, k.zone, k.domain, k.answer})
+	}
+	return deleted
+}
+
+// orphanedMonitors returns the jobs the managed file says this config had
+// the service create, but that no target in cfg monitors any more, as when
+// a target or its monitor was removed while the service wasnt running.
+// Jobs other hosts made, even with the same owner, are never among them
+func orphanedMonitors(cfg *config.Config) ([]monitored, error) {
+	h, err := loadHistory(cfg.ManagedFile)
+	if err != nil {
+		return nil, err
+	}
+	wanted := monitoredJobs(cfg)
+	targets := map[jobKey]bool{}
+	for _, t := range cfg.Targets {
+		targets[jobKey{t.Provider, t.Zone, t.Domain, t.Answer}.normal()] = true
+	}
+	var orphans []monitored
+	for _, k := range h.sortedJobs() {
+		if _, ok := wanted[k]; ok {
+			continue
+		}
+		// a target that failed over and is still there keeps being served
+		unlink := h.jobs[k] && targets[k]
+		orphans = append(orphans, monitored{k.Provider, k.Zone, k.Domain, k.Answer, unlink})
+	}
+	return orphans, nil
+}
+
+// collectMonitors deletes the orphaned monitoring jobs of cfg, and returns
+// their names. In a dry run they are only named
+func collectMonitors(ctx context.Context, cfg *config.Config, e *env) ([]string, error) {
+	orphans, err := orphanedMonitors(cfg)
+	if err != nil || len(orphans) == 0 {
+		return nil, err
+	}
+	var names []string
+	var deleted []jobKey
+	var errs []error
+	for _, k := range orphans {
+		name := monitoring.Name(k.domain, k.answer)
+		names = append(names, name)
+		if e.dryRun {
+			continue
+		}
+		if err := deleteMonitor(ctx, e, k); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			continue
+		}
+		deleted = append(deleted, jobKey{k.provider, k.zone, k.domain, k.answer})
+	}
+	errs = append(errs, forget(cfg, nil, deleted))
+	return names, multierr.Join(errs...)
+}
+
+func deleteMonitor(ctx context.Context, e *env, k monitored) error {
+	at, err := e.providers.Get(k.provider)
+	if err != nil {
+		return err
+	}
+	mp, ok := at.(provider.Monitoring)
+	if !ok || mp.Jobs() == nil {
+		return nil
+	}
+	if k.unlink {
+		id := compare.Identity{Note: k.answer}
+		if id.Note == "" {
+			id.Note = compare.DefaultNote
+		}
+		p, err := update.PlanFailover(ctx, at, k.zone, k.domain, id, update.Failover{Up: true}, e.marker)
+		if err != nil {
+			return err
+		}
+		if !p.Empty() {
+			log.Printf("Unlinking %s from its monitoring job:\n%s", k.domain, p)
+			if err := e.apply(p); err != nil {
+				return err
+			}
+		}
+	}
+	log.Printf("Deleting monitoring job of %s\n", k.domain)
+	feeds := monitoring.NewFeeds(mp.DataSources(), mp.DataFeeds())
+	return monitoring.Delete(mp.Jobs(), feeds, k.domain, k.answer, e.marker)
+}
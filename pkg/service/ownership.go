@@ -0,0 +1,134 @@
+package service
+
+import (
+	"context"
+	"log"
+
+	"github.com/m1k8/DNSUpdate/pkg/compare"
+	"github.com/m1k8/DNSUpdate/pkg/owner"
+	"github.com/m1k8/DNSUpdate/pkg/plan"
+	"gopkg.in/ns1/ns1-go.v2/rest/model/data"
+	"gopkg.in/ns1/ns1-go.v2/rest/model/dns"
+)
+
+// Adopt marks the existing records of the named target, zone or dyndns host,
+// or of every one, as managed, so that the service will change them. A
+// target's A record with a single unmarked answer has that answer marked as
+// the target's. In a dry run the plan is returned without being applied.
+// Reading the records is cancelled once ctx is done
+func (s *Svc) Adopt(ctx context.Context, name string) (*plan.Plan, error) {
+	targets, err := s.pick(name)
+	zones := s.pickZones(name)
+	s.mu.RLock()
+	e := s.env
+	s.mu.RUnlock()
+	hosts := e.dyndns.pick(name)
+	if err != nil && len(zones) == 0 && len(hosts) == 0 {
+		return nil, err
+	}
+
+	var keys []owner.Key
+	answers := map[owner.Key]compare.Identity{}
+	for _, t := range targets {
+		at := t.provider.Name()
+		a := owner.Key{Provider: at, Zone: t.zoneName, Domain: t.domain, Type: "A"}
+		answers[a] = compare.Identity{Note: t.answer.Note}
+		keys = append(keys, a, owner.Key{Provider: at, Zone: t.zoneName, Domain: t.domain, Type: "SRV"})
+	}
+	for _, h := range hosts {
+		at := h.provider.Name()
+		a := owner.Key{Provider: at, Zone: h.zone, Domain: h.domain, Type: "A"}
+		answers[a] = compare.Identity{Note: h.answer.Note}
+		keys = append(keys, a, owner.Key{Provider: at, Zone: h.zone, Domain: h.domain, Type: "SRV"})
+	}
+	for _, z := range zones {
+		for _, r := range z.cfg.Records {
+			keys = append(keys, owner.Key{Provider: z.provider.Name(), Zone: z.cfg.Zone, Domain: r.FQDN(z.cfg.Zone), Type: r.Type})
+		}
+	}
+
+	p, err := owner.Adopt(ctx, e.providers, e.marker, keys, func(k owner.Key, r *dns.Record) {
+		id, ok := answers[k]
+		if !ok || compare.NewRecordState(r, id).Answer() != nil {
+			return
+		}
+		if len(r.Answers) == 1 && r.Answers[0] != nil && compare.NoteOf(r.Answers[0]) == "" {
+			if r.Answers[0].Meta == nil {
+				r.Answers[0].Meta = &data.Meta{}
+			}
+			r.Answers[0].Meta.Note = id.Note
+		}
+	})
+	if err != nil || e.dryRun || p.Empty() {
+		return p, err
+	}
+	log.Printf("Adopting records:\n%s", p)
+	return p, e.apply(p)
+}
+
+// Collect deletes every record in the zones the config covers that is
+// marked as managed but no longer in the config. Only records the service
+// has managed from this config, as listed in its managed file, are deleted:
+// hosts sharing a zone, and so the owner, each leave the others' records
+// alone. Records a gateway token could have registered are left to their
+// hosts. In a dry run the plan is returned without being applied. Reading
+// the records is cancelled once ctx is done
+func (s *Svc) Collect(ctx context.Context) (*plan.Plan, error) {
+	s.mu.RLock()
+	cfg, e := s.cfg, s.env
+	s.mu.RUnlock()
+
+	had, err := loadHistory(cfg.ManagedFile)
+	if err != nil {
+		return nil, err
+	}
+
+	managed := managed(cfg)
+	var candidates []owner.Key
+	for _, k := range owner.Zones(cfg) {
+		dst, err := e.providers.Get(k.Provider)
+		if err != nil {
+			return nil, err
+		}
+		z, err := dst.Zone(k.Zone)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range owner.Unmanaged(dst.Name(), z, e.marker, managed) {
+			if had.records.Has(c) && !e.gateway.claims(c) {
+				candidates = append(candidates, c)
+			}
+		}
+	}
+	p, err := collect(ctx, e, candidates, had.answers)
+	if err != nil || e.dryRun {
+		return p, err
+	}
+	return p, forget(cfg, candidates, nil)
+}
+
+// CollectMonitors deletes the monitoring jobs this config had the service
+// create that no target monitors any more, along with their feeds, and
+// returns their names. Jobs other hosts made are left alone, as for
+// Collect. In a dry run the jobs are only named
+func (s *Svc) CollectMonitors(ctx context.Context) ([]string, error) {
+	s.mu.RLock()
+	cfg, e := s.cfg, s.env
+	s.mu.RUnlock()
+	return collectMonitors(ctx, cfg, e)
+}
+
+// collect deletes those of candidates marked as managed, or only the answers
+// listed in answers from those shared, unless in a dry run
+func collect(ctx context.Context, e *env, candidates []owner.Key, answers owner.Answers) (*plan.Plan, error) {
+	p, err := owner.Collect(ctx, e.providers, e.marker, candidates, answers)
+	if err != nil || p.Empty() {
+		return p, err
+	}
+	if e.dryRun {
+		log.Printf("Dry run, not deleting records no longer in the config:\n%s", p)
+		return p, nil
+	}
+	log.Printf("Deleting records no longer in the config:\n%s", p)
+	return p, e.apply(p)
+}
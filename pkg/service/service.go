@@ -1,81 +1,739 @@
 package service
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
-	"strings"
+	"sync"
 	"time"
 
+	"github.com/m1k8/DNSUpdate/pkg/clock"
 	"github.com/m1k8/DNSUpdate/pkg/compare"
-	"github.com/m1k8/DNSUpdate/pkg/update"
-	"gopkg.in/ns1/ns1-go.v2/rest"
+	"github.com/m1k8/DNSUpdate/pkg/config"
+	"github.com/m1k8/DNSUpdate/pkg/control"
+	"github.com/m1k8/DNSUpdate/pkg/damping"
+	"github.com/m1k8/DNSUpdate/pkg/dnsapi"
+	"github.com/m1k8/DNSUpdate/pkg/dnswire"
+	"github.com/m1k8/DNSUpdate/pkg/faults"
+	"github.com/m1k8/DNSUpdate/pkg/gateway"
+	"github.com/m1k8/DNSUpdate/pkg/ippolicy"
+	"github.com/m1k8/DNSUpdate/pkg/lease"
+	"github.com/m1k8/DNSUpdate/pkg/owner"
+	"github.com/m1k8/DNSUpdate/pkg/plan"
+	"github.com/m1k8/DNSUpdate/pkg/provider"
+	"github.com/m1k8/DNSUpdate/pkg/schedule"
+	"github.com/m1k8/DNSUpdate/pkg/snapshot"
 	api "gopkg.in/ns1/ns1-go.v2/rest"
-	"gopkg.in/ns1/ns1-go.v2/rest/model/dns"
 )
 
+const (
+	// how often the wall clock is compared against the monotonic clock, and
+	// how far apart they must drift to count as a jump
+	clockCheckEvery    = time.Minute
+	clockJumpThreshold = 2 * time.Minute
+
+	// backoff between attempts to look up a target's zone at startup
+	discoverMinBackoff = 5 * time.Second
+	discoverMaxBackoff = 5 * time.Minute
+)
+
+// Result is the outcome of a single check
+type Result struct {
+	Target  string    `json:"target"`
+	Time    time.Time `json:"time"`
+	OldIP   string    `json:"old_ip,omitempty"`
+	NewIP   string    `json:"new_ip,omitempty"`
+	Changed bool      `json:"changed"`
+	Error   string    `json:"error,omitempty"`
+
+	// Skipped is why no check was made, if none was
+	Skipped string `json:"skipped,omitempty"`
+
+	// Held is why a new IP was found but not published, if it wasnt
+	Held string `json:"held,omitempty"`
+
+	// Plan is the changes that were, or in a dry run would have been, made
+	Plan *plan.Plan `json:"plan,omitempty"`
+}
+
+var (
+	errStopped       = errors.New("service is not running")
+	errRunning       = errors.New("service is running")
+	errUnknownTarget = errors.New("no such target")
+)
+
+// Deps are the outside services Svc relies on. Any left nil are built from
+// the config, or use the real thing. Records, Zones and Jobs stand in for
+// the default NS1 account
+type Deps struct {
+	Records dnsapi.Records
+	Zones   dnsapi.Zones
+	Jobs    dnsapi.Jobs
+	IP      compare.IPSource
+	Clock   clock.Clock
+
+	// DryRun logs the changes each check would make instead of making them
+	DryRun bool
+}
+
+// env is what targets use to do their work
+type env struct {
+	providers provider.Registry
+	ip        compare.IPSource
+	marker    owner.Marker
+	dryRun    bool
+
+	alerts *alerts
+
+	// snapshots is nil if they are turned off
+	snapshots *snapshot.Store
+	clock     clock.Clock
+
+	// dyndns is nil without a dyndns2 server, and gateway without a
+	// gateway
+	dyndns  *dyndnsHosts
+	gateway *gatewayTokens
+
+	// reaper is nil if nothing is ephemeral
+	reaper *reaper
+}
+
+// snapshot saves a copy of the records p is about to change
+func (e *env) snapshot(p *plan.Plan) error {
+	if e.snapshots == nil || p.Empty() {
+		return nil
+	}
+	name, err := e.snapshots.Save(p, e.clock.Now())
+	if err != nil {
+		return fmt.Errorf("saving snapshot, not changing records: %w", err)
+	}
+	log.Printf("Saved snapshot %s\n", name)
+	return nil
+}
+
+// apply saves a snapshot of the records p changes, then changes them
+func (e *env) apply(p *plan.Plan) error {
+	if err := e.snapshot(p); err != nil {
+		return err
+	}
+	return p.Apply(e.providers)
+}
+
 type Svc struct {
-	zone   *dns.Zone
-	domain string
-	client *api.Client
-	ticker time.Ticker
-	done   chan bool
+	cfg     *config.Config
+	deps    Deps
+	ctl     *control.Server
+	servers []*httpServer
+	done    chan bool
+
+	mu           sync.RWMutex
+	env          *env
+	targets      []*target
+	zones        []*zone
+	startupDelay time.Duration
+	quit         chan struct{}
+	wg           sync.WaitGroup
+
+	// started is set once Start runs, and stopping once Stop is called, so
+	// Stop doesnt wait on a service that never started
+	started  bool
+	stopping bool
+	stopped  chan struct{}
 }
 
-func NewSvc(a, d string) *Svc {
+// NewSvc builds the service described by cfg. It does not contact NS1; zones
+// are looked up once the service starts, and retried until the network is up
+func NewSvc(cfg *config.Config) (*Svc, error) {
+	return New(cfg, Deps{})
+}
 
-	httpClient := &http.Client{Timeout: time.Second * 10}
-	client := api.NewClient(httpClient, api.SetAPIKey(a))
-	zone, httpres, clientErr := client.Zones.Get(d)
+// New is NewSvc with some or all of the outside services replaced
+func New(cfg *config.Config, deps Deps) (*Svc, error) {
+	if deps.Clock == nil {
+		deps.Clock = clock.Real
+	}
+	if deps.IP == nil {
+		deps.IP = compare.DefaultIPSource
+	}
 
-	if clientErr != nil {
-		if strings.Contains(clientErr.Error(), "tcp") {
-			log.Println(clientErr.Error())
-			return nil
-		} else if httpres.StatusCode != 200 {
-			log.Println(fmt.Sprintf("Error %d", httpres.StatusCode))
-			return nil
-		}
+	e, targets, zones, err := build(cfg, deps)
+	if err != nil {
+		return nil, err
 	}
 
 	return &Svc{
-		ticker: *time.NewTicker(30 * time.Minute),
-		done:   make(chan bool),
-		zone:   zone,
-		domain: d,
-		client: client,
+		cfg:          cfg,
+		deps:         deps,
+		env:          e,
+		targets:      targets,
+		zones:        zones,
+		startupDelay: time.Duration(cfg.StartupDelay),
+		done:         make(chan bool),
+		stopped:      make(chan struct{}),
+	}, nil
+}
+
+// build creates the providers, targets and zones described by cfg, using
+// deps in place of the real services where given
+func build(cfg *config.Config, deps Deps) (*env, []*target, []*zone, error) {
+
+	var doer api.Doer = &http.Client{Timeout: time.Second * 10}
+	// faults are only injected into NS1 requests, so the other providers
+	// share the plain doer
+	ns1Doer := doer
+	if cfg.Faults != nil {
+		inject, err := faults.New(*cfg.Faults)
+		if err != nil {
+			return nil, nil, nil, &ConfigError{Target: "faults", Err: err}
+		}
+		log.Println("Injecting faults into NS1 requests")
+		ns1Doer = api.Decorate(doer, inject)
+	}
+
+	client := ns1Client(ns1Doer, cfg.APIKey, cfg.Endpoint)
+	if deps.Records != nil {
+		client.Records = deps.Records
+	}
+	if deps.Zones != nil {
+		client.Zones = deps.Zones
+	}
+	if deps.Jobs != nil {
+		client.Jobs = deps.Jobs
+	}
+	providers, err := buildProviders(cfg, doer, ns1Doer, client, deps.Clock)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	e := &env{
+		providers: providers,
+		ip:        deps.IP,
+		marker:    owner.Marker{Owner: cfg.Owner, Tags: cfg.MarkWith == "tags"},
+		dryRun:    deps.DryRun,
+		clock:     deps.Clock,
+		reaper:    buildReaper(cfg, deps.Clock),
+	}
+	if cfg.Alerts != nil {
+		e.alerts = &alerts{webhook: cfg.Alerts.Webhook, client: &http.Client{Timeout: 10 * time.Second}}
+	}
+	if cfg.Snapshots != nil && cfg.Snapshots.Keep > 0 {
+		e.snapshots = &snapshot.Store{Dir: cfg.Snapshots.Dir, Keep: cfg.Snapshots.Keep}
+	}
+	if cfg.DynDNS != nil {
+		if e.dyndns, err = buildDynDNS(cfg.DynDNS, providers); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	if cfg.Gateway != nil {
+		if e.gateway, err = buildGateway(cfg.Gateway, providers); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	targets := make([]*target, 0, len(cfg.Targets))
+	for _, t := range cfg.Targets {
+		sched, err := schedule.New(t.Schedule)
+		if err != nil {
+			return nil, nil, nil, &ConfigError{Target: t.Name(), Err: err}
+		}
+
+		damper, err := damping.New(t.Damping)
+		if err != nil {
+			return nil, nil, nil, &ConfigError{Target: t.Name(), Err: err}
+		}
+
+		policy, err := ippolicy.New(t.Policy)
+		if err != nil {
+			return nil, nil, nil, &ConfigError{Target: t.Name(), Err: err}
+		}
+
+		dst, err := providers.Get(t.Provider)
+		if err != nil {
+			return nil, nil, nil, &ConfigError{Target: t.Name(), Err: err}
+		}
+
+		tgt := newTarget(t.Name(), t.Zone, t.Domain, t.Answer, sched, deps.Clock)
+		tgt.provider = dst
+		tgt.damper = damper
+		tgt.policy = policy
+		if tgt.watcher, err = buildWatcher(t, dst, e.marker); err != nil {
+			return nil, nil, nil, &ConfigError{Target: t.Name(), Err: err}
+		}
+		if tgt.watcher != nil {
+			tgt.monitorStatus = &MonitorStatus{}
+		}
+		if t.Ephemeral != nil {
+			tgt.expiry.ttl = time.Duration(t.Ephemeral.TTL)
+			tgt.deleteOnStop = t.Ephemeral.DeleteOnStop
+		}
+		if tgt.lease, err = buildLease(cfg.Lease, dst, t.Zone, t.Domain, deps.Clock); err != nil {
+			return nil, nil, nil, &ConfigError{Target: t.Name(), Err: err}
+		}
+		targets = append(targets, tgt)
+	}
+
+	zones := make([]*zone, 0, len(cfg.Zones))
+	for _, z := range cfg.Zones {
+		sched, err := schedule.New(z.Schedule)
+		if err != nil {
+			return nil, nil, nil, &ConfigError{Target: z.Zone, Err: err}
+		}
+
+		policy, err := ippolicy.New(z.Policy)
+		if err != nil {
+			return nil, nil, nil, &ConfigError{Target: z.Zone, Err: err}
+		}
+
+		dst, err := providers.Get(z.Provider)
+		if err != nil {
+			return nil, nil, nil, &ConfigError{Target: z.Zone, Err: err}
+		}
+
+		zn := newZone(z, sched, deps.Clock)
+		zn.provider = dst
+		zn.policy = policy
+		// a name of its own, so it doesnt share the lease of a target at the
+		// apex
+		if zn.lease, err = buildLease(cfg.Lease, dst, z.Zone, "_zone."+z.Zone, deps.Clock); err != nil {
+			return nil, nil, nil, &ConfigError{Target: z.Zone, Err: err}
+		}
+		zones = append(zones, zn)
 	}
+
+	return e, targets, zones, nil
 }
 
-func (s *Svc) Start() {
-	doDelete := true
-	for {
-		select {
-		case <-s.ticker.C:
-			old, new, err := compare.GetOldNewIPs(s.zone, s.client, s.domain)
-			if err != nil {
-				if err == rest.ErrRecordMissing {
-					doDelete = false
+// buildProviders creates every provider in cfg. client is the default NS1
+// account, and the other NS1 accounts send requests with ns1Doer rather than
+// doer
+// buildLease returns the lease electing the host to update domain, kept in
+// the NS1 account at is, or nil if cfg is
+func buildLease(cfg *config.Lease, at provider.Provider, zone, domain string, c clock.Clock) (*lease.Lease, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	ns1, ok := at.(*provider.NS1)
+	if !ok {
+		return nil, errors.New("provider " + at.Name() + " cant hold a lease")
+	}
+	return lease.New(ns1.Records(), zone, domain, cfg.Owner, time.Duration(cfg.Duration), c), nil
+}
+
+func buildProviders(cfg *config.Config, doer, ns1Doer api.Doer, client *dnsapi.Client, c clock.Clock) (provider.Registry, error) {
+	providers := provider.Registry{config.DefaultProvider: provider.NewNS1(config.DefaultProvider, client)}
+	for _, p := range cfg.Providers {
+		switch p.Type {
+		case "ns1":
+			providers[p.Name] = provider.NewNS1(p.Name, ns1Client(ns1Doer, p.APIKey, p.Endpoint))
+		case "rfc2136":
+			client := &dnswire.Client{Server: p.Server, TCP: p.Transport == "tcp"}
+			if p.TSIG != nil {
+				key, err := dnswire.NewKey(p.TSIG.Name, p.TSIG.Algorithm, p.TSIG.Secret)
+				if err != nil {
+					return nil, &ConfigError{Target: "provider " + p.Name, Err: err}
 				}
-				log.Println("Error getting IP(s) - " + err.Error())
-				continue
+				client.Key = key
 			}
+			providers[p.Name] = provider.NewRFC2136(p.Name, client)
+		case "dyndns2":
+			providers[p.Name] = provider.NewDynDNS2(p.Name, p.Endpoint, p.Username, p.Password, doer, c)
+		case "gateway":
+			gwDoer, err := gatewayDoer(p, doer)
+			if err != nil {
+				return nil, &ConfigError{Target: "provider " + p.Name, Err: err}
+			}
+			providers[p.Name] = provider.NewGateway(p.Name, &gateway.Client{
+				Endpoint: p.Endpoint,
+				Token:    p.Token,
+				Secret:   p.Secret,
+				Auth:     p.Auth,
+				Doer:     gwDoer,
+				Now:      c.Now,
+			})
+		default:
+			return nil, &ConfigError{Target: "provider " + p.Name, Err: fmt.Errorf("unknown type %q", p.Type)}
+		}
+	}
+	return providers, nil
+}
 
-			if old != new {
-				err = update.ChangeIP(new, s.client, s.zone.String(), s.domain, doDelete)
-				if err != nil {
-					log.Println("Error updating IP - " + err.Error())
+func ns1Client(doer api.Doer, key, endpoint string) *dnsapi.Client {
+	options := []func(*api.Client){api.SetAPIKey(key)}
+	if endpoint != "" {
+		options = append(options, api.SetEndpoint(endpoint))
+	}
+	return dnsapi.FromREST(api.NewClient(doer, options...))
+}
+
+// Listen opens the control channel. It is served from Start until Stop
+func (s *Svc) Listen(addr, tokenFile string) error {
+	ctl, err := control.Listen(addr, tokenFile, s.handle)
+	if err != nil {
+		return err
+	}
+	s.ctl = ctl
+	return nil
+}
+
+func (s *Svc) Start() {
+	defer close(s.stopped)
+
+	s.mu.Lock()
+	if s.stopping {
+		s.mu.Unlock()
+		return
+	}
+	s.started = true
+	s.startTargets(s.startupDelay)
+	cfg, e := s.cfg, s.env
+	if !e.dryRun {
+		// jobs of targets removed while the service wasnt running
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), CheckTimeout)
+			defer cancel()
+			if _, err := collectMonitors(ctx, cfg, e); err != nil {
+				log.Println("Error deleting orphaned monitoring jobs - " + err.Error())
+			}
+		}()
+	}
+	s.mu.Unlock()
+	if !e.dryRun {
+		if err := remember(cfg); err != nil {
+			log.Println("Error recording managed records - " + err.Error())
+		}
+	}
+
+	if s.ctl != nil {
+		go s.ctl.Serve()
+	}
+	for _, srv := range s.servers {
+		go srv.serve()
+	}
+
+	<-s.done
+	log.Println("Finishing!")
+	if s.ctl != nil {
+		if err := s.ctl.Close(); err != nil {
+			log.Println("Error closing control channel - " + err.Error())
+		}
+	}
+	for _, srv := range s.servers {
+		srv.close()
+	}
+
+	s.mu.Lock()
+	s.stopTargets()
+	// bounded, so an unreachable provider doesnt hold up stopping
+	ctx, cancel := context.WithTimeout(context.Background(), CheckTimeout)
+	releaseOnStop(ctx, s.env, s.targets)
+	cancel()
+	for _, t := range s.targets {
+		if t.lease != nil {
+			t.lease.Release()
+		}
+	}
+	for _, z := range s.zones {
+		if z.lease != nil {
+			z.lease.Release()
+		}
+	}
+	s.mu.Unlock()
+}
+
+// startTargets runs every target and zone in its own goroutine, and the
+// reaper if there is one. The caller must hold mu for writing
+func (s *Svc) startTargets(delay time.Duration) {
+	s.quit = make(chan struct{})
+	for _, t := range s.targets {
+		s.wg.Add(1)
+		go func(t *target) {
+			defer s.wg.Done()
+			t.run(s.env, delay, s.quit)
+		}(t)
+	}
+	for _, z := range s.zones {
+		s.wg.Add(1)
+		go func(z *zone) {
+			defer s.wg.Done()
+			z.run(s.env, delay, s.quit)
+		}(z)
+	}
+	if r := s.env.reaper; r != nil {
+		s.wg.Add(1)
+		go func(e *env) {
+			defer s.wg.Done()
+			r.run(e, s.quit)
+		}(s.env)
+	}
+}
+
+// stopTargets stops every target and zone and waits for them. The caller must hold
+// mu for writing
+func (s *Svc) stopTargets() {
+	close(s.quit)
+	s.wg.Wait()
+	s.quit = nil
+}
+
+// Reload rereads the config file and restarts every target with it. Paused
+// targets stay paused. If the new config is invalid the old one is kept.
+// Records of targets and zones no longer in the config are deleted, if they
+// are marked as managed, though only a removed target's answer is dropped
+// from an A record that holds others. The lock file and control channel are not changed
+// until the service is restarted
+func (s *Svc) Reload() error {
+	s.mu.RLock()
+	path := s.cfg.Path
+	s.mu.RUnlock()
+
+	cfg, err := config.Load(path)
+	if err != nil {
+		return err
+	}
+	e, targets, zones, err := build(cfg, s.deps)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.quit == nil {
+		return errStopped
+	}
+
+	paused := map[string]bool{}
+	for _, t := range s.targets {
+		paused[t.name] = t.isPaused()
+	}
+	for _, t := range targets {
+		t.setPaused(paused[t.name])
+	}
+	pausedZones := map[string]bool{}
+	for _, z := range s.zones {
+		pausedZones[z.cfg.Zone] = z.isPaused()
+	}
+	for _, z := range zones {
+		z.setPaused(pausedZones[z.cfg.Zone])
+	}
+
+	s.stopTargets()
+	removed := managed(s.cfg).Minus(managed(cfg))
+	// a removed target's answer is dropped from an A record other answers
+	// still share, rather than the record being deleted
+	dropped := owner.ManagedAnswers(s.cfg).Minus(owner.ManagedAnswers(cfg))
+	collected := owner.NewSet(removed...)
+	for k := range dropped {
+		collected.Add(k)
+	}
+	candidates := collected.Minus(nil)
+	unmonitored, old := removedMonitors(s.cfg, cfg), s.env
+	s.cfg, s.env, s.targets, s.zones = cfg, e, targets, zones
+	s.startTargets(0)
+	log.Printf("Reloaded config, %d target(s), %d zone(s)\n", len(s.targets), len(s.zones))
+
+	if !s.deps.DryRun {
+		if err := remember(cfg); err != nil {
+			log.Println("Error recording managed records - " + err.Error())
+		}
+	}
+	if len(candidates) > 0 {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), CheckTimeout)
+			defer cancel()
+			if _, err := collect(ctx, e, candidates, dropped); err != nil {
+				log.Println("Error deleting removed records - " + err.Error())
+				return
+			}
+			if !e.dryRun {
+				if err := forget(cfg, removed, nil); err != nil {
+					log.Println("Error recording managed records - " + err.Error())
 				}
 			}
+		}()
+	}
+	if len(unmonitored) > 0 {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), CheckTimeout)
+			defer cancel()
+			// from the old providers, as the account may have been removed too
+			deleted := deleteMonitors(ctx, old, unmonitored)
+			if err := forget(cfg, nil, deleted); err != nil {
+				log.Println("Error recording managed records - " + err.Error())
+			}
+		}()
+	}
+	return nil
+}
+
+// Plan works out the changes a check of each target would make, without
+// making them. It is for a service that has not been started, as running
+// targets check themselves
+func (s *Svc) Plan(ctx context.Context) ([]Result, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.quit != nil {
+		return nil, errRunning
+	}
+
+	results := make([]Result, 0, len(s.targets))
+	for _, t := range s.targets {
+		if err := t.discover(s.env); err != nil {
+			results = append(results, Result{Target: t.name, Time: t.clock.Now(), Error: err.Error()})
+			continue
+		}
+		results = append(results, t.check(ctx, s.env, false))
+	}
+	return results, nil
+}
+
+// pick returns the named target, or every target if name is empty
+func (s *Svc) pick(name string) ([]*target, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if name == "" {
+		return append([]*target(nil), s.targets...), nil
+	}
+	for _, t := range s.targets {
+		if t.name == name {
+			return []*target{t}, nil
+		}
+	}
+	return nil, errUnknownTarget
+}
+
+// PlanZones works out the changes needed to bring each declared zone back to
+// its declaration, without making them. Like Plan, it is for a service that
+// has not been started
+func (s *Svc) PlanZones(ctx context.Context) ([]ZoneResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.quit != nil {
+		return nil, errRunning
+	}
+
+	results := make([]ZoneResult, 0, len(s.zones))
+	for _, z := range s.zones {
+		res := ZoneResult{Zone: z.cfg.Zone, Time: z.clock.Now()}
+		p, err := z.plan(ctx, s.env)
+		if err != nil {
+			res.Error = err.Error()
+		} else if !p.Empty() {
+			res.Plan = p
+			res.Skipped = "dry run"
+		}
+		results = append(results, res)
+	}
+	return results, nil
+}
+
+// pickZones returns the named zone, or every zone if name is empty
+func (s *Svc) pickZones(name string) []*zone {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if name == "" {
+		return append([]*zone(nil), s.zones...)
+	}
+	for _, z := range s.zones {
+		if z.cfg.Zone == name {
+			return []*zone{z}
+		}
+	}
+	return nil
+}
+
+// CheckNow checks every target immediately, outside of their schedules, and
+// returns the results
+func (s *Svc) CheckNow(ctx context.Context) ([]Result, error) {
+	return s.send(ctx, "", request{})
+}
+
+// send passes req to the named target, or every target, and waits for the
+// results
+func (s *Svc) send(ctx context.Context, name string, req request) ([]Result, error) {
+	targets, err := s.pick(name)
+	if err != nil {
+		return nil, err
+	}
 
-		case <-s.done:
-			log.Println("Finishing!")
-			return
+	replies := make([]chan Result, len(targets))
+	for i, t := range targets {
+		replies[i] = make(chan Result, 1)
+		r := req
+		r.reply = replies[i]
+		select {
+		case t.requests <- r:
+		case <-t.done:
+			return nil, errStopped
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	results := make([]Result, len(targets))
+	for i, reply := range replies {
+		select {
+		case results[i] = <-reply:
+		case <-ctx.Done():
+			return nil, ctx.Err()
 		}
 	}
+	return results, nil
+}
 
+// Pause stops the named target or zone, or every one, from updating DNS
+// until Resume is called
+func (s *Svc) Pause(name string) error {
+	return s.setPaused(name, true)
 }
 
+// Resume undoes Pause
+func (s *Svc) Resume(name string) error {
+	return s.setPaused(name, false)
+}
+
+func (s *Svc) setPaused(name string, paused bool) error {
+	targets, err := s.pick(name)
+	zones := s.pickZones(name)
+	if err != nil && len(zones) == 0 {
+		return err
+	}
+	for _, t := range targets {
+		t.setPaused(paused)
+	}
+	for _, z := range zones {
+		z.setPaused(paused)
+	}
+	return nil
+}
+
+// Publish sets the named target, or every target, to ip instead of the
+// detected address. The targets are paused afterwards, so the next check
+// does not put the detected address straight back
+func (s *Svc) Publish(ctx context.Context, name, ip string) ([]Result, error) {
+	return s.send(ctx, name, request{publish: ip})
+}
+
+// Stop stops every target and the control channel, and waits for them. If
+// the service hasnt been started it returns at once, and Start wont start it
 func (s *Svc) Stop() {
-	s.done <- true
+	s.mu.Lock()
+	s.stopping = true
+	started := s.started
+	s.mu.Unlock()
+	if !started {
+		return
+	}
+	select {
+	case s.done <- true:
+	case <-s.stopped:
+	}
+	<-s.stopped
 }
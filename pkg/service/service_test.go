@@ -0,0 +1,612 @@
+package service
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/m1k8/DNSUpdate/pkg/ca"
+	"github.com/m1k8/DNSUpdate/pkg/clock"
+	"github.com/m1k8/DNSUpdate/pkg/compare"
+	"github.com/m1k8/DNSUpdate/pkg/config"
+	"github.com/m1k8/DNSUpdate/pkg/dnsapi"
+	"github.com/m1k8/DNSUpdate/pkg/monitoring"
+	"github.com/m1k8/DNSUpdate/pkg/ns1fake"
+	"github.com/m1k8/DNSUpdate/pkg/owner"
+	"github.com/m1k8/DNSUpdate/pkg/provider"
+	"gopkg.in/ns1/ns1-go.v2/rest/model/dns"
+	"gopkg.in/ns1/ns1-go.v2/rest/model/monitor"
+)
+
+// loadConfig loads a config file holding js from a temporary directory, so
+// the lock, token and snapshots are kept there too
+func loadConfig(t *testing.T, js string) *config.Config {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "dnsupdate.json")
+	if err := os.WriteFile(path, []byte(js), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func TestFaultsOnlyReachNS1(t *testing.T) {
+	f := ns1fake.New()
+	defer f.Close()
+	f.AddZone("example.com")
+
+	var sent int32
+	dyn := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&sent, 1)
+		fmt.Fprint(w, "good 8.8.4.7")
+	}))
+	defer dyn.Close()
+
+	cfg := loadConfig(t, fmt.Sprintf(`{
+		"api_key": "key", "endpoint": %q,
+		"faults": { "random": [ { "kind": "status", "status": 503, "probability": 1 } ] },
+		"providers": [ { "name": "dyn", "type": "dyndns2", "endpoint": %q, "username": "u", "password": "p" } ],
+		"targets": [ { "zone": "example.com", "domain": "home.example.com", "provider": "dyn" } ]
+	}`, f.Endpoint(), dyn.URL))
+	e, _, _, err := build(cfg, Deps{Clock: clock.NewFake(time.Now())})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := e.providers[provider.Default].Zones(); err == nil {
+		t.Error("NS1 requests should fail with the injected fault")
+	}
+	r := dns.NewRecord("example.com", "home.example.com", "A")
+	r.AddAnswer(dns.NewAv4Answer("8.8.4.7"))
+	if err := e.providers["dyn"].Upsert(r); err != nil {
+		t.Errorf("dyndns2 requests should be left alone: %v", err)
+	}
+	if atomic.LoadInt32(&sent) != 1 {
+		t.Errorf("dyndns2 server got %d requests, want 1", sent)
+	}
+}
+
+func TestCollectOnlyDeletesRecordsThisConfigManaged(t *testing.T) {
+	f := ns1fake.New()
+	defer f.Close()
+	f.AddZone("example.com")
+	m := owner.Marker{Owner: "dnsupdate"}
+	for _, domain := range []string{"old.example.com", "other-host.example.com", "by-hand.example.com"} {
+		r := dns.NewRecord("example.com", domain, "A")
+		r.AddAnswer(dns.NewAv4Answer("8.8.4.7"))
+		if domain != "by-hand.example.com" {
+			m.Mark(r)
+		}
+		f.PutRecord(r)
+	}
+
+	cfg := loadConfig(t, fmt.Sprintf(`{
+		"api_key": "key", "endpoint": %q,
+		"targets": [ { "zone": "example.com", "domain": "home.example.com" } ]
+	}`, f.Endpoint()))
+	// old.example.com was a target of this config, other-host.example.com
+	// one of another host's with the same owner
+	had := &history{records: owner.NewSet(owner.Key{Zone: "example.com", Domain: "old.example.com", Type: "A"})}
+	if err := had.write(cfg.ManagedFile); err != nil {
+		t.Fatal(err)
+	}
+	s, err := New(cfg, Deps{Clock: clock.NewFake(time.Now())})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Collect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for domain, kept := range map[string]bool{"old.example.com": false, "other-host.example.com": true, "by-hand.example.com": true} {
+		if got := f.Record("example.com", domain, "A") != nil; got != kept {
+			t.Errorf("%s kept %v, want %v", domain, got, kept)
+		}
+	}
+	if had, err = loadHistory(cfg.ManagedFile); err != nil || len(had.records) != 0 {
+		t.Errorf("managed file holds %v, %v; want the collected record dropped", had.records, err)
+	}
+
+	if err := remember(cfg); err != nil {
+		t.Fatal(err)
+	}
+	had, _ = loadHistory(cfg.ManagedFile)
+	if !had.records.Has(owner.Key{Zone: "example.com", Domain: "home.example.com", Type: "A"}) {
+		t.Errorf("managed file holds %v, want the target remembered", had.records)
+	}
+}
+
+func TestCollectMonitorsOnlyDeletesJobsThisConfigMade(t *testing.T) {
+	f := ns1fake.New()
+	defer f.Close()
+	f.AddZone("example.com")
+	jobs := dnsapi.FromREST(f.Client()).Jobs
+	m := owner.Marker{Owner: "dnsupdate"}
+	for _, name := range []string{"old.example.com home", "www.example.com cloud", "home.example.com home"} {
+		j := monitor.NewTCPConfig("8.8.4.7", 11774, 2000, 5000, "", false)
+		if _, err := jobs.Create(&monitor.Job{Name: monitoring.NamePrefix + name, Type: "tcp", Config: *j, Notes: m.Note()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := loadConfig(t, fmt.Sprintf(`{
+		"api_key": "key", "endpoint": %q, "startup_delay": "1h",
+		"targets": [ { "zone": "example.com", "domain": "home.example.com", "answer": "home", "monitor": { "type": "tcp" } } ]
+	}`, f.Endpoint()))
+	// old.example.com was monitored by this config, and www.example.com's
+	// cloud answer is another host's
+	had := &history{records: owner.Set{}, jobs: map[jobKey]bool{
+		{Provider: provider.Default, Zone: "example.com", Domain: "old.example.com", Answer: "home"}: false,
+	}}
+	if err := had.write(cfg.ManagedFile); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		dryRun bool
+		left   []string
+	}{
+		{name: "dry run", dryRun: true, left: []string{"home.example.com home", "old.example.com home", "www.example.com cloud"}},
+		{name: "collect", left: []string{"home.example.com home", "www.example.com cloud"}},
+		{name: "again", left: []string{"home.example.com home", "www.example.com cloud"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := New(cfg, Deps{Clock: clock.NewFake(time.Now()), DryRun: tt.dryRun})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.CollectMonitors(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			var left []string
+			for _, j := range f.Jobs() {
+				left = append(left, strings.TrimPrefix(j.Name, monitoring.NamePrefix))
+			}
+			sort.Strings(left)
+			if strings.Join(left, ", ") != strings.Join(tt.left, ", ") {
+				t.Errorf("jobs left %v, want %v", left, tt.left)
+			}
+		})
+	}
+}
+
+// ipFunc is an IP source calling itself
+type ipFunc func(ctx context.Context) (string, error)
+
+func (f ipFunc) PublicIP(ctx context.Context) (string, error) {
+	return f(ctx)
+}
+
+func publicIP(addr string) ipFunc {
+	return func(context.Context) (string, error) { return addr, nil }
+}
+
+// start runs s until the test ends
+func start(t *testing.T, s *Svc) {
+	t.Helper()
+	go s.Start()
+	t.Cleanup(s.Stop)
+}
+
+func TestCheckNow(t *testing.T) {
+	m := owner.Marker{Owner: "dnsupdate"}
+	record := func(ip string) *dns.Record {
+		r := dns.NewRecord("example.com", "home.example.com", "A")
+		a := dns.NewAv4Answer(ip)
+		a.Meta.Note = compare.DefaultNote
+		r.AddAnswer(a)
+		m.Mark(r)
+		return r
+	}
+	tests := []struct {
+		name   string
+		record *dns.Record
+		ip     compare.IPSource
+		apiKey string
+
+		changed bool
+		wantErr string
+		// want is the address left published, or empty if there should
+		// be no record
+		want string
+	}{
+		{name: "create", ip: publicIP("8.8.4.7"), changed: true, want: "8.8.4.7"},
+		{name: "update", record: record("8.8.4.4"), ip: publicIP("8.8.4.7"), changed: true, want: "8.8.4.7"},
+		{name: "unchanged", record: record("8.8.4.7"), ip: publicIP("8.8.4.7"), want: "8.8.4.7"},
+		{
+			name:    "ip lookup fails",
+			record:  record("8.8.4.4"),
+			ip:      ipFunc(func(context.Context) (string, error) { return "", errors.New("ipify is down") }),
+			wantErr: "ipify is down",
+			want:    "8.8.4.4",
+		},
+		{name: "ip blocked by policy", record: record("8.8.4.4"), ip: publicIP("10.0.0.7"), wantErr: "10.0.0.7", want: "8.8.4.4"},
+		{name: "api key refused", ip: publicIP("8.8.4.7"), apiKey: "another", wantErr: "401"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := ns1fake.New()
+			defer f.Close()
+			f.AddZone("example.com")
+			if tt.record != nil {
+				f.PutRecord(tt.record)
+			}
+			f.RequireAPIKey(tt.apiKey)
+
+			cfg := loadConfig(t, fmt.Sprintf(`{
+				"api_key": "key", "endpoint": %q, "startup_delay": "1h",
+				"targets": [ { "zone": "example.com", "domain": "home.example.com" } ]
+			}`, f.Endpoint()))
+			s, err := New(cfg, Deps{IP: tt.ip, Clock: clock.NewFake(time.Now())})
+			if err != nil {
+				t.Fatal(err)
+			}
+			start(t, s)
+
+			results, err := s.CheckNow(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			res := results[0]
+			if res.Changed != tt.changed {
+				t.Errorf("changed %v, want %v", res.Changed, tt.changed)
+			}
+			if tt.wantErr == "" && res.Error != "" {
+				t.Errorf("unexpected error: %s", res.Error)
+			}
+			if tt.wantErr != "" && !strings.Contains(res.Error, tt.wantErr) {
+				t.Errorf("got error %q, want %q", res.Error, tt.wantErr)
+			}
+
+			var got string
+			if r := f.Record("example.com", "home.example.com", "A"); r != nil {
+				if len(r.Answers) != 1 {
+					t.Fatalf("record has answers %v, want one", r.Answers)
+				}
+				got = r.Answers[0].Rdata[0]
+			}
+			if got != tt.want {
+				t.Errorf("published %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReloadDeletesRemovedTargets(t *testing.T) {
+	f := ns1fake.New()
+	defer f.Close()
+	f.AddZone("example.com")
+
+	cfg := loadConfig(t, fmt.Sprintf(`{
+		"api_key": "key", "endpoint": %q, "startup_delay": "1h",
+		"targets": [
+			{ "zone": "example.com", "domain": "home.example.com" },
+			{ "zone": "example.com", "domain": "old.example.com" }
+		]
+	}`, f.Endpoint()))
+	s, err := New(cfg, Deps{IP: publicIP("8.8.4.7"), Clock: clock.NewFake(time.Now())})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start(t, s)
+	if _, err := s.CheckNow(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for _, domain := range []string{"home.example.com", "old.example.com"} {
+		if f.Record("example.com", domain, "A") == nil {
+			t.Fatalf("%s wasnt created", domain)
+		}
+	}
+
+	js := fmt.Sprintf(`{
+		"api_key": "key", "endpoint": %q, "startup_delay": "1h",
+		"targets": [ { "zone": "example.com", "domain": "home.example.com" } ]
+	}`, f.Endpoint())
+	if err := os.WriteFile(cfg.Path, []byte(js), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	// the records are deleted in the background, and Stop waits for it
+	s.Stop()
+	if f.Record("example.com", "old.example.com", "A") != nil {
+		t.Error("old.example.com should be deleted once its target is removed")
+	}
+	if f.Record("example.com", "home.example.com", "A") == nil {
+		t.Error("home.example.com should be kept")
+	}
+}
+
+// failingRecords passes record requests through, except updates of the
+// domains in fail
+type failingRecords struct {
+	dnsapi.Records
+	fail map[string]error
+}
+
+func (f failingRecords) Update(r *dns.Record) (*http.Response, error) {
+	if err := f.fail[r.Domain]; err != nil {
+		return nil, err
+	}
+	return f.Records.Update(r)
+}
+
+func TestCheckNowPartialFailure(t *testing.T) {
+	f := ns1fake.New()
+	defer f.Close()
+	f.AddZone("example.com")
+	m := owner.Marker{Owner: "dnsupdate"}
+	for _, domain := range []string{"home.example.com", "www.example.com"} {
+		for _, typ := range []string{"A", "SRV"} {
+			r := dns.NewRecord("example.com", domain, typ)
+			if typ == "A" {
+				a := dns.NewAv4Answer("8.8.4.4")
+				a.Meta.Note = compare.DefaultNote
+				r.AddAnswer(a)
+			} else {
+				r.AddAnswer(dns.NewSRVAnswer(0, 0, 11774, domain))
+			}
+			m.Mark(r)
+			f.PutRecord(r)
+		}
+	}
+
+	// nothing listens at the endpoint, so every request must go through
+	// the injected services
+	cfg := loadConfig(t, `{
+		"api_key": "key", "endpoint": "http://127.0.0.1:1/v1/", "startup_delay": "1h",
+		"targets": [
+			{ "zone": "example.com", "domain": "home.example.com" },
+			{ "zone": "example.com", "domain": "www.example.com" }
+		]
+	}`)
+	c := dnsapi.FromREST(f.Client())
+	s, err := New(cfg, Deps{
+		Records: failingRecords{Records: c.Records, fail: map[string]error{"www.example.com": errors.New("ns1 is down")}},
+		Zones:   c.Zones,
+		IP:      publicIP("8.8.4.7"),
+		Clock:   clock.NewFake(time.Now()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start(t, s)
+
+	results, err := s.CheckNow(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]struct {
+		changed bool
+		err     string
+		ip      string
+	}{
+		"home.example.com": {changed: true, ip: "8.8.4.7"},
+		"www.example.com":  {err: "ns1 is down", ip: "8.8.4.4"},
+	}
+	if len(results) != len(want) {
+		t.Fatalf("got %d results, want %d", len(results), len(want))
+	}
+	for _, res := range results {
+		w := want[res.Target]
+		if res.Changed != w.changed || !strings.Contains(res.Error, w.err) || (w.err == "") != (res.Error == "") {
+			t.Errorf("%s: changed %v, error %q; want %v, %q", res.Target, res.Changed, res.Error, w.changed, w.err)
+		}
+		if got := f.Record("example.com", res.Target, "A").Answers[0].Rdata[0]; got != w.ip {
+			t.Errorf("%s published %s, want %s", res.Target, got, w.ip)
+		}
+	}
+}
+
+func TestReloadDropsOnlyTheRemovedAnswer(t *testing.T) {
+	f := ns1fake.New()
+	defer f.Close()
+	f.AddZone("example.com")
+	// a manual answer next to the one old.example.com's target publishes
+	r := dns.NewRecord("example.com", "old.example.com", "A")
+	a := dns.NewAv4Answer("8.8.8.8")
+	a.Meta.Note = "cloud"
+	r.AddAnswer(a)
+	f.PutRecord(r)
+
+	config := func(targets ...string) string {
+		return fmt.Sprintf(`{
+			"api_key": "key", "endpoint": %q, "startup_delay": "1h",
+			"targets": [ %s ]
+		}`, f.Endpoint(), strings.Join(targets, ", "))
+	}
+	const (
+		old     = `{ "zone": "example.com", "domain": "old.example.com", "answer": "home" }`
+		sharedA = `{ "zone": "example.com", "domain": "shared.example.com", "answer": "a" }`
+		sharedB = `{ "zone": "example.com", "domain": "shared.example.com", "answer": "b" }`
+	)
+	cfg := loadConfig(t, config(old, sharedA, sharedB))
+	s, err := New(cfg, Deps{IP: publicIP("8.8.4.7"), Clock: clock.NewFake(time.Now())})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start(t, s)
+	// old.example.com's record has to be adopted, as it was made by hand
+	if _, err := s.Adopt(context.Background(), "old.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.CheckNow(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(cfg.Path, []byte(config(sharedA)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	// the records are changed in the background, and Stop waits for it
+	s.Stop()
+
+	tests := []struct {
+		domain, t string
+		// notes are those of the answers left, or nil if the record
+		// should be gone
+		notes []string
+	}{
+		{domain: "old.example.com", t: "A", notes: []string{"cloud"}},
+		{domain: "old.example.com", t: "SRV", notes: []string{""}},
+		{domain: "shared.example.com", t: "A", notes: []string{"a"}},
+		{domain: "shared.example.com", t: "SRV", notes: []string{""}},
+	}
+	for _, tt := range tests {
+		var notes []string
+		if r := f.Record("example.com", tt.domain, tt.t); r != nil {
+			for _, a := range r.Answers {
+				notes = append(notes, compare.NoteOf(a))
+			}
+		}
+		if !reflect.DeepEqual(notes, tt.notes) {
+			t.Errorf("%s %s has answers %q, want %q", tt.domain, tt.t, notes, tt.notes)
+		}
+	}
+}
+
+func TestStopWithoutStart(t *testing.T) {
+	f := ns1fake.New()
+	defer f.Close()
+	f.AddZone("example.com")
+	cfg := loadConfig(t, fmt.Sprintf(`{
+		"api_key": "key", "endpoint": %q, "startup_delay": "1h",
+		"targets": [ { "zone": "example.com", "domain": "home.example.com" } ]
+	}`, f.Endpoint()))
+	s, err := New(cfg, Deps{Clock: clock.NewFake(time.Now())})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		s.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop hung on a service that was never started")
+	}
+
+	// a service stopped before it started stays stopped
+	started := make(chan struct{})
+	go func() {
+		s.Start()
+		close(started)
+	}()
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Start ran a service that was already stopped")
+	}
+}
+
+func TestRequireClientCerts(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	authority, err := ca.Init(dir, "dnsupdate test CA", time.Hour, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issue := func(host string) tls.Certificate {
+		t.Helper()
+		certPEM, keyPEM, _, err := authority.Issue(host, nil, time.Hour, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pair, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pair
+	}
+	server, good, revoked := issue("gateway.example.com"), issue("good.example.com"), issue("revoked.example.com")
+
+	tc := &tls.Config{Certificates: []tls.Certificate{server}}
+	if err := requireClientCerts(tc, filepath.Join(dir, ca.CertFile), filepath.Join(dir, ca.RevokedFile)); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	// handshake returns the error the gateway's side of a handshake ends in
+	handshake := func(client tls.Certificate) error {
+		go func() {
+			// the client doesnt check the gateway, which has a client
+			// certificate only to have one
+			c, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{Certificates: []tls.Certificate{client}, InsecureSkipVerify: true})
+			if err == nil {
+				c.Close()
+			}
+		}()
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		return tls.Server(conn, tc).Handshake()
+	}
+
+	if err := handshake(good); err != nil {
+		t.Errorf("good certificate refused: %v", err)
+	}
+	if err := handshake(revoked); err != nil {
+		t.Errorf("certificate refused before it was revoked: %v", err)
+	}
+
+	cert, err := x509.ParseCertificate(revoked.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := authority.Revoke(cert, now); err != nil {
+		t.Fatal(err)
+	}
+	// the gateway reads the list again on the next connection
+	if err := handshake(revoked); err == nil || !strings.Contains(err.Error(), "is revoked") {
+		t.Errorf("revoked certificate got error %v, want it refused", err)
+	}
+	if err := handshake(good); err != nil {
+		t.Errorf("good certificate refused after another was revoked: %v", err)
+	}
+
+	// a certificate from another CA fails verification before the list
+	other, err := ca.Init(t.TempDir(), "another CA", time.Hour, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM, keyPEM, _, err := other.Issue("good.example.com", nil, time.Hour, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	foreign, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := handshake(foreign); err == nil {
+		t.Error("a certificate from another CA should be refused")
+	}
+}
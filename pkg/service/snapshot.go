@@ -0,0 +1,45 @@
+package service
+
+import (
+	"errors"
+
+	"github.com/m1k8/DNSUpdate/pkg/plan"
+)
+
+var errNoSnapshots = errors.New("snapshots are turned off")
+
+// Snapshots returns the name of every snapshot kept, oldest first
+func (s *Svc) Snapshots() ([]string, error) {
+	s.mu.RLock()
+	e := s.env
+	s.mu.RUnlock()
+	if e.snapshots == nil {
+		return nil, errNoSnapshots
+	}
+	return e.snapshots.List()
+}
+
+// PlanRestore works out the changes that would put the records in the named
+// snapshot back as they were
+func (s *Svc) PlanRestore(name string) (*plan.Plan, error) {
+	s.mu.RLock()
+	e := s.env
+	s.mu.RUnlock()
+	if e.snapshots == nil {
+		return nil, errNoSnapshots
+	}
+	snap, err := e.snapshots.Load(name)
+	if err != nil {
+		return nil, err
+	}
+	return snap.Restore(e.providers, e.marker)
+}
+
+// Restore applies a plan from PlanRestore. The records are snapshotted
+// first, so a restore can itself be undone
+func (s *Svc) Restore(p *plan.Plan) error {
+	s.mu.RLock()
+	e := s.env
+	s.mu.RUnlock()
+	return e.apply(p)
+}
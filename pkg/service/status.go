@@ -0,0 +1,81 @@
+package service
+
+import "time"
+
+// States a target can be in
+const (
+	StateStarting       = "starting"
+	StateWaitingNetwork = "waiting for network"
+	StateRunning        = "running"
+	StateStandby        = "standby"
+	StatePaused         = "paused"
+	StateStopped        = "stopped"
+)
+
+// Status is a snapshot of the service, for the control channel
+type Status struct {
+	Targets []TargetStatus `json:"targets"`
+	Zones   []ZoneStatus   `json:"zones,omitempty"`
+	Hosts   []HostStatus   `json:"dyndns_hosts,omitempty"`
+}
+
+// TargetStatus describes one target
+type TargetStatus struct {
+	Target string    `json:"target"`
+	Zone   string    `json:"zone"`
+	State  string    `json:"state"`
+	Paused bool      `json:"paused"`
+	Since  time.Time `json:"since"`
+
+	// StartupError is why the target is waiting, if it is
+	StartupError string `json:"startup_error,omitempty"`
+
+	// LeaseHolder is the host currently allowed to update the target, when
+	// a lease is configured
+	LeaseHolder  string    `json:"lease_holder,omitempty"`
+	LeaseExpires time.Time `json:"lease_expires,omitempty"`
+
+	LastResult *Result   `json:"last_result,omitempty"`
+	NextCheck  time.Time `json:"next_check"`
+
+	// Alert is standing until the detected IP is allowed again
+	Alert *Alert `json:"alert,omitempty"`
+
+	// Monitor is the target's NS1 monitoring job, if it has one
+	Monitor *MonitorStatus `json:"monitor,omitempty"`
+}
+
+// ZoneStatus describes one declared zone
+type ZoneStatus struct {
+	Zone    string `json:"zone"`
+	Drift   string `json:"drift"`
+	Records int    `json:"records"`
+	Paused  bool   `json:"paused"`
+
+	LeaseHolder  string    `json:"lease_holder,omitempty"`
+	LeaseExpires time.Time `json:"lease_expires,omitempty"`
+
+	LastResult *ZoneResult `json:"last_result,omitempty"`
+	NextCheck  time.Time   `json:"next_check"`
+
+	Alert *Alert `json:"alert,omitempty"`
+}
+
+// Status reports the current state of every target, zone and dyndns host
+func (s *Svc) Status() Status {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	st := Status{Targets: make([]TargetStatus, 0, len(s.targets))}
+	for _, t := range s.targets {
+		st.Targets = append(st.Targets, t.status())
+	}
+	for _, z := range s.zones {
+		st.Zones = append(st.Zones, z.status())
+	}
+	if d := s.env.dyndns; d != nil {
+		for _, k := range d.order {
+			st.Hosts = append(st.Hosts, d.hosts[k].status())
+		}
+	}
+	return st
+}
@@ -0,0 +1,482 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/m1k8/DNSUpdate/pkg/clock"
+	"github.com/m1k8/DNSUpdate/pkg/compare"
+	"github.com/m1k8/DNSUpdate/pkg/damping"
+	"github.com/m1k8/DNSUpdate/pkg/ippolicy"
+	"github.com/m1k8/DNSUpdate/pkg/lease"
+	"github.com/m1k8/DNSUpdate/pkg/plan"
+	"github.com/m1k8/DNSUpdate/pkg/provider"
+	"github.com/m1k8/DNSUpdate/pkg/schedule"
+	"github.com/m1k8/DNSUpdate/pkg/update"
+	"gopkg.in/ns1/ns1-go.v2/rest/model/dns"
+)
+
+// request asks a target to check now, or to publish a given IP
+type request struct {
+	publish string
+	reply   chan Result
+}
+
+// target is one hostname, checked on its own schedule
+type target struct {
+	name     string
+	zoneName string
+	domain   string
+	provider provider.Provider
+	sched    schedule.Schedule
+	clock    clock.Clock
+	lease    *lease.Lease
+	requests chan request
+	done     chan struct{}
+
+	// only touched by run
+	zone    *dns.Zone
+	answer  compare.Identity
+	damper  *damping.Damper
+	policy  *ippolicy.Policy
+	backoff time.Duration
+	expiry  renewal
+
+	// watcher is nil unless NS1 monitors the target
+	watcher *watcher
+
+	// deleteOnStop releases the answer when the service stops
+	deleteOnStop bool
+
+	alarm alarm
+
+	mu         sync.Mutex
+	paused     bool
+	state      string
+	since      time.Time
+	startupErr error
+	last       *Result
+	next       time.Time
+
+	monitorStatus *MonitorStatus
+}
+
+func newTarget(name, zone, domain, note string, sched schedule.Schedule, c clock.Clock) *target {
+	if note == "" {
+		note = compare.DefaultNote
+	}
+	return &target{
+		name:     name,
+		zoneName: zone,
+		domain:   domain,
+		sched:    sched,
+		clock:    c,
+		answer:   compare.Identity{Note: note},
+		damper:   &damping.Damper{},
+		policy:   &ippolicy.Policy{},
+		backoff:  discoverMinBackoff,
+		requests: make(chan request),
+		done:     make(chan struct{}),
+		state:    StateStarting,
+		since:    c.Now(),
+	}
+}
+
+// run checks the target after delay and then on its schedule, until quit is
+// closed. Until the target's zone has been found it stays waiting for the
+// network, retrying with backoff
+func (t *target) run(env *env, delay time.Duration, quit <-chan struct{}) {
+	defer close(t.done)
+	defer t.setState(StateStopped, nil)
+	jumps := schedule.WatchClock(t.clock, quit, clockCheckEvery, clockJumpThreshold)
+
+	// cancelled on quit, so a check in progress doesnt hold up Stop
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-quit:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	var acquired <-chan struct{}
+	if t.lease != nil {
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			t.lease.Run(quit)
+		}()
+		defer wg.Wait()
+		acquired = t.lease.Acquired()
+	}
+
+	if delay > 0 {
+		log.Printf("%s: waiting %s before first check\n", t.name, delay)
+	}
+	t.setNext(t.clock.Now().Add(delay))
+
+	timer := t.clock.NewTimer(delay)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C():
+			t.step(ctx, env, timer)
+
+		case <-acquired:
+			log.Printf("%s: took over lease, checking now\n", t.name)
+			if !timer.Stop() {
+				<-timer.C()
+			}
+			t.step(ctx, env, timer)
+
+		case jump := <-jumps:
+			log.Printf("%s: clock jumped by %s, checking now\n", t.name, jump)
+			if !timer.Stop() {
+				<-timer.C()
+			}
+			t.step(ctx, env, timer)
+
+		case req := <-t.requests:
+			if !timer.Stop() {
+				<-timer.C()
+			}
+			if req.publish != "" {
+				req.reply <- t.publish(ctx, env, timer, req.publish)
+			} else {
+				req.reply <- t.step(ctx, env, timer)
+			}
+
+		case <-quit:
+			return
+		}
+	}
+}
+
+// step looks up the zone if it is not yet known, otherwise runs a check, and
+// then resets timer for the next attempt. The timer must be stopped and drained
+func (t *target) step(ctx context.Context, env *env, timer clock.Timer) Result {
+	if t.zone == nil {
+		if err := t.discover(env); err != nil {
+			res := Result{Target: t.name, Time: t.clock.Now(), Error: err.Error()}
+			t.setState(StateWaitingNetwork, err)
+			t.setLast(res)
+
+			log.Printf("%s: %s - %s, retrying in %s\n", t.name, StateWaitingNetwork, err.Error(), t.backoff)
+			t.reschedule(timer, t.clock.Now().Add(t.backoff))
+			t.backoff *= 2
+			if t.backoff > discoverMaxBackoff {
+				t.backoff = discoverMaxBackoff
+			}
+			return res
+		}
+		t.backoff = discoverMinBackoff
+	}
+
+	if skipped, ok := t.skip(); ok {
+		res := Result{Target: t.name, Time: t.clock.Now(), Skipped: skipped}
+		// a paused host is still there, but one on standby isnt registered
+		if t.isPaused() {
+			t.renew(ctx, env)
+		}
+		t.setLast(res)
+		t.reschedule(timer, t.sched.Next(t.clock.Now(), schedule.Unchanged))
+		return res
+	}
+
+	res := t.check(ctx, env, !env.dryRun)
+	if res.Error == "" {
+		t.renew(ctx, env)
+		// a new address being held back isnt published yet
+		ip := res.NewIP
+		if !res.Changed {
+			ip = res.OldIP
+		}
+		t.watch(ctx, env, ip)
+	}
+	t.setLast(res)
+
+	outcome := schedule.Unchanged
+	switch {
+	case res.Error != "":
+		outcome = schedule.Failed
+	case res.Changed:
+		outcome = schedule.Changed
+	}
+	next := t.sched.Next(t.clock.Now(), outcome)
+	// check again as soon as an IP being held back is stable
+	if due := t.damper.Due(); !due.IsZero() && due.Before(next) {
+		next = due
+	}
+	t.reschedule(timer, next)
+	return res
+}
+
+// skip reports whether the target should not be updated right now, and why
+func (t *target) skip() (string, bool) {
+	if t.isPaused() {
+		t.setState(StatePaused, nil)
+		return "paused", true
+	}
+	if t.lease != nil && !t.lease.Held() {
+		t.setState(StateStandby, nil)
+		holder, expires := t.lease.Holder()
+		if holder == "" {
+			return "standby, no lease", true
+		}
+		return fmt.Sprintf("standby, lease held by %s until %s", holder, expires.Format(time.RFC3339)), true
+	}
+	t.setState(StateRunning, nil)
+	return "", false
+}
+
+// publish sets the record to ip rather than the detected address, then
+// pauses the target so the next check doesnt undo it
+func (t *target) publish(ctx context.Context, env *env, timer clock.Timer, ip string) Result {
+	res := Result{Target: t.name, Time: t.clock.Now(), NewIP: ip}
+	defer t.reschedule(timer, t.sched.Next(t.clock.Now(), schedule.Changed))
+
+	if t.zone == nil {
+		if err := t.discover(env); err != nil {
+			res.Error = err.Error()
+			return res
+		}
+		t.backoff = discoverMinBackoff
+	}
+	if t.lease != nil && !t.lease.Held() {
+		res.Error = "not publishing from standby"
+		return res
+	}
+	if err := t.allowed(env, ip); err != nil {
+		res.Error = err.Error()
+		return res
+	}
+
+	state, err := compare.GetRecord(ctx, t.zone, t.provider, t.domain, t.answer)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	res.OldIP = state.IP()
+	t.remember(state)
+
+	if res.OldIP != ip {
+		p, err := update.PlanChange(ctx, ip, t.provider, t.zone.String(), t.domain, state, t.answer, env.marker)
+		res.Plan = p
+		if err != nil {
+			res.Error = err.Error()
+			return res
+		}
+		if env.dryRun {
+			log.Printf("%s: dry run, not publishing:\n%s", t.name, p)
+			res.Skipped = "dry run"
+			return res
+		}
+		if res.Plan, err = t.applyOrReplan(ctx, env, p, ip); err != nil {
+			res.Error = err.Error()
+			return res
+		}
+		res.Changed = true
+	}
+	t.watch(ctx, env, ip)
+
+	t.setPaused(true)
+	t.setState(StatePaused, nil)
+	t.setLast(res)
+	return res
+}
+
+// renew stamps an ephemeral target as still here
+func (t *target) renew(ctx context.Context, env *env) {
+	if err := t.expiry.renew(ctx, env, t.provider, t.zoneName, t.domain, t.answer.Note, t.clock.Now()); err != nil {
+		log.Printf("%s: error renewing ephemeral ttl - %s\n", t.name, err.Error())
+	}
+}
+
+func (t *target) discover(env *env) error {
+	zone, err := t.provider.Zone(t.zoneName)
+	if err != nil {
+		return err
+	}
+	t.zone = zone
+	return nil
+}
+
+func (t *target) reschedule(timer clock.Timer, next time.Time) {
+	log.Printf("%s: next check at %s\n", t.name, next.Format(time.RFC3339))
+	t.setNext(next)
+	timer.Reset(next.Sub(t.clock.Now()))
+}
+
+// check compares the published and detected IPs, and if they differ works out
+// the changes needed, making them if apply is set
+func (t *target) check(ctx context.Context, env *env, apply bool) Result {
+	res := Result{Target: t.name, Time: t.clock.Now()}
+
+	state, new, err := compare.GetOldNewIPs(ctx, t.zone, t.provider, env.ip, t.domain, t.answer, compare.DefaultTimeouts)
+	res.OldIP, res.NewIP = state.IP(), new
+	t.remember(state)
+	if err != nil {
+		log.Println("Error getting IP(s) - " + err.Error())
+		res.Error = err.Error()
+		return res
+	}
+
+	if err := t.allowed(env, new); err != nil {
+		res.Error = err.Error()
+		return res
+	}
+
+	decision := t.damper.Observe(new, res.OldIP, t.clock.Now())
+	if res.OldIP == new {
+		return res
+	}
+	if !decision.Publish {
+		log.Printf("%s: %s\n", t.name, decision.Reason)
+		res.Held = decision.Reason
+		return res
+	}
+
+	p, err := update.PlanChange(ctx, new, t.provider, t.zone.String(), t.domain, state, t.answer, env.marker)
+	res.Plan = p
+	if err != nil {
+		log.Println("Error planning update - " + err.Error())
+		res.Error = err.Error()
+		return res
+	}
+	if !apply {
+		log.Printf("%s: dry run, not publishing:\n%s", t.name, p)
+		res.Skipped = "dry run"
+		return res
+	}
+
+	if others := state.Others(); len(others) > 0 {
+		log.Printf("%s: leaving %d other answer(s) alone\n", t.name, len(others))
+	}
+	if res.Plan, err = t.applyOrReplan(ctx, env, p, new); err != nil {
+		log.Println("Error updating IP - " + err.Error())
+		res.Error = err.Error()
+		return res
+	}
+	res.Changed = true
+	return res
+}
+
+// allowed checks ip against the target's policy, raising an alert if it is
+// blocked
+func (t *target) allowed(env *env, ip string) error {
+	if err := t.policy.Check(ip); err != nil {
+		t.alarm.raise(env.alerts, Alert{Time: t.clock.Now(), Target: t.name, IP: ip, Reason: err.Error()})
+		return err
+	}
+	t.alarm.clear(t.name)
+	return nil
+}
+
+// apply snapshots and makes the changes in p, and remembers the ID of the
+// managed answer
+func (t *target) apply(env *env, p *plan.Plan) error {
+	if err := env.snapshot(p); err != nil {
+		return err
+	}
+	id, err := update.Apply(p, env.providers, t.answer)
+	if err != nil {
+		return err
+	}
+	if id != "" {
+		t.answer.ID = id
+	}
+	return nil
+}
+
+// applyOrReplan applies p, which publishes ip. If the record changed since p
+// was planned, it is read again and the plan made afresh, once, so a record
+// someone else has just created is refused rather than overwritten. The plan
+// applied is returned
+func (t *target) applyOrReplan(ctx context.Context, env *env, p *plan.Plan, ip string) (*plan.Plan, error) {
+	err := t.apply(env, p)
+	if !errors.Is(err, provider.ErrConflict) {
+		return p, err
+	}
+	log.Printf("%s: %s, planning again\n", t.name, err)
+	state, err := compare.GetRecord(ctx, t.zone, t.provider, t.domain, t.answer)
+	if err != nil {
+		return p, err
+	}
+	t.remember(state)
+	if p, err = update.PlanChange(ctx, ip, t.provider, t.zone.String(), t.domain, state, t.answer, env.marker); err != nil {
+		return p, err
+	}
+	return p, t.apply(env, p)
+}
+
+// remember keeps the ID of the managed answer, so it is still found if its
+// note is edited
+func (t *target) remember(state compare.RecordState) {
+	if a := state.Answer(); a != nil && a.ID != "" {
+		t.answer.ID = a.ID
+	}
+}
+
+func (t *target) setState(state string, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.state != state {
+		t.since = t.clock.Now()
+	}
+	t.state = state
+	t.startupErr = err
+}
+
+func (t *target) isPaused() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.paused
+}
+
+func (t *target) setPaused(paused bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.paused = paused
+}
+
+func (t *target) setLast(res Result) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.last = &res
+}
+
+func (t *target) setNext(next time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.next = next
+}
+
+func (t *target) status() TargetStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	st := TargetStatus{
+		Target:     t.name,
+		Zone:       t.zoneName,
+		State:      t.state,
+		Paused:     t.paused,
+		Since:      t.since,
+		LastResult: t.last,
+		NextCheck:  t.next,
+		Alert:      t.alarm.get(),
+		Monitor:    t.monitorStatus,
+	}
+	if t.startupErr != nil {
+		st.StartupError = t.startupErr.Error()
+	}
+	if t.lease != nil {
+		st.LeaseHolder, st.LeaseExpires = t.lease.Holder()
+	}
+	return st
+}
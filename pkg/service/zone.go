@@ -0,0 +1,238 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/m1k8/DNSUpdate/pkg/clock"
+	"github.com/m1k8/DNSUpdate/pkg/compare"
+	"github.com/m1k8/DNSUpdate/pkg/config"
+	"github.com/m1k8/DNSUpdate/pkg/ippolicy"
+	"github.com/m1k8/DNSUpdate/pkg/lease"
+	"github.com/m1k8/DNSUpdate/pkg/plan"
+	"github.com/m1k8/DNSUpdate/pkg/provider"
+	"github.com/m1k8/DNSUpdate/pkg/reconcile"
+	"github.com/m1k8/DNSUpdate/pkg/schedule"
+)
+
+// ZoneResult is the outcome of reconciling a zone once
+type ZoneResult struct {
+	Zone string    `json:"zone"`
+	Time time.Time `json:"time"`
+
+	// Drift is each record that differed from its declaration
+	Drift     []string `json:"drift,omitempty"`
+	Corrected bool     `json:"corrected"`
+	Error     string   `json:"error,omitempty"`
+
+	// Skipped is why the zone was not reconciled, if it wasnt
+	Skipped string `json:"skipped,omitempty"`
+
+	Plan *plan.Plan `json:"plan,omitempty"`
+}
+
+// zone keeps the records declared for a zone as declared, on its own
+// schedule
+type zone struct {
+	cfg      config.Zone
+	sched    schedule.Schedule
+	clock    clock.Clock
+	lease    *lease.Lease
+	provider provider.Provider
+	policy   *ippolicy.Policy
+	done     chan struct{}
+	alarm    alarm
+
+	mu     sync.Mutex
+	paused bool
+	last   *ZoneResult
+	next   time.Time
+}
+
+func newZone(cfg config.Zone, sched schedule.Schedule, c clock.Clock) *zone {
+	return &zone{
+		cfg:    cfg,
+		sched:  sched,
+		clock:  c,
+		policy: &ippolicy.Policy{},
+		done:   make(chan struct{}),
+	}
+}
+
+// run reconciles the zone after delay and then on its schedule, until quit
+// is closed
+func (z *zone) run(env *env, delay time.Duration, quit <-chan struct{}) {
+	defer close(z.done)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-quit:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	var acquired <-chan struct{}
+	if z.lease != nil {
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			z.lease.Run(quit)
+		}()
+		defer wg.Wait()
+		acquired = z.lease.Acquired()
+	}
+
+	z.setNext(z.clock.Now().Add(delay))
+	timer := z.clock.NewTimer(delay)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C():
+		case <-acquired:
+			if !timer.Stop() {
+				<-timer.C()
+			}
+		case <-quit:
+			return
+		}
+
+		res := z.reconcile(ctx, env)
+		outcome := schedule.Unchanged
+		switch {
+		case res.Error != "":
+			outcome = schedule.Failed
+		case len(res.Drift) > 0:
+			outcome = schedule.Changed
+		}
+		next := z.sched.Next(z.clock.Now(), outcome)
+		z.setNext(next)
+		timer.Reset(next.Sub(z.clock.Now()))
+	}
+}
+
+// reconcile compares the zone with its declaration, and corrects any drift if
+// the policy allows
+func (z *zone) reconcile(ctx context.Context, env *env) ZoneResult {
+	res := ZoneResult{Zone: z.cfg.Zone, Time: z.clock.Now()}
+	defer func() { z.setLast(res) }()
+
+	if z.isPaused() {
+		res.Skipped = "paused"
+		return res
+	}
+	if z.lease != nil && !z.lease.Held() {
+		res.Skipped = "standby"
+		return res
+	}
+
+	p, err := z.plan(ctx, env)
+	if err != nil {
+		log.Printf("zone %s: %s\n", z.cfg.Zone, err.Error())
+		res.Error = err.Error()
+		return res
+	}
+	if p.Empty() && len(p.Refused) == 0 {
+		return res
+	}
+
+	res.Plan = p
+	for _, r := range p.Refused {
+		log.Printf("zone %s: refused to %s\n", z.cfg.Zone, r)
+		res.Drift = append(res.Drift, "refused "+r)
+	}
+	for _, c := range p.Changes {
+		r := c.Record()
+		res.Drift = append(res.Drift, fmt.Sprintf("%s %s %s", c.Action, r.Domain, r.Type))
+	}
+
+	switch {
+	case p.Empty():
+	case env.dryRun:
+		log.Printf("zone %s: dry run, not correcting drift:\n%s", z.cfg.Zone, p)
+		res.Skipped = "dry run"
+	case z.cfg.Drift == config.DriftReport:
+		log.Printf("zone %s: drift found, not correcting:\n%s", z.cfg.Zone, p)
+	default:
+		log.Printf("zone %s: correcting drift:\n%s", z.cfg.Zone, p)
+		if err := env.apply(p); err != nil {
+			res.Error = err.Error()
+			return res
+		}
+		res.Corrected = true
+	}
+	return res
+}
+
+// plan reads the zone and works out what would bring it back to its
+// declaration
+func (z *zone) plan(ctx context.Context, env *env) (*plan.Plan, error) {
+	ip := ""
+	if reconcile.NeedsIP(z.cfg) {
+		ctx, cancel := context.WithTimeout(ctx, compare.DefaultTimeouts.IP)
+		defer cancel()
+		var err error
+		if ip, err = env.ip.PublicIP(ctx); err != nil {
+			return nil, fmt.Errorf("getting public IP: %w", err)
+		}
+		if err := z.policy.Check(ip); err != nil {
+			z.alarm.raise(env.alerts, Alert{Time: z.clock.Now(), Target: "zone " + z.cfg.Zone, IP: ip, Reason: err.Error()})
+			return nil, err
+		}
+		z.alarm.clear("zone " + z.cfg.Zone)
+	}
+
+	published, err := z.provider.Zone(z.cfg.Zone)
+	if err != nil {
+		return nil, err
+	}
+	return reconcile.Plan(published, z.provider, reconcile.Desired(z.cfg, ip), env.marker)
+}
+
+func (z *zone) isPaused() bool {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	return z.paused
+}
+
+func (z *zone) setPaused(paused bool) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	z.paused = paused
+}
+
+func (z *zone) setLast(res ZoneResult) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	z.last = &res
+}
+
+func (z *zone) setNext(next time.Time) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	z.next = next
+}
+
+func (z *zone) status() ZoneStatus {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	st := ZoneStatus{
+		Zone:       z.cfg.Zone,
+		Drift:      z.cfg.Drift,
+		Records:    len(z.cfg.Records),
+		Paused:     z.paused,
+		LastResult: z.last,
+		NextCheck:  z.next,
+		Alert:      z.alarm.get(),
+	}
+	if z.lease != nil {
+		st.LeaseHolder, st.LeaseExpires = z.lease.Holder()
+	}
+	return st
+}
@@ -0,0 +1,179 @@
+package snapshot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/m1k8/DNSUpdate/pkg/owner"
+	"github.com/m1k8/DNSUpdate/pkg/plan"
+	"github.com/m1k8/DNSUpdate/pkg/provider"
+	"gopkg.in/ns1/ns1-go.v2/rest/model/data"
+	"gopkg.in/ns1/ns1-go.v2/rest/model/dns"
+)
+
+// timeFormat names snapshot files so they sort oldest first
+const timeFormat = "20060102T150405.000Z"
+
+// Snapshot is the state of the records a plan was about to change
+type Snapshot struct {
+	Time   time.Time `json:"time"`
+	Reason string    `json:"reason"`
+	Items  []Item    `json:"records"`
+}
+
+// Item is one record as it was. Record is nil if it didnt exist. Provider is
+// empty for the default one
+type Item struct {
+	Provider string      `json:"provider,omitempty"`
+	Zone     string      `json:"zone"`
+	Domain   string      `json:"domain"`
+	Type     string      `json:"type"`
+	Record   *dns.Record `json:"record"`
+}
+
+// Store keeps snapshots as JSON files in Dir, deleting all but the newest
+// Keep
+type Store struct {
+	Dir  string
+	Keep int
+}
+
+// Save writes a snapshot of the records p changes, as they were when p was
+// worked out, and returns its name
+func (s *Store) Save(p *plan.Plan, now time.Time) (string, error) {
+	snap := Snapshot{Time: now.UTC(), Reason: p.Target}
+	for _, c := range p.Changes {
+		r := c.Record()
+		snap.Items = append(snap.Items, Item{Provider: c.Provider, Zone: r.Zone, Domain: r.Domain, Type: r.Type, Record: c.Before})
+	}
+
+	buf, err := json.MarshalIndent(snap, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(s.Dir, 0700); err != nil {
+		return "", err
+	}
+	name := snap.Time.Format(timeFormat) + "-" + slug(p.Target)
+	if err := ioutil.WriteFile(filepath.Join(s.Dir, name+".json"), buf, 0600); err != nil {
+		return "", err
+	}
+	return name, s.prune()
+}
+
+// List returns the name of every snapshot, oldest first
+func (s *Store) List() ([]string, error) {
+	entries, err := ioutil.ReadDir(s.Dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), ".json") {
+			names = append(names, strings.TrimSuffix(e.Name(), ".json"))
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Load reads the named snapshot
+func (s *Store) Load(name string) (*Snapshot, error) {
+	if name != filepath.Base(name) {
+		return nil, fmt.Errorf("bad snapshot name %q", name)
+	}
+	buf, err := ioutil.ReadFile(filepath.Join(s.Dir, strings.TrimSuffix(name, ".json")+".json"))
+	if err != nil {
+		return nil, err
+	}
+	var snap Snapshot
+	if err := json.Unmarshal(buf, &snap); err != nil {
+		return nil, fmt.Errorf("snapshot %s: %w", name, err)
+	}
+	return &snap, nil
+}
+
+func (s *Store) prune() error {
+	names, err := s.List()
+	if err != nil {
+		return err
+	}
+	for len(names) > s.Keep {
+		if err := os.Remove(filepath.Join(s.Dir, names[0]+".json")); err != nil {
+			return err
+		}
+		names = names[1:]
+	}
+	return nil
+}
+
+// Restore plans putting each record back as it was in snap. Records that
+// didnt exist are deleted, if they are marked with m; otherwise that is
+// refused. Records already as they were are left alone
+func (snap *Snapshot) Restore(providers provider.Registry, m owner.Marker) (*plan.Plan, error) {
+	p := &plan.Plan{Target: "restore " + snap.Time.Format(time.RFC3339)}
+
+	// a record changed more than once in a plan is restored to how it was
+	// first
+	seen := owner.Set{}
+	for _, it := range snap.Items {
+		k := owner.Key{Provider: it.Provider, Zone: it.Zone, Domain: it.Domain, Type: it.Type}
+		if seen.Has(k) {
+			continue
+		}
+		seen.Add(k)
+
+		records, err := providers.Get(it.Provider)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", k, err)
+		}
+		current, err := records.Record(context.Background(), it.Zone, it.Domain, it.Type)
+		missing := errors.Is(err, provider.ErrRecordMissing)
+		if err != nil && !missing {
+			return nil, fmt.Errorf("get %s: %w", k, err)
+		}
+
+		switch {
+		case it.Record == nil && missing:
+		case it.Record == nil && !m.Owns(current):
+			p.Refuse("delete %s: %s", k, owner.ErrNotOwned)
+		case it.Record == nil:
+			p.Add(plan.Change{Action: plan.Delete, Provider: it.Provider, Before: current})
+		case missing:
+			after := plan.CopyRecord(it.Record)
+			after.ID = ""
+			p.Add(plan.Change{Action: plan.Create, Provider: it.Provider, After: after})
+		case !plan.Same(current, it.Record):
+			after := plan.CopyRecord(it.Record)
+			after.ID = current.ID
+			if after.Meta == nil {
+				// NS1 keeps fields an update leaves out, so clear it
+				after.Meta = &data.Meta{}
+			}
+			p.Add(plan.Change{Action: plan.Update, Provider: it.Provider, Before: current, After: after})
+		}
+	}
+	return p, nil
+}
+
+// slug makes s safe to use in a file name
+func slug(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-':
+			return r
+		}
+		return '_'
+	}, s)
+}
@@ -0,0 +1,170 @@
+package snapshot
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/m1k8/DNSUpdate/pkg/dnsapi"
+	"github.com/m1k8/DNSUpdate/pkg/ns1fake"
+	"github.com/m1k8/DNSUpdate/pkg/owner"
+	"github.com/m1k8/DNSUpdate/pkg/plan"
+	"github.com/m1k8/DNSUpdate/pkg/provider"
+	"gopkg.in/ns1/ns1-go.v2/rest/model/dns"
+)
+
+const zone = "example.com"
+
+var (
+	marker = owner.Marker{Owner: "dnsupdate"}
+	start  = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+)
+
+func aRecord(domain, ip string, marked bool) *dns.Record {
+	r := dns.NewRecord(zone, domain, "A")
+	r.AddAnswer(dns.NewAv4Answer(ip))
+	if marked {
+		marker.Mark(r)
+	}
+	return r
+}
+
+// addresses returns the address each A record in the zone points at
+func addresses(f *ns1fake.Server) map[string]string {
+	ips := map[string]string{}
+	for _, r := range f.Records(zone) {
+		if r.Type == "A" && len(r.Answers) > 0 {
+			ips[r.Domain] = r.Answers[0].Rdata[0]
+		}
+	}
+	return ips
+}
+
+func TestRestore(t *testing.T) {
+	f := ns1fake.New()
+	defer f.Close()
+	f.AddZone(zone)
+	f.PutRecord(aRecord("home.example.com", "8.8.4.4", true))
+	f.PutRecord(aRecord("gone.example.com", "8.8.4.5", true))
+	f.PutRecord(aRecord("same.example.com", "8.8.4.6", true))
+	at := provider.NewNS1(provider.Default, dnsapi.FromREST(f.Client()))
+	providers := provider.Registry{provider.Default: at}
+	before := addresses(f)
+
+	// a plan that updates one record, deletes another and creates two, and
+	// leaves one alone
+	var changes []plan.Change
+	home := f.Record(zone, "home.example.com", "A")
+	changed := plan.CopyRecord(home)
+	changed.Answers = []*dns.Answer{dns.NewAv4Answer("8.8.8.8")}
+	changes = append(changes,
+		plan.Change{Action: plan.Update, Provider: provider.Default, Before: home, After: changed},
+		plan.Change{Action: plan.Delete, Provider: provider.Default, Before: f.Record(zone, "gone.example.com", "A")},
+		plan.Change{Action: plan.Create, Provider: provider.Default, After: aRecord("new.example.com", "8.8.8.9", true)},
+		plan.Change{Action: plan.Create, Provider: provider.Default, After: aRecord("hand.example.com", "8.8.8.10", true)},
+	)
+	p := &plan.Plan{Target: "home.example.com", Changes: changes}
+
+	s := &Store{Dir: t.TempDir(), Keep: 20}
+	name, err := s.Save(p, start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Apply(providers); err != nil {
+		t.Fatal(err)
+	}
+	// a record created by the plan is since taken over by hand
+	hand := f.Record(zone, "hand.example.com", "A")
+	hand.Meta.Note = ""
+	f.PutRecord(hand)
+
+	snap, err := s.Load(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !snap.Time.Equal(start) || snap.Reason != "home.example.com" || len(snap.Items) != len(changes) {
+		t.Fatalf("loaded %+v, want the plan's %d records at %s", snap, len(changes), start)
+	}
+	restore, err := snap.Restore(providers, marker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actions []string
+	for _, c := range restore.Changes {
+		actions = append(actions, string(c.Action)+" "+c.Record().Domain)
+	}
+	want := []string{"update home.example.com", "create gone.example.com", "delete new.example.com"}
+	if !reflect.DeepEqual(actions, want) {
+		t.Errorf("restore plans %v, want %v", actions, want)
+	}
+	if len(restore.Refused) != 1 {
+		t.Errorf("refused %v, want only the unmarked hand.example.com", restore.Refused)
+	}
+	if err := restore.Apply(providers); err != nil {
+		t.Fatal(err)
+	}
+
+	before["hand.example.com"] = "8.8.8.10"
+	if got := addresses(f); !reflect.DeepEqual(got, before) {
+		t.Errorf("restored to %v, want %v", got, before)
+	}
+	// restoring again finds nothing to change
+	if again, err := snap.Restore(providers, marker); err != nil || !again.Empty() {
+		t.Errorf("restoring twice plans %v, %v, want nothing", again, err)
+	}
+}
+
+func TestKeep(t *testing.T) {
+	tests := []struct {
+		name  string
+		keep  int
+		saves int
+		want  int
+	}{
+		{name: "fewer than keep", keep: 3, saves: 2, want: 2},
+		{name: "exactly keep", keep: 3, saves: 3, want: 3},
+		{name: "more than keep", keep: 3, saves: 7, want: 3},
+		{name: "keep one", keep: 1, saves: 4, want: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Store{Dir: t.TempDir(), Keep: tt.keep}
+			var saved []string
+			for i := 0; i < tt.saves; i++ {
+				p := &plan.Plan{Target: "home.example.com", Changes: []plan.Change{{Action: plan.Create, After: aRecord("home.example.com", "8.8.4.4", true)}}}
+				// 1.5s apart, so names sharing a second sort by their milliseconds
+				name, err := s.Save(p, start.Add(time.Duration(i)*1500*time.Millisecond))
+				if err != nil {
+					t.Fatal(err)
+				}
+				saved = append(saved, name)
+			}
+			got, err := s.List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := saved[len(saved)-tt.want:]; !reflect.DeepEqual(got, want) {
+				t.Errorf("kept %v, want the newest %v", got, want)
+			}
+		})
+	}
+}
+
+func TestLoadName(t *testing.T) {
+	s := &Store{Dir: t.TempDir(), Keep: 20}
+	name, err := s.Save(&plan.Plan{Target: "home/example com"}, start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "20240101T000000.000Z-home_example_com"; name != want {
+		t.Errorf("saved as %s, want %s", name, want)
+	}
+	for _, n := range []string{name, name + ".json"} {
+		if _, err := s.Load(n); err != nil {
+			t.Errorf("loading %s: %v", n, err)
+		}
+	}
+	if _, err := s.Load("../" + name); err == nil {
+		t.Error("a name outside the store should be refused")
+	}
+}
@@ -0,0 +1,83 @@
+package update
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/m1k8/DNSUpdate/pkg/compare"
+	"github.com/m1k8/DNSUpdate/pkg/owner"
+	"github.com/m1k8/DNSUpdate/pkg/plan"
+	"github.com/m1k8/DNSUpdate/pkg/provider"
+	"gopkg.in/ns1/ns1-go.v2/rest/model/data"
+	"gopkg.in/ns1/ns1-go.v2/rest/model/filter"
+)
+
+// Failover is how a record fails over between its answers: the filters it
+// is served through, and the managed answer's place among the others
+type Failover struct {
+	// Filters replace the record's, unless nil
+	Filters []*filter.Filter
+
+	// Up is the answer's "up" meta, usually the feed of its monitoring job
+	Up interface{}
+
+	// Priority is the answer's priority, lowest first, or 0 to leave it
+	// unset
+	Priority int
+}
+
+// Chain returns the filters of a record failing over between answers that
+// are up: the up filter, then if priorities is set the priority filter, and
+// if first isnt 0 one serving only that many answers
+func Chain(priorities bool, first int) []*filter.Filter {
+	chain := []*filter.Filter{filter.NewUp()}
+	if priorities {
+		chain = append(chain, filter.NewPriority())
+	}
+	if first > 0 {
+		chain = append(chain, filter.NewSelFirstN(first))
+	}
+	return chain
+}
+
+// PlanFailover works out the changes needed to serve domain's A record
+// through f's filters, with f's meta on the answer identified by id. Other
+// answers are left as they are. Nothing is planned if the record or answer
+// doesnt exist yet, and a record that isnt marked with m is refused, with
+// an error wrapping owner.ErrNotOwned
+func PlanFailover(ctx context.Context, records provider.Provider, zone, domain string, id compare.Identity, f Failover, m owner.Marker) (*plan.Plan, error) {
+	p := &plan.Plan{Target: domain}
+	r, err := records.Record(ctx, zone, domain, "A")
+	if errors.Is(err, provider.ErrRecordMissing) {
+		return p, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	state := compare.NewRecordState(r, id)
+	if state.Answer() == nil {
+		return p, nil
+	}
+	if !m.Owns(r) {
+		p.Refuse("update %s A: %s", domain, owner.ErrNotOwned)
+		return p, fmt.Errorf("%s A: %w", domain, owner.ErrNotOwned)
+	}
+
+	after := plan.CopyRecord(r)
+	if f.Filters != nil {
+		after.Filters = f.Filters
+	}
+	a := after.Answers[state.Owned]
+	if a.Meta == nil {
+		a.Meta = &data.Meta{}
+	}
+	a.Meta.Up = f.Up
+	if f.Priority > 0 {
+		a.Meta.Priority = f.Priority
+	}
+	if !plan.Same(r, after) {
+		p.Add(plan.Change{Action: plan.Update, Provider: records.Name(), Before: r, After: after})
+	}
+	return p, nil
+}
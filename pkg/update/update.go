@@ -1,68 +1,107 @@
 package update
 
 import (
-	"log"
+	"context"
+	"errors"
+	"fmt"
 
-	api "gopkg.in/ns1/ns1-go.v2/rest"
+	"github.com/m1k8/DNSUpdate/pkg/compare"
+	"github.com/m1k8/DNSUpdate/pkg/owner"
+	"github.com/m1k8/DNSUpdate/pkg/plan"
+	"github.com/m1k8/DNSUpdate/pkg/provider"
+	"gopkg.in/ns1/ns1-go.v2/rest/model/data"
 	"gopkg.in/ns1/ns1-go.v2/rest/model/dns"
-
-	"errors"
-	"time"
 )
 
-func deleteOld(client *api.Client, zone string, args string) error {
-	client.Records.Delete(zone, args, "A")
-	client.Records.Delete(zone, args, "SRV")
-
-	//busy wait until the delete has propogated
-	ticker := time.NewTimer(30 * time.Second)
-	for {
-		select {
-		case <-ticker.C:
-			return errors.New("delete hasnt propogated")
-
-		default:
-			a, _, _ := client.Records.Get(zone, args, "A")
-			srv, _, _ := client.Records.Get(zone, args, "SRV")
-			if a != nil && srv != nil {
-				log.Println("Found A and SRV Records: " + a.Domain)
-				return nil
-			}
-		}
+// TTL of the records created
+const TTL = 600
+
+// SRVPort is the port published in the SRV record created alongside the A
+// record
+const SRVPort = 11774
+
+// ChangeIP points the answer identified by id at newIP, leaving any other
+// answers in the record as they are. state is the record as last read; if
+// it doesnt exist it is created. It returns the answer's ID, so it can be
+// found again even if its note is edited
+func ChangeIP(ctx context.Context, newIP string, records provider.Provider, zone string, args string, state compare.RecordState, id compare.Identity, m owner.Marker) (string, error) {
+	p, err := PlanChange(ctx, newIP, records, zone, args, state, id, m)
+	if err != nil {
+		return "", err
 	}
+	return Apply(p, provider.Registry{records.Name(): records}, id)
 }
 
-// ChangeIP changes the A and SRV records of a given client zone
-func ChangeIP(newIP string, client *api.Client, zone string, args string, deleteOldIP bool) error {
-
-	var err error
-	newA := dns.NewRecord(zone, args, "A")
-
-	newSRV := dns.NewRecord(zone, args, "SRV")
-
-	newA.TTL = 600
-
-	newSRV.TTL = 600
-
-	newA.AddAnswer(dns.NewAv4Answer(newIP))
-	newSRV.AddAnswer(dns.NewSRVAnswer(0, 0, 11774, args))
-
-	if deleteOldIP {
-		err = deleteOld(client, zone, args)
-		if err != nil {
-			return err
+// PlanChange works out the changes ChangeIP would make, without making them.
+// It only reads from the provider. Records created are marked with m, and an existing
+// record is only changed if it is marked or already holds the answer
+// identified by id; otherwise the plan is returned with the change refused,
+// and an error wrapping owner.ErrNotOwned
+func PlanChange(ctx context.Context, newIP string, records provider.Provider, zone string, args string, state compare.RecordState, id compare.Identity, m owner.Marker) (*plan.Plan, error) {
+	p := &plan.Plan{Target: args}
+	at := records.Name()
+
+	if !state.Exists() {
+		r := dns.NewRecord(zone, args, "A")
+		r.TTL = TTL
+		r.AddAnswer(newAnswer(newIP, id))
+		m.Mark(r)
+		p.Add(plan.Change{Action: plan.Create, Provider: at, After: r})
+	} else if state.Owned < 0 && !m.Owns(state.Record) {
+		p.Refuse("update %s A: %s", args, owner.ErrNotOwned)
+		return p, fmt.Errorf("%s A: %w", args, owner.ErrNotOwned)
+	} else {
+		r := plan.CopyRecord(state.Record)
+		if state.Owned >= 0 {
+			a := r.Answers[state.Owned]
+			a.Rdata = []string{newIP}
+			if a.Meta == nil {
+				a.Meta = &data.Meta{}
+			}
+			a.Meta.Note = id.Note
+		} else {
+			r.AddAnswer(newAnswer(newIP, id))
 		}
+		p.Add(plan.Change{Action: plan.Update, Provider: at, Before: state.Record, After: r})
 	}
-	_, errACreate := client.Records.Create(newA)
-	_, errSRVCreate := client.Records.Create(newSRV)
-
-	if errACreate != nil {
-		return errACreate
 
+	// the SRV record doesnt depend on the IP, so it is only created if it is
+	// missing, and where the provider can hold one
+	if !provider.Supports(records, "SRV") {
+		return p, nil
+	}
+	_, err := records.Record(ctx, zone, args, "SRV")
+	if errors.Is(err, provider.ErrRecordMissing) {
+		srv := dns.NewRecord(zone, args, "SRV")
+		srv.TTL = TTL
+		srv.AddAnswer(dns.NewSRVAnswer(0, 0, SRVPort, args))
+		m.Mark(srv)
+		p.Add(plan.Change{Action: plan.Create, Provider: at, After: srv})
+	} else if err != nil {
+		return nil, err
 	}
-	if errSRVCreate != nil {
-		return errSRVCreate
+	return p, nil
+}
 
+// Apply makes the changes in a plan from PlanChange, and returns the ID the
+// provider gave the answer identified by id
+func Apply(p *plan.Plan, providers provider.Registry, id compare.Identity) (string, error) {
+	if err := p.Apply(providers); err != nil {
+		return "", err
 	}
-	return nil
+	for _, c := range p.Changes {
+		if c.After == nil || c.After.Type != "A" {
+			continue
+		}
+		if a := compare.NewRecordState(c.After, compare.Identity{Note: id.Note}).Answer(); a != nil {
+			return a.ID, nil
+		}
+	}
+	return "", nil
+}
+
+func newAnswer(ip string, id compare.Identity) *dns.Answer {
+	a := dns.NewAv4Answer(ip)
+	a.Meta.Note = id.Note
+	return a
 }
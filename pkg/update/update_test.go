@@ -0,0 +1,284 @@
+package update
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/m1k8/DNSUpdate/pkg/compare"
+	"github.com/m1k8/DNSUpdate/pkg/dnsapi"
+	"github.com/m1k8/DNSUpdate/pkg/ns1fake"
+	"github.com/m1k8/DNSUpdate/pkg/owner"
+	"github.com/m1k8/DNSUpdate/pkg/plan"
+	"github.com/m1k8/DNSUpdate/pkg/provider"
+	"gopkg.in/ns1/ns1-go.v2/rest/model/dns"
+)
+
+const (
+	zone   = "example.com"
+	domain = "home.example.com"
+)
+
+var (
+	errDown = errors.New("ns1 is down")
+	marker  = owner.Marker{Owner: "dnsupdate"}
+	home    = compare.Identity{Note: "home"}
+)
+
+// failing passes record requests through to the fake, except those named
+// in fail, "<op> <domain> <type>", which fail without being sent
+type failing struct {
+	dnsapi.Records
+	fail map[string]error
+}
+
+func (f failing) GetContext(ctx context.Context, zone, domain, t string) (*dns.Record, *http.Response, error) {
+	if err := f.fail["get "+domain+" "+t]; err != nil {
+		return nil, nil, err
+	}
+	return f.Records.GetContext(ctx, zone, domain, t)
+}
+
+func (f failing) Create(r *dns.Record) (*http.Response, error) {
+	if err := f.fail["create "+r.Domain+" "+r.Type]; err != nil {
+		return nil, err
+	}
+	return f.Records.Create(r)
+}
+
+func (f failing) Update(r *dns.Record) (*http.Response, error) {
+	if err := f.fail["update "+r.Domain+" "+r.Type]; err != nil {
+		return nil, err
+	}
+	return f.Records.Update(r)
+}
+
+func (f failing) Delete(zone, domain, t string) (*http.Response, error) {
+	if err := f.fail["delete "+domain+" "+t]; err != nil {
+		return nil, err
+	}
+	return f.Records.Delete(zone, domain, t)
+}
+
+// newProvider returns an NS1 provider backed by a fake holding records, with
+// the requests in fail failing
+func newProvider(t *testing.T, fail map[string]error, records ...*dns.Record) (*ns1fake.Server, provider.Provider) {
+	t.Helper()
+	f := ns1fake.New()
+	t.Cleanup(f.Close)
+	f.AddZone(zone)
+	for _, r := range records {
+		f.PutRecord(r)
+	}
+	c := dnsapi.FromREST(f.Client())
+	c.Records = failing{Records: c.Records, fail: fail}
+	return f, provider.NewNS1(provider.Default, c)
+}
+
+// record returns the A record of domain holding an answer for each note
+// and address pair
+func record(marked bool, answers ...[2]string) *dns.Record {
+	r := dns.NewRecord(zone, domain, "A")
+	for _, a := range answers {
+		ans := dns.NewAv4Answer(a[1])
+		ans.Meta.Note = a[0]
+		r.AddAnswer(ans)
+	}
+	if marked {
+		marker.Mark(r)
+	}
+	return r
+}
+
+func srv() *dns.Record {
+	r := dns.NewRecord(zone, domain, "SRV")
+	r.AddAnswer(dns.NewSRVAnswer(0, 0, SRVPort, domain))
+	return r
+}
+
+// published returns the addresses of the A record of domain by note, or
+// nil if there is no record
+func published(f *ns1fake.Server) map[string]string {
+	r := f.Record(zone, domain, "A")
+	if r == nil {
+		return nil
+	}
+	ips := map[string]string{}
+	for _, a := range r.Answers {
+		ips[compare.NoteOf(a)] = a.Rdata[0]
+	}
+	return ips
+}
+
+func TestPlanChange(t *testing.T) {
+	tests := []struct {
+		name    string
+		records []*dns.Record
+		fail    map[string]error
+
+		actions []string
+		wantErr error
+		// want is the A record once the plan is applied
+		want map[string]string
+	}{
+		{
+			name:    "missing record",
+			actions: []string{"create A", "create SRV"},
+			want:    map[string]string{"home": "8.8.4.7"},
+		},
+		{
+			name:    "missing record with an SRV record",
+			records: []*dns.Record{srv()},
+			actions: []string{"create A"},
+			want:    map[string]string{"home": "8.8.4.7"},
+		},
+		{
+			name:    "update of the managed answer",
+			records: []*dns.Record{record(true, [2]string{"home", "8.8.4.4"}, [2]string{"cloud", "8.8.8.8"}), srv()},
+			actions: []string{"update A"},
+			want:    map[string]string{"home": "8.8.4.7", "cloud": "8.8.8.8"},
+		},
+		{
+			name:    "answer added to a marked record",
+			records: []*dns.Record{record(true, [2]string{"cloud", "8.8.8.8"}), srv()},
+			actions: []string{"update A"},
+			want:    map[string]string{"home": "8.8.4.7", "cloud": "8.8.8.8"},
+		},
+		{
+			name:    "unmarked record holding the answer",
+			records: []*dns.Record{record(false, [2]string{"home", "8.8.4.4"}), srv()},
+			actions: []string{"update A"},
+			want:    map[string]string{"home": "8.8.4.7"},
+		},
+		{
+			name:    "unmarked record without the answer",
+			records: []*dns.Record{record(false, [2]string{"cloud", "8.8.8.8"}), srv()},
+			wantErr: owner.ErrNotOwned,
+			want:    map[string]string{"cloud": "8.8.8.8"},
+		},
+		{
+			name:    "srv lookup fails",
+			fail:    map[string]error{"get " + domain + " SRV": errDown},
+			wantErr: errDown,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, p := newProvider(t, tt.fail, tt.records...)
+			state, err := compare.GetRecord(context.Background(), dns.NewZone(zone), p, domain, home)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			pl, err := PlanChange(context.Background(), "8.8.4.7", p, zone, domain, state, home, marker)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			var actions []string
+			if pl != nil {
+				for _, c := range pl.Changes {
+					actions = append(actions, string(c.Action)+" "+c.Record().Type)
+				}
+			}
+			if !reflect.DeepEqual(actions, tt.actions) {
+				t.Errorf("planned %v, want %v", actions, tt.actions)
+			}
+			if err != nil {
+				return
+			}
+
+			if _, err := Apply(pl, provider.Registry{provider.Default: p}, home); err != nil {
+				t.Fatal(err)
+			}
+			if got := published(f); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("published %v, want %v", got, tt.want)
+			}
+			if r := f.Record(zone, domain, "A"); !marker.Owns(r) && state.Owned < 0 {
+				t.Error("a record created or added to should be marked")
+			}
+		})
+	}
+}
+
+func TestApply(t *testing.T) {
+	a := record(true, [2]string{"home", "8.8.4.7"})
+	s := srv()
+	marker.Mark(s)
+	tests := []struct {
+		name    string
+		records []*dns.Record
+		changes []plan.Change
+		fail    map[string]error
+
+		wantErr error
+		// left is the types of the records of domain once applied
+		left []string
+	}{
+		{
+			name:    "create",
+			changes: []plan.Change{{Action: plan.Create, After: a}, {Action: plan.Create, After: s}},
+			left:    []string{"A", "SRV"},
+		},
+		{
+			name:    "delete",
+			records: []*dns.Record{a, s},
+			changes: []plan.Change{{Action: plan.Delete, Before: a}, {Action: plan.Delete, Before: s}},
+		},
+		{
+			name:    "first change fails",
+			changes: []plan.Change{{Action: plan.Create, After: a}, {Action: plan.Create, After: s}},
+			fail:    map[string]error{"create " + domain + " A": errDown},
+			wantErr: errDown,
+		},
+		{
+			name:    "later change fails",
+			changes: []plan.Change{{Action: plan.Create, After: a}, {Action: plan.Create, After: s}},
+			fail:    map[string]error{"create " + domain + " SRV": errDown},
+			wantErr: errDown,
+			left:    []string{"A"},
+		},
+		{
+			name:    "delete fails part way",
+			records: []*dns.Record{a, s},
+			changes: []plan.Change{{Action: plan.Delete, Before: a}, {Action: plan.Delete, Before: s}},
+			fail:    map[string]error{"delete " + domain + " SRV": errDown},
+			wantErr: errDown,
+			left:    []string{"SRV"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var records []*dns.Record
+			for _, r := range tt.records {
+				records = append(records, plan.CopyRecord(r))
+			}
+			f, p := newProvider(t, tt.fail, records...)
+			changes := make([]plan.Change, len(tt.changes))
+			for i, c := range tt.changes {
+				if c.After != nil {
+					c.After = plan.CopyRecord(c.After)
+				}
+				changes[i] = c
+			}
+
+			id, err := Apply(&plan.Plan{Target: domain, Changes: changes}, provider.Registry{provider.Default: p}, home)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && changes[0].Action == plan.Create && id == "" {
+				t.Error("the created answer's ID should be returned")
+			}
+			var left []string
+			for _, typ := range []string{"A", "SRV"} {
+				if f.Record(zone, domain, typ) != nil {
+					left = append(left, typ)
+				}
+			}
+			if !reflect.DeepEqual(left, tt.left) {
+				t.Errorf("records left %v, want %v", left, tt.left)
+			}
+		})
+	}
+}